@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// asyncDroppedKey is the key of the counter the AsyncSink reports dropped
+// observations under, emitted directly to the wrapped sink.
+var asyncDroppedKey = []string{"async_sink.dropped"}
+
+// AsyncSink wraps a MetricSink and delivers observations to it from a pool of
+// background workers, so that emitting a metric never blocks the caller on the
+// wrapped sink. When the buffer is full observations are dropped rather than
+// blocking, and the number of dropped observations is reported to the wrapped
+// sink as the "async_sink.dropped" counter.
+type AsyncSink struct {
+	sink  MetricSink
+	queue chan asyncObservation
+	wg    sync.WaitGroup
+
+	closeLock sync.RWMutex
+	closed    bool
+
+	dropped        uint64 // update with atomic
+	droppedPending uint64 // update with atomic
+	droppedEmitter MetricEmitter
+}
+
+type asyncObservation struct {
+	emitter   MetricEmitter
+	emitterAt MetricEmitterAt // set instead of emitter for timestamped values
+	val       float64
+	at        time.Time
+}
+
+// NewAsyncSink creates an AsyncSink that buffers up to bufferSize observations
+// and delivers them to sink using the given number of worker goroutines. A
+// worker count below one is treated as one.
+func NewAsyncSink(sink MetricSink, bufferSize int, workers int) *AsyncSink {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	s := &AsyncSink{
+		sink:           sink,
+		queue:          make(chan asyncObservation, bufferSize),
+		droppedEmitter: sink.BuildMetricEmitter(MetricTypeCounter, asyncDroppedKey, nil),
+	}
+
+	s.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.run()
+	}
+
+	return s
+}
+
+func (s *AsyncSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	emitter := s.sink.BuildMetricEmitter(mType, keys, labels)
+
+	return func(val float64) {
+		s.enqueue(asyncObservation{emitter: emitter, val: val})
+	}
+}
+
+// BuildMetricEmitterAt is like BuildMetricEmitter, delivering the values with
+// their timestamps to the wrapped sink if it is a TimestampSink
+func (s *AsyncSink) BuildMetricEmitterAt(mType MetricType, keys []string, labels []Label) MetricEmitterAt {
+	emitter := BuildMetricEmitterAt(s.sink, mType, keys, labels)
+
+	return func(val float64, at time.Time) {
+		s.enqueue(asyncObservation{emitterAt: emitter, val: val, at: at})
+	}
+}
+
+// enqueue queues the observation for the workers, or drops it if the queue
+// is full or the sink is shut down
+func (s *AsyncSink) enqueue(obs asyncObservation) {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.queue <- obs:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		atomic.AddUint64(&s.droppedPending, 1)
+	}
+}
+
+// Dropped returns the total number of observations dropped because the
+// buffer was full.
+func (s *AsyncSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// ForgetMetric forwards to the wrapped sink if it is a ForgetSink
+func (s *AsyncSink) ForgetMetric(mType MetricType, keys []string, labels []Label) {
+	if fs, ok := s.sink.(ForgetSink); ok {
+		fs.ForgetMetric(mType, keys, labels)
+	}
+}
+
+// Shutdown stops accepting new observations, drains the buffer to the
+// wrapped sink, and then shuts down the wrapped sink if it is a ShutdownSink.
+func (s *AsyncSink) Shutdown() error {
+	s.closeLock.Lock()
+	if s.closed {
+		s.closeLock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.closeLock.Unlock()
+
+	s.wg.Wait()
+	s.reportDropped()
+
+	if ss, ok := s.sink.(ShutdownSink); ok {
+		return ss.Shutdown()
+	}
+	return nil
+}
+
+// run delivers queued observations until the queue is closed
+func (s *AsyncSink) run() {
+	defer s.wg.Done()
+
+	for obs := range s.queue {
+		s.deliver(obs)
+		s.reportDropped()
+	}
+}
+
+// deliver emits a single observation, preventing a panicking sink from
+// taking down the worker
+func (s *AsyncSink) deliver(obs asyncObservation) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[ERR] Panic recovered in async sink emitter! Err: %v", r)
+		}
+	}()
+
+	if obs.emitterAt != nil {
+		obs.emitterAt(obs.val, obs.at)
+		return
+	}
+	obs.emitter(obs.val)
+}
+
+// reportDropped emits any drops not yet reported to the wrapped sink
+func (s *AsyncSink) reportDropped() {
+	if n := atomic.SwapUint64(&s.droppedPending, 0); n > 0 {
+		s.droppedEmitter(float64(n))
+	}
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blockingSink blocks every emit until release is closed, signaling on
+// started when an emit begins
+type blockingSink struct {
+	MockSink
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	emitter := b.MockSink.BuildMetricEmitter(mType, keys, labels)
+	return func(val float64) {
+		b.started <- struct{}{}
+		<-b.release
+		emitter(val)
+	}
+}
+
+func TestAsyncSink(t *testing.T) {
+	m := &MockSink{}
+	s := NewAsyncSink(m, 10, 1)
+
+	label := L("a", "b")
+	s.BuildMetricEmitter(MetricTypeGauge, []string{"gkey"}, []Label{label})(1)
+	s.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)(2)
+
+	s.Shutdown()
+
+	require.True(t, m.shutdown)
+	require.Len(t, m.keys, 2)
+	require.Equal(t, []string{"gkey"}, m.keys[0])
+	require.Equal(t, float64(1), m.vals[0])
+	require.Equal(t, []Label{label}, m.labels[0])
+	require.Equal(t, []string{"ckey"}, m.keys[1])
+	require.Equal(t, float64(2), m.vals[1])
+	require.Equal(t, uint64(0), s.Dropped())
+
+	// emits after shutdown are discarded
+	s.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)(3)
+	require.Len(t, m.keys, 2)
+
+	// shutting down twice is safe
+	s.Shutdown()
+}
+
+func TestAsyncSink_Timestamps(t *testing.T) {
+	ts := &timestampSink{}
+	s := NewAsyncSink(ts, 10, 1)
+	var _ TimestampSink = s
+
+	at := time.Unix(1700000000, 0)
+	s.BuildMetricEmitterAt(MetricTypeGauge, []string{"gkey"}, nil)(1, at)
+	s.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)(2)
+	s.Shutdown()
+
+	require.Equal(t, [][]string{{"gkey"}, {"ckey"}}, ts.keys)
+	require.Equal(t, []time.Time{at}, ts.times)
+}
+
+func TestAsyncSink_Drop(t *testing.T) {
+	b := &blockingSink{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s := NewAsyncSink(b, 1, 1)
+
+	emitter := s.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)
+
+	// first is picked up by the worker, which then blocks
+	emitter(1)
+	<-b.started
+
+	// second fills the buffer, third is dropped
+	emitter(2)
+	emitter(3)
+	require.Equal(t, uint64(1), s.Dropped())
+
+	go func() {
+		for range b.started {
+		}
+	}()
+	close(b.release)
+	s.Shutdown()
+	close(b.started)
+
+	require.Len(t, b.keys, 3)
+	require.Equal(t, float64(1), b.vals[0])
+
+	// the drop is reported as a counter on the wrapped sink once the worker
+	// finishes the observation it was blocked on
+	require.Equal(t, asyncDroppedKey, b.keys[1])
+	require.Equal(t, float64(1), b.vals[1])
+
+	require.Equal(t, []string{"ckey"}, b.keys[2])
+	require.Equal(t, float64(2), b.vals[2])
+}
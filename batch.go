@@ -0,0 +1,124 @@
+package metrics
+
+import "time"
+
+// A Batch collects metrics that share labels, such as a snapshot of stats, and
+// emits them together with Emit. The shared labels are enriched and filtered
+// once per Emit rather than once per metric. A Batch is not safe for
+// concurrent use.
+type Batch struct {
+	m       *Metrics
+	labels  []Label
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	mType    MetricType
+	typeName string
+	key      string
+	val      float64
+	labels   []Label
+}
+
+// Batch returns an empty batch whose metrics all have the given labels, ahead
+// of any per-metric labels
+func (m *Metrics) Batch(labels ...Label) *Batch {
+	return &Batch{m: m, labels: labels}
+}
+
+// SetGauge adds a gauge value to the batch
+func (b *Batch) SetGauge(key string, val float64, labels ...Label) {
+	b.add(MetricTypeGauge, "gauge", key, val, labels)
+}
+
+// Incr adds a counter increment to the batch
+func (b *Batch) Incr(key string, val float64, labels ...Label) {
+	b.add(MetricTypeCounter, "counter", key, val, labels)
+}
+
+// Decr adds a counter decrement to the batch, see Counter.Decr for sink support
+func (b *Batch) Decr(key string, val float64, labels ...Label) {
+	b.add(MetricTypeCounter, "counter", key, -val, labels)
+}
+
+// Sample adds a histogram observation to the batch
+func (b *Batch) Sample(key string, val float64, labels ...Label) {
+	b.add(MetricTypeHistogram, "histogram", key, val, labels)
+}
+
+// MeasureSince adds the time elapsed since start to the batch as a timer. The
+// time is measured when it is added, not when the batch is emitted.
+func (b *Batch) MeasureSince(key string, start time.Time, labels ...Label) {
+	elapsed := b.m.clock().Now().Sub(start)
+	b.add(MetricTypeTimer, "timer", key, float64(elapsed.Nanoseconds())/float64(b.m.cfg.timerGranularity()), labels)
+}
+
+// Observe adds a distribution observation to the batch
+func (b *Batch) Observe(key string, val float64, labels ...Label) {
+	b.add(MetricTypeDistribution, "distribution", key, val, labels)
+}
+
+// Len returns the number of metrics in the batch
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+func (b *Batch) add(mType MetricType, typeName string, key string, val float64, labels []Label) {
+	b.entries = append(b.entries, batchEntry{
+		mType:    mType,
+		typeName: typeName,
+		key:      key,
+		val:      val,
+		labels:   labels,
+	})
+}
+
+// Emit sends the metrics of the batch to the sink, in the order they were
+// added, and empties the batch so it can be reused. Metrics without their own
+// labels share the enriched and filtered batch labels, the others are enriched
+// individually as if emitted on their own.
+func (b *Batch) Emit() {
+	if len(b.entries) == 0 {
+		return
+	}
+
+	m := b.m
+	root := m.root()
+	f := root.loadFilters()
+	sink := root.currentSink()
+
+	// process the shared labels once
+	shared := m.enrichLabels(b.labels)
+	sharedFiltered := f.filterLabels(shared)
+	sharedBlocked := len(shared) - len(sharedFiltered)
+	sharedFiltered, sharedOverLimit := m.limitLabels(sharedFiltered)
+
+	for i, e := range b.entries {
+		var (
+			allowed bool
+			keys    []string
+			labels  []Label
+		)
+		if len(e.labels) == 0 {
+			keys = m.enrichKeys(e.typeName, e.key)
+			allowed = m.checkLabelLimit(root.allowKey(f, keys, sharedBlocked), sharedOverLimit)
+			allowed = m.checkSeriesLimit(allowed, keys, sharedFiltered)
+			labels = sharedFiltered
+		} else {
+			all := make([]Label, 0, len(b.labels)+len(e.labels))
+			all = append(all, b.labels...)
+			all = append(all, e.labels...)
+			allowed, keys, labels = m.enrich(e.typeName, e.key, all)
+		}
+
+		if allowed {
+			root.countEmit(e.mType)
+			sink.BuildMetricEmitter(e.mType, keys, labels)(e.val)
+		} else if len(e.labels) == 0 {
+			// the others are recorded by enrich
+			m.recordFiltered(e.typeName, keys, labels)
+		}
+		b.entries[i] = batchEntry{}
+	}
+	b.entries = b.entries[:0]
+}
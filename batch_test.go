@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.BaseLabels = []Label{L("env", "prod")}
+		c.TimerGranularity = time.Millisecond
+	})
+
+	b := met.Batch(L("pool", "a"))
+	b.SetGauge("gkey", 1)
+	b.Incr("ckey", 2, L("code", "200"))
+	b.Decr("ckey", 3)
+	b.Sample("hkey", 4)
+	b.Observe("dkey", 5)
+	b.MeasureSince("tkey", time.Now().Add(-time.Second))
+	require.Equal(t, 6, b.Len())
+	require.Empty(t, m.keys)
+
+	b.Emit()
+	require.Equal(t, [][]string{{"gkey"}, {"ckey"}, {"ckey"}, {"hkey"}, {"dkey"}, {"tkey"}}, m.keys)
+	require.Equal(t, []float64{1, 2, -3, 4, 5}, m.vals[:5])
+	require.InDelta(t, 1000, m.vals[5], 100)
+
+	shared := []Label{L("pool", "a"), L("env", "prod")}
+	require.Equal(t, shared, m.labels[0])
+	require.Equal(t, []Label{L("pool", "a"), L("code", "200"), L("env", "prod")}, m.labels[1])
+	require.Equal(t, shared, m.labels[2])
+
+	// the batch is emptied and can be reused
+	require.Equal(t, 0, b.Len())
+	b.Emit()
+	require.Len(t, m.keys, 6)
+	b.Incr("ckey", 1)
+	b.Emit()
+	require.Len(t, m.keys, 7)
+}
+
+func TestBatch_Filters(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(c *Config) {
+		c.EnableHostnameLabel = false
+		c.EnableRuntimeMetrics = false
+		c.BlockedPrefixes = []string{"debug"}
+		c.BlockedLabels = []string{"secret"}
+		c.MaxLabels = 1
+		c.MaxLabelsPolicy = MaxLabelsDrop
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	b := met.Batch(L("secret", "x"), L("pool", "a"))
+	b.Incr("debug.thing", 1)
+	b.Incr("thing", 1)
+	b.Incr("over", 1, L("code", "200"))
+	b.Emit()
+
+	require.Equal(t, [][]string{{"thing"}}, m.getKeys())
+	require.Equal(t, []Label{L("pool", "a")}, m.labels[0])
+	require.Equal(t, FilterStats{FilteredByPrefix: 1, BlockedLabels: 2, OverLabelLimit: 1}, met.FilterStats())
+}
+
+// Emitting ten counters with shared labels, individually and as a batch:
+//
+// BenchmarkBatch/individual         	  248191	      4218 ns/op	    2400 B/op	      40 allocs/op
+// BenchmarkBatch/batch              	 1000000	      1270 ns/op	     256 B/op	      11 allocs/op
+func BenchmarkBatch(b *testing.B) {
+	met, err := New(&BlackholeSink{}, func(cfg *Config) {
+		cfg.EnableRuntimeMetrics = false
+		cfg.HostName = "localhost"
+		cfg.BaseLabels = []Label{L("env", "prod")}
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "stats.key" + strconv.Itoa(i)
+	}
+	label := L("pool", "a")
+
+	b.Run("individual", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				met.Incr(key, 1, label)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		batch := met.Batch(label)
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				batch.Incr(key, 1)
+			}
+			batch.Emit()
+		}
+	})
+}
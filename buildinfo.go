@@ -0,0 +1,14 @@
+package metrics
+
+// buildInfoKey is the key of the EmitBuildInfo gauge
+const buildInfoKey = "build_info"
+
+// EmitBuildInfo publishes a "build_info" gauge of 1, labeled with the info,
+// such as the version and commit, on the persisted metrics interval. The
+// labels are sorted by name and enriched and filtered like those of any other
+// metric. Stop the returned gauge to stop publishing it.
+func (m *Metrics) EmitBuildInfo(info map[string]string) PersistentGauge {
+	g := m.NewPersistentGauge(buildInfoKey, LabelsFromMap(info))
+	g.Set(1)
+	return g
+}
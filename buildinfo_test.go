@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitBuildInfo(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(c *Config) {
+		c.EnableRuntimeMetrics = false
+		c.PersistentInterval = 0
+		c.HostName = "host1"
+		c.BlockedLabels = []string{"builder"}
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	g := met.EmitBuildInfo(map[string]string{"version": "1.2.3", "commit": "abc123", "builder": "ci"})
+	met.publishPersistedMetrics()
+	met.publishPersistedMetrics()
+
+	require.Equal(t, [][]string{{"build_info"}, {"build_info"}}, m.getKeys())
+	require.Equal(t, []float64{1, 1}, m.vals)
+	require.Equal(t, []Label{L("commit", "abc123"), L("version", "1.2.3"), L("host", "host1")}, m.labels[0])
+
+	g.Stop()
+	met.publishPersistedMetrics()
+	require.Len(t, m.getKeys(), 2)
+}
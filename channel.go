@@ -0,0 +1,58 @@
+package metrics
+
+import "sync/atomic"
+
+// An Observation is a single emitted value, as sent by a ChannelSink
+type Observation struct {
+	Type   MetricType
+	Keys   []string
+	Labels []Label
+	Value  float64
+}
+
+// ChannelSink is a MetricSink that sends each emitted value as an Observation
+// on a buffered channel, for assertions in tests or custom processing.
+// Observations are dropped and counted when the channel is full, so emitting
+// never blocks.
+type ChannelSink struct {
+	ch      chan Observation
+	dropped atomic.Uint64
+}
+
+// NewChannelSink creates a ChannelSink with a channel buffering size
+// observations
+func NewChannelSink(size int) *ChannelSink {
+	return &ChannelSink{ch: make(chan Observation, size)}
+}
+
+// BuildMetricEmitter copies the keys and labels once, they are shared by the
+// observations of the emitter and must not be modified.
+func (s *ChannelSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	keys = append([]string(nil), keys...)
+	if len(labels) > 0 {
+		labels = append([]Label(nil), labels...)
+	}
+
+	return func(val float64) {
+		select {
+		case s.ch <- Observation{Type: mType, Keys: keys, Labels: labels, Value: val}:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Observations returns the channel of observations. It is never closed.
+func (s *ChannelSink) Observations() <-chan Observation {
+	return s.ch
+}
+
+// Dropped returns the number of observations dropped on a full channel
+func (s *ChannelSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// SendErrors returns the number of observations dropped, see Dropped
+func (s *ChannelSink) SendErrors() uint64 {
+	return s.Dropped()
+}
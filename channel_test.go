@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelSink(t *testing.T) {
+	s := NewChannelSink(2)
+	var _ SendErrorSink = s
+
+	keys := []string{"ckey"}
+	labels := []Label{L("a", "b")}
+	counter := s.BuildMetricEmitter(MetricTypeCounter, keys, labels)
+	gauge := s.BuildMetricEmitter(MetricTypeGauge, []string{"gkey"}, nil)
+
+	// the emitter doesn't share the slices it was built with
+	keys[0] = "changed"
+	labels[0] = L("c", "d")
+
+	counter(1)
+	gauge(2)
+	counter(3)
+
+	require.Equal(t, Observation{Type: MetricTypeCounter, Keys: []string{"ckey"}, Labels: []Label{L("a", "b")}, Value: 1}, <-s.Observations())
+	require.Equal(t, Observation{Type: MetricTypeGauge, Keys: []string{"gkey"}, Value: 2}, <-s.Observations())
+	require.Empty(t, s.Observations())
+	require.Equal(t, uint64(1), s.Dropped())
+	require.Equal(t, uint64(1), s.SendErrors())
+}
+
+func TestChannelSink_Metrics(t *testing.T) {
+	s := NewChannelSink(10)
+	met, err := New(s, func(c *Config) {
+		c.EnableHostnameLabel = false
+		c.EnableRuntimeMetrics = false
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	met.Incr("requests", 1, L("code", "200"))
+
+	obs := <-s.Observations()
+	require.Equal(t, MetricTypeCounter, obs.Type)
+	require.Equal(t, []string{"requests"}, obs.Keys)
+	require.Equal(t, []Label{L("code", "200")}, obs.Labels)
+	require.Equal(t, float64(1), obs.Value)
+}
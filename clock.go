@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"math/rand"
+	"time"
+)
+
+// A Clock tells the time for timers and drives the periodic collection of
+// metrics. Tests can set a fake clock with Config.Clock or WithInmemClock to
+// control the time instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// A Ticker delivers ticks like a time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// SystemClock is the Clock of the time package, used by default
+var SystemClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{t: time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTicker) Reset(d time.Duration) {
+	r.t.Reset(d)
+}
+
+func (r realTicker) Stop() {
+	r.t.Stop()
+}
+
+// clockOrReal returns the clock, or the SystemClock if nil
+func clockOrReal(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
+
+// clock returns the Config.Clock of the metrics
+func (m *Metrics) clock() Clock {
+	return clockOrReal(m.cfg.Clock)
+}
+
+// jitterRand returns a random value in [0, 1) for ticker jitter
+var jitterRand = rand.Float64
+
+// jitterTicker is a Ticker whose first tick is delayed by a random fraction of
+// the interval, up to Config.TickerJitter, so that instances started together
+// don't tick in sync. The loop receiving the ticks must call ticked on each.
+type jitterTicker struct {
+	Ticker
+	d       time.Duration
+	jitter  float64
+	delayed bool // the first tick is still delayed
+}
+
+// newTicker returns a jitterTicker of the clock ticking every d
+func (m *Metrics) newTicker(d time.Duration) *jitterTicker {
+	t := &jitterTicker{d: d, jitter: m.cfg.TickerJitter}
+	t.Ticker = m.clock().NewTicker(t.delay(d))
+	return t
+}
+
+// delay returns the interval until the first tick of a ticker every d
+func (t *jitterTicker) delay(d time.Duration) time.Duration {
+	delay := time.Duration(t.jitter * jitterRand() * float64(d))
+	t.delayed = delay > 0
+	return d + delay
+}
+
+// Reset changes the interval to d, delaying the next tick again
+func (t *jitterTicker) Reset(d time.Duration) {
+	t.d = d
+	t.Ticker.Reset(t.delay(d))
+}
+
+// ticked resumes the regular interval after the delayed first tick
+func (t *jitterTicker) ticked() {
+	if t.delayed {
+		t.delayed = false
+		t.Ticker.Reset(t.d)
+	}
+}
@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a Clock whose time only moves with Advance, which also fires
+// the tickers that are due
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTicker(d time.Duration) Ticker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{clock: f, c: make(chan time.Time, 1), d: d, next: f.now.Add(d)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the time forward, ticking every ticker due
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		if t.stopped || t.next.After(f.now) {
+			continue
+		}
+		for !t.next.After(f.now) {
+			t.next = t.next.Add(t.d)
+		}
+		// drop the tick if the last wasn't received, like a time.Ticker
+		select {
+		case t.c <- f.now:
+		default:
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock   *fakeClock
+	c       chan time.Time
+	d       time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.d = d
+	t.next = t.clock.now.Add(d)
+	t.stopped = false
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+}
+
+func TestClock_Timer(t *testing.T) {
+	clock := newFakeClock()
+	m, met := mockMetric(t, func(c *Config) {
+		c.TimerGranularity = time.Millisecond
+		c.Clock = clock
+	})
+
+	start := clock.Now()
+	clock.Advance(250 * time.Millisecond)
+	met.MeasureSince("timer", start)
+	met.NewTimer("timer").MeasureSince(start)
+
+	rt := met.NewTimerStart("timer")
+	clock.Advance(time.Second)
+	rt.Stop()
+
+	require.Equal(t, []float64{250, 250, 1000}, m.vals)
+}
+
+func TestClock_Persisted(t *testing.T) {
+	clock := newFakeClock()
+	m := &MockSink{}
+	met, err := New(m, func(c *Config) {
+		c.EnableRuntimeMetrics = false
+		c.PersistentInterval = time.Hour
+		c.TickerJitter = 0
+		c.Clock = clock
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	g := met.NewPersistentGauge("pkey", nil)
+	g.Set(1)
+
+	// wait for the poller to create its ticker before advancing
+	require.Eventually(t, func() bool {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		return len(clock.tickers) > 0
+	}, 5*time.Second, time.Millisecond)
+	require.Empty(t, m.getKeys())
+
+	clock.Advance(time.Hour)
+	require.Eventually(t, func() bool {
+		return len(m.getKeys()) == 1
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestClock_TickerJitter(t *testing.T) {
+	jitterRand = func() float64 { return 0.5 }
+	defer func() { jitterRand = rand.Float64 }()
+
+	clock := newFakeClock()
+	m := &MockSink{}
+	met, err := New(m, func(c *Config) {
+		c.EnableRuntimeMetrics = false
+		c.PersistentInterval = time.Hour
+		c.TickerJitter = 0.2
+		c.Clock = clock
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	met.NewPersistentGauge("pkey", nil).Set(1)
+	require.Eventually(t, func() bool {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		return len(clock.tickers) > 0
+	}, 5*time.Second, time.Millisecond)
+
+	// the first tick is delayed by half the jitter, 6 minutes
+	clock.Advance(time.Hour)
+	require.Never(t, func() bool { return len(m.getKeys()) > 0 }, 50*time.Millisecond, time.Millisecond)
+	clock.Advance(6 * time.Minute)
+	require.Eventually(t, func() bool {
+		return len(m.getKeys()) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// then it ticks on the interval
+	require.Eventually(t, func() bool {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+		return clock.tickers[0].d == time.Hour
+	}, 5*time.Second, time.Millisecond)
+	clock.Advance(time.Hour)
+	require.Eventually(t, func() bool {
+		return len(m.getKeys()) == 2
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestInmemSink_Clock(t *testing.T) {
+	clock := newFakeClock()
+	inm := NewInmemSink(10*time.Second, 30*time.Second, WithInmemClock(clock))
+
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)(1)
+	clock.Advance(5 * time.Second)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)(2)
+
+	data := inm.Data()
+	require.Len(t, data, 1)
+	require.Equal(t, clock.Now().Truncate(10*time.Second), data[0].Interval)
+	require.Equal(t, 2, data[0].Counters["ckey"].Count)
+
+	// the next interval starts with the clock, without sleeping
+	clock.Advance(10 * time.Second)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)(3)
+
+	data = inm.Data()
+	require.Len(t, data, 2)
+	require.Equal(t, 1, data[1].Counters["ckey"].Count)
+	require.Equal(t, float64(3), data[1].Counters["ckey"].Sum)
+}
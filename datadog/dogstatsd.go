@@ -2,7 +2,14 @@ package datadog
 
 import (
 	"fmt"
+	"log"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
 	metrics "github.com/mheffner/go-simple-metrics"
@@ -10,16 +17,93 @@ import (
 
 const defaultRate = 1.0
 
+func init() {
+	if err := metrics.RegisterSinkFactory("dogstatsd", NewDogStatsdSinkFromURL); err != nil {
+		panic(err)
+	}
+}
+
 // DogStatsdSink provides a MetricSink that can be used
 // with a dogstatsd server. It utilizes the Dogstatsd client at github.com/DataDog/datadog-go/statsd
 type DogStatsdSink struct {
 	client            *statsd.Client
 	hostName          string
 	propagateHostname bool
+
+	// upDownTotals maps a series to the *runningTotal of an up/down counter,
+	// which is reported as a gauge
+	upDownTotals sync.Map
+
+	// unknownTypes records the unknown metric types already logged
+	unknownTypes sync.Map
+
+	// sendErrors counts the metrics the client failed to send
+	sendErrors atomic.Uint64
+
+	maxTagLength int
+	maxTags      int
+	tagPolicy    TagLimitPolicy
+	tagsLimited  atomic.Uint64
+
+	timersAsDistributions bool
+}
+
+// A DogStatsdOption configures a DogStatsdSink
+type DogStatsdOption func(s *DogStatsdSink)
+
+// TagLimitPolicy is how tags longer than the maximum length are handled
+type TagLimitPolicy int
+
+const (
+	// TagLimitTruncate cuts the tag to the maximum length
+	TagLimitTruncate TagLimitPolicy = iota
+	// TagLimitDrop removes the tag from the metric
+	TagLimitDrop
+)
+
+// WithTagLimits limits the length in bytes of each name:value tag and the
+// number of tags of a metric, since the agent drops metrics over its limits.
+// Tags over maxLength are truncated or dropped by the policy, and tags past
+// the first maxTags are dropped. Zero disables a limit.
+func WithTagLimits(maxLength, maxTags int, policy TagLimitPolicy) DogStatsdOption {
+	return func(s *DogStatsdSink) {
+		s.maxTagLength = maxLength
+		s.maxTags = maxTags
+		s.tagPolicy = policy
+	}
+}
+
+// runningTotal is the current value of an up/down counter series
+type runningTotal struct {
+	lock sync.Mutex
+	val  float64
+}
+
+func (r *runningTotal) add(delta float64) float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.val += delta
+	return r.val
+}
+
+// upDownSeries identifies an up/down counter series
+func upDownSeries(flatKey string, tags []string) string {
+	return flatKey + "|" + strings.Join(tags, ",")
+}
+
+// WithTimersAsDistributions sends timers as distributions (|d) rather than
+// timings (|ms), so their percentiles are computed globally by Datadog. The
+// value is sent as is, in units of Config.TimerGranularity, so the
+// distribution is in milliseconds with the default granularity.
+func WithTimersAsDistributions(enabled bool) DogStatsdOption {
+	return func(s *DogStatsdSink) {
+		s.timersAsDistributions = enabled
+	}
 }
 
 // NewDogStatsdSink is used to create a new DogStatsdSink with sane defaults
-func NewDogStatsdSink(addr string, hostName string) (*DogStatsdSink, error) {
+func NewDogStatsdSink(addr string, hostName string, opts ...DogStatsdOption) (*DogStatsdSink, error) {
 	client, err := statsd.New(addr)
 	if err != nil {
 		return nil, err
@@ -29,9 +113,67 @@ func NewDogStatsdSink(addr string, hostName string) (*DogStatsdSink, error) {
 		hostName:          hostName,
 		propagateHostname: false,
 	}
+	for _, opt := range opts {
+		opt(sink)
+	}
 	return sink, nil
 }
 
+// NewDogStatsdSinkFromURL creates a DogStatsdSink from a URL. It is used
+// (and tested) from metrics.NewMetricSinkFromURL. The host and port become the
+// agent address and the "host" query parameter sets the hostname. The
+// "max_tag_length" and "max_tags" parameters set tag limits, which truncate
+// long tags unless "tag_policy" is "drop". "timers_as_distributions=true"
+// sends timers as distributions.
+func NewDogStatsdSinkFromURL(u *url.URL) (metrics.MetricSink, error) {
+	params := u.Query()
+
+	var opts []DogStatsdOption
+	if params.Has("max_tag_length") || params.Has("max_tags") {
+		maxLength, err := intParam(params, "max_tag_length")
+		if err != nil {
+			return nil, err
+		}
+		maxTags, err := intParam(params, "max_tags")
+		if err != nil {
+			return nil, err
+		}
+
+		policy := TagLimitTruncate
+		switch p := params.Get("tag_policy"); p {
+		case "", "truncate":
+		case "drop":
+			policy = TagLimitDrop
+		default:
+			return nil, fmt.Errorf("bad tag_policy %q, must be truncate or drop", p)
+		}
+		opts = append(opts, WithTagLimits(maxLength, maxTags, policy))
+	}
+
+	if v := params.Get("timers_as_distributions"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad timers_as_distributions %q: %w", v, err)
+		}
+		opts = append(opts, WithTimersAsDistributions(enabled))
+	}
+
+	return NewDogStatsdSink(u.Host, params.Get("host"), opts...)
+}
+
+// intParam parses a non-negative integer query parameter, zero if unset
+func intParam(params url.Values, name string) (int, error) {
+	v := params.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad %s %q, must be a non-negative integer", name, v)
+	}
+	return n, nil
+}
+
 func (s *DogStatsdSink) flattenKey(parts []string) string {
 	joined := strings.Join(parts, ".")
 	return strings.Map(sanitize, joined)
@@ -55,10 +197,12 @@ func (s *DogStatsdSink) parseKey(key []string) ([]string, []metrics.Label) {
 	var labels []metrics.Label
 	hostName := s.hostName
 
-	// Splice the hostname out of the key
+	// Splice the hostname out of a copy of the key, the caller's is kept as is
 	for i, el := range key {
 		if el == hostName {
-			key = append(key[:i], key[i+1:]...)
+			spliced := make([]string, 0, len(key)-1)
+			spliced = append(spliced, key[:i]...)
+			key = append(spliced, key[i+1:]...)
 			break
 		}
 	}
@@ -71,45 +215,186 @@ func (s *DogStatsdSink) parseKey(key []string) ([]string, []metrics.Label) {
 
 // Implementation of methods in the MetricSink interface
 
+// BuildMetricEmitter sanitizes the key and tags once, so the emitter only
+// sends the value with the client.
 func (s *DogStatsdSink) BuildMetricEmitter(mType metrics.MetricType, keys []string, labels []metrics.Label) metrics.MetricEmitter {
 	flatKey, tags := s.getFlatkeyAndCombinedLabels(keys, labels)
 
-	return func(val float64) {
-		switch mType {
-		case metrics.MetricTypeCounter:
-			_ = s.client.Count(flatKey, int64(val), tags, defaultRate)
-		case metrics.MetricTypeGauge:
-			_ = s.client.Gauge(flatKey, val, tags, defaultRate)
-		case metrics.MetricTypeTimer:
-			_ = s.client.TimeInMilliseconds(flatKey, val, tags, defaultRate)
-		case metrics.MetricTypeDistribution:
-			_ = s.client.Distribution(flatKey, val, tags, defaultRate)
-		case metrics.MetricTypeHistogram:
-			_ = s.client.Histogram(flatKey, val, tags, defaultRate)
+	switch mType {
+	case metrics.MetricTypeCounter:
+		return func(val float64) {
+			s.countError(s.client.Count(flatKey, int64(val), tags, defaultRate))
+		}
+	case metrics.MetricTypeGauge:
+		return func(val float64) {
+			s.countError(s.client.Gauge(flatKey, val, tags, defaultRate))
+		}
+	case metrics.MetricTypeUpDownCounter:
+		rt, _ := s.upDownTotals.LoadOrStore(upDownSeries(flatKey, tags), &runningTotal{})
+		total := rt.(*runningTotal)
+
+		return func(val float64) {
+			s.countError(s.client.Gauge(flatKey, total.add(val), tags, defaultRate))
+		}
+	case metrics.MetricTypeTimer:
+		if s.timersAsDistributions {
+			return func(val float64) {
+				s.countError(s.client.Distribution(flatKey, val, tags, defaultRate))
+			}
+		}
+		return func(val float64) {
+			s.countError(s.client.TimeInMilliseconds(flatKey, val, tags, defaultRate))
+		}
+	case metrics.MetricTypeDistribution:
+		return func(val float64) {
+			s.countError(s.client.Distribution(flatKey, val, tags, defaultRate))
+		}
+	case metrics.MetricTypeHistogram:
+		return func(val float64) {
+			s.countError(s.client.Histogram(flatKey, val, tags, defaultRate))
+		}
+	default:
+		s.logUnknownType(mType)
+		return func(float64) {}
+	}
+}
+
+// logUnknownType logs that the sink drops the metrics of a type it doesn't
+// know, once per type
+func (s *DogStatsdSink) logUnknownType(mType metrics.MetricType) {
+	if _, logged := s.unknownTypes.LoadOrStore(mType, struct{}{}); !logged {
+		log.Printf("[WARN] Unknown metric type %d, the Datadog sink drops its metrics", mType)
+	}
+}
+
+// BuildMetricEmitterAt is like BuildMetricEmitter, sending counters, gauges,
+// and up/down counters with their timestamp. The agent doesn't aggregate
+// timestamped values. Dogstatsd has no timestamps for timers, histograms,
+// and distributions, so they are sent as observed now.
+func (s *DogStatsdSink) BuildMetricEmitterAt(mType metrics.MetricType, keys []string, labels []metrics.Label) metrics.MetricEmitterAt {
+	switch mType {
+	case metrics.MetricTypeCounter, metrics.MetricTypeGauge, metrics.MetricTypeUpDownCounter:
+	default:
+		emitter := s.BuildMetricEmitter(mType, keys, labels)
+		return func(val float64, _ time.Time) {
+			emitter(val)
+		}
+	}
+
+	flatKey, tags := s.getFlatkeyAndCombinedLabels(keys, labels)
+	if mType == metrics.MetricTypeCounter {
+		return func(val float64, at time.Time) {
+			if at.IsZero() {
+				s.countError(s.client.Count(flatKey, int64(val), tags, defaultRate))
+				return
+			}
+			s.countError(s.client.CountWithTimestamp(flatKey, int64(val), tags, defaultRate, at))
+		}
+	}
+
+	var total *runningTotal
+	if mType == metrics.MetricTypeUpDownCounter {
+		rt, _ := s.upDownTotals.LoadOrStore(upDownSeries(flatKey, tags), &runningTotal{})
+		total = rt.(*runningTotal)
+	}
+
+	return func(val float64, at time.Time) {
+		if total != nil {
+			val = total.add(val)
+		}
+		if at.IsZero() {
+			s.countError(s.client.Gauge(flatKey, val, tags, defaultRate))
+			return
 		}
+		s.countError(s.client.GaugeWithTimestamp(flatKey, val, tags, defaultRate, at))
 	}
 }
 
+func (s *DogStatsdSink) countError(err error) {
+	if err != nil {
+		s.sendErrors.Add(1)
+	}
+}
+
+// TagsLimited returns the number of tags truncated or dropped by the limits of
+// WithTagLimits, counted when emitters are built
+func (s *DogStatsdSink) TagsLimited() uint64 {
+	return s.tagsLimited.Load()
+}
+
+// SendErrors returns the number of metrics the client returned an error for
+func (s *DogStatsdSink) SendErrors() uint64 {
+	return s.sendErrors.Load()
+}
+
+// ForgetMetric drops the running total of an up/down counter. Other metric
+// types keep no state in the sink.
+func (s *DogStatsdSink) ForgetMetric(mType metrics.MetricType, keys []string, labels []metrics.Label) {
+	if mType != metrics.MetricTypeUpDownCounter {
+		return
+	}
+
+	flatKey, tags := s.getFlatkeyAndCombinedLabels(keys, labels)
+	s.upDownTotals.Delete(upDownSeries(flatKey, tags))
+}
+
 // Shutdown disables further metric collection, blocks to flush data, and tears down the sink.
-func (s *DogStatsdSink) Shutdown() {
-	_ = s.client.Close()
+// It returns the error of the client's final flush and close, which Metrics.Shutdown returns.
+func (s *DogStatsdSink) Shutdown() error {
+	return s.client.Close()
 }
 
 func (s *DogStatsdSink) getFlatkeyAndCombinedLabels(key []string, labels []metrics.Label) (string, []string) {
 	key, parsedLabels := s.parseKey(key)
 	flatKey := s.flattenKey(key)
-	labels = append(labels, parsedLabels...)
 
-	var tags []string
-	for _, label := range labels {
-		label.Name = strings.Map(sanitize, label.Name)
-		label.Value = strings.Map(sanitize, label.Value)
-		if label.Value != "" {
-			tags = append(tags, fmt.Sprintf("%s:%s", label.Name, label.Value))
-		} else {
-			tags = append(tags, label.Name)
+	n := len(labels) + len(parsedLabels)
+	if n == 0 {
+		return flatKey, nil
+	}
+	tags := make([]string, 0, n)
+	for _, l := range [][]metrics.Label{labels, parsedLabels} {
+		for _, label := range l {
+			if t, ok := s.limitTag(tag(label)); ok {
+				tags = append(tags, t)
+			}
 		}
 	}
 
+	if s.maxTags > 0 && len(tags) > s.maxTags {
+		s.tagsLimited.Add(uint64(len(tags) - s.maxTags))
+		tags = tags[:s.maxTags]
+	}
+
 	return flatKey, tags
 }
+
+// limitTag applies the maximum tag length, returning false if the tag is
+// dropped
+func (s *DogStatsdSink) limitTag(t string) (string, bool) {
+	if s.maxTagLength <= 0 || len(t) <= s.maxTagLength {
+		return t, true
+	}
+
+	s.tagsLimited.Add(1)
+	if s.tagPolicy == TagLimitDrop {
+		return "", false
+	}
+
+	// cut at a rune boundary
+	n := s.maxTagLength
+	for n > 0 && !utf8.RuneStart(t[n]) {
+		n--
+	}
+	return t[:n], n > 0
+}
+
+// tag formats a label as a sanitized name:value tag, or only the name if the
+// value is empty
+func tag(label metrics.Label) string {
+	name := strings.Map(sanitize, label.Name)
+	if label.Value == "" {
+		return name
+	}
+	return name + ":" + strings.Map(sanitize, label.Value)
+}
@@ -1,10 +1,17 @@
 package datadog
 
 import (
+	"bytes"
+	"errors"
+	"log"
 	"net"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/DataDog/datadog-go/v5/statsd"
 	metrics "github.com/mheffner/go-simple-metrics"
 )
 
@@ -17,8 +24,11 @@ func MockGetHostname() string {
 	return TestHostname
 }
 
-func mockNewDogStatsdSink(addr string) *DogStatsdSink {
-	dog, _ := NewDogStatsdSink(addr, MockGetHostname())
+// mockNewDogStatsdSink creates a sink closed at the end of the test, so that
+// its client telemetry doesn't reach the server of a later test
+func mockNewDogStatsdSink(t *testing.T, addr string, opts ...DogStatsdOption) *DogStatsdSink {
+	dog, _ := NewDogStatsdSink(addr, MockGetHostname(), opts...)
+	t.Cleanup(func() { dog.Shutdown() })
 	return dog
 }
 
@@ -38,7 +48,7 @@ func TestTaggableMetrics(t *testing.T) {
 	server, buf := setupTestServerAndBuffer(t)
 	defer server.Close()
 
-	dog := mockNewDogStatsdSink(DogStatsdAddr)
+	dog := mockNewDogStatsdSink(t, DogStatsdAddr)
 
 	keys := []string{"sample", "thing"}
 	labels := []metrics.Label{{"tagkey", "tagvalue"}}
@@ -51,6 +61,36 @@ func TestTaggableMetrics(t *testing.T) {
 
 	dog.BuildMetricEmitter(metrics.MetricTypeCounter, keys, labels)(4)
 	assertServerMatchesExpected(t, server, buf, "sample.thing:4|c|#tagkey:tagvalue")
+
+	dog.BuildMetricEmitter(metrics.MetricTypeHistogram, keys, labels)(4)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:4|h|#tagkey:tagvalue")
+
+	// distributions are aggregated globally by the agent, unlike histograms
+	dog.BuildMetricEmitter(metrics.MetricTypeDistribution, keys, labels)(4)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:4|d|#tagkey:tagvalue")
+
+	// up/down counters are gauges of the running total for the series
+	dog.BuildMetricEmitter(metrics.MetricTypeUpDownCounter, keys, labels)(4)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:4|g|#tagkey:tagvalue")
+
+	dog.BuildMetricEmitter(metrics.MetricTypeUpDownCounter, keys, labels)(-1)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:3|g|#tagkey:tagvalue")
+}
+
+func TestTimersAsDistributions(t *testing.T) {
+	server, buf := setupTestServerAndBuffer(t)
+	defer server.Close()
+
+	keys := []string{"sample", "thing"}
+	labels := []metrics.Label{metrics.L("tagkey", "tagvalue")}
+
+	dog := mockNewDogStatsdSink(t, DogStatsdAddr)
+	dog.BuildMetricEmitter(metrics.MetricTypeTimer, keys, labels)(4)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:4.000000|ms|#tagkey:tagvalue")
+
+	dog = mockNewDogStatsdSink(t, DogStatsdAddr, WithTimersAsDistributions(true))
+	dog.BuildMetricEmitter(metrics.MetricTypeTimer, keys, labels)(4)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:4|d|#tagkey:tagvalue")
 }
 
 func assertServerMatchesExpected(t *testing.T, server *net.UDPConn, buf []byte, expected string) {
@@ -121,6 +161,42 @@ func BenchmarkMemoizedCounter(b *testing.B) {
 	met.Shutdown()
 }
 
+// Building an emitter per emit, as unmemoized metrics do, and emitting with a
+// memoized emitter. Before the client call was picked per emitter:
+//
+// BenchmarkEmitter/build            	 1620909	       813.9 ns/op	     256 B/op	      10 allocs/op
+// BenchmarkEmitter/memoized         	13790379	        84.20 ns/op	      48 B/op	       1 allocs/op
+//
+// After:
+//
+// BenchmarkEmitter/build            	 2587524	       484.2 ns/op	     192 B/op	       6 allocs/op
+// BenchmarkEmitter/memoized         	13898389	        90.84 ns/op	      48 B/op	       1 allocs/op
+func BenchmarkEmitter(b *testing.B) {
+	s, err := NewDogStatsdSink("127.0.0.1:2181", "my-host")
+	if err != nil {
+		panic(err)
+	}
+	defer s.Shutdown()
+
+	keys := []string{"svcname", "foo"}
+	labels := []metrics.Label{metrics.L("label1", "value1"), metrics.L("label2", "value2")}
+
+	b.Run("build", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.BuildMetricEmitter(metrics.MetricTypeCounter, keys, labels)(5)
+		}
+	})
+	b.Run("memoized", func(b *testing.B) {
+		emit := s.BuildMetricEmitter(metrics.MetricTypeCounter, keys, labels)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			emit(5)
+		}
+	})
+}
+
 func BenchmarkAggregatedCounter(b *testing.B) {
 	s, err := NewDogStatsdSink("127.0.0.1:2181", "my-host")
 	if err != nil {
@@ -134,7 +210,7 @@ func BenchmarkAggregatedCounter(b *testing.B) {
 		panic(err)
 	}
 
-	c := met.NewAggregatedCounter("foo", metrics.L("label1", "value1"), metrics.L("label2", "value2"))
+	c := met.NewAggregatedCounter("foo", []metrics.Label{metrics.L("label1", "value1"), metrics.L("label2", "value2")})
 
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -144,3 +220,216 @@ func BenchmarkAggregatedCounter(b *testing.B) {
 	b.StopTimer()
 	met.Shutdown()
 }
+
+func TestNewMetricSinkFromURL(t *testing.T) {
+	for _, tc := range []struct {
+		desc       string
+		input      string
+		expect     reflect.Type
+		expectErr  string
+		expectHost string
+	}{
+		{
+			desc:   "dogstatsd scheme yields a DogStatsdSink",
+			input:  "dogstatsd://" + DogStatsdAddr,
+			expect: reflect.TypeOf(&DogStatsdSink{}),
+		},
+		{
+			desc:       "host param sets the hostname",
+			input:      "dogstatsd://" + DogStatsdAddr + "?host=" + TestHostname,
+			expect:     reflect.TypeOf(&DogStatsdSink{}),
+			expectHost: TestHostname,
+		},
+		{
+			desc:   "tag limit params set the limits",
+			input:  "dogstatsd://" + DogStatsdAddr + "?max_tag_length=200&max_tags=10&tag_policy=drop",
+			expect: reflect.TypeOf(&DogStatsdSink{}),
+		},
+		{
+			desc:   "timers_as_distributions param sends timers as distributions",
+			input:  "dogstatsd://" + DogStatsdAddr + "?timers_as_distributions=true",
+			expect: reflect.TypeOf(&DogStatsdSink{}),
+		},
+		{
+			desc:      "bad max_tags yields an error",
+			input:     "dogstatsd://" + DogStatsdAddr + "?max_tags=-1",
+			expectErr: "bad max_tags",
+		},
+		{
+			desc:      "bad tag_policy yields an error",
+			input:     "dogstatsd://" + DogStatsdAddr + "?max_tags=10&tag_policy=nope",
+			expectErr: "bad tag_policy",
+		},
+		{
+			desc:      "unknown scheme yields an error",
+			input:     "notasink://whatever",
+			expectErr: "unrecognized sink name: \"notasink\"",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			ms, err := metrics.NewMetricSinkFromURL(tc.input)
+			if tc.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+					t.Fatalf("expected err: %q to contain: %q", err, tc.expectErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %s", err)
+			}
+			got := reflect.TypeOf(ms)
+			if got != tc.expect {
+				t.Fatalf("expected return type to be %v, got: %v", tc.expect, got)
+			}
+			dog := ms.(*DogStatsdSink)
+			defer dog.Shutdown()
+			if dog.hostName != tc.expectHost {
+				t.Fatalf("expected hostname %q, got: %q", tc.expectHost, dog.hostName)
+			}
+		})
+	}
+}
+
+func TestTagLimits(t *testing.T) {
+	labels := []metrics.Label{
+		metrics.L("short", "v"),
+		metrics.L("long", "abcdefghij"),
+		metrics.L("utf8", "ééééé"),
+		metrics.L("empty", ""),
+	}
+
+	for _, tc := range []struct {
+		desc      string
+		maxLength int
+		maxTags   int
+		policy    TagLimitPolicy
+		expect    []string
+		limited   uint64
+	}{
+		{
+			desc:   "no limits",
+			expect: []string{"short:v", "long:abcdefghij", "utf8:ééééé", "empty"},
+		},
+		{
+			desc:      "long tags are truncated at a rune boundary",
+			maxLength: 10,
+			expect:    []string{"short:v", "long:abcde", "utf8:éé", "empty"},
+			limited:   2,
+		},
+		{
+			desc:      "long tags are dropped",
+			maxLength: 10,
+			policy:    TagLimitDrop,
+			expect:    []string{"short:v", "empty"},
+			limited:   2,
+		},
+		{
+			desc:    "tags past the max are dropped",
+			maxTags: 2,
+			expect:  []string{"short:v", "long:abcdefghij"},
+			limited: 2,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dog := &DogStatsdSink{}
+			WithTagLimits(tc.maxLength, tc.maxTags, tc.policy)(dog)
+
+			_, tags := dog.getFlatkeyAndCombinedLabels([]string{"key"}, labels)
+			if !reflect.DeepEqual(tags, tc.expect) {
+				t.Fatalf("expected tags %q, got: %q", tc.expect, tags)
+			}
+			if n := dog.TagsLimited(); n != tc.limited {
+				t.Fatalf("expected %d tags limited, got: %d", tc.limited, n)
+			}
+		})
+	}
+}
+
+func TestUnknownMetricType(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	// a nil client would count a send error if the emitter sent anything
+	dog := &DogStatsdSink{}
+	unknown := metrics.MetricType(100)
+	dog.BuildMetricEmitter(unknown, []string{"a"}, nil)(1)
+	dog.BuildMetricEmitter(unknown, []string{"b"}, nil)(1)
+
+	if n := strings.Count(buf.String(), "Unknown metric type 100"); n != 1 {
+		t.Fatalf("expected the unknown type to be logged once, got %d times: %s", n, buf.String())
+	}
+	if n := dog.SendErrors(); n != 0 {
+		t.Fatalf("expected nothing sent, got %d send errors", n)
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	// a nil client returns an error for every metric
+	dog := &DogStatsdSink{}
+	var _ metrics.SendErrorSink = dog
+
+	dog.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"key"}, nil)(1)
+	dog.BuildMetricEmitter(metrics.MetricTypeUpDownCounter, []string{"key"}, nil)(1)
+	if n := dog.SendErrors(); n != 2 {
+		t.Fatalf("expected 2 send errors, got: %d", n)
+	}
+}
+
+func TestParseKey_KeysUnchanged(t *testing.T) {
+	// a nil client, nothing is sent
+	dog := &DogStatsdSink{hostName: TestHostname}
+	keys := []string{"sample", TestHostname, "thing"}
+
+	dog.BuildMetricEmitter(metrics.MetricTypeUpDownCounter, keys, nil)(1)
+	dog.ForgetMetric(metrics.MetricTypeUpDownCounter, keys, nil)
+	if want := []string{"sample", TestHostname, "thing"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("expected the keys to be unchanged, got %v", keys)
+	}
+
+	// the total was forgotten under the same series it was kept under
+	dog.upDownTotals.Range(func(k, _ any) bool {
+		t.Fatalf("expected no running totals, got %v", k)
+		return false
+	})
+}
+
+func TestShutdownError(t *testing.T) {
+	// a nil client fails to close
+	dog := &DogStatsdSink{}
+	var _ metrics.ShutdownSink = dog
+
+	met, err := metrics.New(dog, func(c *metrics.Config) {
+		c.EnableRuntimeMetrics = false
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if err := met.Shutdown(); !errors.Is(err, statsd.ErrNoClient) {
+		t.Fatalf("expected the close error, got: %v", err)
+	}
+}
+
+func TestMetricEmitterAt(t *testing.T) {
+	server, buf := setupTestServerAndBuffer(t)
+	defer server.Close()
+
+	dog := mockNewDogStatsdSink(t, DogStatsdAddr)
+	var _ metrics.TimestampSink = dog
+
+	at := time.Unix(1700000000, 0)
+	keys := []string{"sample", "thing"}
+
+	dog.BuildMetricEmitterAt(metrics.MetricTypeCounter, keys, nil)(4, at)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:4|c|T1700000000")
+
+	dog.BuildMetricEmitterAt(metrics.MetricTypeGauge, keys, nil)(4, at)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:4|g|T1700000000")
+
+	dog.BuildMetricEmitterAt(metrics.MetricTypeUpDownCounter, keys, nil)(2, at)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:2|g|T1700000000")
+
+	// dogstatsd has no timestamps for histograms
+	dog.BuildMetricEmitterAt(metrics.MetricTypeHistogram, keys, nil)(4, at)
+	assertServerMatchesExpected(t, server, buf, "sample.thing:4|h")
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// An EmittedSpec describes a metric as it would reach the sink in a DryRun,
+// after enrichment and filtering
+type EmittedSpec struct {
+	Type   MetricType
+	Keys   []string
+	Labels []Label
+
+	// Emits is the number of values emitted, zero for a memoized metric never
+	// emitted and for a filtered one
+	Emits uint64
+
+	// Filtered is set if the filters drop the metric, which would never reach
+	// the sink. The labels are the ones left by the label filters.
+	Filtered bool
+}
+
+type dryRunSpec struct {
+	spec  EmittedSpec
+	emits atomic.Uint64
+}
+
+// dryRunSink records the metrics it's given instead of sending them, see
+// Config.DryRun
+type dryRunSink struct {
+	lock  sync.Mutex
+	specs []*dryRunSpec
+	index map[string]*dryRunSpec
+}
+
+func (s *dryRunSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	spec := s.record(mType, keys, labels, false)
+	return func(val float64) {
+		spec.emits.Add(1)
+	}
+}
+
+// record returns the spec of the metric, recorded the first time it's seen
+func (s *dryRunSink) record(mType MetricType, keys []string, labels []Label, filtered bool) *dryRunSpec {
+	var id strings.Builder
+	id.WriteString(strconv.Itoa(int(mType)))
+	for _, key := range keys {
+		id.WriteString("\x00" + key)
+	}
+	id.WriteString("\x00")
+	for _, label := range labels {
+		id.WriteString("\x00" + label.Name + "=" + label.Value)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if spec, ok := s.index[id.String()]; ok {
+		return spec
+	}
+
+	spec := &dryRunSpec{spec: EmittedSpec{
+		Type:     mType,
+		Keys:     append([]string(nil), keys...),
+		Labels:   append([]Label(nil), labels...),
+		Filtered: filtered,
+	}}
+	if s.index == nil {
+		s.index = make(map[string]*dryRunSpec)
+	}
+	s.index[id.String()] = spec
+	s.specs = append(s.specs, spec)
+	return spec
+}
+
+// recordFiltered records a metric dropped by the filters in a DryRun
+func (m *Metrics) recordFiltered(typeName string, keys []string, labels []Label) {
+	d := m.root().dryRun
+	if d == nil {
+		return
+	}
+	for t, name := range metricTypeNames {
+		if name == typeName {
+			d.record(MetricType(t), keys, labels, true)
+			return
+		}
+	}
+}
+
+// DryRunReport returns the metrics recorded with Config.DryRun, in the order
+// they were first seen, or nil if DryRun isn't set
+func (m *Metrics) DryRunReport() []EmittedSpec {
+	d := m.root().dryRun
+	if d == nil {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	report := make([]EmittedSpec, len(d.specs))
+	for n, spec := range d.specs {
+		report[n] = spec.spec
+		report[n].Keys = append([]string(nil), spec.spec.Keys...)
+		report[n].Labels = append([]Label(nil), spec.spec.Labels...)
+		report[n].Emits = spec.emits.Load()
+	}
+	return report
+}
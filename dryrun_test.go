@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_DryRun(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(c *Config) {
+		c.EnableRuntimeMetrics = false
+		c.DryRun = true
+		c.EnableHostnameLabel = false
+		c.EnableTypePrefix = true
+		c.BaseLabels = []Label{L("env", "test")}
+		c.BlockedPrefixes = []string{"gauge.blocked"}
+		c.BlockedLabels = []string{"secret"}
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	met.Incr("requests", 1, L("secret", "x"))
+	met.Incr("requests", 1, L("secret", "y"))
+	met.SetGauge("blocked", 1)
+	met.NewHistogram("latency")
+
+	b := met.Batch()
+	b.SetGauge("blocked", 2)
+	b.Emit()
+
+	// nothing reaches the sink
+	require.Empty(t, m.getKeys())
+	require.Equal(t, []EmittedSpec{
+		{Type: MetricTypeCounter, Keys: []string{"counter", "requests"}, Labels: []Label{L("env", "test")}, Emits: 2},
+		{Type: MetricTypeGauge, Keys: []string{"gauge", "blocked"}, Labels: []Label{L("env", "test")}, Filtered: true},
+		{Type: MetricTypeHistogram, Keys: []string{"histogram", "latency"}, Labels: []Label{L("env", "test")}},
+	}, met.DryRunReport())
+}
+
+func TestMetrics_DryRunDisabled(t *testing.T) {
+	m, met := mockMetric(t)
+	met.Incr("requests", 1)
+
+	require.Nil(t, met.DryRunReport())
+	require.Len(t, m.getKeys(), 1)
+}
@@ -1,22 +1,289 @@
 package metrics
 
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
 func (m *Metrics) enrich(typeName string, key string, labels []Label) (bool, []string, []Label) {
-	keys := []string{key}
-	if m.cfg.HostName != "" && m.cfg.EnableHostnameLabel {
-		labels = append(labels, Label{"host", m.cfg.HostName})
+	keys := m.enrichKeys(typeName, key)
+	allowed, labelsFiltered := m.root().allowMetric(keys, m.enrichLabels(labels))
+	labelsFiltered, overLimit := m.limitLabels(labelsFiltered)
+	allowed = m.checkSeriesLimit(m.checkLabelLimit(allowed, overLimit), keys, labelsFiltered)
+	if !allowed {
+		m.recordFiltered(typeName, keys, labelsFiltered)
+	}
+	return allowed, keys, labelsFiltered
+}
+
+// enrichKeys returns the key with the scope, service, and type prefixes. The
+// service is its own key unless joined to the key by ServicePrefixSeparator.
+func (m *Metrics) enrichKeys(typeName string, key string) []string {
+	if m.scopePrefix != "" {
+		key = m.scopePrefix + "." + key
 	}
-	if m.cfg.ServiceName != "" && m.cfg.EnableServicePrefix {
-		keys = insert(0, m.cfg.ServiceName, keys)
+
+	// size the keys up front, so they're allocated once
+	servicePrefix := m.cfg.ServiceName != "" && m.cfg.EnableServicePrefix
+	if servicePrefix && m.cfg.ServicePrefixSeparator != "" {
+		key = m.cfg.ServiceName + m.cfg.ServicePrefixSeparator + key
+		servicePrefix = false
+	}
+	numKeys := 1
+	if servicePrefix {
+		numKeys++
+	}
+	if m.cfg.EnableTypePrefix {
+		numKeys++
 	}
+	keys := make([]string, 0, numKeys)
 	if m.cfg.EnableTypePrefix {
-		keys = insert(0, typeName, keys)
+		keys = append(keys, typeName)
 	}
-	if m.cfg.ServiceName != "" && m.cfg.EnableServiceLabel {
-		labels = append(labels, Label{"service", m.cfg.ServiceName})
+	if servicePrefix {
+		keys = append(keys, m.cfg.ServiceName)
 	}
-	labels = append(labels, m.cfg.BaseLabels...)
+	return append(keys, key)
+}
 
-	allowed, labelsFiltered := m.allowMetric(keys, labels)
+// enrichLabels returns the scope labels, labels, and host, service, and base
+// labels. The labels are returned as is if there is nothing to add. The host
+// label is left out if the labels have a NoHostLabel, and base labels named
+// by a WithoutLabel.
+func (m *Metrics) enrichLabels(labels []Label) []Label {
+	labels, opts := stripLabelOptions(labels)
+	hostLabel := m.cfg.HostName != "" && m.cfg.EnableHostnameLabel && !opts.noHost
+	serviceLabel := m.cfg.ServiceName != "" && m.cfg.EnableServiceLabel
+	baseLabels := withoutLabels(m.cfg.BaseLabels, opts.without)
 
-	return allowed, keys, labelsFiltered
+	// size the labels up front, so they're allocated once
+	numLabels := len(m.scopeLabels) + len(labels) + len(baseLabels)
+	if hostLabel {
+		numLabels++
+	}
+	if serviceLabel {
+		numLabels++
+	}
+	if numLabels == len(labels) {
+		return labels
+	}
+
+	enriched := make([]Label, 0, numLabels)
+	enriched = append(enriched, m.scopeLabels...)
+	enriched = append(enriched, labels...)
+	if hostLabel {
+		enriched = append(enriched, Label{"host", m.cfg.HostName})
+	}
+	if serviceLabel {
+		enriched = append(enriched, Label{"service", m.cfg.ServiceName})
+	}
+	return append(enriched, baseLabels...)
+}
+
+// noHostLabelName is the name of the NoHostLabel, which no real label has
+const noHostLabelName = "\x00nohost"
+
+// NoHostLabel returns a label that leaves the host label of
+// EnableHostnameLabel out of the metric it's passed to, or of every metric of
+// a view if passed to With. It's removed before the metric reaches the sink.
+func NoHostLabel() Label {
+	return Label{Name: noHostLabelName}
+}
+
+// withoutLabelName is the name of the WithoutLabel, whose value is the name
+// of the base label to leave out
+const withoutLabelName = "\x00without"
+
+// WithoutLabel returns a label that leaves the base label of the given name
+// out of the metric it's passed to, or of every metric of a view if passed to
+// With. It's removed before the metric reaches the sink. Use NoHostLabel for
+// the host label.
+func WithoutLabel(name string) Label {
+	return Label{Name: withoutLabelName, Value: name}
+}
+
+// labelOptions are the NoHostLabel and WithoutLabel among the labels
+type labelOptions struct {
+	noHost  bool
+	without []string
+}
+
+// stripLabelOptions returns the labels without any NoHostLabel or
+// WithoutLabel, and what they requested. The labels are copied, unless there
+// is none.
+func stripLabelOptions(labels []Label) ([]Label, labelOptions) {
+	var opts labelOptions
+	for n, label := range labels {
+		if label.Name != noHostLabelName && label.Name != withoutLabelName {
+			continue
+		}
+
+		kept := append([]Label(nil), labels[:n]...)
+		for _, label := range labels[n:] {
+			switch label.Name {
+			case noHostLabelName:
+				opts.noHost = true
+			case withoutLabelName:
+				opts.without = append(opts.without, label.Value)
+			default:
+				kept = append(kept, label)
+			}
+		}
+		return kept, opts
+	}
+	return labels, opts
+}
+
+// withoutLabels returns the labels without those of the given names. The
+// labels are copied, unless none are left out.
+func withoutLabels(labels []Label, names []string) []Label {
+	if len(names) == 0 {
+		return labels
+	}
+
+	left := func(label Label) bool {
+		for _, name := range names {
+			if label.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	for n, label := range labels {
+		if !left(label) {
+			continue
+		}
+
+		kept := append([]Label(nil), labels[:n]...)
+		for _, label := range labels[n+1:] {
+			if !left(label) {
+				kept = append(kept, label)
+			}
+		}
+		return kept
+	}
+	return labels
+}
+
+// limitLabels drops empty labels, sorts, and truncates the filtered labels as
+// configured. It also returns whether there were more than MaxLabels.
+func (m *Metrics) limitLabels(labels []Label) ([]Label, bool) {
+	if m.cfg.DropEmptyLabels {
+		labels = dropEmptyLabels(labels)
+	}
+	if m.cfg.SortLabels {
+		labels = sortLabels(labels)
+	}
+	if limit := m.cfg.MaxLabels; limit > 0 && len(labels) > limit {
+		if m.cfg.MaxLabelsPolicy != MaxLabelsDrop {
+			labels = labels[:limit:limit]
+		}
+		return labels, true
+	}
+	return labels, false
+}
+
+// checkLabelLimit counts an allowed metric that was over MaxLabels, and
+// returns whether it's still allowed under the MaxLabelsPolicy
+func (m *Metrics) checkLabelLimit(allowed, overLimit bool) bool {
+	if !allowed || !overLimit {
+		return allowed
+	}
+
+	m.root().overLabelLimit.Add(1)
+	return m.cfg.MaxLabelsPolicy != MaxLabelsDrop
+}
+
+// seriesSet is the label sets seen for a key, see MaxSeriesPerMetric
+type seriesSet struct {
+	lock sync.Mutex
+	seen map[string]struct{}
+}
+
+// checkSeriesLimit returns whether an allowed metric is within the
+// MaxSeriesPerMetric of its key, and counts it if not
+func (m *Metrics) checkSeriesLimit(allowed bool, keys []string, labels []Label) bool {
+	limit := m.cfg.MaxSeriesPerMetric
+	if !allowed || limit <= 0 {
+		return allowed
+	}
+
+	r := m.root()
+	key := strings.Join(keys, ".")
+	v, ok := r.seriesSeen.Load(key)
+	if !ok {
+		v, _ = r.seriesSeen.LoadOrStore(key, &seriesSet{seen: make(map[string]struct{})})
+	}
+	set := v.(*seriesSet)
+	id := seriesID(labels)
+
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	if _, ok := set.seen[id]; ok {
+		return true
+	}
+	if len(set.seen) >= limit {
+		r.overSeriesLimit.Add(1)
+		return false
+	}
+	set.seen[id] = struct{}{}
+	return true
+}
+
+// forgetSeries removes the label set from those seen for the key, making room
+// for another under MaxSeriesPerMetric
+func (m *Metrics) forgetSeries(keys []string, labels []Label) {
+	v, ok := m.root().seriesSeen.Load(strings.Join(keys, "."))
+	if !ok {
+		return
+	}
+	set := v.(*seriesSet)
+
+	set.lock.Lock()
+	defer set.lock.Unlock()
+	delete(set.seen, seriesID(labels))
+}
+
+// seriesID identifies the label set, regardless of the order of the labels
+func seriesID(labels []Label) string {
+	pairs := make([]string, len(labels))
+	for n, label := range labels {
+		pairs[n] = label.Name + "\x00" + label.Value + "\x00"
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "")
+}
+
+// dropEmptyLabels returns the labels with a non-empty value. The labels are
+// copied, unless none are empty.
+func dropEmptyLabels(labels []Label) []Label {
+	for n, label := range labels {
+		if label.Value != "" {
+			continue
+		}
+
+		kept := append([]Label(nil), labels[:n]...)
+		for _, label := range labels[n+1:] {
+			if label.Value != "" {
+				kept = append(kept, label)
+			}
+		}
+		return kept
+	}
+	return labels
+}
+
+// sortLabels returns the labels sorted by name, keeping the order of labels
+// with the same name. The labels are copied before sorting, unless they are
+// already sorted.
+func sortLabels(labels []Label) []Label {
+	less := func(i, j int) bool { return labels[i].Name < labels[j].Name }
+	if sort.SliceIsSorted(labels, less) {
+		return labels
+	}
+
+	labels = append([]Label(nil), labels...)
+	sort.SliceStable(labels, less)
+	return labels
 }
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -16,5 +17,274 @@ func TestEnrich(t *testing.T) {
 	ok, key, _ = m.enrich("gauge", "metricname", []Label{})
 	require.True(t, ok)
 	require.Equal(t, []string{"svcfoo", "metricname"}, key)
+}
+
+func TestEnrich_ServiceNaming(t *testing.T) {
+	for _, tc := range []struct {
+		desc         string
+		prefix       bool
+		label        bool
+		separator    string
+		expectKeys   []string
+		expectLabels []Label
+	}{
+		{
+			desc:       "neither",
+			expectKeys: []string{"db.queries"},
+		},
+		{
+			desc:       "prefix",
+			prefix:     true,
+			expectKeys: []string{"svcfoo", "db.queries"},
+		},
+		{
+			desc:         "label",
+			label:        true,
+			expectKeys:   []string{"db.queries"},
+			expectLabels: []Label{L("service", "svcfoo")},
+		},
+		{
+			desc:         "prefix and label",
+			prefix:       true,
+			label:        true,
+			expectKeys:   []string{"svcfoo", "db.queries"},
+			expectLabels: []Label{L("service", "svcfoo")},
+		},
+		{
+			desc:       "prefix with separator",
+			prefix:     true,
+			separator:  "_",
+			expectKeys: []string{"svcfoo_db.queries"},
+		},
+		{
+			desc:       "separator without prefix",
+			separator:  "_",
+			expectKeys: []string{"db.queries"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			m := &Metrics{cfg: Config{
+				FilterDefault:          true,
+				ServiceName:            "svcfoo",
+				EnableServicePrefix:    tc.prefix,
+				EnableServiceLabel:     tc.label,
+				ServicePrefixSeparator: tc.separator,
+			}}
+
+			ok, keys, labels := m.WithPrefix("db").enrich("gauge", "queries", nil)
+			require.True(t, ok)
+			require.Equal(t, tc.expectKeys, keys)
+			require.Equal(t, tc.expectLabels, labels)
+		})
+	}
+}
+
+func TestEnrich_ScopePrefix(t *testing.T) {
+	m := &Metrics{cfg: Config{FilterDefault: true, ServiceName: "svcfoo", EnableServicePrefix: true, EnableTypePrefix: true}}
+	db := m.WithPrefix("db")
+
+	ok, key, _ := db.enrich("gauge", "queries", []Label{})
+	require.True(t, ok)
+	require.Equal(t, []string{"gauge", "svcfoo", "db.queries"}, key)
+
+	// nested prefixes accumulate, and compose with labels
+	ok, key, labels := db.WithPrefix("pool").With(L("a", "b")).enrich("gauge", "size", []Label{})
+	require.True(t, ok)
+	require.Equal(t, []string{"gauge", "svcfoo", "db.pool.size"}, key)
+	require.Equal(t, []Label{L("a", "b")}, labels)
+
+	// the parent is unaffected
+	ok, key, _ = m.enrich("gauge", "queries", []Label{})
+	require.True(t, ok)
+	require.Equal(t, []string{"gauge", "svcfoo", "queries"}, key)
+}
+
+func TestEnrich_SortLabels(t *testing.T) {
+	m := &Metrics{cfg: Config{FilterDefault: true, HostName: "h1", EnableHostnameLabel: true, BaseLabels: []Label{L("env", "prod")}}}
+	in := []Label{L("zone", "a"), L("app", "web")}
+
+	_, _, labels := m.enrich("gauge", "metricname", in)
+	require.Equal(t, []Label{L("zone", "a"), L("app", "web"), L("host", "h1"), L("env", "prod")}, labels)
+
+	m.cfg.SortLabels = true
+	_, _, labels = m.enrich("gauge", "metricname", in)
+	require.Equal(t, []Label{L("app", "web"), L("env", "prod"), L("host", "h1"), L("zone", "a")}, labels)
+
+	// the caller's labels are not reordered
+	require.Equal(t, []Label{L("zone", "a"), L("app", "web")}, in)
+}
+
+// BenchmarkEnrich_SortLabels/unsorted         	 3344418	       388.5 ns/op
+// BenchmarkEnrich_SortLabels/sorted           	 1000000	      1131 ns/op
+func BenchmarkEnrich_SortLabels(b *testing.B) {
+	labels := []Label{L("zone", "a"), L("app", "web"), L("method", "GET")}
+
+	for _, bench := range []struct {
+		name string
+		sort bool
+	}{
+		{"unsorted", false},
+		{"sorted", true},
+	} {
+		m := &Metrics{cfg: Config{FilterDefault: true, HostName: "h1", EnableHostnameLabel: true, SortLabels: bench.sort}}
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m.enrich("gauge", "metricname", labels)
+			}
+		})
+	}
+}
+
+func TestEnrich_DropEmptyLabels(t *testing.T) {
+	m := &Metrics{cfg: Config{FilterDefault: true, BaseLabels: []Label{L("env", "")}}}
+	in := []Label{L("region", ""), L("app", "web")}
+
+	_, _, labels := m.enrich("gauge", "metricname", in)
+	require.Equal(t, []Label{L("region", ""), L("app", "web"), L("env", "")}, labels)
+
+	m.cfg.DropEmptyLabels = true
+	_, _, labels = m.enrich("gauge", "metricname", in)
+	require.Equal(t, []Label{L("app", "web")}, labels)
+	require.Equal(t, []Label{L("region", ""), L("app", "web")}, in)
+}
+
+func TestEnrich_MaxLabels(t *testing.T) {
+	m := &Metrics{cfg: Config{FilterDefault: true, HostName: "h1", EnableHostnameLabel: true, MaxLabels: 2}}
+
+	// under the limit
+	ok, _, labels := m.enrich("gauge", "metricname", []Label{L("a", "1")})
+	require.True(t, ok)
+	require.Equal(t, []Label{L("a", "1"), L("host", "h1")}, labels)
+	require.Equal(t, uint64(0), m.FilterStats().OverLabelLimit)
+
+	// truncated to the first labels
+	ok, _, labels = m.enrich("gauge", "metricname", []Label{L("c", "3"), L("a", "1")})
+	require.True(t, ok)
+	require.Equal(t, []Label{L("c", "3"), L("a", "1")}, labels)
+	require.Equal(t, uint64(1), m.FilterStats().OverLabelLimit)
+
+	// sorted before truncating
+	m.cfg.SortLabels = true
+	ok, _, labels = m.enrich("gauge", "metricname", []Label{L("c", "3"), L("a", "1")})
+	require.True(t, ok)
+	require.Equal(t, []Label{L("a", "1"), L("c", "3")}, labels)
+
+	// dropped
+	m.cfg.MaxLabelsPolicy = MaxLabelsDrop
+	ok, _, _ = m.enrich("gauge", "metricname", []Label{L("c", "3"), L("a", "1")})
+	require.False(t, ok)
+	require.Equal(t, uint64(3), m.FilterStats().OverLabelLimit)
+
+	ok, _, _ = m.enrich("gauge", "metricname", []Label{})
+	require.True(t, ok)
+	require.Equal(t, uint64(3), m.FilterStats().OverLabelLimit)
+}
+
+func TestEnrich_MaxSeriesPerMetric(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.MaxSeriesPerMetric = 3
+	})
+
+	// a high-cardinality label only creates the first series of each key
+	for i := 0; i < 10; i++ {
+		met.Incr("requests", 1, L("user", strconv.Itoa(i)))
+	}
+	met.Incr("requests", 1, L("user", "0"))
+	met.Incr("other", 1, L("user", "9"))
+	ok, _, _ := met.enrich("counter", "requests", []Label{L("user", "2")})
+	require.True(t, ok)
+
+	counts := map[string]int{}
+	for n, k := range m.getKeys() {
+		counts[k[0]+"/"+m.labels[n][0].Value]++
+	}
+	require.Equal(t, map[string]int{"requests/0": 2, "requests/1": 1, "requests/2": 1, "other/9": 1}, counts)
+	require.Equal(t, uint64(7), met.FilterStats().OverSeriesLimit)
+}
+
+func TestEnrich_MaxSeriesPerMetric_Forget(t *testing.T) {
+	_, met := mockMetric(t, func(c *Config) {
+		c.MaxSeriesPerMetric = 1
+	})
+
+	// the label order doesn't make another series
+	ok, _, _ := met.enrich("gauge", "pool", []Label{L("a", "1"), L("b", "2")})
+	require.True(t, ok)
+	ok, _, _ = met.enrich("gauge", "pool", []Label{L("b", "2"), L("a", "1")})
+	require.True(t, ok)
+
+	g := met.NewGauge("conns", L("user", "a"))
+	ok, _, _ = met.enrich("gauge", "conns", []Label{L("user", "b")})
+	require.False(t, ok)
+
+	// forgetting the memoized gauge makes room for another label set
+	g.Forget()
+	ok, _, _ = met.enrich("gauge", "conns", []Label{L("user", "b")})
+	require.True(t, ok)
+	require.Equal(t, uint64(1), met.FilterStats().OverSeriesLimit)
+}
+
+// Enriching the key and labels of the BenchmarkSimpleCounter scenario in the
+// datadog package, before and after sizing the keys and labels up front:
+//
+// BenchmarkEnrich 	 2719144	       490.1 ns/op	     336 B/op	       4 allocs/op
+// BenchmarkEnrich 	 3982479	       275.0 ns/op	     272 B/op	       3 allocs/op
+//
+// That drops BenchmarkSimpleCounter from 880 B/op and 22 allocs/op to 808 B/op
+// and 20 allocs/op, with the forget hook no longer allocating a closure.
+func BenchmarkEnrich(b *testing.B) {
+	m := &Metrics{cfg: Config{FilterDefault: true, HostName: "my-host", EnableHostnameLabel: true, ServiceName: "svcname", EnableServiceLabel: true}}
+	labels := []Label{L("label1", "value1"), L("label2", "value2")}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.enrich("counter", "foo", labels)
+	}
+}
+
+func TestEnrich_NoHostLabel(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.HostName = "host1"
+		c.EnableHostnameLabel = true
+	})
+
+	met.SetGauge("with_host", 1, L("a", "b"))
+	met.SetGauge("without_host", 1, L("a", "b"), NoHostLabel())
+	met.NewCounter("memoized", NoHostLabel()).Incr(1)
+
+	// a view passed the label leaves out the host for all of its metrics
+	view := met.With(NoHostLabel(), L("pool", "a"))
+	view.SetGauge("view", 1)
+	met.SetGauge("parent", 1)
+
+	require.Equal(t, [][]Label{
+		{L("a", "b"), L("host", "host1")},
+		{L("a", "b")},
+		nil,
+		{L("pool", "a")},
+		{L("host", "host1")},
+	}, m.labels)
+}
+
+func TestEnrich_WithoutLabel(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.BaseLabels = []Label{L("shard", "3"), L("region", "eu")}
+	})
+
+	met.SetGauge("default", 1, L("a", "b"))
+	met.SetGauge("without_shard", 1, L("a", "b"), WithoutLabel("shard"))
+	met.NewCounter("memoized", WithoutLabel("shard"), WithoutLabel("region")).Incr(1)
+
+	// a view passed the label leaves out the base label for all of its metrics
+	view := met.With(WithoutLabel("region"), L("pool", "a"))
+	view.SetGauge("view", 1)
+	met.SetGauge("parent", 1)
 
+	require.Equal(t, [][]Label{
+		{L("a", "b"), L("shard", "3"), L("region", "eu")},
+		{L("a", "b"), L("region", "eu")},
+		nil,
+		{L("pool", "a"), L("shard", "3")},
+		{L("shard", "3"), L("region", "eu")},
+	}, m.labels)
 }
@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envParser parses the value of an environment variable into a Config field
+type envParser func(c *Config, v string) error
+
+// configEnvVars maps the environment variable names, after the prefix, to the
+// Config fields they set
+var configEnvVars = []struct {
+	name  string
+	parse envParser
+}{
+	{"SERVICE_NAME", envString(func(c *Config) *string { return &c.ServiceName })},
+	{"HOST_NAME", envString(func(c *Config) *string { return &c.HostName })},
+	{"ENABLE_HOSTNAME_LABEL", envBool(func(c *Config) *bool { return &c.EnableHostnameLabel })},
+	{"ENABLE_SERVICE_LABEL", envBool(func(c *Config) *bool { return &c.EnableServiceLabel })},
+	{"ENABLE_SERVICE_PREFIX", envBool(func(c *Config) *bool { return &c.EnableServicePrefix })},
+	{"SERVICE_PREFIX_SEPARATOR", envString(func(c *Config) *string { return &c.ServicePrefixSeparator })},
+	{"EXCLUSIVE_SERVICE_NAMING", envBool(func(c *Config) *bool { return &c.ExclusiveServiceNaming })},
+	{"ENABLE_RUNTIME_METRICS", envBool(func(c *Config) *bool { return &c.EnableRuntimeMetrics })},
+	{"ENABLE_RUNTIME_METRICS_V2", envBool(func(c *Config) *bool { return &c.EnableRuntimeMetricsV2 })},
+	{"ENABLE_PROCESS_METRICS", envBool(func(c *Config) *bool { return &c.EnableProcessMetrics })},
+	{"ENABLE_SELF_METRICS", envBool(func(c *Config) *bool { return &c.EnableSelfMetrics })},
+	{"SELF_METRICS_PREFIX", envString(func(c *Config) *string { return &c.SelfMetricsPrefix })},
+	{"ENABLE_TYPE_PREFIX", envBool(func(c *Config) *bool { return &c.EnableTypePrefix })},
+	{"TIMER_GRANULARITY", envDuration(func(c *Config) *time.Duration { return &c.TimerGranularity })},
+	{"PROFILE_INTERVAL", envDuration(func(c *Config) *time.Duration { return &c.ProfileInterval })},
+	{"PERSISTENT_INTERVAL", envDuration(func(c *Config) *time.Duration { return &c.PersistentInterval })},
+	{"RUNTIME_METRICS_PREFIX", envString(func(c *Config) *string { return &c.RuntimeMetricsPrefix })},
+	{"RUNTIME_METRICS_SELECT", envList(func(c *Config) *[]string { return &c.RuntimeMetricsSelect })},
+	{"BASE_LABELS", envLabels},
+	{"SORT_LABELS", envBool(func(c *Config) *bool { return &c.SortLabels })},
+	{"DROP_EMPTY_LABELS", envBool(func(c *Config) *bool { return &c.DropEmptyLabels })},
+	{"MAX_LABELS", envInt(func(c *Config) *int { return &c.MaxLabels })},
+	{"MAX_SERIES_PER_METRIC", envInt(func(c *Config) *int { return &c.MaxSeriesPerMetric })},
+	{"ALLOWED_PREFIXES", envList(func(c *Config) *[]string { return &c.AllowedPrefixes })},
+	{"BLOCKED_PREFIXES", envList(func(c *Config) *[]string { return &c.BlockedPrefixes })},
+	{"ALLOWED_LABELS", envList(func(c *Config) *[]string { return &c.AllowedLabels })},
+	{"BLOCKED_LABELS", envList(func(c *Config) *[]string { return &c.BlockedLabels })},
+	{"ALLOWED_PATTERNS", envList(func(c *Config) *[]string { return &c.AllowedPatterns })},
+	{"BLOCKED_PATTERNS", envList(func(c *Config) *[]string { return &c.BlockedPatterns })},
+	{"BLOCKED_LABEL_VALUES", envBlockedLabelValues},
+	{"FILTER_DEFAULT", envBool(func(c *Config) *bool { return &c.FilterDefault })},
+}
+
+// ConfigFromEnv returns the default Config, with the fields set by environment
+// variables named <prefix>_<FIELD>, e.g. METRICS_SERVICE_NAME for the prefix
+// "METRICS". Variables that aren't set leave the default in place.
+//
+// Booleans are parsed with strconv.ParseBool and intervals with
+// time.ParseDuration. Lists, such as ALLOWED_PREFIXES, are comma-separated,
+// so ALLOWED_PATTERNS and BLOCKED_PATTERNS can't hold patterns with a comma.
+// BASE_LABELS is a comma-separated list of name=value pairs, and
+// BLOCKED_LABEL_VALUES too, with a pair for each value blocked, e.g.
+// "code=500,code=503". An error is returned for each variable that can't be
+// parsed.
+func ConfigFromEnv(prefix string) (*Config, error) {
+	c := defaultConfig()
+	if prefix != "" {
+		prefix += "_"
+	}
+
+	var errs []error
+	for _, v := range configEnvVars {
+		val, ok := os.LookupEnv(prefix + v.name)
+		if !ok {
+			continue
+		}
+		if err := v.parse(c, val); err != nil {
+			errs = append(errs, fmt.Errorf("bad %s: %w", prefix+v.name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func envString(field func(c *Config) *string) envParser {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func envBool(field func(c *Config) *bool) envParser {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func envInt(field func(c *Config) *int) envParser {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func envDuration(field func(c *Config) *time.Duration) envParser {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func envList(field func(c *Config) *[]string) envParser {
+	return func(c *Config, v string) error {
+		*field(c) = splitEnvList(v)
+		return nil
+	}
+}
+
+func envLabels(c *Config, v string) error {
+	labels, err := parseEnvLabels(v)
+	if err != nil {
+		return err
+	}
+	c.BaseLabels = labels
+	return nil
+}
+
+func envBlockedLabelValues(c *Config, v string) error {
+	labels, err := parseEnvLabels(v)
+	if err != nil {
+		return err
+	}
+	blocked := make(map[string][]string)
+	for _, label := range labels {
+		blocked[label.Name] = append(blocked[label.Name], label.Value)
+	}
+	c.BlockedLabelValues = blocked
+	return nil
+}
+
+// parseEnvLabels parses a comma-separated list of name=value pairs
+func parseEnvLabels(v string) ([]Label, error) {
+	var labels []Label
+	for _, pair := range splitEnvList(v) {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("label %q must be name=value", pair)
+		}
+		labels = append(labels, L(name, value))
+	}
+	return labels, nil
+}
+
+// splitEnvList splits a comma-separated list, ignoring empty entries
+func splitEnvList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("METRICS_SERVICE_NAME", "api")
+	t.Setenv("METRICS_ENABLE_RUNTIME_METRICS", "false")
+	t.Setenv("METRICS_ENABLE_SERVICE_LABEL", "1")
+	t.Setenv("METRICS_PROFILE_INTERVAL", "5s")
+	t.Setenv("METRICS_MAX_LABELS", "8")
+	t.Setenv("METRICS_FILTER_DEFAULT", "false")
+	t.Setenv("METRICS_ALLOWED_PREFIXES", "api, db.queries,")
+	t.Setenv("METRICS_BASE_LABELS", "env=prod,region=us-east-1")
+	t.Setenv("METRICS_ALLOWED_PATTERNS", `^api\.`)
+	t.Setenv("METRICS_BLOCKED_PATTERNS", `_debug$, ^tmp\.`)
+	t.Setenv("METRICS_BLOCKED_LABEL_VALUES", "code=500,user=admin,code=503")
+	// not under the prefix
+	t.Setenv("SERVICE_NAME", "other")
+
+	c, err := ConfigFromEnv("METRICS")
+	require.NoError(t, err)
+
+	require.Equal(t, "api", c.ServiceName)
+	require.False(t, c.EnableRuntimeMetrics)
+	require.True(t, c.EnableServiceLabel)
+	require.Equal(t, 5*time.Second, c.ProfileInterval)
+	require.Equal(t, 8, c.MaxLabels)
+	require.False(t, c.FilterDefault)
+	require.Equal(t, []string{"api", "db.queries"}, c.AllowedPrefixes)
+	require.Equal(t, []Label{L("env", "prod"), L("region", "us-east-1")}, c.BaseLabels)
+	require.Equal(t, []string{`^api\.`}, c.AllowedPatterns)
+	require.Equal(t, []string{`_debug$`, `^tmp\.`}, c.BlockedPatterns)
+	require.Equal(t, map[string][]string{"code": {"500", "503"}, "user": {"admin"}}, c.BlockedLabelValues)
+
+	// unset variables keep the defaults
+	def := defaultConfig()
+	require.Equal(t, def.HostName, c.HostName)
+	require.Equal(t, def.EnableHostnameLabel, c.EnableHostnameLabel)
+	require.Equal(t, def.PersistentInterval, c.PersistentInterval)
+	require.Equal(t, def.RuntimeMetricsPrefix, c.RuntimeMetricsPrefix)
+}
+
+func TestConfigFromEnv_NoPrefix(t *testing.T) {
+	t.Setenv("SERVICE_NAME", "api")
+
+	c, err := ConfigFromEnv("")
+	require.NoError(t, err)
+	require.Equal(t, "api", c.ServiceName)
+}
+
+func TestConfigFromEnv_Errors(t *testing.T) {
+	t.Setenv("METRICS_ENABLE_TYPE_PREFIX", "sometimes")
+	t.Setenv("METRICS_PERSISTENT_INTERVAL", "10")
+	t.Setenv("METRICS_BASE_LABELS", "env")
+	t.Setenv("METRICS_BLOCKED_LABEL_VALUES", "=500")
+
+	_, err := ConfigFromEnv("METRICS")
+	require.ErrorContains(t, err, "bad METRICS_ENABLE_TYPE_PREFIX")
+	require.ErrorContains(t, err, "bad METRICS_PERSISTENT_INTERVAL")
+	require.ErrorContains(t, err, `label "env" must be name=value`)
+	require.ErrorContains(t, err, `bad METRICS_BLOCKED_LABEL_VALUES: label "=500" must be name=value`)
+}
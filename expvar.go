@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ExpvarSink publishes metrics as expvar variables, served by the expvar
+// package at /debug/vars, under the key joined with '.' and followed by
+// ";name=value" for each label. Counters and up/down counters are
+// accumulated and gauges set as expvar.Float values. Timers, histograms, and
+// distributions are expvar.Map values with the "count" and "sum" of the
+// observations.
+//
+// Variables are process-wide, so ExpvarSinks reuse the variables already
+// published under the same name. A name published by other code with another
+// var type is not emitted to.
+type ExpvarSink struct{}
+
+// expvarLock guards publishing across all ExpvarSinks, as expvar.Publish
+// panics on duplicates
+var expvarLock sync.Mutex
+
+// NewExpvarSink creates an ExpvarSink
+func NewExpvarSink() *ExpvarSink {
+	return &ExpvarSink{}
+}
+
+// NewExpvarSinkFromURL creates an ExpvarSink from a URL. It is used (and
+// tested) from NewMetricSinkFromURL.
+func NewExpvarSinkFromURL(_ *url.URL) (MetricSink, error) {
+	return NewExpvarSink(), nil
+}
+
+func (s *ExpvarSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	name := s.flattenKeyLabels(keys, labels)
+
+	switch mType {
+	case MetricTypeCounter, MetricTypeUpDownCounter:
+		if f := s.float(name); f != nil {
+			return f.Add
+		}
+	case MetricTypeGauge:
+		if f := s.float(name); f != nil {
+			return f.Set
+		}
+	case MetricTypeTimer, MetricTypeHistogram, MetricTypeDistribution:
+		if m := s.observations(name); m != nil {
+			return func(val float64) {
+				m.Add("count", 1)
+				m.AddFloat("sum", val)
+			}
+		}
+	}
+	return func(val float64) {}
+}
+
+// float returns the expvar.Float published under name, publishing it if
+// needed, or nil if the name is taken by another var type
+func (s *ExpvarSink) float(name string) *expvar.Float {
+	expvarLock.Lock()
+	defer expvarLock.Unlock()
+
+	switch v := expvar.Get(name).(type) {
+	case nil:
+		return expvar.NewFloat(name)
+	case *expvar.Float:
+		return v
+	default:
+		log.Printf("[ERR] Expvar %q is already published as a %T", name, v)
+		return nil
+	}
+}
+
+// observations returns the expvar.Map of the count and sum published under
+// name, like float
+func (s *ExpvarSink) observations(name string) *expvar.Map {
+	expvarLock.Lock()
+	defer expvarLock.Unlock()
+
+	switch v := expvar.Get(name).(type) {
+	case nil:
+		m := expvar.NewMap(name)
+		m.Add("count", 0)
+		m.AddFloat("sum", 0)
+		return m
+	case *expvar.Map:
+		return v
+	default:
+		log.Printf("[ERR] Expvar %q is already published as a %T", name, v)
+		return nil
+	}
+}
+
+// Flattens the key along with labels, removes spaces
+func (s *ExpvarSink) flattenKeyLabels(parts []string, labels []Label) string {
+	buf := &strings.Builder{}
+	spaceReplacer.WriteString(buf, strings.Join(parts, "."))
+	for _, label := range labels {
+		spaceReplacer.WriteString(buf, fmt.Sprintf(";%s=%s", label.Name, label.Value))
+	}
+	return buf.String()
+}
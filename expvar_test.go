@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// expvarRuns makes the var names unique when tests are run more than once,
+// since vars can't be unpublished
+var expvarRuns atomic.Int64
+
+func TestExpvarSink(t *testing.T) {
+	prefix := "expvar" + strconv.FormatInt(expvarRuns.Add(1), 10)
+	s := NewExpvarSink()
+	labels := []Label{L("code", "200")}
+
+	c := s.BuildMetricEmitter(MetricTypeCounter, []string{prefix, "counter"}, labels)
+	c(1)
+	c(2.5)
+	s.BuildMetricEmitter(MetricTypeGauge, []string{prefix, "gauge"}, nil)(3)
+	s.BuildMetricEmitter(MetricTypeGauge, []string{prefix, "gauge"}, nil)(4)
+	h := s.BuildMetricEmitter(MetricTypeHistogram, []string{prefix, "histogram"}, nil)
+	h(10)
+	h(20)
+
+	require.Equal(t, "3.5", expvar.Get(prefix+".counter;code=200").String())
+	require.Equal(t, "4", expvar.Get(prefix+".gauge").String())
+	require.JSONEq(t, `{"count": 2, "sum": 30}`, expvar.Get(prefix+".histogram").String())
+
+	// another sink reuses the published vars
+	NewExpvarSink().BuildMetricEmitter(MetricTypeCounter, []string{prefix, "counter"}, labels)(1)
+	require.Equal(t, "4.5", expvar.Get(prefix+".counter;code=200").String())
+}
+
+func TestExpvarSink_Conflict(t *testing.T) {
+	if expvar.Get("expvar.conflict") == nil {
+		expvar.NewString("expvar.conflict").Set("taken")
+	}
+
+	s := NewExpvarSink()
+	s.BuildMetricEmitter(MetricTypeCounter, []string{"expvar", "conflict"}, nil)(1)
+	s.BuildMetricEmitter(MetricTypeHistogram, []string{"expvar", "conflict"}, nil)(1)
+	require.Equal(t, `"taken"`, expvar.Get("expvar.conflict").String())
+}
+
+func TestExpvarSink_ConcurrentSinks(t *testing.T) {
+	prefix := "expvar" + strconv.FormatInt(expvarRuns.Add(1), 10)
+
+	// sinks publishing the same name at once must not both publish it
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			NewExpvarSink().BuildMetricEmitter(MetricTypeCounter, []string{prefix, "counter"}, nil)(1)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, "8", expvar.Get(prefix+".counter").String())
+}
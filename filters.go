@@ -1,86 +1,342 @@
 package metrics
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
 
 	iradix "github.com/hashicorp/go-immutable-radix/v2"
 )
 
-// setFilterAndLabels overwrites the existing filter with the given rules.
-func (m *Metrics) setFilterAndLabels(allow, block, allowedLabels, blockedLabels []string) {
-	m.cfg.AllowedPrefixes = allow
-	m.cfg.BlockedPrefixes = block
+// filterSet holds the compiled filter rules. It is never modified once
+// built, filters are changed by swapping in a new set.
+type filterSet struct {
+	prefixes        *iradix.Tree[bool]
+	allowedGlobs    globSet
+	blockedGlobs    globSet
+	allowedLabels   map[string]bool
+	blockedLabels   map[string]bool
+	allowedPatterns []*regexp.Regexp
+	blockedPatterns []*regexp.Regexp
 
-	if allowedLabels == nil {
+	blockedLabelValues map[string]map[string]bool
+}
+
+// noFilters is used by instances that haven't configured any filters
+var noFilters = newFilterSet(nil, nil, nil, nil)
+
+// newFilterSet builds a filter set from the given prefix and label rules
+func newFilterSet(allow, block, allowedLabels, blockedLabels []string) *filterSet {
+	f := &filterSet{}
+	if allowedLabels != nil {
 		// Having a white list means we take only elements from it
-		m.allowedLabels = nil
-	} else {
-		m.allowedLabels = make(map[string]bool)
+		f.allowedLabels = make(map[string]bool)
 		for _, v := range allowedLabels {
-			m.allowedLabels[v] = true
+			f.allowedLabels[v] = true
 		}
 	}
-	m.blockedLabels = make(map[string]bool)
+	f.blockedLabels = make(map[string]bool)
 	for _, v := range blockedLabels {
-		m.blockedLabels[v] = true
+		f.blockedLabels[v] = true
+	}
+
+	f.prefixes = iradix.New[bool]()
+	for _, prefix := range allow {
+		if strings.Contains(prefix, "*") {
+			f.allowedGlobs.add(prefix)
+			continue
+		}
+		f.prefixes, _, _ = f.prefixes.Insert([]byte(prefix), true)
+	}
+	for _, prefix := range block {
+		if strings.Contains(prefix, "*") {
+			f.blockedGlobs.add(prefix)
+			continue
+		}
+		f.prefixes, _, _ = f.prefixes.Insert([]byte(prefix), false)
+	}
+	return f
+}
+
+// setPatterns compiles the given key patterns into the filter set
+func (f *filterSet) setPatterns(allow, block []string) error {
+	allowed, err := compilePatterns(allow)
+	if err != nil {
+		return err
+	}
+	blocked, err := compilePatterns(block)
+	if err != nil {
+		return err
+	}
+
+	f.allowedPatterns = allowed
+	f.blockedPatterns = blocked
+	return nil
+}
+
+// setLabelValues sets the label values to remove, keyed by label name
+func (f *filterSet) setLabelValues(blocked map[string][]string) {
+	if len(blocked) == 0 {
+		f.blockedLabelValues = nil
+		return
+	}
+
+	f.blockedLabelValues = make(map[string]map[string]bool, len(blocked))
+	for name, values := range blocked {
+		f.blockedLabelValues[name] = make(map[string]bool, len(values))
+		for _, v := range values {
+			f.blockedLabelValues[name][v] = true
+		}
 	}
-	m.cfg.AllowedLabels = allowedLabels
-	m.cfg.BlockedLabels = blockedLabels
+}
+
+// UpdateFilters replaces the prefix and label filters, taking effect for
+// metrics created after it returns. It is safe to call while metrics are being
+// emitted. Key patterns, blocked label values, and FilterDefault are
+// unchanged. Calling UpdateFilters on a scoped view updates the instance it
+// was created from.
+func (m *Metrics) UpdateFilters(allowed, blocked, allowedLabels, blockedLabels []string) {
+	r := m.root()
+
+	r.filterLock.Lock()
+	defer r.filterLock.Unlock()
 
-	m.filter = iradix.New[bool]()
-	for _, prefix := range m.cfg.AllowedPrefixes {
-		m.filter, _, _ = m.filter.Insert([]byte(prefix), true)
+	f := newFilterSet(allowed, blocked, allowedLabels, blockedLabels)
+	if curr := r.filters.Load(); curr != nil {
+		f.allowedPatterns = curr.allowedPatterns
+		f.blockedPatterns = curr.blockedPatterns
+		f.blockedLabelValues = curr.blockedLabelValues
 	}
-	for _, prefix := range m.cfg.BlockedPrefixes {
-		m.filter, _, _ = m.filter.Insert([]byte(prefix), false)
+	r.filters.Store(f)
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric filter pattern %q: %w", p, err)
+		}
+		res = append(res, re)
 	}
+	return res, nil
 }
 
 // labelIsAllowed return true if a should be included in metric
-// the caller should lock m.filterLock while calling this method
-func (m *Metrics) labelIsAllowed(label *Label) bool {
+func (f *filterSet) labelIsAllowed(label *Label) bool {
 	labelName := (*label).Name
-	if m.blockedLabels != nil {
-		_, ok := m.blockedLabels[labelName]
+	if f.blockedLabels != nil {
+		_, ok := f.blockedLabels[labelName]
 		if ok {
 			// If present, let's remove this label
 			return false
 		}
 	}
-	if m.allowedLabels != nil {
-		_, ok := m.allowedLabels[labelName]
+	if f.blockedLabelValues != nil && f.blockedLabelValues[labelName][label.Value] {
+		return false
+	}
+	if f.allowedLabels != nil {
+		_, ok := f.allowedLabels[labelName]
 		return ok
 	}
 	// Allow by default
 	return true
 }
 
-// filterLabels return only allowed labels
-// the caller should lock m.filterLock while calling this method
-func (m *Metrics) filterLabels(labels []Label) []Label {
+// filterLabels return only allowed labels. Without label filters the labels
+// are returned as is, so they must not be modified by the caller.
+func (f *filterSet) filterLabels(labels []Label) []Label {
 	if labels == nil {
 		return nil
 	}
-	toReturn := []Label{}
+	if !f.hasLabelFilters() {
+		return labels
+	}
+	toReturn := make([]Label, 0, len(labels))
 	for _, label := range labels {
-		if m.labelIsAllowed(&label) {
+		if f.labelIsAllowed(&label) {
 			toReturn = append(toReturn, label)
 		}
 	}
 	return toReturn
 }
 
-// Returns whether the metric should be allowed based on configured prefix filters
+// Returns whether the metric should be allowed based on configured prefix and
+// pattern filters. Prefixes containing a '*' wildcard take precedence over
+// plain prefixes, and patterns take precedence over both. For both wildcards
+// and patterns, a blocked match wins over an allowed one.
 // Also return the applicable labels
 func (m *Metrics) allowMetric(key []string, labels []Label) (bool, []Label) {
-	if m.filter == nil || m.filter.Len() == 0 {
-		return m.cfg.FilterDefault, m.filterLabels(labels)
+	f := m.loadFilters()
+	filtered := f.filterLabels(labels)
+	return m.allowKey(f, key, len(labels)-len(filtered)), filtered
+}
+
+// loadFilters returns the current filters, or noFilters if none are set
+func (m *Metrics) loadFilters() *filterSet {
+	if f := m.filters.Load(); f != nil {
+		return f
+	}
+	return noFilters
+}
+
+// allowKey returns whether the key is allowed by the filters. It counts the
+// metric as filtered if not, or the number of labels blocked from it if so.
+func (m *Metrics) allowKey(f *filterSet, key []string, blockedLabels int) bool {
+	allowed := m.cfg.FilterDefault
+	// skip joining the key when there is nothing to match it against
+	if f.hasKeyFilters() {
+		allowed = f.keyIsAllowed(strings.Join(key, "."), allowed)
+	}
+
+	if !allowed {
+		m.filteredByPrefix.Add(1)
+	} else if blockedLabels > 0 {
+		m.labelsBlocked.Add(uint64(blockedLabels))
+	}
+	return allowed
+}
+
+// hasLabelFilters returns whether any label name or value filters are set
+func (f *filterSet) hasLabelFilters() bool {
+	return f.allowedLabels != nil || len(f.blockedLabels) != 0 || len(f.blockedLabelValues) != 0
+}
+
+// hasKeyFilters returns whether any prefix, wildcard, or pattern filters are set
+func (f *filterSet) hasKeyFilters() bool {
+	return f.prefixes.Len() != 0 || !f.allowedGlobs.empty() || !f.blockedGlobs.empty() ||
+		len(f.allowedPatterns) != 0 || len(f.blockedPatterns) != 0
+}
+
+// keyIsAllowed returns whether the flattened key is allowed by the prefix,
+// wildcard, and pattern filters, or allowed if none match
+func (f *filterSet) keyIsAllowed(flat string, allowed bool) bool {
+	if f.prefixes.Len() != 0 {
+		if _, v, ok := f.prefixes.Root().LongestPrefix([]byte(flat)); ok {
+			allowed = v
+		}
+	}
+	if f.blockedGlobs.match(flat) {
+		allowed = false
+	} else if f.allowedGlobs.match(flat) {
+		allowed = true
+	}
+	if matchAny(f.blockedPatterns, flat) {
+		allowed = false
+	} else if matchAny(f.allowedPatterns, flat) {
+		allowed = true
+	}
+	return allowed
+}
+
+func matchAny(patterns []*regexp.Regexp, key string) bool {
+	for _, re := range patterns {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// globSet holds wildcard prefixes split into segments
+type globSet []glob
+
+// glob is a wildcard prefix, with the literal text ahead of its first '*' so
+// that most keys are told apart without matching the segments
+type glob struct {
+	literal  string
+	segments []string
+}
+
+func (g *globSet) add(prefix string) {
+	*g = append(*g, glob{
+		literal:  prefix[:strings.IndexByte(prefix, '*')],
+		segments: strings.Split(prefix, "."),
+	})
+}
+
+func (g globSet) empty() bool {
+	return len(g) == 0
+}
+
+// match returns whether the leading segments of the flattened key match any
+// of the globs
+func (g globSet) match(flat string) bool {
+	for _, glob := range g {
+		if strings.HasPrefix(flat, glob.literal) && matchGlob(glob.segments, flat) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob returns whether the leading segments of the flattened key match
+// the glob segments. The key is walked in place rather than split, to not
+// allocate for every key.
+func matchGlob(glob []string, flat string) bool {
+	for i, g := range glob {
+		segment, rest, more := strings.Cut(flat, ".")
+		if !matchSegment(g, segment) || (!more && i < len(glob)-1) {
+			return false
+		}
+		flat = rest
 	}
+	return true
+}
 
-	_, allowed, ok := m.filter.Root().LongestPrefix([]byte(strings.Join(key, ".")))
-	if !ok {
-		return m.cfg.FilterDefault, m.filterLabels(labels)
+// matchSegment returns whether the key segment matches the glob segment, in
+// which each '*' matches any run of characters, so "ba*" matches "bar"
+func matchSegment(glob, segment string) bool {
+	if glob == "*" {
+		return true
+	}
+	if !strings.Contains(glob, "*") {
+		return glob == segment
 	}
 
-	return allowed, m.filterLabels(labels)
+	// backtrack to the last '*' on a mismatch, letting it match one more
+	// character
+	var g, s, star, starS = 0, 0, -1, 0
+	for s < len(segment) {
+		switch {
+		case g < len(glob) && glob[g] == '*':
+			star, starS = g, s
+			g++
+		case g < len(glob) && glob[g] == segment[s]:
+			g++
+			s++
+		case star >= 0:
+			starS++
+			g, s = star+1, starS
+		default:
+			return false
+		}
+	}
+	for g < len(glob) && glob[g] == '*' {
+		g++
+	}
+	return g == len(glob)
+}
+
+// FilterStats counts the metrics affected by the configured filters
+type FilterStats struct {
+	FilteredByPrefix uint64 // Metrics dropped by prefix filters or FilterDefault
+	BlockedLabels    uint64 // Labels removed from metrics by label filters
+	OverLabelLimit   uint64 // Metrics with more than MaxLabels labels, truncated or dropped
+	OverSeriesLimit  uint64 // Metrics dropped for a new label set past MaxSeriesPerMetric
+}
+
+// FilterStats returns the number of metrics dropped and labels removed by
+// filtering, to help diagnose metrics that are missing because of filter
+// configuration. Metrics are counted each time a one-liner method is called
+// and once when a memoized metric is created. Scoped views report the stats
+// of the instance they were created from.
+func (m *Metrics) FilterStats() FilterStats {
+	r := m.root()
+	return FilterStats{
+		FilteredByPrefix: r.filteredByPrefix.Load(),
+		BlockedLabels:    r.labelsBlocked.Load(),
+		OverLabelLimit:   r.overLabelLimit.Load(),
+		OverSeriesLimit:  r.overSeriesLimit.Load(),
+	}
 }
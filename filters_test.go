@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -53,6 +54,66 @@ func TestMetrics_Filter_Denylist(t *testing.T) {
 	}
 }
 
+func TestMetrics_Filter_Patterns(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(cfg *Config) {
+		cfg.AllowedPrefixes = []string{"service"}
+		cfg.BlockedPrefixes = []string{"legacy"}
+		cfg.AllowedPatterns = []string{`^legacy\.keep\.`}
+		cfg.BlockedPatterns = []string{`.*\.debug\..*`}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Allowed by default
+	key := "thing"
+	met.SetGauge(key, 1)
+	if !reflect.DeepEqual(m.getKeys()[0], []string{key}) {
+		t.Fatalf("key doesn't exist %v, %v", m.getKeys()[0], key)
+	}
+
+	// Blocked by pattern, even under an allowed prefix
+	key = "service.debug.thing"
+	met.SetGauge(key, 2)
+	if len(m.getKeys()) != 1 {
+		t.Fatalf("key shouldn't exist")
+	}
+
+	// Allowed by pattern, under a blocked prefix
+	key = "legacy.keep.thing"
+	met.SetGauge(key, 3)
+	if !reflect.DeepEqual(m.getKeys()[1], []string{key}) {
+		t.Fatalf("key doesn't exist")
+	}
+	if m.vals[1] != 3 {
+		t.Fatalf("bad val: %v", m.vals[1])
+	}
+
+	// Blocked pattern wins over allowed pattern
+	key = "legacy.keep.debug.thing"
+	met.SetGauge(key, 4)
+	if len(m.getKeys()) != 2 {
+		t.Fatalf("key shouldn't exist")
+	}
+
+	// Blocked by prefix
+	key = "legacy.other"
+	met.SetGauge(key, 5)
+	if len(m.getKeys()) != 2 {
+		t.Fatalf("key shouldn't exist")
+	}
+}
+
+func TestMetrics_Filter_InvalidPattern(t *testing.T) {
+	_, err := New(&MockSink{}, func(cfg *Config) {
+		cfg.BlockedPatterns = []string{"debug("}
+	})
+	if err == nil {
+		t.Fatalf("expected error for invalid pattern")
+	}
+}
+
 func TestMetrics_Filter_Allowlist(t *testing.T) {
 	m := &MockSink{}
 	met, err := New(m, func(conf *Config) {
@@ -198,3 +259,287 @@ func TestMetrics_Filter_Labels_ModifyArgs(t *testing.T) {
 		t.Fatalf("SetGauge modified the input argument")
 	}
 }
+
+func TestMetrics_FilterStats(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(conf *Config) {
+		conf.EnableHostnameLabel = false
+		conf.EnableRuntimeMetrics = false
+		conf.BlockedPrefixes = []string{"debug"}
+		conf.BlockedLabels = []string{"secret"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	met.Incr("debug.thing", 1)
+	met.Incr("debug.other", 1)
+	met.NewGauge("debug.gauge").Set(1)
+	met.Incr("thing", 1, L("secret", "a"), L("ok", "b"), L("secret", "c"))
+	met.With(L("secret", "d")).Incr("thing", 1)
+	met.Incr("thing", 1, L("ok", "b"))
+
+	stats := met.FilterStats()
+	if stats.FilteredByPrefix != 3 {
+		t.Fatalf("bad filtered count: %d", stats.FilteredByPrefix)
+	}
+	if stats.BlockedLabels != 3 {
+		t.Fatalf("bad blocked label count: %d", stats.BlockedLabels)
+	}
+	if !reflect.DeepEqual(met.WithPrefix("x").FilterStats(), stats) {
+		t.Fatalf("views should report the root stats")
+	}
+}
+
+func TestMetrics_UpdateFilters(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(cfg *Config) {
+		cfg.EnableHostnameLabel = false
+		cfg.EnableRuntimeMetrics = false
+		cfg.BlockedPrefixes = []string{"debug"}
+		cfg.BlockedPatterns = []string{`\.internal$`}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	met.Incr("debug.thing", 1)
+	if len(m.getKeys()) != 0 {
+		t.Fatalf("key shouldn't exist")
+	}
+
+	met.WithPrefix("scoped").UpdateFilters(nil, []string{"service"}, nil, []string{"secret"})
+
+	met.Incr("debug.thing", 1, L("secret", "x"))
+	if !reflect.DeepEqual(m.getKeys()[0], []string{"debug.thing"}) {
+		t.Fatalf("key doesn't exist")
+	}
+	if len(m.labels[0]) != 0 {
+		t.Fatalf("label should be blocked: %v", m.labels[0])
+	}
+
+	met.Incr("service.thing", 1)
+	// patterns are kept
+	met.Incr("debug.internal", 1)
+	if len(m.getKeys()) != 1 {
+		t.Fatalf("key shouldn't exist")
+	}
+}
+
+func TestMetrics_UpdateFilters_Race(t *testing.T) {
+	met, err := New(&BlackholeSink{}, func(cfg *Config) {
+		cfg.EnableRuntimeMetrics = false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				met.Incr("debug.thing", 1, L("secret", "x"))
+				met.With(L("a", "b")).SetGauge("service.thing", 1)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			met.UpdateFilters([]string{"service"}, []string{"debug"}, nil, []string{"secret"})
+		} else {
+			met.UpdateFilters(nil, nil, []string{"a"}, nil)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestMetrics_Filter_LabelValues(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(cfg *Config) {
+		cfg.EnableHostnameLabel = false
+		cfg.EnableRuntimeMetrics = false
+		cfg.BlockedLabels = []string{"secret"}
+		cfg.BlockedLabelValues = map[string][]string{
+			"user_id": {"noisy", "bot"},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userLabel := Label{Name: "user_id", Value: "42"}
+	noisyLabel := Label{Name: "user_id", Value: "noisy"}
+	botLabel := Label{Name: "user_id", Value: "bot"}
+	secretLabel := Label{Name: "secret", Value: "42"}
+
+	met.SetGauge("thing", 1, userLabel, secretLabel)
+	if !reflect.DeepEqual(m.labels[0], []Label{userLabel}) {
+		t.Fatalf("bad labels: %v", m.labels[0])
+	}
+
+	met.SetGauge("thing", 2, noisyLabel, secretLabel)
+	if len(m.labels[1]) != 0 {
+		t.Fatalf("bad labels: %v", m.labels[1])
+	}
+
+	met.SetGauge("thing", 3, botLabel, Label{Name: "other", Value: "noisy"})
+	if !reflect.DeepEqual(m.labels[2], []Label{{Name: "other", Value: "noisy"}}) {
+		t.Fatalf("bad labels: %v", m.labels[2])
+	}
+
+	// value rules survive filter updates
+	met.UpdateFilters(nil, nil, nil, nil)
+	met.SetGauge("thing", 4, noisyLabel, secretLabel)
+	if !reflect.DeepEqual(m.labels[3], []Label{secretLabel}) {
+		t.Fatalf("bad labels: %v", m.labels[3])
+	}
+}
+
+func TestMetrics_Filter_Wildcards(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(cfg *Config) {
+		cfg.EnableRuntimeMetrics = false
+		cfg.AllowedPrefixes = []string{"service", "debug.*.errors", "*.health"}
+		cfg.BlockedPrefixes = []string{"debug", "service.*.errors", "service.db*"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key     string
+		allowed bool
+	}{
+		{"thing", true},
+		{"service.thing", true},
+		{"service.api.errors", false},
+		{"service.api.errors.count", false},
+		{"service.api.requests", true},
+		{"service.errors", true},
+		{"debug.thing", false},
+		{"debug.api.errors", true},
+		{"debug.api.other", false},
+		{"debug.health", true},
+		{"service.health", true},
+		{"service.db", false},
+		{"service.dbpool.size", false},
+		{"service.adb", true},
+	}
+	for _, test := range tests {
+		allowed, _ := met.allowMetric([]string{test.key}, nil)
+		if allowed != test.allowed {
+			t.Errorf("key %q: expected allowed=%v", test.key, test.allowed)
+		}
+	}
+}
+
+func TestMatchSegment(t *testing.T) {
+	tests := []struct {
+		glob, segment string
+		match         bool
+	}{
+		{"*", "", true},
+		{"*", "api", true},
+		{"ba*", "bar", true},
+		{"ba*", "ba", true},
+		{"ba*", "foo", false},
+		{"*ors", "errors", true},
+		{"*ors", "error", false},
+		{"e*r*s", "errors", true},
+		{"e*r*s", "eats", false},
+		{"a*a", "a", false},
+		{"a**", "abc", true},
+	}
+	for _, test := range tests {
+		if match := matchSegment(test.glob, test.segment); match != test.match {
+			t.Errorf("matchSegment(%q, %q) = %v, want %v", test.glob, test.segment, match, test.match)
+		}
+	}
+}
+
+// Keys outside the literal text ahead of the wildcards skip matching them, so
+// only keys under service. pay for the wildcard:
+//
+// BenchmarkMetrics_AllowMetric/prefixes                  	31776948	        42.15 ns/op	       0 B/op	       0 allocs/op
+// BenchmarkMetrics_AllowMetric/prefixes/other            	22605332	        56.01 ns/op	       0 B/op	       0 allocs/op
+// BenchmarkMetrics_AllowMetric/prefixes+wildcards        	10562338	       110.8 ns/op	       0 B/op	       0 allocs/op
+// BenchmarkMetrics_AllowMetric/prefixes+wildcards/other  	20128678	        60.96 ns/op	       0 B/op	       0 allocs/op
+func BenchmarkMetrics_AllowMetric(b *testing.B) {
+	prefixes := func(cfg *Config) {
+		cfg.EnableRuntimeMetrics = false
+		cfg.AllowedPrefixes = []string{"service", "debug.thing"}
+		cfg.BlockedPrefixes = []string{"debug"}
+	}
+	withWildcards := func(cfg *Config) {
+		prefixes(cfg)
+		cfg.BlockedPrefixes = append(cfg.BlockedPrefixes, "service.*.errors")
+	}
+
+	for _, bench := range []struct {
+		name string
+		opt  ConfigOption
+		key  string
+	}{
+		{"prefixes", prefixes, "service.api.requests"},
+		{"prefixes/other", prefixes, "debug.thing.requests"},
+		{"prefixes+wildcards", withWildcards, "service.api.requests"},
+		{"prefixes+wildcards/other", withWildcards, "debug.thing.requests"},
+	} {
+		met, err := New(&BlackholeSink{}, bench.opt)
+		if err != nil {
+			b.Fatal(err)
+		}
+		key := []string{bench.key}
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				met.allowMetric(key, nil)
+			}
+		})
+	}
+}
+
+// Filtering labels, before and after returning the labels as is when there
+// are no label filters:
+//
+// BenchmarkMetrics_AllowMetric_Labels/unfiltered 	10666718	       118.2 ns/op	      64 B/op	       1 allocs/op
+// BenchmarkMetrics_AllowMetric_Labels/unfiltered 	136489218	         9.131 ns/op	       0 B/op	       0 allocs/op
+//
+// BenchmarkMetrics_AllowMetric_Labels/blocked    	11736853	       119.0 ns/op	      64 B/op	       1 allocs/op
+//
+// That also drops BenchmarkEnrich from 272 B/op and 3 allocs/op to 144 B/op
+// and 2 allocs/op.
+func BenchmarkMetrics_AllowMetric_Labels(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		opt  ConfigOption
+	}{
+		{"unfiltered", func(cfg *Config) {}},
+		{"blocked", func(cfg *Config) { cfg.BlockedLabels = []string{"secret"} }},
+	} {
+		met, err := New(&BlackholeSink{}, func(cfg *Config) {
+			cfg.EnableRuntimeMetrics = false
+			bench.opt(cfg)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		key := []string{"service.api.requests"}
+		labels := []Label{{"method", "GET"}, {"code", "200"}}
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				met.allowMetric(key, labels)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ toolchain go1.21.7
 
 require (
 	github.com/DataDog/datadog-go/v5 v5.5.0
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/golang/protobuf v1.5.3
 	github.com/hashicorp/go-immutable-radix/v2 v2.1.0
 	github.com/pascaldekloe/goe v0.1.1
@@ -18,7 +19,6 @@ require (
 require (
 	github.com/Microsoft/go-winio v0.5.0 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
-	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/hashicorp/golang-lru/v2 v2.0.0 // indirect
 	github.com/kr/text v0.2.0 // indirect
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"math"
+	"math/rand"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -31,6 +34,52 @@ type InmemSink struct {
 	intervalLock sync.RWMutex
 
 	rateDenom float64
+
+	// upDownTotals maps the key to the running total of an up/down counter,
+	// which outlives any single interval
+	upDownTotals map[string]float64
+	upDownLock   sync.Mutex
+
+	// maxSampleValues is the number of raw values retained per sample each
+	// interval to compute percentiles, zero disables percentiles
+	maxSampleValues int
+
+	// sampleBuckets are the sorted upper bounds of the buckets samples are
+	// counted in, nil disables buckets
+	sampleBuckets []float64
+
+	// clock tells the interval values are emitted in
+	clock Clock
+}
+
+// InmemOption configures optional behavior of an InmemSink
+type InmemOption func(i *InmemSink)
+
+// WithInmemClock sets the clock that tells which interval values are emitted
+// in, instead of the real clock
+func WithInmemClock(clock Clock) InmemOption {
+	return func(i *InmemSink) {
+		i.clock = clock
+	}
+}
+
+// WithInmemPercentiles retains up to maxValues raw values per sample each
+// interval, so that percentiles can be reported for samples. Values beyond
+// maxValues are reservoir sampled, bounding memory use per sample.
+func WithInmemPercentiles(maxValues int) InmemOption {
+	return func(i *InmemSink) {
+		i.maxSampleValues = maxValues
+	}
+}
+
+// WithInmemBuckets counts samples in buckets with the upper bounds, so that
+// the distribution of samples is reported. A value equal to a bound is counted
+// in its bucket.
+func WithInmemBuckets(bounds []float64) InmemOption {
+	return func(i *InmemSink) {
+		i.sampleBuckets = append([]float64(nil), bounds...)
+		sort.Float64s(i.sampleBuckets)
+	}
 }
 
 // IntervalMetrics stores the aggregated metrics
@@ -52,6 +101,11 @@ type IntervalMetrics struct {
 	// which has the rolled up view of a sample
 	Samples map[string]SampledValue
 
+	// Distributions maps the key to an AggregateSample of a distribution,
+	// kept apart from samples since sinks like Datadog aggregate them
+	// differently
+	Distributions map[string]SampledValue
+
 	// done is closed when this interval has ended, and a new IntervalMetrics
 	// has been created to receive any future metrics.
 	done chan struct{}
@@ -60,11 +114,12 @@ type IntervalMetrics struct {
 // NewIntervalMetrics creates a new IntervalMetrics for a given interval
 func NewIntervalMetrics(intv time.Time) *IntervalMetrics {
 	return &IntervalMetrics{
-		Interval: intv,
-		Gauges:   make(map[string]GaugeValue),
-		Counters: make(map[string]SampledValue),
-		Samples:  make(map[string]SampledValue),
-		done:     make(chan struct{}),
+		Interval:      intv,
+		Gauges:        make(map[string]GaugeValue),
+		Counters:      make(map[string]SampledValue),
+		Samples:       make(map[string]SampledValue),
+		Distributions: make(map[string]SampledValue),
+		done:          make(chan struct{}),
 	}
 }
 
@@ -78,6 +133,14 @@ type AggregateSample struct {
 	Min         float64   // Minimum value
 	Max         float64   // Maximum value
 	LastUpdated time.Time `json:"-"` // When value was last updated
+
+	// values retained to compute percentiles, up to maxValues
+	values    []float64
+	maxValues int
+
+	// counts of values in each bucket, and above the last bound
+	bounds       []float64
+	bucketCounts []int
 }
 
 // Computes a Stddev of the values
@@ -100,17 +163,106 @@ func (a *AggregateSample) Mean() float64 {
 
 // Ingest is used to update a sample
 func (a *AggregateSample) Ingest(v float64, rateDenom float64) {
-	a.Count++
-	a.Sum += v
-	a.SumSq += (v * v)
-	if v < a.Min || a.Count == 1 {
+	a.ingestAt(v, rateDenom, time.Now())
+}
+
+// ingestAt updates the sample with a value observed at now
+func (a *AggregateSample) ingestAt(v float64, rateDenom float64, now time.Time) {
+	a.ingestNAt(v, 1, rateDenom, now)
+}
+
+// ingestNAt updates the sample with a value observed n times at now, the
+// same as n calls to ingestAt
+func (a *AggregateSample) ingestNAt(v float64, n int, rateDenom float64, now time.Time) {
+	first := a.Count == 0
+	a.Count += n
+	a.Sum += v * float64(n)
+	a.SumSq += (v * v) * float64(n)
+	if v < a.Min || first {
 		a.Min = v
 	}
-	if v > a.Max || a.Count == 1 {
+	if v > a.Max || first {
 		a.Max = v
 	}
 	a.Rate = float64(a.Sum) / rateDenom
-	a.LastUpdated = time.Now()
+	a.LastUpdated = now
+
+	if a.maxValues > 0 {
+		a.retainValues(v, n)
+	}
+
+	if a.bounds != nil {
+		if a.bucketCounts == nil {
+			a.bucketCounts = make([]int, len(a.bounds)+1)
+		}
+		a.bucketCounts[sort.SearchFloat64s(a.bounds, v)] += n
+	}
+}
+
+// retainValues adds the value observed n times, the last n of Count, to the
+// retained values. Reservoir sampling keeps a uniform sample of all values,
+// in at most maxValues steps: from n values on, the retained values are drawn
+// directly out of all those seen rather than replaced one value at a time.
+func (a *AggregateSample) retainValues(v float64, n int) {
+	for ; n > 0 && len(a.values) < a.maxValues; n-- {
+		a.values = append(a.values, v)
+	}
+	if n < a.maxValues {
+		for seen := a.Count - n + 1; seen <= a.Count; seen++ {
+			if j := rand.Intn(seen); j < a.maxValues {
+				a.values[j] = v
+			}
+		}
+		return
+	}
+
+	// each retained value is drawn without replacement from all values seen,
+	// of which the last n are v, and the retained values not drawn as v are
+	// a uniform sample of the earlier ones
+	remaining, remainingV := a.Count, n
+	for j := range a.values {
+		if rand.Float64()*float64(remaining) < float64(remainingV) {
+			a.values[j] = v
+			remainingV--
+		}
+		remaining--
+	}
+}
+
+// BucketCounts returns the cumulative count of values up to each bucket bound, or
+// nil if buckets aren't enabled. Values above the last bound are only
+// included in Count.
+func (a *AggregateSample) BucketCounts() []Bucket {
+	if a.bounds == nil {
+		return nil
+	}
+
+	buckets := make([]Bucket, len(a.bounds))
+	total := 0
+	for n, bound := range a.bounds {
+		if a.bucketCounts != nil {
+			total += a.bucketCounts[n]
+		}
+		buckets[n] = Bucket{UpperBound: bound, Count: total}
+	}
+	return buckets
+}
+
+// Percentile returns the q-th percentile, between 0 and 1, of the retained
+// values, interpolating between the closest ranks. The second return is false
+// if no values were retained or q is outside [0, 1].
+func (a *AggregateSample) Percentile(q float64) (float64, bool) {
+	if len(a.values) == 0 || !(q >= 0 && q <= 1) {
+		return 0, false
+	}
+
+	sorted := append([]float64(nil), a.values...)
+	sort.Float64s(sorted)
+
+	pos := q * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(pos-float64(lo)), true
 }
 
 func (a *AggregateSample) String() string {
@@ -139,28 +291,55 @@ func NewInmemSinkFromURL(u *url.URL) (MetricSink, error) {
 		return nil, fmt.Errorf("Bad 'retain' param: %s", err)
 	}
 
-	return NewInmemSink(interval, retain), nil
+	var opts []InmemOption
+	if s := params.Get("percentile_samples"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Bad 'percentile_samples' param: %q", s)
+		}
+		opts = append(opts, WithInmemPercentiles(n))
+	}
+	if s := params.Get("buckets"); s != "" {
+		var bounds []float64
+		for _, b := range strings.Split(s, ",") {
+			bound, err := strconv.ParseFloat(b, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Bad 'buckets' param: %s", err)
+			}
+			bounds = append(bounds, bound)
+		}
+		opts = append(opts, WithInmemBuckets(bounds))
+	}
+
+	return NewInmemSink(interval, retain, opts...), nil
 }
 
 // NewInmemSink is used to construct a new in-memory sink.
 // Uses an aggregation interval and maximum retention period.
-func NewInmemSink(interval, retain time.Duration) *InmemSink {
+func NewInmemSink(interval, retain time.Duration, opts ...InmemOption) *InmemSink {
 	rateTimeUnit := time.Second
 	i := &InmemSink{
 		interval:     interval,
 		retain:       retain,
 		maxIntervals: int(retain / interval),
 		rateDenom:    float64(interval.Nanoseconds()) / float64(rateTimeUnit.Nanoseconds()),
+		upDownTotals: make(map[string]float64),
 	}
 	i.intervals = make([]*IntervalMetrics, 0, i.maxIntervals)
+	for _, opt := range opts {
+		opt(i)
+	}
+	i.clock = clockOrReal(i.clock)
 	return i
 }
 
 func (i *InmemSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
 	k, name := i.flattenKeyLabels(keys, labels)
-	intv := i.getInterval()
 
 	return func(val float64) {
+		// resolved per emit, so values land in the interval they occur in
+		now := i.clock.Now()
+		intv := i.getIntervalAt(now)
 		intv.Lock()
 		defer intv.Unlock()
 
@@ -175,26 +354,165 @@ func (i *InmemSink) BuildMetricEmitter(mType MetricType, keys []string, labels [
 				}
 				intv.Counters[k] = agg
 			}
-			agg.Ingest(float64(val), i.rateDenom)
+			agg.ingestAt(float64(val), i.rateDenom, now)
 		case MetricTypeGauge:
 			intv.Gauges[k] = GaugeValue{Name: name, Value: val, Labels: labels}
+		case MetricTypeUpDownCounter:
+			// reported as a gauge of the running total
+			intv.Gauges[k] = GaugeValue{Name: name, Value: i.addUpDown(k, val), Labels: labels}
 		case MetricTypeTimer:
 			fallthrough
-		case MetricTypeDistribution:
-			fallthrough
 		case MetricTypeHistogram:
-			agg, ok := intv.Samples[k]
-			if !ok {
-				agg = SampledValue{
-					Name:            name,
-					AggregateSample: &AggregateSample{},
-					Labels:          labels,
-				}
-				intv.Samples[k] = agg
+			i.ingestSample(intv.Samples, k, name, labels, val, 1, now)
+		case MetricTypeDistribution:
+			i.ingestSample(intv.Distributions, k, name, labels, val, 1, now)
+		}
+	}
+}
+
+// BuildMetricEmitterN is like BuildMetricEmitter, adding a value observed
+// count times to the aggregate of a timer, histogram, or distribution at
+// once. Values of other types are emitted count times.
+func (i *InmemSink) BuildMetricEmitterN(mType MetricType, keys []string, labels []Label) MetricEmitterN {
+	if mType != MetricTypeTimer && mType != MetricTypeHistogram && mType != MetricTypeDistribution {
+		emitter := i.BuildMetricEmitter(mType, keys, labels)
+		return func(val float64, count int) {
+			for n := 0; n < count; n++ {
+				emitter(val)
 			}
-			agg.Ingest(float64(val), i.rateDenom)
 		}
 	}
+
+	k, name := i.flattenKeyLabels(keys, labels)
+	return func(val float64, count int) {
+		if count <= 0 {
+			return
+		}
+		now := i.clock.Now()
+		intv := i.getIntervalAt(now)
+		intv.Lock()
+		defer intv.Unlock()
+
+		samples := intv.Samples
+		if mType == MetricTypeDistribution {
+			samples = intv.Distributions
+		}
+		i.ingestSample(samples, k, name, labels, val, count, now)
+	}
+}
+
+// ingestSample adds the value observed n times to the sample of the key in
+// samples, creating it if needed. The interval must be locked.
+func (i *InmemSink) ingestSample(samples map[string]SampledValue, k, name string, labels []Label, val float64, n int, now time.Time) {
+	agg, ok := samples[k]
+	if !ok {
+		agg = SampledValue{
+			Name:            name,
+			AggregateSample: &AggregateSample{maxValues: i.maxSampleValues, bounds: i.sampleBuckets},
+			Labels:          labels,
+		}
+		samples[k] = agg
+	}
+	agg.ingestNAt(val, n, i.rateDenom, now)
+}
+
+// ForgetMetric removes the metric from the current interval, and drops the
+// running total of an up/down counter. Finished intervals are left intact.
+func (i *InmemSink) ForgetMetric(mType MetricType, keys []string, labels []Label) {
+	k, _ := i.flattenKeyLabels(keys, labels)
+	intv := i.getInterval()
+
+	intv.Lock()
+	switch mType {
+	case MetricTypeCounter:
+		delete(intv.Counters, k)
+	case MetricTypeGauge, MetricTypeUpDownCounter:
+		delete(intv.Gauges, k)
+	case MetricTypeTimer, MetricTypeHistogram:
+		delete(intv.Samples, k)
+	case MetricTypeDistribution:
+		delete(intv.Distributions, k)
+	}
+	intv.Unlock()
+
+	if mType == MetricTypeUpDownCounter {
+		i.upDownLock.Lock()
+		delete(i.upDownTotals, k)
+		i.upDownLock.Unlock()
+	}
+}
+
+// GaugeValue returns the value of the gauge or up/down counter in the current
+// interval, and false if it wasn't set in it. The key is the dot-joined key
+// the sink received, including any service or type prefix, and the labels
+// are matched in the order they were emitted with.
+func (i *InmemSink) GaugeValue(key string, labels ...Label) (float64, bool) {
+	k, _ := i.flattenKeyLabels([]string{key}, labels)
+	intv := i.getInterval()
+
+	intv.RLock()
+	defer intv.RUnlock()
+	g, ok := intv.Gauges[k]
+	return g.Value, ok
+}
+
+// CounterValue returns the sum of the counter in the current interval, and
+// false if it wasn't incremented in it. The key and labels are as of
+// GaugeValue.
+func (i *InmemSink) CounterValue(key string, labels ...Label) (float64, bool) {
+	k, _ := i.flattenKeyLabels([]string{key}, labels)
+	intv := i.getInterval()
+
+	intv.RLock()
+	defer intv.RUnlock()
+	c, ok := intv.Counters[k]
+	if !ok {
+		return 0, false
+	}
+	return c.Sum, true
+}
+
+// SampleStats returns a copy of the aggregate of the timer, histogram, or
+// else distribution in the current interval, and false if nothing was
+// observed in it. The key and labels are as of GaugeValue.
+func (i *InmemSink) SampleStats(key string, labels ...Label) (AggregateSample, bool) {
+	k, _ := i.flattenKeyLabels([]string{key}, labels)
+	intv := i.getInterval()
+
+	intv.RLock()
+	defer intv.RUnlock()
+	v, ok := intv.Samples[k]
+	if !ok {
+		if v, ok = intv.Distributions[k]; !ok {
+			return AggregateSample{}, false
+		}
+	}
+	return *v.deepCopy().AggregateSample, true
+}
+
+// Reset discards all retained intervals and up/down counter totals, so the
+// sink starts fresh with a new current interval.
+func (i *InmemSink) Reset() {
+	i.intervalLock.Lock()
+	if n := len(i.intervals); n > 0 {
+		// wake any streams waiting on the discarded interval
+		close(i.intervals[n-1].done)
+	}
+	i.intervals = make([]*IntervalMetrics, 0, i.maxIntervals)
+	i.intervalLock.Unlock()
+
+	i.upDownLock.Lock()
+	i.upDownTotals = make(map[string]float64)
+	i.upDownLock.Unlock()
+}
+
+// addUpDown adds delta to the running total for key and returns the new total
+func (i *InmemSink) addUpDown(key string, delta float64) float64 {
+	i.upDownLock.Lock()
+	defer i.upDownLock.Unlock()
+
+	i.upDownTotals[key] += delta
+	return i.upDownTotals[key]
 }
 
 // Data is used to retrieve all the aggregated metrics
@@ -232,6 +550,10 @@ func (i *InmemSink) Data() []*IntervalMetrics {
 	for k, v := range current.Samples {
 		copyCurrent.Samples[k] = v.deepCopy()
 	}
+	copyCurrent.Distributions = make(map[string]SampledValue, len(current.Distributions))
+	for k, v := range current.Distributions {
+		copyCurrent.Distributions[k] = v.deepCopy()
+	}
 	current.RUnlock()
 
 	return intervals
@@ -241,7 +563,12 @@ func (i *InmemSink) Data() []*IntervalMetrics {
 // previous interval exists, or if the current time is beyond the window for the
 // current interval.
 func (i *InmemSink) getInterval() *IntervalMetrics {
-	intv := time.Now().Truncate(i.interval)
+	return i.getIntervalAt(i.clock.Now())
+}
+
+// getIntervalAt returns the interval of the time, like getInterval
+func (i *InmemSink) getIntervalAt(now time.Time) *IntervalMetrics {
+	intv := now.Truncate(i.interval)
 
 	// Attempt to return the existing interval first, because it only requires
 	// a read lock.
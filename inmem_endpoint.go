@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -14,6 +15,8 @@ type MetricsSummary struct {
 	Gauges    []GaugeValue
 	Counters  []SampledValue
 	Samples   []SampledValue
+
+	Distributions []SampledValue
 }
 
 type GaugeValue struct {
@@ -29,41 +32,84 @@ type SampledValue struct {
 	Name string
 	Hash string `json:"-"`
 	*AggregateSample
-	Mean   float64
-	Stddev float64
+	Mean        float64
+	Stddev      float64
+	Percentiles *Percentiles `json:",omitempty"` // Set if the sink retains values for percentiles
+	Buckets     []Bucket     `json:",omitempty"` // Set if the sink counts samples in buckets
 
 	Labels        []Label           `json:"-"`
 	DisplayLabels map[string]string `json:"Labels"`
 }
 
+// Percentiles of the values of a sample in an interval
+type Percentiles struct {
+	P50 float64
+	P90 float64
+	P99 float64
+}
+
+// Bucket is the count of values less than or equal to its upper bound
+type Bucket struct {
+	UpperBound float64
+	Count      int
+}
+
 // deepCopy allocates a new instance of AggregateSample
 func (source *SampledValue) deepCopy() SampledValue {
 	dest := *source
 	if source.AggregateSample != nil {
 		dest.AggregateSample = &AggregateSample{}
 		*dest.AggregateSample = *source.AggregateSample
+		dest.AggregateSample.values = append([]float64(nil), source.AggregateSample.values...)
+		dest.AggregateSample.bucketCounts = append([]int(nil), source.AggregateSample.bucketCounts...)
 	}
 	return dest
 }
 
 // DisplayMetrics returns a summary of the metrics from the most recent finished interval.
+// If req is set, the "prefix" query parameter limits the summary to metrics
+// whose name has the prefix, and "type" to one of gauge, counter, sample, or
+// distribution.
 func (i *InmemSink) DisplayMetrics(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	var prefix, typ string
+	if req != nil {
+		params := req.URL.Query()
+		prefix, typ = params.Get("prefix"), params.Get("type")
+		switch typ {
+		case "", "gauge", "counter", "sample", "distribution":
+		default:
+			return nil, fmt.Errorf("invalid metric type %q, must be gauge, counter, sample, or distribution", typ)
+		}
+	}
+
+	interval, err := i.displayInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := newMetricSummaryFromInterval(interval)
+	if prefix != "" || typ != "" {
+		summary = summary.filter(prefix, typ)
+	}
+	return summary, nil
+}
+
+// displayInterval returns the most recent finished interval, or the current
+// one if it's the only interval
+func (i *InmemSink) displayInterval() (*IntervalMetrics, error) {
 	data := i.Data()
 
-	var interval *IntervalMetrics
 	n := len(data)
 	switch {
 	case n == 0:
 		return nil, fmt.Errorf("no metric intervals have been initialized yet")
 	case n == 1:
 		// Show the current interval if it's all we have
-		interval = data[0]
+		return data[0], nil
 	default:
 		// Show the most recent finished interval if we have one
-		interval = data[n-2]
+		return data[n-2], nil
 	}
-
-	return newMetricSummaryFromInterval(interval), nil
 }
 
 func newMetricSummaryFromInterval(interval *IntervalMetrics) MetricsSummary {
@@ -93,10 +139,51 @@ func newMetricSummaryFromInterval(interval *IntervalMetrics) MetricsSummary {
 
 	summary.Counters = formatSamples(interval.Counters)
 	summary.Samples = formatSamples(interval.Samples)
+	summary.Distributions = formatSamples(interval.Distributions)
 
 	return summary
 }
 
+// filter returns the metrics of the summary with the name prefix, of the type
+// if set
+func (s MetricsSummary) filter(prefix, typ string) MetricsSummary {
+	filtered := MetricsSummary{
+		Timestamp: s.Timestamp,
+		Gauges:    []GaugeValue{},
+		Counters:  []SampledValue{},
+		Samples:   []SampledValue{},
+
+		Distributions: []SampledValue{},
+	}
+	if typ == "" || typ == "gauge" {
+		for _, g := range s.Gauges {
+			if strings.HasPrefix(g.Name, prefix) {
+				filtered.Gauges = append(filtered.Gauges, g)
+			}
+		}
+	}
+	if typ == "" || typ == "counter" {
+		filtered.Counters = filterSamples(s.Counters, prefix)
+	}
+	if typ == "" || typ == "sample" {
+		filtered.Samples = filterSamples(s.Samples, prefix)
+	}
+	if typ == "" || typ == "distribution" {
+		filtered.Distributions = filterSamples(s.Distributions, prefix)
+	}
+	return filtered
+}
+
+func filterSamples(values []SampledValue, prefix string) []SampledValue {
+	filtered := []SampledValue{}
+	for _, v := range values {
+		if strings.HasPrefix(v.Name, prefix) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
 func formatSamples(source map[string]SampledValue) []SampledValue {
 	output := make([]SampledValue, 0, len(source))
 	for hash, sample := range source {
@@ -111,6 +198,8 @@ func formatSamples(source map[string]SampledValue) []SampledValue {
 			AggregateSample: sample.AggregateSample,
 			Mean:            sample.AggregateSample.Mean(),
 			Stddev:          sample.AggregateSample.Stddev(),
+			Percentiles:     samplePercentiles(sample.AggregateSample),
+			Buckets:         sample.AggregateSample.BucketCounts(),
 			DisplayLabels:   displayLabels,
 		})
 	}
@@ -121,6 +210,18 @@ func formatSamples(source map[string]SampledValue) []SampledValue {
 	return output
 }
 
+// samplePercentiles returns the percentiles of the sample, or nil if it has no
+// retained values
+func samplePercentiles(a *AggregateSample) *Percentiles {
+	p50, ok := a.Percentile(0.5)
+	if !ok {
+		return nil
+	}
+	p90, _ := a.Percentile(0.9)
+	p99, _ := a.Percentile(0.99)
+	return &Percentiles{P50: p50, P90: p90, P99: p99}
+}
+
 type Encoder interface {
 	Encode(interface{}) error
 }
@@ -137,6 +137,55 @@ func TestDisplayMetrics(t *testing.T) {
 	verify.Values(t, "all", result, expected)
 }
 
+func TestDisplayMetrics_Filter(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+
+	inm.BuildMetricEmitter(MetricTypeGauge, []string{"db", "conns"}, nil)(1)
+	inm.BuildMetricEmitter(MetricTypeGauge, []string{"http", "conns"}, nil)(2)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"db", "queries"}, nil)(3)
+	inm.BuildMetricEmitter(MetricTypeHistogram, []string{"db", "latency"}, nil)(4)
+	inm.BuildMetricEmitter(MetricTypeHistogram, []string{"http", "latency"}, nil)(5)
+
+	names := func(query string) []string {
+		req := httptest.NewRequest("GET", "/metrics"+query, nil)
+		raw, err := inm.DisplayMetrics(nil, req)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		result := raw.(MetricsSummary)
+
+		var names []string
+		for _, g := range result.Gauges {
+			names = append(names, "gauge:"+g.Name)
+		}
+		for _, c := range result.Counters {
+			names = append(names, "counter:"+c.Name)
+		}
+		for _, s := range result.Samples {
+			names = append(names, "sample:"+s.Name)
+		}
+		return names
+	}
+
+	verify.Values(t, "none", names(""), []string{
+		"gauge:db.conns", "gauge:http.conns", "counter:db.queries", "sample:db.latency", "sample:http.latency",
+	})
+	verify.Values(t, "prefix", names("?prefix=db."), []string{
+		"gauge:db.conns", "counter:db.queries", "sample:db.latency",
+	})
+	verify.Values(t, "type", names("?type=sample"), []string{
+		"sample:db.latency", "sample:http.latency",
+	})
+	verify.Values(t, "both", names("?prefix=http.&type=gauge"), []string{
+		"gauge:http.conns",
+	})
+
+	req := httptest.NewRequest("GET", "/metrics?type=timer", nil)
+	if _, err := inm.DisplayMetrics(nil, req); err == nil {
+		t.Fatalf("expected error for an invalid type")
+	}
+}
+
 func TestDisplayMetrics_RaceSetGauge(t *testing.T) {
 	interval := 200 * time.Millisecond
 	inm := NewInmemSink(interval, 10*interval)
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrometheusText writes the metrics of the most recent finished interval, the
+// same interval as DisplayMetrics, in the Prometheus text exposition format.
+func (i *InmemSink) PrometheusText(w io.Writer) error {
+	interval, err := i.displayInterval()
+	if err != nil {
+		return err
+	}
+
+	return newMetricSummaryFromInterval(interval).WritePrometheus(w)
+}
+
+// WritePrometheus writes the summary in the Prometheus text exposition format.
+// Gauges are written as gauges, counters as gauges of their sum over the
+// interval, as it isn't monotonic like a Prometheus counter, and samples as
+// summaries, with quantiles if the sink retains percentiles.
+func (s MetricsSummary) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	gauges := make(map[string][]GaugeValue)
+	for _, g := range s.Gauges {
+		name := promName(g.Name)
+		gauges[name] = append(gauges[name], g)
+	}
+	for _, name := range sortedKeys(gauges) {
+		writePromType(bw, name, "gauge")
+		for _, g := range gauges[name] {
+			writePromValue(bw, name, g.DisplayLabels, "", "", g.Value)
+		}
+	}
+
+	counters := groupSamples(s.Counters, "")
+	for _, name := range sortedKeys(counters) {
+		writePromType(bw, name, "gauge")
+		for _, c := range counters[name] {
+			writePromValue(bw, name, c.DisplayLabels, "", "", c.Sum)
+		}
+	}
+
+	// distributions are summaries too, merged with samples of the same name
+	allSamples := make([]SampledValue, 0, len(s.Samples)+len(s.Distributions))
+	allSamples = append(allSamples, s.Samples...)
+	allSamples = append(allSamples, s.Distributions...)
+	samples := groupSamples(allSamples, "")
+	for _, name := range sortedKeys(samples) {
+		writePromType(bw, name, "summary")
+		for _, v := range samples[name] {
+			if p := v.Percentiles; p != nil {
+				writePromValue(bw, name, v.DisplayLabels, "quantile", "0.5", p.P50)
+				writePromValue(bw, name, v.DisplayLabels, "quantile", "0.9", p.P90)
+				writePromValue(bw, name, v.DisplayLabels, "quantile", "0.99", p.P99)
+			}
+			writePromValue(bw, name+"_sum", v.DisplayLabels, "", "", v.Sum)
+			writePromValue(bw, name+"_count", v.DisplayLabels, "", "", float64(v.Count))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// groupSamples groups the values by their Prometheus metric name
+func groupSamples(values []SampledValue, suffix string) map[string][]SampledValue {
+	groups := make(map[string][]SampledValue)
+	for _, v := range values {
+		name := promName(v.Name) + suffix
+		groups[name] = append(groups[name], v)
+	}
+	return groups
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writePromType(w *bufio.Writer, name, typ string) {
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// writePromValue writes a single sample line, with the labels sorted by name
+// and an optional extra label, e.g. the quantile of a summary
+func writePromValue(w *bufio.Writer, name string, labels map[string]string, extraName, extraValue string, val float64) {
+	w.WriteString(name)
+
+	names := sortedKeys(labels)
+	if len(names) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for n, l := range names {
+			if n > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(promLabelName(l) + `="` + promLabelEscaper.Replace(labels[l]) + `"`)
+		}
+		if extraName != "" {
+			if len(names) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteString(" " + strconv.FormatFloat(val, 'g', -1, 64) + "\n")
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promName replaces the characters not allowed in Prometheus metric names,
+// such as the '.' separator, with underscores
+func promName(name string) string {
+	return promSanitize(name, true)
+}
+
+// promLabelName replaces the characters not allowed in Prometheus label names
+func promLabelName(name string) string {
+	return promSanitize(name, false)
+}
+
+func promSanitize(name string, allowColon bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case c >= '0' && c <= '9' && i > 0:
+		case c == ':' && allowColon:
+		default:
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
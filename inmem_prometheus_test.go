@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestInmemSink_PrometheusText(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour, WithInmemPercentiles(100))
+
+	inm.BuildMetricEmitter(MetricTypeGauge, []string{"queue", "size"}, []Label{{"host", "a"}})(5)
+	inm.BuildMetricEmitter(MetricTypeGauge, []string{"queue", "size"}, []Label{{"host", `b"\`}})(7)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"requests"}, []Label{{"code-class", "2xx"}})(3)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"requests"}, []Label{{"code-class", "2xx"}})(2)
+	latency := inm.BuildMetricEmitter(MetricTypeHistogram, []string{"latency"}, nil)
+	latency(0)
+	latency(100)
+
+	var buf bytes.Buffer
+	if err := inm.PrometheusText(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := `# TYPE queue_size gauge
+queue_size{host="a"} 5
+queue_size{host="b\"\\"} 7
+# TYPE requests gauge
+requests{code_class="2xx"} 5
+# TYPE latency summary
+latency{quantile="0.5"} 50
+latency{quantile="0.9"} 90
+latency{quantile="0.99"} 99
+latency_sum 100
+latency_count 2
+`
+	if buf.String() != expected {
+		t.Fatalf("bad output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestInmemSink_PrometheusText_NoPercentiles(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+	inm.BuildMetricEmitter(MetricTypeHistogram, []string{"latency"}, []Label{{"op", "get"}})(2)
+
+	var buf bytes.Buffer
+	if err := inm.PrometheusText(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := `# TYPE latency summary
+latency_sum{op="get"} 2
+latency_count{op="get"} 1
+`
+	if buf.String() != expected {
+		t.Fatalf("bad output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
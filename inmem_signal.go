@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -17,6 +18,7 @@ type InmemSignal struct {
 	signal syscall.Signal
 	inm    *InmemSink
 	w      io.Writer
+	format SignalFormat
 	sigCh  chan os.Signal
 
 	stop     bool
@@ -24,9 +26,30 @@ type InmemSignal struct {
 	stopLock sync.Mutex
 }
 
+// SignalFormat is the output format of an InmemSignal dump
+type SignalFormat int
+
+const (
+	// SignalFormatText writes a line per metric, the default
+	SignalFormatText SignalFormat = iota
+	// SignalFormatJSON writes a line per interval, with the MetricsSummary
+	// as returned by DisplayMetrics encoded as JSON
+	SignalFormatJSON
+)
+
+// InmemSignalOption configures optional behavior of an InmemSignal
+type InmemSignalOption func(i *InmemSignal)
+
+// WithSignalFormat sets the output format of the dump
+func WithSignalFormat(format SignalFormat) InmemSignalOption {
+	return func(i *InmemSignal) {
+		i.format = format
+	}
+}
+
 // NewInmemSignal creates a new InmemSignal which listens for a given signal,
 // and dumps the current metrics out to a writer
-func NewInmemSignal(inmem *InmemSink, sig syscall.Signal, w io.Writer) *InmemSignal {
+func NewInmemSignal(inmem *InmemSink, sig syscall.Signal, w io.Writer, opts ...InmemSignalOption) *InmemSignal {
 	i := &InmemSignal{
 		signal: sig,
 		inm:    inmem,
@@ -34,6 +57,9 @@ func NewInmemSignal(inmem *InmemSink, sig syscall.Signal, w io.Writer) *InmemSig
 		sigCh:  make(chan os.Signal, 1),
 		stopCh: make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(i)
+	}
 	signal.Notify(i.sigCh, sig)
 	go i.run()
 	return i
@@ -72,34 +98,54 @@ func (i *InmemSignal) run() {
 
 // dumpStats is used to dump the data to output writer
 func (i *InmemSignal) dumpStats() {
+	i.inm.Dump(i.w, i.format)
+}
+
+// Dump writes the metrics of the finished intervals to w in the format, the
+// same output as an InmemSignal. It can be used to render the metrics without
+// a signal, e.g. from a debug endpoint or a test.
+func (i *InmemSink) Dump(w io.Writer, format SignalFormat) error {
 	buf := bytes.NewBuffer(nil)
 
-	data := i.inm.Data()
+	data := i.Data()
 	// Skip the last period which is still being aggregated
 	for j := 0; j < len(data)-1; j++ {
 		intv := data[j]
+		if format == SignalFormatJSON {
+			// the encoder ends each summary with a newline
+			if err := json.NewEncoder(buf).Encode(newMetricSummaryFromInterval(intv)); err != nil {
+				return err
+			}
+			continue
+		}
+
 		intv.RLock()
 		for _, val := range intv.Gauges {
-			name := i.flattenLabels(val.Name, val.Labels)
+			name := flattenDumpLabels(val.Name, val.Labels)
 			fmt.Fprintf(buf, "[%v][G] '%s': %0.3f\n", intv.Interval, name, val.Value)
 		}
 		for _, agg := range intv.Counters {
-			name := i.flattenLabels(agg.Name, agg.Labels)
+			name := flattenDumpLabels(agg.Name, agg.Labels)
 			fmt.Fprintf(buf, "[%v][C] '%s': %s\n", intv.Interval, name, agg.AggregateSample)
 		}
 		for _, agg := range intv.Samples {
-			name := i.flattenLabels(agg.Name, agg.Labels)
+			name := flattenDumpLabels(agg.Name, agg.Labels)
 			fmt.Fprintf(buf, "[%v][S] '%s': %s\n", intv.Interval, name, agg.AggregateSample)
 		}
+		for _, agg := range intv.Distributions {
+			name := flattenDumpLabels(agg.Name, agg.Labels)
+			fmt.Fprintf(buf, "[%v][D] '%s': %s\n", intv.Interval, name, agg.AggregateSample)
+		}
 		intv.RUnlock()
 	}
 
 	// Write out the bytes
-	i.w.Write(buf.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // Flattens the key for formatting along with its labels, removes spaces
-func (i *InmemSignal) flattenLabels(name string, labels []Label) string {
+func flattenDumpLabels(name string, labels []Label) string {
 	buf := bytes.NewBufferString(name)
 	replacer := strings.NewReplacer(" ", "_", ":", "_")
 
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"bytes"
+	"encoding/json"
 	"os"
 	"strings"
 	"sync"
@@ -61,6 +62,45 @@ func TestInmemSignal(t *testing.T) {
 	}
 }
 
+func TestInmemSignal_JSON(t *testing.T) {
+	buf := newBuffer()
+	inm := NewInmemSink(10*time.Millisecond, 50*time.Millisecond)
+	sig := NewInmemSignal(inm, syscall.SIGUSR1, buf, WithSignalFormat(SignalFormatJSON))
+	defer sig.Stop()
+
+	inm.BuildMetricEmitter(MetricTypeGauge, []string{"foo"}, []Label{{"a", "b"}})(42)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"baz"}, []Label{})(42)
+
+	// Wait for period to end
+	time.Sleep(15 * time.Millisecond)
+
+	// Send signal!
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+
+	// Wait for flush
+	time.Sleep(10 * time.Millisecond)
+
+	// the metrics may land in separate intervals, each dumped on its own line
+	var summary MetricsSummary
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var intv MetricsSummary
+		if err := json.Unmarshal([]byte(line), &intv); err != nil {
+			t.Fatalf("bad json %q: %v", line, err)
+		}
+		summary.Gauges = append(summary.Gauges, intv.Gauges...)
+		summary.Counters = append(summary.Counters, intv.Counters...)
+	}
+	if len(summary.Gauges) != 1 || summary.Gauges[0].Name != "foo" || summary.Gauges[0].Value != 42 {
+		t.Fatalf("bad gauges: %v", summary.Gauges)
+	}
+	if summary.Gauges[0].DisplayLabels["a"] != "b" {
+		t.Fatalf("bad labels: %v", summary.Gauges[0].DisplayLabels)
+	}
+	if len(summary.Counters) != 1 || summary.Counters[0].Name != "baz" || summary.Counters[0].Sum != 42 {
+		t.Fatalf("bad counters: %v", summary.Counters)
+	}
+}
+
 func newBuffer() *syncBuffer {
 	return &syncBuffer{buf: bytes.NewBuffer(nil)}
 }
@@ -1,8 +1,10 @@
 package metrics
 
 import (
+	"bytes"
 	"math"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -117,13 +119,251 @@ func TestInmemSink(t *testing.T) {
 	}
 }
 
+func TestInmemSink_UpDownCounter(t *testing.T) {
+	inm := NewInmemSink(10*time.Millisecond, 50*time.Millisecond)
+
+	// separate emitters for the same series share the running total
+	inm.BuildMetricEmitter(MetricTypeUpDownCounter, []string{"foo", "bar"}, []Label{{"a", "b"}})(5)
+	inm.BuildMetricEmitter(MetricTypeUpDownCounter, []string{"foo", "bar"}, []Label{{"a", "b"}})(-2)
+
+	data := inm.Data()
+	if v := data[len(data)-1].Gauges["foo.bar;a=b"].Value; v != 3 {
+		t.Fatalf("bad val: %v", v)
+	}
+
+	// the total outlives the interval
+	time.Sleep(10 * time.Millisecond)
+	inm.BuildMetricEmitter(MetricTypeUpDownCounter, []string{"foo", "bar"}, []Label{{"a", "b"}})(1)
+
+	data = inm.Data()
+	if v := data[len(data)-1].Gauges["foo.bar;a=b"].Value; v != 4 {
+		t.Fatalf("bad val: %v", v)
+	}
+}
+
+func TestInmemSink_ForgetMetric(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+
+	inm.BuildMetricEmitter(MetricTypeGauge, []string{"foo"}, []Label{{"a", "b"}})(1)
+	inm.BuildMetricEmitter(MetricTypeGauge, []string{"foo"}, []Label{{"a", "c"}})(2)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"foo"}, []Label{{"a", "b"}})(3)
+	inm.BuildMetricEmitter(MetricTypeHistogram, []string{"foo"}, []Label{{"a", "b"}})(4)
+	inm.BuildMetricEmitter(MetricTypeUpDownCounter, []string{"bar"}, []Label{{"a", "b"}})(5)
+
+	inm.ForgetMetric(MetricTypeGauge, []string{"foo"}, []Label{{"a", "b"}})
+	inm.ForgetMetric(MetricTypeCounter, []string{"foo"}, []Label{{"a", "b"}})
+	inm.ForgetMetric(MetricTypeHistogram, []string{"foo"}, []Label{{"a", "b"}})
+	inm.ForgetMetric(MetricTypeUpDownCounter, []string{"bar"}, []Label{{"a", "b"}})
+
+	data := inm.Data()
+	intvM := data[len(data)-1]
+	if _, ok := intvM.Gauges["foo;a=b"]; ok {
+		t.Fatalf("gauge not forgotten: %v", intvM.Gauges)
+	}
+	if _, ok := intvM.Gauges["foo;a=c"]; !ok {
+		t.Fatalf("other gauge should remain: %v", intvM.Gauges)
+	}
+	if len(intvM.Counters) != 0 || len(intvM.Samples) != 0 {
+		t.Fatalf("counter or sample not forgotten: %v %v", intvM.Counters, intvM.Samples)
+	}
+
+	// the running total restarts
+	inm.BuildMetricEmitter(MetricTypeUpDownCounter, []string{"bar"}, []Label{{"a", "b"}})(1)
+	data = inm.Data()
+	if v := data[len(data)-1].Gauges["bar;a=b"].Value; v != 1 {
+		t.Fatalf("bad val: %v", v)
+	}
+}
+
+func TestInmemSink_Percentiles(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour, WithInmemPercentiles(1000))
+
+	sample := inm.BuildMetricEmitter(MetricTypeHistogram, []string{"foo"}, nil)
+	for i := 1; i <= 100; i++ {
+		sample(float64(i))
+	}
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"bar"}, nil)(1)
+
+	summary := newMetricSummaryFromInterval(inm.getInterval())
+	p := summary.Samples[0].Percentiles
+	if p == nil {
+		t.Fatalf("missing percentiles")
+	}
+	if p.P50 != 50.5 || math.Abs(p.P90-90.1) > 1e-9 || math.Abs(p.P99-99.01) > 1e-9 {
+		t.Fatalf("bad percentiles: %+v", p)
+	}
+	for _, q := range []float64{-0.1, 1.1, math.NaN()} {
+		if _, ok := inm.getInterval().Samples["foo"].Percentile(q); ok {
+			t.Fatalf("expected no percentile for q = %f", q)
+		}
+	}
+	if p100, ok := inm.getInterval().Samples["foo"].Percentile(1); !ok || p100 != 100 {
+		t.Fatalf("bad p100: %f", p100)
+	}
+	if summary.Counters[0].Percentiles != nil {
+		t.Fatalf("counters should not have percentiles: %+v", summary.Counters[0].Percentiles)
+	}
+
+	// retained values are bounded
+	small := NewInmemSink(time.Minute, time.Hour, WithInmemPercentiles(10))
+	sample = small.BuildMetricEmitter(MetricTypeHistogram, []string{"foo"}, nil)
+	for i := 0; i < 1000; i++ {
+		sample(float64(i))
+	}
+	agg := small.getInterval().Samples["foo"].AggregateSample
+	if len(agg.values) != 10 || agg.Count != 1000 {
+		t.Fatalf("bad retained values: %d of %d", len(agg.values), agg.Count)
+	}
+
+	// disabled by default
+	inm = NewInmemSink(time.Minute, time.Hour)
+	inm.BuildMetricEmitter(MetricTypeHistogram, []string{"foo"}, nil)(1)
+	if _, ok := inm.getInterval().Samples["foo"].Percentile(0.5); ok {
+		t.Fatalf("percentiles should be disabled")
+	}
+}
+
+func TestInmemSink_Reset(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+
+	gauge := inm.BuildMetricEmitter(MetricTypeGauge, []string{"foo"}, nil)
+	gauge(1)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"foo"}, nil)(2)
+	inm.BuildMetricEmitter(MetricTypeHistogram, []string{"foo"}, nil)(3)
+	upDown := inm.BuildMetricEmitter(MetricTypeUpDownCounter, []string{"bar"}, nil)
+	upDown(4)
+
+	inm.Reset()
+
+	data := inm.Data()
+	if len(data) != 1 {
+		t.Fatalf("expected only a new current interval: %v", data)
+	}
+	intvM := data[0]
+	if len(intvM.Gauges) != 0 || len(intvM.Counters) != 0 || len(intvM.Samples) != 0 {
+		t.Fatalf("metrics not reset: %v %v %v", intvM.Gauges, intvM.Counters, intvM.Samples)
+	}
+
+	// existing emitters write to the new interval, and totals restart
+	gauge(5)
+	upDown(1)
+	data = inm.Data()
+	if v := data[0].Gauges["foo"].Value; v != 5 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := data[0].Gauges["bar"].Value; v != 1 {
+		t.Fatalf("bad val: %v", v)
+	}
+}
+
+func TestInmemSink_Reset_Race(t *testing.T) {
+	inm := NewInmemSink(time.Millisecond, 10*time.Millisecond)
+	emitter := inm.BuildMetricEmitter(MetricTypeHistogram, []string{"foo"}, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for n := 0; n < 1000; n++ {
+			emitter(float64(n))
+			inm.DisplayMetrics(nil, nil)
+		}
+	}()
+	for n := 0; n < 100; n++ {
+		inm.Reset()
+	}
+	<-done
+}
+
+func TestInmemSink_Dump(t *testing.T) {
+	inm := NewInmemSink(10*time.Millisecond, 50*time.Millisecond)
+	inm.BuildMetricEmitter(MetricTypeGauge, []string{"foo"}, []Label{{"a", "b"}})(42)
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"baz"}, []Label{})(42)
+
+	// Wait for period to end
+	time.Sleep(15 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := inm.Dump(&buf, SignalFormatText); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "[G] 'foo.b': 42") {
+		t.Fatalf("bad: %v", out)
+	}
+	if !strings.Contains(out, "[C] 'baz': Count: 1 Sum: 42") {
+		t.Fatalf("bad: %v", out)
+	}
+
+	buf.Reset()
+	if err := inm.Dump(&buf, SignalFormatJSON); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "{") || !strings.Contains(buf.String(), `"Name":"foo"`) {
+		t.Fatalf("bad: %v", buf.String())
+	}
+}
+
+func TestInmemSink_Buckets(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour, WithInmemBuckets([]float64{10, 1, 5}))
+
+	sample := inm.BuildMetricEmitter(MetricTypeHistogram, []string{"foo"}, nil)
+	for _, v := range []float64{0.5, 1, 3, 7, 10, 20} {
+		sample(v)
+	}
+	inm.BuildMetricEmitter(MetricTypeCounter, []string{"bar"}, nil)(1)
+
+	summary := newMetricSummaryFromInterval(inm.getInterval())
+	expected := []Bucket{{1, 2}, {5, 3}, {10, 5}}
+	if got := summary.Samples[0].Buckets; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("bad buckets: %v", got)
+	}
+	if summary.Counters[0].Buckets != nil {
+		t.Fatalf("counters should not have buckets: %v", summary.Counters[0].Buckets)
+	}
+
+	// disabled by default
+	inm = NewInmemSink(time.Minute, time.Hour)
+	inm.BuildMetricEmitter(MetricTypeHistogram, []string{"foo"}, nil)(1)
+	if b := inm.getInterval().Samples["foo"].BucketCounts(); b != nil {
+		t.Fatalf("buckets should be disabled: %v", b)
+	}
+}
+
+func TestInmemSink_Distribution(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour)
+
+	inm.BuildMetricEmitter(MetricTypeDistribution, []string{"latency"}, nil)(10)
+	inm.BuildMetricEmitter(MetricTypeDistribution, []string{"latency"}, nil)(20)
+	inm.BuildMetricEmitter(MetricTypeHistogram, []string{"latency"}, nil)(5)
+
+	intv := inm.getInterval()
+	if d := intv.Distributions["latency"]; d.AggregateSample == nil || d.Count != 2 || d.Sum != 30 {
+		t.Fatalf("bad distribution: %v", intv.Distributions)
+	}
+	if s := intv.Samples["latency"]; s.AggregateSample == nil || s.Count != 1 || s.Sum != 5 {
+		t.Fatalf("bad sample: %v", intv.Samples)
+	}
+
+	summary := newMetricSummaryFromInterval(intv).filter("", "distribution")
+	if len(summary.Distributions) != 1 || len(summary.Samples) != 0 || summary.Distributions[0].Mean != 15 {
+		t.Fatalf("bad summary: %+v", summary)
+	}
+
+	inm.ForgetMetric(MetricTypeDistribution, []string{"latency"}, nil)
+	if len(intv.Distributions) != 0 || len(intv.Samples) != 1 {
+		t.Fatalf("only the distribution should be forgotten")
+	}
+}
+
 func TestNewInmemSinkFromURL(t *testing.T) {
 	for _, tc := range []struct {
-		desc           string
-		input          string
-		expectErr      string
-		expectInterval time.Duration
-		expectRetain   time.Duration
+		desc              string
+		input             string
+		expectErr         string
+		expectInterval    time.Duration
+		expectRetain      time.Duration
+		expectPercentiles int
+		expectBuckets     []float64
 	}{
 		{
 			desc:           "interval and duration are set via query params",
@@ -131,6 +371,30 @@ func TestNewInmemSinkFromURL(t *testing.T) {
 			expectInterval: duration(t, "11s"),
 			expectRetain:   duration(t, "22s"),
 		},
+		{
+			desc:              "percentile samples are set via query params",
+			input:             "inmem://?interval=11s&retain=22s&percentile_samples=100",
+			expectInterval:    duration(t, "11s"),
+			expectRetain:      duration(t, "22s"),
+			expectPercentiles: 100,
+		},
+		{
+			desc:           "buckets are set via query params",
+			input:          "inmem://?interval=11s&retain=22s&buckets=10,1.5",
+			expectInterval: duration(t, "11s"),
+			expectRetain:   duration(t, "22s"),
+			expectBuckets:  []float64{1.5, 10},
+		},
+		{
+			desc:      "buckets must be numbers",
+			input:     "inmem://?interval=11s&retain=22s&buckets=1,two",
+			expectErr: "Bad 'buckets' param",
+		},
+		{
+			desc:      "percentile samples must be a number",
+			input:     "inmem://?interval=11s&retain=22s&percentile_samples=lots",
+			expectErr: "Bad 'percentile_samples' param",
+		},
 		{
 			desc:      "interval is required",
 			input:     "inmem://?retain=22s",
@@ -173,6 +437,12 @@ func TestNewInmemSinkFromURL(t *testing.T) {
 				if is.retain != tc.expectRetain {
 					t.Fatalf("expected retain %s, got: %s", tc.expectRetain, is.retain)
 				}
+				if is.maxSampleValues != tc.expectPercentiles {
+					t.Fatalf("expected percentile samples %d, got: %d", tc.expectPercentiles, is.maxSampleValues)
+				}
+				if !reflect.DeepEqual(is.sampleBuckets, tc.expectBuckets) {
+					t.Fatalf("expected buckets %v, got: %v", tc.expectBuckets, is.sampleBuckets)
+				}
 			}
 		})
 	}
@@ -192,3 +462,113 @@ func duration(t *testing.T, s string) time.Duration {
 	}
 	return dur
 }
+
+func TestInmemSink_SampleN(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour, WithInmemPercentiles(10), WithInmemBuckets([]float64{1, 10}))
+	met, err := New(inm, func(c *Config) {
+		c.EnableRuntimeMetrics = false
+		c.EnableHostnameLabel = false
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	defer met.Shutdown()
+
+	// the same aggregate as sampling 5 once and 2 four times
+	h := met.NewHistogram("latency")
+	h.Sample(5)
+	h.SampleN(2, 4)
+	met.NewDistribution("size").ObserveN(3, 20)
+
+	agg, ok := inm.SampleStats("latency")
+	if !ok {
+		t.Fatalf("expected the histogram sample")
+	}
+	if agg.Count != 5 || agg.Sum != 13 || agg.SumSq != 41 || agg.Min != 2 || agg.Max != 5 {
+		t.Fatalf("bad aggregate: %s", agg.String())
+	}
+	if stddev := agg.Stddev(); math.Abs(stddev-math.Sqrt(1.8)) > 1e-9 {
+		t.Fatalf("bad stddev: %f", stddev)
+	}
+	buckets := agg.BucketCounts()
+	if buckets[0].Count != 0 || buckets[1].Count != 5 {
+		t.Fatalf("bad buckets: %v", buckets)
+	}
+	if p50, _ := agg.Percentile(0.5); p50 != 2 {
+		t.Fatalf("bad p50: %f", p50)
+	}
+
+	// the retained values are limited as for single samples
+	agg, ok = inm.SampleStats("size")
+	if !ok {
+		t.Fatalf("expected the distribution sample")
+	}
+	if agg.Count != 20 || agg.Sum != 60 || len(agg.values) != 10 {
+		t.Fatalf("bad aggregate: %s, %d values", agg.String(), len(agg.values))
+	}
+
+	// a huge count takes as many steps as values are retained, and almost
+	// surely replaces every earlier value
+	met.NewDistribution("size").ObserveN(4, 1e9)
+	agg, _ = inm.SampleStats("size")
+	if agg.Count != 1e9+20 || len(agg.values) != 10 {
+		t.Fatalf("bad aggregate: %s, %d values", agg.String(), len(agg.values))
+	}
+	for _, v := range agg.values {
+		if v != 4 {
+			t.Fatalf("expected the retained values to be replaced, got %v", agg.values)
+		}
+	}
+}
+
+func TestInmemSink_Lookup(t *testing.T) {
+	inm := NewInmemSink(time.Minute, time.Hour, WithInmemPercentiles(100))
+	met, err := New(inm, func(c *Config) {
+		c.EnableRuntimeMetrics = false
+		c.HostName = "host1"
+		c.ServiceName = "svc"
+		c.EnableServicePrefix = true
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer met.Shutdown()
+
+	met.SetGauge("queue size", 5, L("pool", "a"))
+	met.Incr("requests", 2)
+	met.Incr("requests", 3)
+	met.Sample("latency", 10)
+	met.Sample("latency", 30)
+	met.Observe("size", 7)
+
+	// the labels are matched as enriched, including the host
+	host := L("host", "host1")
+	if v, ok := inm.GaugeValue("svc.queue size", L("pool", "a"), host); !ok || v != 5 {
+		t.Fatalf("bad gauge: %v %v", v, ok)
+	}
+	if _, ok := inm.GaugeValue("svc.queue size", L("pool", "b"), host); ok {
+		t.Fatalf("unexpected gauge")
+	}
+
+	if v, ok := inm.CounterValue("svc.requests", host); !ok || v != 5 {
+		t.Fatalf("bad counter: %v %v", v, ok)
+	}
+	if _, ok := inm.CounterValue("svc.requests"); ok {
+		t.Fatalf("unexpected counter")
+	}
+
+	stats, ok := inm.SampleStats("svc.latency", host)
+	if !ok || stats.Count != 2 || stats.Mean() != 20 {
+		t.Fatalf("bad sample: %v %v", stats.String(), ok)
+	}
+	if p50, _ := stats.Percentile(0.5); p50 != 20 {
+		t.Fatalf("bad p50: %v", p50)
+	}
+
+	if stats, ok := inm.SampleStats("svc.size", host); !ok || stats.Sum != 7 {
+		t.Fatalf("bad distribution: %v %v", stats.String(), ok)
+	}
+	if _, ok := inm.SampleStats("svc.missing", host); ok {
+		t.Fatalf("unexpected sample")
+	}
+}
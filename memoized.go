@@ -1,20 +1,177 @@
 package metrics
 
-import "time"
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type MetricEmitter func(val float64)
 
 type baseMetric struct {
 	drop    bool
 	emitter MetricEmitter
+
+	// set if the sink supports forgetting the series
+	forgetSink ForgetSink
+
+	// what is needed to re-build the emitter once Metrics.SetSink replaces
+	// the sink it was built for, kept as fields rather than a closure to avoid
+	// an allocation for one-liner metrics
+	root    *Metrics
+	gen     uint64 // sink generation of emitter and forgetSink
+	mType   MetricType
+	keys    []string
+	labels  []Label
+	buckets []float64 // set for timer histograms, see NewTimerHistogram
+	rebuilt atomic.Pointer[builtMetric]
+	counted atomic.Pointer[countedMetric] // built on the first emitN
+}
+
+// countedMetric is a metric's emitter of counted values for a sink generation
+type countedMetric struct {
+	gen     uint64
+	emitter MetricEmitterN
+}
+
+// builtMetric is a metric's emitter re-built for a replaced sink
+type builtMetric struct {
+	gen        uint64
+	emitter    MetricEmitter
+	forgetSink ForgetSink
+}
+
+// build sets the emitter for the metric, and what is needed to forget it or
+// re-build it for a replaced sink. The labels may be the caller's, as passed
+// to the constructor, so they are copied to not change if the caller reuses
+// the slice.
+func (m *Metrics) build(b *baseMetric, mType MetricType, keys []string, labels []Label) {
+	root := m.root()
+	b.root = root
+	b.mType = mType
+	b.keys = keys
+	b.labels = append([]Label(nil), labels...)
+
+	// the generation is loaded first, so the emitter is never older than it
+	b.gen = root.sinkGen.Load()
+	sink := root.currentSink()
+	b.emitter = b.buildEmitter(sink)
+	b.forgetSink, _ = sink.(ForgetSink)
+}
+
+// buildEmitter builds the emitter of the metric for the sink
+func (b *baseMetric) buildEmitter(sink MetricSink) MetricEmitter {
+	if b.buckets != nil {
+		return b.buildTimerHistogram(sink)
+	}
+	return sink.BuildMetricEmitter(b.mType, b.keys, b.labels)
+}
+
+// current returns the emitter and forget sink of the metric for the current
+// sink, re-building them if the sink was replaced since
+func (b *baseMetric) current() (MetricEmitter, ForgetSink) {
+	gen := b.root.sinkGen.Load()
+	if gen == b.gen {
+		return b.emitter, b.forgetSink
+	}
+	if r := b.rebuilt.Load(); r != nil && r.gen == gen {
+		return r.emitter, r.forgetSink
+	}
+
+	sink := b.root.currentSink()
+	r := &builtMetric{gen: gen, emitter: b.buildEmitter(sink)}
+	r.forgetSink, _ = sink.(ForgetSink)
+	b.rebuilt.Store(r)
+	return r.emitter, r.forgetSink
+}
+
+// emit sends the value to the current sink
+func (b *baseMetric) emit(val float64) {
+	emitter, _ := b.current()
+	b.root.countEmit(b.mType)
+	emitter(val)
+}
+
+// emitN sends the value observed count times to the current sink
+func (b *baseMetric) emitN(val float64, count int) {
+	if count <= 0 {
+		return
+	}
+
+	gen := b.root.sinkGen.Load()
+	c := b.counted.Load()
+	if c == nil || c.gen != gen {
+		c = &countedMetric{gen: gen, emitter: BuildMetricEmitterN(b.root.currentSink(), b.mType, b.keys, b.labels)}
+		b.counted.Store(c)
+	}
+	b.root.countEmits(b.mType, uint64(count))
+	c.emitter(val, count)
+}
+
+// Forget signals the sink to drop any state it holds for the metric's series,
+// such as a Prometheus series that would otherwise be kept until it expires.
+// Use it when a metric with a short-lived label value will not be emitted
+// again. It is a no-op for sinks that don't keep per-series state. The label
+// set no longer counts towards MaxSeriesPerMetric, even if the metric is
+// emitted to again.
+func (b *baseMetric) Forget() {
+	if b.drop {
+		return
+	}
+
+	b.root.forgetSeries(b.keys, b.labels)
+	if _, fs := b.current(); fs != nil {
+		fs.ForgetMetric(b.mType, b.keys, b.labels)
+	}
+}
+
+// A LastValuer reports the last value a memoized metric emitted, for
+// debugging or deriving other metrics. The gauges and counters returned by
+// NewGauge and NewCounter implement it.
+type LastValuer interface {
+	// LastValue returns the last value emitted, the increment for counters,
+	// and false if nothing was emitted yet or the metric is dropped by filters
+	LastValue() (float64, bool)
+}
+
+// lastValue records the last value a metric emitted
+type lastValue struct {
+	bits    atomic.Uint64 // as float64 bits
+	emitted atomic.Bool
+}
+
+func (l *lastValue) record(val float64) {
+	l.bits.Store(math.Float64bits(val))
+	l.emitted.Store(true)
+}
+
+func (l *lastValue) LastValue() (float64, bool) {
+	if !l.emitted.Load() {
+		return 0, false
+	}
+	return math.Float64frombits(l.bits.Load()), true
 }
 
 type Gauge interface {
 	Set(val float64)
+
+	// Add adjusts the gauge by delta from its last value, as set by Set or Add
+	// on this instance, and emits the new value. Concurrent calls to Set and Add
+	// are serialized along with their emits, so the last value emitted is the
+	// current value of the gauge.
+	Add(delta float64)
+
+	Forget()
 }
 
 type gauge struct {
 	baseMetric
+	lastValue // also the current value Add adjusts
+
+	// lock orders the emits of Set and Add like their updates
+	lock sync.Mutex
 }
 
 func (m *Metrics) NewGauge(key string, labels ...Label) Gauge {
@@ -25,7 +182,7 @@ func (m *Metrics) NewGauge(key string, labels ...Label) Gauge {
 		return g
 	}
 
-	g.emitter = m.sink.BuildMetricEmitter(MetricTypeGauge, keys, labels)
+	m.build(&g.baseMetric, MetricTypeGauge, keys, labels)
 	return g
 }
 
@@ -34,15 +191,46 @@ func (g *gauge) Set(val float64) {
 		return
 	}
 
-	g.emitter(val)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.record(val)
+	g.emit(val)
+}
+
+func (g *gauge) Add(delta float64) {
+	if g.drop {
+		return
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	val := math.Float64frombits(g.bits.Load()) + delta
+	g.record(val)
+	g.emit(val)
 }
 
 type Counter interface {
 	Incr(val float64)
+
+	// Decr decrements the counter by emitting a negative increment. Not all
+	// sinks support negative counter values, the Prometheus sink for example
+	// ignores them since its counters are monotonic.
+	Decr(val float64)
+
+	// Set mirrors an external monotonic source, such as a counter read from
+	// the OS, by emitting the increase since the value of the previous Set.
+	// The first call only records the starting value and emits nothing. A
+	// decrease is taken as a reset of the source: nothing is emitted and the
+	// next increase is counted from the new value.
+	Set(absolute float64)
+
+	Forget()
 }
 
 type counter struct {
 	baseMetric
+	lastValue
+	absolute atomic.Uint64 // complemented float64 bits of the last Set, zero before the first
 }
 
 func (m *Metrics) NewCounter(key string, labels ...Label) Counter {
@@ -53,7 +241,7 @@ func (m *Metrics) NewCounter(key string, labels ...Label) Counter {
 		return c
 	}
 
-	c.emitter = m.sink.BuildMetricEmitter(MetricTypeCounter, keys, labels)
+	m.build(&c.baseMetric, MetricTypeCounter, keys, labels)
 	return c
 }
 
@@ -62,11 +250,43 @@ func (c *counter) Incr(val float64) {
 		return
 	}
 
-	c.emitter(val)
+	c.record(val)
+	c.emit(val)
+}
+
+func (c *counter) Decr(val float64) {
+	if c.drop {
+		return
+	}
+
+	c.record(-val)
+	c.emit(-val)
+}
+
+func (c *counter) Set(absolute float64) {
+	if c.drop || math.IsNaN(absolute) {
+		return
+	}
+
+	// complemented, so only a NaN, which isn't stored, has the zero bits
+	prev := c.absolute.Swap(^math.Float64bits(absolute))
+	if prev == 0 {
+		return
+	}
+	if delta := absolute - math.Float64frombits(^prev); delta > 0 {
+		c.record(delta)
+		c.emit(delta)
+	}
 }
 
 type Timer interface {
 	MeasureSince(start time.Time)
+
+	// MeasureSinceAt records the time elapsed from start to end, for callers
+	// that already know the end time and for exact durations in tests
+	MeasureSinceAt(start, end time.Time)
+
+	Forget()
 }
 
 type timer struct {
@@ -75,16 +295,19 @@ type timer struct {
 }
 
 func (m *Metrics) NewTimer(key string, labels ...Label) Timer {
-	t := &timer{granularity: m.cfg.TimerGranularity}
+	return m.newTimer(key, labels)
+}
+
+func (m *Metrics) newTimer(key string, labels []Label) *timer {
+	t := &timer{granularity: m.cfg.timerGranularity()}
 	allowed, keys, labels := m.enrich("timer", key, labels)
 	if !allowed {
 		t.drop = true
 		return t
 	}
 
-	t.emitter = m.sink.BuildMetricEmitter(MetricTypeTimer, keys, labels)
+	m.build(&t.baseMetric, MetricTypeTimer, keys, labels)
 	return t
-
 }
 
 func (t *timer) MeasureSince(start time.Time) {
@@ -92,21 +315,90 @@ func (t *timer) MeasureSince(start time.Time) {
 		return
 	}
 
-	now := time.Now()
-	elapsed := now.Sub(start)
+	t.MeasureSinceAt(start, t.root.clock().Now())
+}
+
+func (t *timer) MeasureSinceAt(start, end time.Time) {
+	if t.drop {
+		return
+	}
+
+	elapsed := end.Sub(start)
 	msec := float64(elapsed.Nanoseconds()) / float64(t.granularity)
 
-	t.emitter(msec)
+	t.emit(msec)
+}
+
+// A RunningTimer measures the time from its creation until it is stopped,
+// supporting the `defer m.NewTimerStart("key").Stop()` pattern.
+type RunningTimer interface {
+	// Stop records the time elapsed since the timer was started
+	Stop()
+
+	// StopWithLabels records the time elapsed since the timer was started with
+	// additional labels that were not known at start, such as a result code
+	StopWithLabels(labels ...Label)
+}
+
+type runningTimer struct {
+	m      *Metrics
+	key    string
+	labels []Label
+	timer  Timer
+	start  time.Time
+}
+
+// NewTimerStart creates a memoized timer and starts it
+func (m *Metrics) NewTimerStart(key string, labels ...Label) RunningTimer {
+	return &runningTimer{
+		m:      m,
+		key:    key,
+		labels: labels,
+		timer:  m.NewTimer(key, labels...),
+		start:  m.clock().Now(),
+	}
+}
+
+func (r *runningTimer) Stop() {
+	r.timer.MeasureSince(r.start)
+}
+
+func (r *runningTimer) StopWithLabels(labels ...Label) {
+	if len(labels) == 0 {
+		r.Stop()
+		return
+	}
+
+	all := make([]Label, 0, len(r.labels)+len(labels))
+	all = append(all, r.labels...)
+	all = append(all, labels...)
+	r.m.NewTimer(r.key, all...).MeasureSince(r.start)
 }
 
 type Histogram interface {
 	Sample(val float64)
+
+	// SampleN records the value observed count times, in one call to sinks
+	// that support counted values, see CountedSink
+	SampleN(val float64, count int)
+
+	// WithSampleRate returns the histogram sending the given fraction of its
+	// samples, between 0 and 1, skipping the others at random before the
+	// sink. The rate isn't passed on to the sink, so the counts it reports are
+	// scaled down by the rate. The histogram it is called on is not modified.
+	// A NaN rate is ignored and the histogram is returned as is.
+	WithSampleRate(rate float64) Histogram
+
+	Forget()
 }
 
 type histogram struct {
 	baseMetric
 }
 
+// sampleRand returns a random value in [0, 1) for sample rates
+var sampleRand = rand.Float64
+
 func (m *Metrics) NewHistogram(key string, labels ...Label) Histogram {
 	h := &histogram{}
 	allowed, keys, labels := m.enrich("histogram", key, labels)
@@ -115,7 +407,7 @@ func (m *Metrics) NewHistogram(key string, labels ...Label) Histogram {
 		return h
 	}
 
-	h.emitter = m.sink.BuildMetricEmitter(MetricTypeHistogram, keys, labels)
+	m.build(&h.baseMetric, MetricTypeHistogram, keys, labels)
 	return h
 }
 
@@ -124,11 +416,69 @@ func (h *histogram) Sample(val float64) {
 		return
 	}
 
-	h.emitter(val)
+	h.emit(val)
+}
+
+func (h *histogram) SampleN(val float64, count int) {
+	if h.drop {
+		return
+	}
+
+	h.emitN(val, count)
+}
+
+func (h *histogram) WithSampleRate(rate float64) Histogram {
+	if math.IsNaN(rate) || rate >= 1 {
+		return h
+	}
+
+	// a rate of zero sends nothing, like a filtered metric
+	return &sampledHistogram{histogram: h, rate: math.Max(rate, 0)}
+}
+
+// sampledHistogram is a histogram sending a fraction of its samples, see
+// WithSampleRate
+type sampledHistogram struct {
+	*histogram
+	rate float64
+}
+
+func (s *sampledHistogram) Sample(val float64) {
+	if s.drop || !s.sampled() {
+		return
+	}
+
+	s.emit(val)
+}
+
+func (s *sampledHistogram) SampleN(val float64, count int) {
+	// the observations are kept or skipped together
+	if s.drop || !s.sampled() {
+		return
+	}
+
+	s.emitN(val, count)
+}
+
+// sampled returns whether to send a sample under the sample rate
+func (s *sampledHistogram) sampled() bool {
+	return s.rate > 0 && sampleRand() < s.rate
+}
+
+func (s *sampledHistogram) WithSampleRate(rate float64) Histogram {
+	if math.IsNaN(rate) {
+		return s
+	}
+	return s.histogram.WithSampleRate(rate)
 }
 
 type Distribution interface {
 	Observe(val float64)
+
+	// ObserveN records the value observed count times, see Histogram.SampleN
+	ObserveN(val float64, count int)
+
+	Forget()
 }
 
 type distribution struct {
@@ -143,7 +493,7 @@ func (m *Metrics) NewDistribution(key string, labels ...Label) Distribution {
 		return d
 	}
 
-	d.emitter = m.sink.BuildMetricEmitter(MetricTypeDistribution, keys, labels)
+	m.build(&d.baseMetric, MetricTypeDistribution, keys, labels)
 	return d
 }
 
@@ -152,5 +502,45 @@ func (d *distribution) Observe(val float64) {
 		return
 	}
 
-	d.emitter(val)
+	d.emit(val)
+}
+
+func (d *distribution) ObserveN(val float64, count int) {
+	if d.drop {
+		return
+	}
+
+	d.emitN(val, count)
+}
+
+// An UpDownCounter tracks a value that may go up or down, such as a queue depth
+// or the number of active connections. Each call to Add emits the delta and
+// sinks maintain the running total for the series, e.g. as a Prometheus gauge.
+type UpDownCounter interface {
+	Add(delta float64)
+	Forget()
+}
+
+type upDownCounter struct {
+	baseMetric
+}
+
+func (m *Metrics) NewUpDownCounter(key string, labels ...Label) UpDownCounter {
+	u := &upDownCounter{}
+	allowed, keys, labels := m.enrich("updowncounter", key, labels)
+	if !allowed {
+		u.drop = true
+		return u
+	}
+
+	m.build(&u.baseMetric, MetricTypeUpDownCounter, keys, labels)
+	return u
+}
+
+func (u *upDownCounter) Add(delta float64) {
+	if u.drop {
+		return
+	}
+
+	u.emit(delta)
 }
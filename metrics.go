@@ -1,6 +1,9 @@
 package metrics
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // Proxy all the methods to the globalMetrics instance
 func (m *Metrics) SetGauge(key string, val float64, labels ...Label) {
@@ -11,6 +14,10 @@ func (m *Metrics) Incr(key string, val float64, labels ...Label) {
 	m.NewCounter(key, labels...).Incr(val)
 }
 
+func (m *Metrics) Decr(key string, val float64, labels ...Label) {
+	m.NewCounter(key, labels...).Decr(val)
+}
+
 func (m *Metrics) Sample(key string, val float64, labels ...Label) {
 	m.NewHistogram(key, labels...).Sample(val)
 }
@@ -19,25 +26,230 @@ func (m *Metrics) MeasureSince(key string, start time.Time, labels ...Label) {
 	m.NewTimer(key, labels...).MeasureSince(start)
 }
 
+// MeasureSinceAt records the time elapsed from start to end as a timer
+func (m *Metrics) MeasureSinceAt(key string, start, end time.Time, labels ...Label) {
+	m.newTimer(key, labels).MeasureSinceAt(start, end)
+}
+
+// Time records how long fn takes to run as a timer. The duration is recorded
+// even if fn panics.
+func (m *Metrics) Time(key string, fn func(), labels ...Label) {
+	defer m.NewTimerStart(key, labels...).Stop()
+	fn()
+}
+
+// TimeErr records how long fn takes to run as a timer and returns its error.
+// The duration is recorded even if fn panics.
+func (m *Metrics) TimeErr(key string, fn func() error, labels ...Label) error {
+	defer m.NewTimerStart(key, labels...).Stop()
+	return fn()
+}
+
 func (m *Metrics) Observe(key string, val float64, labels ...Label) {
 	m.NewDistribution(key, labels...).Observe(val)
 }
 
-func (m *Metrics) Shutdown() {
-	if m.runtimeMetricsCancel != nil {
-		m.runtimeMetricsCancel()
-		m.runtimeWaitG.Wait()
+// SetGaugeCtx is SetGauge with labels from the Config.ContextLabeler. Nothing
+// is emitted if ctx is done.
+func (m *Metrics) SetGaugeCtx(ctx context.Context, key string, val float64, labels ...Label) {
+	if labels, ok := m.contextLabels(ctx, labels); ok {
+		m.SetGauge(key, val, labels...)
 	}
-	if m.persistedPublishCancel != nil {
-		m.persistedPublishCancel()
-		m.persistedPublishWaitG.Wait()
+}
+
+// IncrCtx is Incr with labels from the Config.ContextLabeler. Nothing is
+// emitted if ctx is done.
+func (m *Metrics) IncrCtx(ctx context.Context, key string, val float64, labels ...Label) {
+	if labels, ok := m.contextLabels(ctx, labels); ok {
+		m.Incr(key, val, labels...)
 	}
+}
 
-	if ss, ok := m.sink.(ShutdownSink); ok {
-		ss.Shutdown()
+// DecrCtx is Decr with labels from the Config.ContextLabeler. Nothing is
+// emitted if ctx is done.
+func (m *Metrics) DecrCtx(ctx context.Context, key string, val float64, labels ...Label) {
+	if labels, ok := m.contextLabels(ctx, labels); ok {
+		m.Decr(key, val, labels...)
 	}
 }
 
+// SampleCtx is Sample with labels from the Config.ContextLabeler. Nothing is
+// emitted if ctx is done.
+func (m *Metrics) SampleCtx(ctx context.Context, key string, val float64, labels ...Label) {
+	if labels, ok := m.contextLabels(ctx, labels); ok {
+		m.Sample(key, val, labels...)
+	}
+}
+
+// MeasureSinceCtx is MeasureSince with labels from the Config.ContextLabeler.
+// Nothing is emitted if ctx is done.
+func (m *Metrics) MeasureSinceCtx(ctx context.Context, key string, start time.Time, labels ...Label) {
+	if labels, ok := m.contextLabels(ctx, labels); ok {
+		m.MeasureSince(key, start, labels...)
+	}
+}
+
+// ObserveCtx is Observe with labels from the Config.ContextLabeler. Nothing is
+// emitted if ctx is done.
+func (m *Metrics) ObserveCtx(ctx context.Context, key string, val float64, labels ...Label) {
+	if labels, ok := m.contextLabels(ctx, labels); ok {
+		m.Observe(key, val, labels...)
+	}
+}
+
+// contextLabels returns the labels followed by those from the ContextLabeler,
+// or false if ctx is done
+func (m *Metrics) contextLabels(ctx context.Context, labels []Label) ([]Label, bool) {
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	if m.cfg.ContextLabeler == nil {
+		return labels, true
+	}
+
+	extra := m.cfg.ContextLabeler(ctx)
+	if len(extra) == 0 {
+		return labels, true
+	}
+	all := make([]Label, 0, len(labels)+len(extra))
+	all = append(all, labels...)
+	return append(all, extra...), true
+}
+
+// With returns a scoped view of m whose metrics include the given labels,
+// ahead of any per-call labels. The view shares the sink, filters, and config
+// of m, which is not modified. Calling With on a view accumulates labels.
+func (m *Metrics) With(labels ...Label) *Metrics {
+	labels, opts := stripLabelOptions(labels)
+	scoped := make([]Label, 0, len(m.scopeLabels)+len(labels))
+	scoped = append(scoped, m.scopeLabels...)
+	scoped = append(scoped, labels...)
+
+	v := m.view()
+	v.scopeLabels = scoped
+	if opts.noHost {
+		v.cfg.EnableHostnameLabel = false
+	}
+	v.cfg.BaseLabels = withoutLabels(v.cfg.BaseLabels, opts.without)
+	return v
+}
+
+// WithPrefix returns a scoped view of m that prefixes every key with the given
+// prefix, dot-joined, before any service or type prefix is added. The view
+// shares the sink, filters, and config of m, which is not modified. Calling
+// WithPrefix on a view accumulates prefixes.
+func (m *Metrics) WithPrefix(prefix string) *Metrics {
+	v := m.view()
+	switch {
+	case prefix == "":
+	case v.scopePrefix == "":
+		v.scopePrefix = prefix
+	default:
+		v.scopePrefix = v.scopePrefix + "." + prefix
+	}
+	return v
+}
+
+// WithPersistInterval returns a scoped view of m whose persisted and aggregated
+// metrics publish on the given interval instead of the PersistentInterval, for
+// example to publish costly metrics less often. A zero interval restores the
+// PersistentInterval. Pass WithInterval to set the interval of a single
+// metric instead. Per-metric intervals only apply while the publisher is
+// enabled with a non-zero PersistentInterval.
+func (m *Metrics) WithPersistInterval(interval time.Duration) *Metrics {
+	v := m.view()
+	v.persistInterval = interval
+	return v
+}
+
+// view creates a scoped view of m with the same scope as m
+func (m *Metrics) view() *Metrics {
+	return &Metrics{
+		cfg:             m.cfg,
+		parent:          m.root(),
+		scopeLabels:     m.scopeLabels,
+		scopePrefix:     m.scopePrefix,
+		persistInterval: m.persistInterval,
+	}
+}
+
+// root returns the instance owning shared state, which is m unless m is a
+// scoped view
+func (m *Metrics) root() *Metrics {
+	if m.parent != nil {
+		return m.parent
+	}
+	return m
+}
+
+// SetSink replaces the sink metrics are emitted to, e.g. after reloading the
+// configuration, and shuts down the previous sink if it's a ShutdownSink,
+// returning its error. Memoized metrics, including persisted, runtime, and
+// process metrics, switch to the new sink on their next emit. Values emitted
+// concurrently with the switch may still reach the previous sink, and are
+// lost if it was shut down. Calling SetSink on a scoped view replaces the sink
+// of the instance it was created from.
+func (m *Metrics) SetSink(sink MetricSink) error {
+	r := m.root()
+	r.sinkLock.Lock()
+	defer r.sinkLock.Unlock()
+
+	prev := r.configuredSink()
+	r.setSink.Store(&sink)
+	// after the sink is stored, so a metric never builds an emitter for an
+	// older sink than the generation it records
+	r.sinkGen.Add(1)
+
+	if ss, ok := prev.(ShutdownSink); ok {
+		return ss.Shutdown()
+	}
+	return nil
+}
+
+// currentSink returns the sink to emit to: the configured sink, or the
+// recording sink of a DryRun
+func (m *Metrics) currentSink() MetricSink {
+	if d := m.root().dryRun; d != nil {
+		return d
+	}
+	return m.configuredSink()
+}
+
+// configuredSink returns the sink set by SetSink, or the sink passed to New
+func (m *Metrics) configuredSink() MetricSink {
+	r := m.root()
+	if s := r.setSink.Load(); s != nil {
+		return *s
+	}
+	return r.sink
+}
+
+// Shutdown stops background collection and shuts down the sink, returning
+// any error the sink reports while flushing. Repeated calls are no-ops that
+// return the result of the first. Calling Shutdown on a scoped view is a
+// no-op, the instance it was created from must be shut down instead.
+func (m *Metrics) Shutdown() error {
+	if m.parent != nil {
+		return nil
+	}
+
+	m.shutdownOnce.Do(func() {
+		if m.runtimeMetricsCancel != nil {
+			m.runtimeMetricsCancel()
+			m.runtimeWaitG.Wait()
+		}
+		if m.persistedPublishCancel != nil {
+			m.persistedPublishCancel()
+			m.persistedPublishWaitG.Wait()
+		}
+
+		if ss, ok := m.configuredSink().(ShutdownSink); ok {
+			m.shutdownErr = ss.Shutdown()
+		}
+	})
+	return m.shutdownErr
+}
+
 // Creates a new slice with the provided string value as the first element
 // and the provided slice values as the remaining values.
 // Ordering of the values in the provided input slice is kept in tact in the output slice.
@@ -1,7 +1,12 @@
 package metrics
 
 import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -85,6 +90,65 @@ func TestMetrics_SetGauge(t *testing.T) {
 	}
 }
 
+func TestMetrics_Gauge_Add(t *testing.T) {
+	m, met := mockMetric(t)
+
+	g := met.NewGauge("inflight")
+	g.Add(1)
+	g.Add(1)
+	g.Add(-1)
+	g.Set(10)
+	g.Add(2.5)
+	require.Equal(t, []float64{1, 2, 1, 10, 12.5}, m.vals)
+
+	// concurrent adds compose
+	g.Set(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				g.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, float64(1000), m.vals[len(m.vals)-1])
+}
+
+func TestMetrics_LastValue(t *testing.T) {
+	met, err := New(&MockSink{}, func(c *Config) {
+		c.EnableRuntimeMetrics = false
+		c.BlockedPrefixes = []string{"debug"}
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	g := met.NewGauge("inflight").(LastValuer)
+	_, ok := g.LastValue()
+	require.False(t, ok)
+	g.(Gauge).Set(3)
+	g.(Gauge).Add(2)
+	val, ok := g.LastValue()
+	require.True(t, ok)
+	require.Equal(t, float64(5), val)
+
+	// counters report the last increment
+	c := met.NewCounter("requests")
+	c.Incr(4)
+	c.Decr(1)
+	val, ok = c.(LastValuer).LastValue()
+	require.True(t, ok)
+	require.Equal(t, float64(-1), val)
+
+	// nothing is emitted for a filtered metric
+	dropped := met.NewGauge("debug.inflight")
+	dropped.Set(1)
+	_, ok = dropped.(LastValuer).LastValue()
+	require.False(t, ok)
+}
+
 func TestMetrics_Incr(t *testing.T) {
 	m, met := mockMetric(t)
 	met.Incr("key", float64(1))
@@ -129,6 +193,126 @@ func TestMetrics_Incr(t *testing.T) {
 	}
 }
 
+func TestMetrics_Decr(t *testing.T) {
+	m, met := mockMetric(t)
+	labels := []Label{{"a", "b"}}
+	met.Decr("key", float64(2), labels...)
+	require.Equal(t, []string{"key"}, m.getKeys()[0])
+	require.Equal(t, float64(-2), m.vals[0])
+	require.Equal(t, labels, m.labels[0])
+
+	c := met.NewCounter("ckey")
+	c.Incr(3)
+	c.Decr(1)
+	require.Equal(t, float64(3), m.vals[1])
+	require.Equal(t, float64(-1), m.vals[2])
+
+	m, met = mockMetric(t, func(c *Config) {
+		c.FilterDefault = false
+	})
+	met.Decr("key", float64(1))
+	require.Empty(t, m.getKeys())
+}
+
+func TestMetrics_CounterSet(t *testing.T) {
+	m, met := mockMetric(t)
+	c := met.NewCounter("bytes")
+
+	c.Set(100) // the starting value
+	c.Set(150)
+	c.Set(150) // unchanged
+	c.Set(175.5)
+	c.Set(20) // a reset of the source
+	c.Set(30)
+	c.Set(math.NaN())
+	c.Set(31)
+
+	require.Equal(t, []float64{50, 25.5, 10, 1}, m.vals)
+	val, ok := c.(LastValuer).LastValue()
+	require.True(t, ok)
+	require.Equal(t, float64(1), val)
+}
+
+func TestMetrics_UpDownCounter(t *testing.T) {
+	m, met := mockMetric(t)
+	labels := []Label{{"a", "b"}}
+	u := met.NewUpDownCounter("key", labels...)
+	u.Add(2)
+	u.Add(-1)
+	require.Equal(t, []string{"key"}, m.getKeys()[0])
+	require.Equal(t, float64(2), m.vals[0])
+	require.Equal(t, float64(-1), m.vals[1])
+	require.Equal(t, labels, m.labels[0])
+
+	m, met = mockMetric(t, func(c *Config) {
+		c.EnableTypePrefix = true
+	})
+	met.NewUpDownCounter("key").Add(1)
+	require.Equal(t, []string{"updowncounter", "key"}, m.getKeys()[0])
+
+	m, met = mockMetric(t, func(c *Config) {
+		c.FilterDefault = false
+	})
+	met.NewUpDownCounter("key").Add(1)
+	require.Empty(t, m.getKeys())
+}
+
+func TestMetrics_Histogram_WithSampleRate(t *testing.T) {
+	// the random values cycle through 0, 0.1, ... 0.9
+	var n int
+	sampleRand = func() float64 {
+		n++
+		return float64(n%10) / 10
+	}
+	defer func() { sampleRand = rand.Float64 }()
+
+	m, met := mockMetric(t)
+	h := met.NewHistogram("latency").WithSampleRate(0.3)
+	all := met.NewHistogram("all").WithSampleRate(1)
+	none := met.NewHistogram("none").WithSampleRate(0)
+	for i := 0; i < 100; i++ {
+		h.Sample(1)
+		all.Sample(1)
+		none.Sample(1)
+	}
+
+	counts := map[string]int{}
+	for _, k := range m.getKeys() {
+		counts[k[0]]++
+	}
+	require.Equal(t, map[string]int{"latency": 30, "all": 100}, counts)
+}
+
+func TestMetrics_Histogram_WithSampleRate_View(t *testing.T) {
+	sampleRand = func() float64 { return 0.5 }
+	defer func() { sampleRand = rand.Float64 }()
+
+	m, met := mockMetric(t)
+	h := met.NewHistogram("latency")
+	none := h.WithSampleRate(0)
+	half := h.WithSampleRate(0.9).WithSampleRate(0.4)
+
+	// the histograms sampled from are not modified, and NaN rates are ignored
+	h.Sample(1)
+	h.WithSampleRate(math.NaN()).Sample(2)
+	none.Sample(3)
+	none.WithSampleRate(math.NaN()).SampleN(4, 2)
+	half.Sample(5)
+	half.WithSampleRate(1).Sample(6)
+
+	require.Equal(t, []float64{1, 2, 6}, m.vals)
+}
+
+func TestMetrics_SampleN(t *testing.T) {
+	// the mock sink isn't a CountedSink, so values are emitted count times
+	m, met := mockMetric(t)
+	met.NewHistogram("latency").SampleN(2, 3)
+	met.NewDistribution("size").ObserveN(5, 2)
+	met.NewHistogram("none").SampleN(1, 0)
+
+	require.Equal(t, []float64{2, 2, 2, 5, 5}, m.vals)
+}
+
 func TestMetrics_Sample(t *testing.T) {
 	m, met := mockMetric(t)
 	met.Sample("key", float64(1))
@@ -223,6 +407,306 @@ func TestMetrics_MeasureSince(t *testing.T) {
 	}
 }
 
+func TestMetrics_MeasureSinceAt(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.TimerGranularity = time.Millisecond
+	})
+	start := time.Now()
+	met.MeasureSinceAt("key", start, start.Add(1500*time.Microsecond), L("a", "b"))
+	met.NewTimer("key").MeasureSinceAt(start, start.Add(time.Second))
+
+	require.Equal(t, [][]string{{"key"}, {"key"}}, m.getKeys())
+	require.Equal(t, []float64{1.5, 1000}, m.vals)
+	require.Equal(t, []Label{L("a", "b")}, m.labels[0])
+}
+
+func TestMetrics_MeasureSince_ZeroGranularity(t *testing.T) {
+	m := &MockSink{}
+	met := &Metrics{cfg: Config{FilterDefault: true}, sink: m}
+
+	met.MeasureSince("key", time.Now().Add(-2*time.Millisecond))
+	require.Len(t, m.vals, 1)
+	require.False(t, math.IsInf(m.vals[0], 0) || math.IsNaN(m.vals[0]), "value is not finite: %f", m.vals[0])
+	require.GreaterOrEqual(t, m.vals[0], float64(2))
+}
+
+func TestMetrics_NewTimerStart(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.TimerGranularity = time.Millisecond
+	})
+	labels := []Label{{"a", "b"}}
+
+	func() {
+		defer met.NewTimerStart("key", labels...).Stop()
+		time.Sleep(2 * time.Millisecond)
+	}()
+	require.Equal(t, []string{"key"}, m.getKeys()[0])
+	require.Equal(t, labels, m.labels[0])
+	require.GreaterOrEqual(t, m.vals[0], 2.0)
+
+	rt := met.NewTimerStart("key", labels...)
+	rt.StopWithLabels(L("code", "200"))
+	require.Equal(t, []string{"key"}, m.getKeys()[1])
+	require.Equal(t, []Label{{"a", "b"}, {"code", "200"}}, m.labels[1])
+	require.Less(t, m.vals[1], 0.5)
+
+	// filtered timers are a no-op
+	m, met = mockMetric(t, func(c *Config) {
+		c.TimerGranularity = time.Millisecond
+		c.FilterDefault = false
+	})
+	met.NewTimerStart("key").Stop()
+	require.Empty(t, m.getKeys())
+}
+
+func TestMetrics_Time(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.TimerGranularity = time.Millisecond
+	})
+	labels := []Label{{"a", "b"}}
+
+	met.Time("key", func() {
+		time.Sleep(2 * time.Millisecond)
+	}, labels...)
+	require.Equal(t, []string{"key"}, m.getKeys()[0])
+	require.Equal(t, labels, m.labels[0])
+	require.GreaterOrEqual(t, m.vals[0], 2.0)
+
+	// recorded even on panic
+	require.Panics(t, func() {
+		met.Time("key", func() {
+			panic("boom")
+		})
+	})
+	require.Len(t, m.getKeys(), 2)
+}
+
+func TestMetrics_TimeErr(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.TimerGranularity = time.Millisecond
+	})
+
+	errBoom := errors.New("boom")
+	err := met.TimeErr("key", func() error {
+		return errBoom
+	})
+	require.Equal(t, errBoom, err)
+	require.Equal(t, []string{"key"}, m.getKeys()[0])
+
+	err = met.TimeErr("key", func() error {
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, m.getKeys(), 2)
+
+	require.Panics(t, func() {
+		_ = met.TimeErr("key", func() error {
+			panic("boom")
+		})
+	})
+	require.Len(t, m.getKeys(), 3)
+
+	// filtered timers are not recorded, but fn still runs
+	m, met = mockMetric(t, func(c *Config) {
+		c.TimerGranularity = time.Millisecond
+		c.FilterDefault = false
+	})
+	ran := false
+	err = met.TimeErr("key", func() error {
+		ran = true
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, ran)
+	require.Empty(t, m.getKeys())
+}
+
+func TestMetrics_With(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.BaseLabels = []Label{L("base", "1")}
+	})
+
+	tenant := met.With(L("tenant", "t1"))
+	tenant.Incr("key", 1, L("call", "c1"))
+	require.Equal(t, []Label{L("tenant", "t1"), L("call", "c1"), L("base", "1")}, m.labels[0])
+
+	// nested views accumulate labels
+	shard := tenant.With(L("shard", "s1"))
+	shard.NewGauge("key").Set(2)
+	require.Equal(t, []Label{L("tenant", "t1"), L("shard", "s1"), L("base", "1")}, m.labels[1])
+
+	// neither the parent nor the first view are modified
+	met.Incr("key", 1)
+	require.Equal(t, []Label{L("base", "1")}, m.labels[2])
+	tenant.Incr("key", 1)
+	require.Equal(t, []Label{L("tenant", "t1"), L("base", "1")}, m.labels[3])
+
+	// persisted metrics created from a view are published by the parent
+	pg := shard.NewPersistentGauge("pkey", nil)
+	pg.Set(5)
+	met.publishPersistedMetrics()
+	require.Equal(t, []string{"pkey"}, m.keys[4])
+	require.Equal(t, float64(5), m.vals[4])
+	require.Equal(t, []Label{L("tenant", "t1"), L("shard", "s1"), L("base", "1")}, m.labels[4])
+	pg.Stop()
+
+	// shutting down a view leaves the sink alone
+	shard.Shutdown()
+	require.False(t, m.shutdown)
+}
+
+func TestMetrics_With_Filters(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(cfg *Config) {
+		cfg.EnableHostnameLabel = false
+		cfg.EnableRuntimeMetrics = false
+		cfg.BlockedPrefixes = []string{"blocked"}
+		cfg.BlockedLabels = []string{"secret"}
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		met.Shutdown()
+	})
+
+	view := met.With(L("secret", "x"), L("ok", "y"))
+	view.Incr("blocked.key", 1)
+	require.Empty(t, m.getKeys())
+
+	view.Incr("allowed.key", 1)
+	require.Equal(t, []Label{L("ok", "y")}, m.labels[0])
+}
+
+func TestMetrics_Forget(t *testing.T) {
+	m, met := mockMetric(t)
+
+	g := met.NewGauge("gkey", L("request", "1"))
+	g.Set(1)
+	g.Forget()
+	require.Equal(t, [][]string{{"gkey"}}, m.forgotten)
+
+	met.NewCounter("ckey").Forget()
+	met.NewTimer("tkey").Forget()
+	met.NewHistogram("hkey").Forget()
+	met.NewDistribution("dkey").Forget()
+	met.NewUpDownCounter("ukey").Forget()
+	require.Equal(t, [][]string{{"gkey"}, {"ckey"}, {"tkey"}, {"hkey"}, {"dkey"}, {"ukey"}}, m.forgotten)
+
+	// dropped metrics are never forgotten
+	m, met = mockMetric(t, func(c *Config) {
+		c.FilterDefault = false
+	})
+	met.NewGauge("gkey").Forget()
+	require.Empty(t, m.forgotten)
+
+	// sinks without per-series state are unaffected
+	met = &Metrics{cfg: Config{FilterDefault: true}, sink: &BlackholeSink{}}
+	met.NewGauge("gkey").Forget()
+}
+
+func TestMetrics_Ctx(t *testing.T) {
+	type tenantKey struct{}
+	m, met := mockMetric(t, func(c *Config) {
+		c.ContextLabeler = func(ctx context.Context) []Label {
+			if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+				return []Label{L("tenant", tenant)}
+			}
+			return nil
+		}
+	})
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	met.IncrCtx(ctx, "ckey", 1, L("code", "200"))
+	met.SetGaugeCtx(ctx, "gkey", 2)
+	met.SampleCtx(context.Background(), "hkey", 3, L("code", "200"))
+	require.Equal(t, [][]string{{"ckey"}, {"gkey"}, {"hkey"}}, m.keys)
+	require.Equal(t, []float64{1, 2, 3}, m.vals)
+	require.Equal(t, [][]Label{
+		{L("code", "200"), L("tenant", "acme")},
+		{L("tenant", "acme")},
+		{L("code", "200")},
+	}, m.labels)
+
+	// nothing is emitted once the context is done
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	met.IncrCtx(cancelled, "ckey", 1)
+	met.DecrCtx(cancelled, "ckey", 1)
+	met.ObserveCtx(cancelled, "dkey", 1)
+	met.MeasureSinceCtx(cancelled, "tkey", time.Now())
+	require.Len(t, m.keys, 3)
+}
+
+func TestMetrics_SetSink(t *testing.T) {
+	m1, met := mockMetric(t)
+
+	c := met.NewCounter("ckey")
+	view := met.With(L("tenant", "a"))
+	c.Incr(1)
+	view.Incr("vkey", 1)
+	require.Equal(t, [][]string{{"ckey"}, {"vkey"}}, m1.keys)
+
+	m2 := &MockSink{}
+	require.NoError(t, view.SetSink(m2))
+	require.True(t, m1.shutdown)
+
+	// memoized metrics switch to the new sink
+	c.Incr(2)
+	c.Forget()
+	met.Incr("ckey", 3)
+	view.Incr("vkey", 4)
+	require.Len(t, m1.keys, 2)
+	require.Equal(t, [][]string{{"ckey"}, {"ckey"}, {"vkey"}}, m2.keys)
+	require.Equal(t, []float64{2, 3, 4}, m2.vals)
+	require.Equal(t, [][]string{{"ckey"}}, m2.forgotten)
+	require.Empty(t, m1.forgotten)
+
+	// the error shutting down the previous sink is returned
+	errFailed := errors.New("failed")
+	m2.shutdownErr = errFailed
+	require.ErrorIs(t, met.SetSink(&BlackholeSink{}), errFailed)
+	c.Incr(5)
+	require.Len(t, m2.keys, 3)
+}
+
+func TestMetrics_SetSink_CallerLabels(t *testing.T) {
+	_, met := mockMetric(t)
+	labels := []Label{L("tenant", "a")}
+	c := met.NewCounter("ckey", labels...)
+
+	// the caller reusing its labels doesn't change the re-built metric
+	labels[0] = L("tenant", "b")
+	m2 := &MockSink{}
+	require.NoError(t, met.SetSink(m2))
+	c.Incr(1)
+	c.Forget()
+	require.Equal(t, [][]Label{{L("tenant", "a")}}, m2.labels)
+}
+
+func TestMetrics_SetSink_Race(t *testing.T) {
+	_, met := mockMetric(t)
+	c := met.NewCounter("ckey")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Incr(1)
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, met.SetSink(&MockSink{}))
+	}
+	wg.Wait()
+
+	last := &MockSink{}
+	require.NoError(t, met.SetSink(last))
+	c.Incr(1)
+	require.Equal(t, []float64{1}, last.vals)
+}
+
 func TestInsert(t *testing.T) {
 	k := []string{"hi", "bob"}
 	exp := []string{"hi", "there", "bob"}
@@ -0,0 +1,183 @@
+// Package metricstest provides a sink recording the metrics it receives, with
+// assertion helpers for tests of instrumented code.
+//
+//	sink := metricstest.NewSink()
+//	met, _ := metrics.New(sink, func(c *metrics.Config) {
+//		c.EnableRuntimeMetrics = false
+//		c.EnableHostnameLabel = false
+//	})
+//	met.Incr("requests", 1, metrics.L("code", "200"))
+//	sink.AssertCounter(t, "requests", []metrics.Label{metrics.L("code", "200")}, 1)
+package metricstest
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	metrics "github.com/mheffner/go-simple-metrics"
+)
+
+// Series is what a Sink recorded for a metric type, key, and label set
+type Series struct {
+	Type   metrics.MetricType
+	Keys   []string
+	Labels []metrics.Label
+	Values []float64 // Every value emitted, in order
+	Sum    float64   // The sum of the values, the total of counters
+}
+
+// Last returns the last value emitted, the value of gauges
+func (s Series) Last() float64 {
+	if len(s.Values) == 0 {
+		return 0
+	}
+	return s.Values[len(s.Values)-1]
+}
+
+// Sink is a metrics.MetricSink recording every value it receives. Series are
+// looked up by their type, dot-joined key, and labels in any order. It is
+// safe for concurrent use.
+type Sink struct {
+	lock   sync.Mutex
+	series map[string]*Series
+	counts map[string]int // number of values by type and key, of all label sets
+}
+
+// NewSink returns an empty Sink
+func NewSink() *Sink {
+	return &Sink{series: make(map[string]*Series), counts: make(map[string]int)}
+}
+
+func (s *Sink) BuildMetricEmitter(mType metrics.MetricType, keys []string, labels []metrics.Label) metrics.MetricEmitter {
+	key := strings.Join(keys, ".")
+	id := seriesID(mType, key, labels)
+	count := countID(mType, key)
+
+	s.lock.Lock()
+	series, ok := s.series[id]
+	if !ok {
+		series = &Series{
+			Type:   mType,
+			Keys:   append([]string(nil), keys...),
+			Labels: append([]metrics.Label(nil), labels...),
+		}
+		s.series[id] = series
+	}
+	s.lock.Unlock()
+
+	return func(val float64) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		series.Values = append(series.Values, val)
+		series.Sum += val
+		s.counts[count]++
+	}
+}
+
+// Series returns a copy of the series of the type, dot-joined key, and labels,
+// and false if the sink has no such series
+func (s *Sink) Series(mType metrics.MetricType, key string, labels ...metrics.Label) (Series, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	series, ok := s.series[seriesID(mType, key, labels)]
+	if !ok {
+		return Series{}, false
+	}
+
+	c := *series
+	c.Values = append([]float64(nil), series.Values...)
+	return c, true
+}
+
+// Count returns the number of values emitted of the type and key, of all
+// label sets
+func (s *Sink) Count(mType metrics.MetricType, key string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[countID(mType, key)]
+}
+
+// Reset drops everything recorded. Emitters built before keep recording into
+// series that are no longer looked up, so memoized metrics should be created
+// again.
+func (s *Sink) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.series = make(map[string]*Series)
+	s.counts = make(map[string]int)
+}
+
+// AssertCounter reports an error if the total of the counter differs from
+// expected, or if it wasn't emitted
+func (s *Sink) AssertCounter(t testing.TB, key string, labels []metrics.Label, expected float64) {
+	t.Helper()
+	series, ok := s.Series(metrics.MetricTypeCounter, key, labels...)
+	if !ok {
+		t.Errorf("counter %s%v wasn't emitted", key, labels)
+		return
+	}
+	if series.Sum != expected {
+		t.Errorf("counter %s%v is %v, expected %v", key, labels, series.Sum, expected)
+	}
+}
+
+// AssertGauge reports an error if the last value of the gauge differs from
+// expected, or if it wasn't emitted
+func (s *Sink) AssertGauge(t testing.TB, key string, labels []metrics.Label, expected float64) {
+	t.Helper()
+	series, ok := s.Series(metrics.MetricTypeGauge, key, labels...)
+	if !ok {
+		t.Errorf("gauge %s%v wasn't emitted", key, labels)
+		return
+	}
+	if last := series.Last(); last != expected {
+		t.Errorf("gauge %s%v is %v, expected %v", key, labels, last, expected)
+	}
+}
+
+// AssertHistogramCount reports an error if the number of observations of the
+// histogram, of all label sets, differs from n. Timers and distributions are
+// counted as histograms.
+func (s *Sink) AssertHistogramCount(t testing.TB, key string, n int) {
+	t.Helper()
+	count := s.Count(metrics.MetricTypeHistogram, key) +
+		s.Count(metrics.MetricTypeTimer, key) +
+		s.Count(metrics.MetricTypeDistribution, key)
+	if count != n {
+		t.Errorf("histogram %s has %d observations, expected %d", key, count, n)
+	}
+}
+
+// AssertNotEmitted reports an error if a metric of the key was emitted
+func (s *Sink) AssertNotEmitted(t testing.TB, key string) {
+	t.Helper()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, series := range s.series {
+		if strings.Join(series.Keys, ".") == key && len(series.Values) > 0 {
+			t.Errorf("%s%v was emitted %d times, expected none", key, series.Labels, len(series.Values))
+			return
+		}
+	}
+}
+
+// seriesID identifies a series by type, key, and labels sorted by name
+func seriesID(mType metrics.MetricType, key string, labels []metrics.Label) string {
+	sorted := append([]metrics.Label(nil), labels...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var id strings.Builder
+	id.WriteString(countID(mType, key))
+	for _, label := range sorted {
+		id.WriteString("\x00" + label.Name + "=" + label.Value)
+	}
+	return id.String()
+}
+
+// countID identifies the series of a type and key, of all label sets
+func countID(mType metrics.MetricType, key string) string {
+	return strconv.Itoa(int(mType)) + "\x00" + key
+}
@@ -0,0 +1,92 @@
+package metricstest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	metrics "github.com/mheffner/go-simple-metrics"
+)
+
+// recordingT records the errors of the assertions instead of failing
+type recordingT struct {
+	testing.TB
+	errs []string
+}
+
+func (r *recordingT) Helper() {}
+
+func (r *recordingT) Errorf(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+func newMetrics(t *testing.T, sink *Sink) *metrics.Metrics {
+	met, err := metrics.New(sink, func(c *metrics.Config) {
+		c.EnableRuntimeMetrics = false
+		c.EnableHostnameLabel = false
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	t.Cleanup(func() { met.Shutdown() })
+	return met
+}
+
+func TestSink(t *testing.T) {
+	sink := NewSink()
+	met := newMetrics(t, sink)
+
+	met.Incr("requests", 1, metrics.L("code", "200"), metrics.L("method", "GET"))
+	met.Incr("requests", 2, metrics.L("method", "GET"), metrics.L("code", "200"))
+	met.Incr("requests", 1, metrics.L("code", "500"))
+	met.SetGauge("queue", 3)
+	met.SetGauge("queue", 1)
+	met.Sample("latency", 10, metrics.L("route", "a"))
+	met.Sample("latency", 20, metrics.L("route", "b"))
+	met.MeasureSince("latency", time.Now())
+
+	// the labels match in any order
+	sink.AssertCounter(t, "requests", []metrics.Label{metrics.L("method", "GET"), metrics.L("code", "200")}, 3)
+	sink.AssertCounter(t, "requests", []metrics.Label{metrics.L("code", "500")}, 1)
+	sink.AssertGauge(t, "queue", nil, 1)
+	sink.AssertHistogramCount(t, "latency", 3)
+	sink.AssertNotEmitted(t, "other")
+
+	series, ok := sink.Series(metrics.MetricTypeGauge, "queue")
+	if !ok || len(series.Values) != 2 || series.Values[0] != 3 {
+		t.Fatalf("bad series: %+v", series)
+	}
+	if n := sink.Count(metrics.MetricTypeCounter, "requests"); n != 3 {
+		t.Fatalf("expected 3 counter values, got %d", n)
+	}
+
+	sink.Reset()
+	if _, ok := sink.Series(metrics.MetricTypeGauge, "queue"); ok {
+		t.Fatalf("expected the series to be reset")
+	}
+}
+
+func TestSink_AssertionErrors(t *testing.T) {
+	sink := NewSink()
+	met := newMetrics(t, sink)
+	met.Incr("requests", 1)
+	met.SetGauge("queue", 2)
+
+	rt := &recordingT{}
+	sink.AssertCounter(rt, "requests", nil, 2)
+	sink.AssertCounter(rt, "requests", []metrics.Label{metrics.L("code", "200")}, 1)
+	sink.AssertGauge(rt, "queue", nil, 1)
+	sink.AssertHistogramCount(rt, "latency", 1)
+	sink.AssertNotEmitted(rt, "queue")
+
+	expected := []string{
+		"counter requests[] is 1, expected 2",
+		"counter requests[{code 200}] wasn't emitted",
+		"gauge queue[] is 2, expected 1",
+		"histogram latency has 0 observations, expected 1",
+		"queue[] was emitted 1 times, expected none",
+	}
+	if fmt.Sprint(rt.errs) != fmt.Sprint(expected) {
+		t.Fatalf("expected errors %q, got %q", expected, rt.errs)
+	}
+}
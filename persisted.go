@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"context"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -15,21 +16,27 @@ type PersistentGauge interface {
 	Set(val int64) int64
 	Incr(val int64) int64
 	Decr(val int64) int64
+
+	// Value returns the current value, which is published on the next report
+	Value() int64
 }
 
 type persistentGauge struct {
 	m     *Metrics
 	gauge Gauge
 	val   int64
+
+	persistSchedule
 }
 
-func (m *Metrics) NewPersistentGauge(key string, labels ...Label) PersistentGauge {
+func (m *Metrics) NewPersistentGauge(key string, labels []Label, opts ...PersistOption) PersistentGauge {
 	g := &persistentGauge{
-		m:     m,
-		gauge: m.NewGauge(key, labels...),
+		m:               m.root(),
+		gauge:           m.NewGauge(key, labels...),
+		persistSchedule: m.newPersistSchedule(opts),
 	}
 
-	m.persistedGauges.Store(g, struct{}{})
+	g.m.persistedGauges.Store(g, struct{}{})
 
 	return g
 }
@@ -50,32 +57,81 @@ func (p *persistentGauge) Decr(delta int64) int64 {
 	return atomic.AddInt64(&p.val, -delta)
 }
 
+func (p *persistentGauge) Value() int64 {
+	return atomic.LoadInt64(&p.val)
+}
+
 func (p *persistentGauge) report() {
 	curr := atomic.LoadInt64(&p.val)
 	p.gauge.Set(float64(curr))
 }
 
+// A PersistentGaugeFunc polls a function on the publishing interval and publishes
+// the returned value as a gauge. It suits values that are cheaper to sample than
+// to maintain on every change, such as a cache size or queue depth.
+type PersistentGaugeFunc interface {
+	Stop()
+}
+
+type persistentGaugeFunc struct {
+	m     *Metrics
+	gauge Gauge
+	fn    func() float64
+
+	persistSchedule
+}
+
+func (m *Metrics) NewPersistentGaugeFunc(key string, fn func() float64, labels []Label, opts ...PersistOption) PersistentGaugeFunc {
+	g := &persistentGaugeFunc{
+		m:               m.root(),
+		gauge:           m.NewGauge(key, labels...),
+		fn:              fn,
+		persistSchedule: m.newPersistSchedule(opts),
+	}
+
+	g.m.persistedGauges.Store(g, struct{}{})
+
+	return g
+}
+
+func (p *persistentGaugeFunc) Stop() {
+	p.m.persistedGauges.Delete(p)
+}
+
+func (p *persistentGaugeFunc) report() {
+	// a panicking callback must not stop the other persisted metrics
+	defer p.m.panicRecover()
+
+	p.gauge.Set(p.fn())
+}
+
 // An AggregatedCounter can be useful for extremely hot-path metric instrumentation. It aggregates the total
 // increment delta internally and publishes the current delta on each report interval. Unlike the PersistentGauge,
 // an AggregatedCounter will reset its value to zero on each reporting interval.
 type AggregatedCounter interface {
 	Stop()
 	Incr(delta int64)
+
+	// Value returns the delta accumulated since the last report
+	Value() int64
 }
 
 type aggregatedCounter struct {
 	m       *Metrics
 	counter Counter
 	val     int64
+
+	persistSchedule
 }
 
-func (m *Metrics) NewAggregatedCounter(key string, labels ...Label) AggregatedCounter {
+func (m *Metrics) NewAggregatedCounter(key string, labels []Label, opts ...PersistOption) AggregatedCounter {
 	c := &aggregatedCounter{
-		m:       m,
-		counter: m.NewCounter(key, labels...),
+		m:               m.root(),
+		counter:         m.NewCounter(key, labels...),
+		persistSchedule: m.newPersistSchedule(opts),
 	}
 
-	m.aggregatedCounters.Store(c, struct{}{})
+	c.m.aggregatedCounters.Store(c, struct{}{})
 	return c
 }
 
@@ -87,23 +143,255 @@ func (a *aggregatedCounter) Incr(delta int64) {
 	atomic.AddInt64(&a.val, delta)
 }
 
+func (a *aggregatedCounter) Value() int64 {
+	return atomic.LoadInt64(&a.val)
+}
+
 func (a *aggregatedCounter) report() {
 	curr := atomic.SwapInt64(&a.val, 0)
 	// We could elide this if curr == 0?
 	a.counter.Incr(float64(curr))
 }
 
+// An AggregatedGauge records observations internally and publishes their
+// minimum, maximum, and mean as the gauges "<key>.min", "<key>.max", and
+// "<key>.avg" on each report interval, then resets. Nothing is published for
+// intervals without observations. It reduces sink writes for high-frequency
+// gauge updates, such as per-request memory usage.
+type AggregatedGauge interface {
+	Stop()
+	Record(val float64)
+}
+
+type aggregatedGauge struct {
+	m    *Metrics
+	min  Gauge
+	max  Gauge
+	mean Gauge
+
+	lock  sync.Mutex
+	count int64
+	sum   float64
+	lo    float64
+	hi    float64
+
+	persistSchedule
+}
+
+func (m *Metrics) NewAggregatedGauge(key string, labels []Label, opts ...PersistOption) AggregatedGauge {
+	g := &aggregatedGauge{
+		m:               m.root(),
+		min:             m.NewGauge(key+".min", labels...),
+		max:             m.NewGauge(key+".max", labels...),
+		mean:            m.NewGauge(key+".avg", labels...),
+		persistSchedule: m.newPersistSchedule(opts),
+	}
+
+	g.m.aggregatedGauges.Store(g, struct{}{})
+	return g
+}
+
+func (a *aggregatedGauge) Stop() {
+	a.m.aggregatedGauges.Delete(a)
+}
+
+func (a *aggregatedGauge) Record(val float64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.count == 0 || val < a.lo {
+		a.lo = val
+	}
+	if a.count == 0 || val > a.hi {
+		a.hi = val
+	}
+	a.count++
+	a.sum += val
+}
+
+func (a *aggregatedGauge) report() {
+	a.lock.Lock()
+	count, sum, lo, hi := a.count, a.sum, a.lo, a.hi
+	a.count, a.sum = 0, 0
+	a.lock.Unlock()
+
+	if count == 0 {
+		return
+	}
+
+	a.min.Set(lo)
+	a.max.Set(hi)
+	a.mean.Set(sum / float64(count))
+}
+
+// A PersistentCounter tracks a monotonic total internally that can be read back
+// with Value, and publishes the increase since the last report as a counter
+// increment on each report interval. Unlike the AggregatedCounter, the total is
+// never reset.
+type PersistentCounter interface {
+	Stop()
+
+	// Incr adds val to the total
+	Incr(val int64)
+
+	// Add is an alias of Incr, for callers that think of the value as a delta
+	Add(delta int64)
+
+	// Value returns the total, including what is not reported yet
+	Value() int64
+}
+
+type persistentCounter struct {
+	m        *Metrics
+	counter  Counter
+	val      int64
+	reported int64 // only accessed by the publisher
+
+	persistSchedule
+}
+
+func (m *Metrics) NewPersistentCounter(key string, labels []Label, opts ...PersistOption) PersistentCounter {
+	c := &persistentCounter{
+		m:               m.root(),
+		counter:         m.NewCounter(key, labels...),
+		persistSchedule: m.newPersistSchedule(opts),
+	}
+
+	c.m.persistentCounters.Store(c, struct{}{})
+	return c
+}
+
+func (p *persistentCounter) Stop() {
+	p.m.persistentCounters.Delete(p)
+}
+
+func (p *persistentCounter) Incr(val int64) {
+	atomic.AddInt64(&p.val, val)
+}
+
+func (p *persistentCounter) Add(delta int64) {
+	p.Incr(delta)
+}
+
+func (p *persistentCounter) Value() int64 {
+	return atomic.LoadInt64(&p.val)
+}
+
+func (p *persistentCounter) report() {
+	curr := atomic.LoadInt64(&p.val)
+	delta := curr - p.reported
+	p.reported = curr
+	p.counter.Incr(float64(delta))
+}
+
 //
 // Reporting
 //
 
+// persistedMetric is implemented by all metrics published by the poller
+type persistedMetric interface {
+	report()
+	schedule() *persistSchedule
+}
+
+// persistSchedule tracks when a persisted metric is next due to be published
+type persistSchedule struct {
+	interval time.Duration // zero uses the PersistentInterval
+	next     time.Time     // only accessed by the publisher
+}
+
+func (s *persistSchedule) schedule() *persistSchedule {
+	return s
+}
+
+// due returns whether the metric should be published at now, and schedules
+// the next publish if so. Metrics due within slack of now are published early
+// so that ticks arriving slightly early don't skip a whole interval.
+func (s *persistSchedule) due(now time.Time, interval time.Duration, slack time.Duration) bool {
+	if s.interval > 0 {
+		interval = s.interval
+	}
+	if now.Add(slack).Before(s.next) {
+		return false
+	}
+
+	s.next = now.Add(interval)
+	return true
+}
+
+// A PersistOption configures a persisted or aggregated metric
+type PersistOption func(s *persistSchedule)
+
+// WithInterval makes the persisted or aggregated metric publish on the given
+// interval instead of the PersistentInterval, or the interval of the view set
+// by WithPersistInterval. A zero interval keeps that default. It only applies
+// while the publisher is enabled with a non-zero PersistentInterval.
+func WithInterval(interval time.Duration) PersistOption {
+	return func(s *persistSchedule) {
+		if interval > 0 {
+			s.interval = interval
+		}
+	}
+}
+
+// newPersistSchedule creates the schedule for a persisted metric created
+// through m with the options, using the interval of WithPersistInterval unless
+// the options set one
+func (m *Metrics) newPersistSchedule(opts []PersistOption) persistSchedule {
+	s := persistSchedule{interval: m.persistInterval}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	if s.interval > 0 {
+		m.root().lowerPersistTick(s.interval)
+	}
+	return s
+}
+
+// lowerPersistTick makes sure the poller ticks at least every interval
+func (m *Metrics) lowerPersistTick(interval time.Duration) {
+	for {
+		curr := m.persistMinInterval.Load()
+		if curr != 0 && curr <= int64(interval) {
+			return
+		}
+		if m.persistMinInterval.CompareAndSwap(curr, int64(interval)) {
+			break
+		}
+	}
+
+	// wake the poller to pick up the new tick
+	select {
+	case m.persistReset <- struct{}{}:
+	default:
+	}
+}
+
+// persistTick returns the interval the poller ticks at, the smallest of the
+// PersistentInterval and the intervals of individual metrics
+func (m *Metrics) persistTick() time.Duration {
+	tick := m.cfg.PersistentInterval
+	if min := time.Duration(m.persistMinInterval.Load()); min > 0 && min < tick {
+		tick = min
+	}
+	return tick
+}
+
 func (m *Metrics) pollPersistedMetrics(ctx context.Context) {
-	t := time.NewTicker(m.cfg.PersistentInterval)
+	tick := m.persistTick()
+	t := m.newTicker(tick)
+	defer t.Stop()
 
 	for {
 		select {
-		case <-t.C:
-			m.publishPersistedMetrics()
+		case now := <-t.C():
+			t.ticked()
+			m.publishDuePersistedMetrics(now, tick/2)
+		case <-m.persistReset:
+			if next := m.persistTick(); next != tick {
+				tick = next
+				t.Reset(tick)
+			}
 		case <-ctx.Done():
 			// publish one last time
 			m.publishPersistedMetrics()
@@ -112,26 +400,34 @@ func (m *Metrics) pollPersistedMetrics(ctx context.Context) {
 	}
 }
 
+// publishPersistedMetrics publishes all persisted metrics, regardless of when
+// they are due
 func (m *Metrics) publishPersistedMetrics() {
-	m.persistedGauges.Range(func(key, value any) bool {
-		g, ok := key.(*persistentGauge)
-		if !ok {
-			// invariant
-			return true
-		}
-
-		g.report()
-		return true
+	m.rangePersistedMetrics(func(p persistedMetric) {
+		p.report()
 	})
+}
 
-	m.aggregatedCounters.Range(func(key, value any) bool {
-		c, ok := key.(*aggregatedCounter)
-		if !ok {
-			// invariant
-			return true
+// publishDuePersistedMetrics publishes the persisted metrics due at now
+func (m *Metrics) publishDuePersistedMetrics(now time.Time, slack time.Duration) {
+	m.rangePersistedMetrics(func(p persistedMetric) {
+		if p.schedule().due(now, m.cfg.PersistentInterval, slack) {
+			p.report()
 		}
-
-		c.report()
-		return true
 	})
 }
+
+func (m *Metrics) rangePersistedMetrics(fn func(p persistedMetric)) {
+	for _, metrics := range []*sync.Map{&m.persistedGauges, &m.aggregatedCounters, &m.aggregatedGauges, &m.persistentCounters} {
+		metrics.Range(func(key, value any) bool {
+			p, ok := key.(persistedMetric)
+			if !ok {
+				// invariant
+				return true
+			}
+
+			fn(p)
+			return true
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package metrics
 
 import (
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -10,7 +12,7 @@ func TestPersistentGauge(t *testing.T) {
 	m, met := mockMetric(t)
 
 	label := L("label", "value")
-	pg := met.NewPersistentGauge("pkey", label)
+	pg := met.NewPersistentGauge("pkey", []Label{label})
 	pg.Set(1)
 
 	met.publishPersistedMetrics()
@@ -22,7 +24,9 @@ func TestPersistentGauge(t *testing.T) {
 	require.Equal(t, []Label{label}, m.labels[0])
 
 	pg.Incr(2)
+	require.Equal(t, int64(3), pg.Value())
 	met.publishPersistedMetrics()
+	require.Equal(t, int64(3), pg.Value())
 
 	require.Len(t, m.keys, 2)
 	require.Equal(t, float64(3), m.vals[1])
@@ -33,11 +37,60 @@ func TestPersistentGauge(t *testing.T) {
 	require.Len(t, m.keys, 2)
 }
 
+func TestPersistentGaugeFunc(t *testing.T) {
+	m, met := mockMetric(t)
+
+	label := L("label", "value")
+	size := 1
+	pg := met.NewPersistentGaugeFunc("pkey", func() float64 {
+		return float64(size)
+	}, []Label{label})
+
+	met.publishPersistedMetrics()
+
+	require.Len(t, m.keys, 1)
+
+	require.Equal(t, "pkey", m.keys[0][0])
+	require.Equal(t, float64(1), m.vals[0])
+	require.Equal(t, []Label{label}, m.labels[0])
+
+	size = 7
+	met.publishPersistedMetrics()
+
+	require.Len(t, m.keys, 2)
+	require.Equal(t, float64(7), m.vals[1])
+
+	pg.Stop()
+
+	met.publishPersistedMetrics()
+	require.Len(t, m.keys, 2)
+}
+
+func TestPersistentGaugeFunc_Panic(t *testing.T) {
+	m, met := mockMetric(t)
+
+	var recovered any
+	met.cfg.PanicHandler = func(r any, stack []byte) {
+		recovered = r
+	}
+
+	met.NewPersistentGaugeFunc("bad", func() float64 {
+		panic("boom")
+	}, nil)
+	pg := met.NewPersistentGauge("good", nil)
+	pg.Set(1)
+
+	met.publishPersistedMetrics()
+
+	require.Equal(t, "boom", recovered)
+	require.Equal(t, [][]string{{"good"}}, m.keys)
+}
+
 func TestAggregatedCounter(t *testing.T) {
 	m, met := mockMetric(t)
 
 	label := L("label", "value")
-	ag := met.NewAggregatedCounter("ckey", label)
+	ag := met.NewAggregatedCounter("ckey", []Label{label})
 	ag.Incr(3)
 
 	met.publishPersistedMetrics()
@@ -49,7 +102,9 @@ func TestAggregatedCounter(t *testing.T) {
 	require.Equal(t, []Label{label}, m.labels[0])
 
 	ag.Incr(5)
+	require.Equal(t, int64(5), ag.Value())
 	met.publishPersistedMetrics()
+	require.Equal(t, int64(0), ag.Value())
 
 	require.Len(t, m.keys, 2)
 	require.Equal(t, float64(5), m.vals[1])
@@ -60,3 +115,157 @@ func TestAggregatedCounter(t *testing.T) {
 
 	require.Len(t, m.keys, 2)
 }
+
+func TestAggregatedGauge(t *testing.T) {
+	m, met := mockMetric(t)
+
+	label := L("label", "value")
+	ag := met.NewAggregatedGauge("gkey", []Label{label})
+	ag.Record(3)
+	ag.Record(-1)
+	ag.Record(10)
+
+	met.publishPersistedMetrics()
+
+	require.Equal(t, [][]string{{"gkey.min"}, {"gkey.max"}, {"gkey.avg"}}, m.keys)
+	require.Equal(t, []float64{-1, 10, 4}, m.vals)
+	require.Equal(t, []Label{label}, m.labels[0])
+
+	// nothing recorded
+	met.publishPersistedMetrics()
+	require.Len(t, m.keys, 3)
+
+	ag.Record(5)
+	met.publishPersistedMetrics()
+	require.Len(t, m.keys, 6)
+	require.Equal(t, []float64{5, 5, 5}, m.vals[3:])
+
+	ag.Stop()
+	ag.Record(1)
+
+	met.publishPersistedMetrics()
+	require.Len(t, m.keys, 6)
+}
+
+func TestPersistentCounter(t *testing.T) {
+	m, met := mockMetric(t)
+
+	label := L("label", "value")
+	pc := met.NewPersistentCounter("ckey", []Label{label})
+	pc.Incr(3)
+
+	met.publishPersistedMetrics()
+
+	require.Len(t, m.keys, 1)
+
+	require.Equal(t, "ckey", m.keys[0][0])
+	require.Equal(t, float64(3), m.vals[0])
+	require.Equal(t, []Label{label}, m.labels[0])
+
+	pc.Add(5)
+	pc.Incr(1)
+	require.Equal(t, int64(9), pc.Value())
+	met.publishPersistedMetrics()
+
+	require.Len(t, m.keys, 2)
+	require.Equal(t, float64(6), m.vals[1])
+	require.Equal(t, int64(9), pc.Value())
+
+	pc.Stop()
+
+	met.publishPersistedMetrics()
+
+	require.Len(t, m.keys, 2)
+}
+
+func TestPersistInterval_Due(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.PersistentInterval = time.Second
+	})
+
+	fast := met.NewPersistentGauge("fast", nil)
+	slow := met.WithPersistInterval(3*time.Second).WithPrefix("scoped").NewPersistentGauge("slow", nil)
+	fast.Set(1)
+	slow.Set(2)
+	require.Equal(t, int64(3*time.Second), met.persistMinInterval.Load())
+	require.Equal(t, time.Second, met.persistTick())
+
+	start := time.Now()
+	published := func(tick int) []string {
+		m.keys = nil
+		met.publishDuePersistedMetrics(start.Add(time.Duration(tick)*time.Second), 500*time.Millisecond)
+		var keys []string
+		for _, k := range m.keys {
+			keys = append(keys, k[0])
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	require.Equal(t, []string{"fast", "scoped.slow"}, published(0))
+	require.Equal(t, []string{"fast"}, published(1))
+	require.Equal(t, []string{"fast"}, published(2))
+	require.Equal(t, []string{"fast", "scoped.slow"}, published(3))
+
+	// everything is published on the final flush
+	m.keys = nil
+	met.publishPersistedMetrics()
+	require.Len(t, m.keys, 2)
+}
+
+func TestPersistInterval_PerMetric(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.PersistentInterval = time.Second
+	})
+
+	fast := met.NewPersistentGauge("fast", nil)
+	slow := met.NewPersistentGauge("slow", []Label{L("a", "b")}, WithInterval(3*time.Second))
+	counted := met.NewAggregatedCounter("counted", nil, WithInterval(2*time.Second))
+	// the option takes precedence over the view
+	viewed := met.WithPersistInterval(3*time.Second).NewPersistentGauge("viewed", nil, WithInterval(2*time.Second))
+	fast.Set(1)
+	slow.Set(2)
+	counted.Incr(1)
+	viewed.Set(3)
+
+	start := time.Now()
+	published := func(tick int) []string {
+		m.keys, m.labels = nil, nil
+		met.publishDuePersistedMetrics(start.Add(time.Duration(tick)*time.Second), 500*time.Millisecond)
+		var keys []string
+		for _, k := range m.keys {
+			keys = append(keys, k[0])
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	require.Equal(t, []string{"counted", "fast", "slow", "viewed"}, published(0))
+	require.Equal(t, []string{"fast"}, published(1))
+	require.Equal(t, []string{"counted", "fast", "viewed"}, published(2))
+	require.Equal(t, []string{"fast", "slow"}, published(3))
+
+	// the labels are passed on as is
+	for n, k := range m.getKeys() {
+		if k[0] == "slow" {
+			require.Equal(t, []Label{L("a", "b")}, m.labels[n])
+		}
+	}
+}
+
+func TestPersistInterval_Poller(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(m, func(c *Config) {
+		c.EnableRuntimeMetrics = false
+		c.PersistentInterval = time.Hour
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	g := met.WithPersistInterval(10*time.Millisecond).NewPersistentGauge("fast", nil)
+	g.Set(1)
+
+	require.Eventually(t, func() bool {
+		return len(m.getKeys()) >= 2
+	}, 5*time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,40 @@
+package metrics
+
+// processStats are the OS-level statistics of the current process
+type processStats struct {
+	cpuSeconds    float64
+	residentBytes float64
+	virtualBytes  float64
+	openFDs       float64
+}
+
+type processMetrics struct {
+	cpuSeconds     Gauge
+	residentMemory Gauge
+	virtualMemory  Gauge
+	openFDs        Gauge
+}
+
+// newProcessMetrics creates the metrics emitted from the process stats
+func (m *Metrics) newProcessMetrics() *processMetrics {
+	return &processMetrics{
+		cpuSeconds:     m.NewGauge("process.cpu_seconds_total"),
+		residentMemory: m.NewGauge("process.resident_memory_bytes"),
+		virtualMemory:  m.NewGauge("process.virtual_memory_bytes"),
+		openFDs:        m.NewGauge("process.open_fds"),
+	}
+}
+
+// Emits process statistics, nothing is emitted if they can't be read on this
+// platform
+func (m *Metrics) emitProcessStats(pm *processMetrics) {
+	stats, ok := readProcessStats()
+	if !ok {
+		return
+	}
+
+	pm.cpuSeconds.Set(stats.cpuSeconds)
+	pm.residentMemory.Set(stats.residentBytes)
+	pm.virtualMemory.Set(stats.virtualBytes)
+	pm.openFDs.Set(stats.openFDs)
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package metrics
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// userHZ is the kernel's clock tick rate used for process CPU times in
+// /proc, which is 100 on all common architectures
+const userHZ = 100
+
+// readProcessStats reads the process stats from /proc/self
+func readProcessStats() (processStats, bool) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return processStats{}, false
+	}
+
+	// The command name may contain spaces, so skip past its closing paren.
+	// The fields that follow start with the state, field 3 in proc(5).
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return processStats{}, false
+	}
+	fields := bytes.Fields(data[i+1:])
+	if len(fields) < 22 {
+		return processStats{}, false
+	}
+
+	utime, err1 := strconv.ParseUint(string(fields[11]), 10, 64)
+	stime, err2 := strconv.ParseUint(string(fields[12]), 10, 64)
+	vsize, err3 := strconv.ParseUint(string(fields[20]), 10, 64)
+	rss, err4 := strconv.ParseInt(string(fields[21]), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return processStats{}, false
+	}
+
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return processStats{}, false
+	}
+
+	return processStats{
+		cpuSeconds:    float64(utime+stime) / userHZ,
+		residentBytes: float64(rss * int64(os.Getpagesize())),
+		virtualBytes:  float64(vsize),
+		openFDs:       float64(len(fds)),
+	}, true
+}
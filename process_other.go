@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package metrics
+
+// readProcessStats is not supported on this platform
+func readProcessStats() (processStats, bool) {
+	return processStats{}, false
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_EmitProcessStats(t *testing.T) {
+	m, met := mockMetric(t)
+
+	pm := met.newProcessMetrics()
+	met.emitProcessStats(pm)
+
+	if runtime.GOOS != "linux" {
+		if len(m.getKeys()) != 0 {
+			t.Fatalf("expected no process stats on %s: %v", runtime.GOOS, m.getKeys())
+		}
+		return
+	}
+
+	if m.getKeys()[0][0] != "process.cpu_seconds_total" {
+		t.Fatalf("bad key %v", m.getKeys())
+	}
+	if m.vals[0] < 0 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+
+	if m.vals[1] <= 100000 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+
+	if m.vals[2] <= m.vals[1] {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+
+	if m.getKeys()[3][0] != "process.open_fds" {
+		t.Fatalf("bad key %v", m.getKeys())
+	}
+	if m.vals[3] < 3 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+}
+
+func TestMetrics_ProcessMetricsOnly(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("process stats are not supported on %s", runtime.GOOS)
+	}
+
+	m := &MockSink{}
+	met, err := New(m, func(cfg *Config) {
+		cfg.EnableRuntimeMetrics = false
+		cfg.EnableProcessMetrics = true
+		cfg.ProfileInterval = 10 * time.Millisecond
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.getKeys()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("process stats not emitted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	met.Shutdown()
+
+	for _, k := range m.getKeys() {
+		if !strings.HasPrefix(k[0], "process.") {
+			t.Fatalf("unexpected key %v", k)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package prometheus
+
+import (
+	metrics "github.com/mheffner/go-simple-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// InmemCollector is a prometheus.Collector exposing the metrics of an
+// InmemSink, so a single sink serves both the in-process view and scrapes.
+// Each collect reports the interval shown by InmemSink.DisplayMetrics, the
+// most recent finished one. Counters are reported as gauges of their sum over
+// the interval, as it isn't monotonic, gauges as gauges, and samples and
+// distributions as summaries, with quantiles if the InmemSink retains
+// percentiles.
+type InmemCollector struct {
+	inm        *metrics.InmemSink
+	fixedNames fixedNames
+}
+
+// NewInmemCollector creates an InmemCollector of the sink and registers it
+// with the registerer, or the default registerer if nil
+func NewInmemCollector(inm *metrics.InmemSink, reg prometheus.Registerer) (*InmemCollector, error) {
+	c := &InmemCollector{inm: inm}
+
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	return c, reg.Register(c)
+}
+
+// Describe sends nothing, as the metrics of the sink aren't known ahead of
+// collecting them. This makes the collector unchecked, so collectors of
+// several sinks can be registered with one registry.
+func (c *InmemCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect sends the metrics of the interval shown by DisplayMetrics. Nothing
+// is sent before the sink has an interval.
+func (c *InmemCollector) Collect(ch chan<- prometheus.Metric) {
+	data, err := c.inm.DisplayMetrics(nil, nil)
+	if err != nil {
+		return
+	}
+	summary := data.(metrics.MetricsSummary)
+
+	for _, g := range summary.Gauges {
+		if desc := c.desc(g.Name, g.DisplayLabels); desc != nil {
+			ch <- constMetric(desc, prometheus.GaugeValue, g.Value)
+		}
+	}
+	for _, v := range summary.Counters {
+		if desc := c.desc(v.Name, v.DisplayLabels); desc != nil {
+			ch <- constMetric(desc, prometheus.GaugeValue, v.Sum)
+		}
+	}
+	for _, samples := range [][]metrics.SampledValue{summary.Samples, summary.Distributions} {
+		for _, v := range samples {
+			desc := c.desc(v.Name, v.DisplayLabels)
+			if desc == nil {
+				continue
+			}
+			var quantiles map[float64]float64
+			if p := v.Percentiles; p != nil {
+				quantiles = map[float64]float64{0.5: p.P50, 0.9: p.P90, 0.99: p.P99}
+			}
+			m, err := prometheus.NewConstSummary(desc, uint64(v.Count), v.Sum, quantiles)
+			if err != nil {
+				m = prometheus.NewInvalidMetric(desc, err)
+			}
+			ch <- m
+		}
+	}
+}
+
+// desc describes a metric of the InmemSink, named and with the help of the
+// series of a PrometheusSink. Invalid label names are fixed like metric names,
+// and labels left without a name are dropped. It returns nil if the name is
+// empty.
+func (c *InmemCollector) desc(name string, labels map[string]string) *prometheus.Desc {
+	key := validName(forbiddenChars.Replace(name), &c.fixedNames)
+	if key == "" {
+		return nil
+	}
+
+	constLabels := make(prometheus.Labels, len(labels))
+	for k, v := range labels {
+		if k = validLabelName(k, &c.fixedNames); k != "" {
+			constLabels[k] = v
+		}
+	}
+	return prometheus.NewDesc(key, key, nil, constLabels)
+}
+
+// validLabelName returns the name changed to be a valid Prometheus label name,
+// in the way of validName, except that ':' is invalid too
+func validLabelName(name string, fixed *fixedNames) string {
+	return fixName(forbiddenChars.Replace(name), func(r rune, i int) bool {
+		return r != ':' && validNameRune(r, i)
+	}, fixed)
+}
+
+func constMetric(desc *prometheus.Desc, valueType prometheus.ValueType, val float64) prometheus.Metric {
+	m, err := prometheus.NewConstMetric(desc, valueType, val)
+	if err != nil {
+		return prometheus.NewInvalidMetric(desc, err)
+	}
+	return m
+}
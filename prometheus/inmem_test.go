@@ -0,0 +1,91 @@
+package prometheus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	metrics "github.com/mheffner/go-simple-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestInmemCollector(t *testing.T) {
+	inm := metrics.NewInmemSink(time.Minute, time.Hour, metrics.WithInmemPercentiles(100))
+	reg := prometheus.NewRegistry()
+	if _, err := NewInmemCollector(inm, reg); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	// nothing is collected before the first interval
+	if families, err := reg.Gather(); err != nil || len(families) != 0 {
+		t.Fatalf("expected no families, got %d (err %v)", len(families), err)
+	}
+
+	inm.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"queue", "size"}, []metrics.Label{metrics.L("host", "a"), metrics.L("aws.region", "us-east-1")})(5)
+	inm.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, nil)(3)
+	inm.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, nil)(2)
+	latency := inm.BuildMetricEmitter(metrics.MetricTypeHistogram, []string{"latency"}, nil)
+	latency(0)
+	latency(100)
+	inm.BuildMetricEmitter(metrics.MetricTypeDistribution, []string{"size"}, nil)(7)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	var buf bytes.Buffer
+	for _, f := range families {
+		if _, err := expfmt.MetricFamilyToText(&buf, f); err != nil {
+			t.Fatalf("err = %v, want nil", err)
+		}
+	}
+
+	expected := `# HELP latency latency
+# TYPE latency summary
+latency{quantile="0.5"} 50
+latency{quantile="0.9"} 90
+latency{quantile="0.99"} 99
+latency_sum 100
+latency_count 2
+# HELP queue_size queue_size
+# TYPE queue_size gauge
+queue_size{aws_region="us-east-1",host="a"} 5
+# HELP requests requests
+# TYPE requests gauge
+requests 5
+# HELP size size
+# TYPE size summary
+size{quantile="0.5"} 7
+size{quantile="0.9"} 7
+size{quantile="0.99"} 7
+size_sum 7
+size_count 1
+`
+	if buf.String() != expected {
+		t.Fatalf("bad output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestInmemCollector_Multiple(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	first := metrics.NewInmemSink(time.Minute, time.Hour)
+	second := metrics.NewInmemSink(time.Minute, time.Hour)
+	if _, err := NewInmemCollector(first, reg); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if _, err := NewInmemCollector(second, reg); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	first.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"first"}, nil)(1)
+	second.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"second"}, nil)(2)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if len(families) != 2 {
+		t.Fatalf("expected the metrics of both sinks, got %d families", len(families))
+	}
+}
@@ -4,17 +4,23 @@
 package prometheus
 
 import (
-	"fmt"
+	"encoding/binary"
+	"errors"
+	"io"
 	"log"
-	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"github.com/cespare/xxhash/v2"
 	metrics "github.com/mheffner/go-simple-metrics"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 var (
@@ -52,16 +58,113 @@ type PrometheusOpts struct {
 	SummaryDefinitions []SummaryDefinition
 	CounterDefinitions []CounterDefinition
 	Name               string
+
+	// MaxSeries limits the number of series created at runtime, if positive.
+	// Once reached, emits to new series are dropped, and counted by
+	// DroppedSeries, until existing series expire or are forgotten. The
+	// emitters then create their series on the next emit.
+	// Pre-declared metrics don't count towards the limit.
+	MaxSeries int
+
+	// Namespace and Subsystem are passed to the options of every metric,
+	// naming them namespace_subsystem_key. Empty parts are omitted.
+	Namespace string
+	Subsystem string
+
+	// ConstLabels are added to every series of the sink, including the
+	// pre-declared metrics, ahead of the series' own labels.
+	ConstLabels []metrics.Label
+
+	// ReportStats collects the sink's Stats with its metrics, as the
+	// prometheus_sink_series_created_total and _expired_total counters and
+	// the prometheus_sink_series_live gauge, labeled by type.
+	ReportStats bool
+
+	// Clock tells the time series are updated and collected at, for expiry.
+	// If not set the metrics.SystemClock is used.
+	Clock metrics.Clock
+
+	// DualHistograms also observes the histograms, timers, and distributions
+	// kept in summaries into histograms of the same name with a _histogram
+	// suffix, to migrate dashboards from summaries to histograms. It's meant
+	// to be temporary: each series then costs a summary and a histogram with
+	// a series per bucket. DualHistogramKeys enables it for the given keys
+	// only, as flattened before the Namespace and Subsystem. The histograms
+	// have the DualHistogramBuckets, or prometheus.DefBuckets if empty.
+	DualHistograms       bool
+	DualHistogramKeys    []string
+	DualHistogramBuckets []float64
+
+	// KeepDots keeps the dots of keys in metric names, joining the parts of
+	// keys with dots, so foo.bar stays foo.bar rather than foo_bar. Dotted
+	// names are only valid with UTF-8 names, which Prometheus servers before
+	// 3.0 reject: the sink can't be created unless model.NameValidationScheme
+	// of github.com/prometheus/common/model is set to model.UTF8Validation.
+	KeepDots bool
 }
 
+// dualHistogramSuffix is appended to the name of the histograms of
+// PrometheusOpts.DualHistograms, which can't share the summaries' names
+const dualHistogramSuffix = "_histogram"
+
 type PrometheusSink struct {
 	// If these will ever be copied, they should be converted to *sync.Map values and initialized appropriately
 	gauges     sync.Map
 	summaries  sync.Map
 	counters   sync.Map
+	histograms sync.Map
 	expiration time.Duration
 	help       map[string]string
 	name       string
+	namespace  string
+	subsystem  string
+	clock      metrics.Clock
+
+	constLabels []metrics.Label
+
+	dualHistograms       bool
+	dualHistogramKeys    map[string]struct{}
+	dualHistogramBuckets []float64
+
+	keepDots bool
+
+	// upDownTotals maps the hash of an up/down counter series to its
+	// *runningTotal, which expiry and Reset leave alone
+	upDownTotals sync.Map
+
+	// unknownTypes records the unknown metric types already logged
+	unknownTypes sync.Map
+	fixedNames   fixedNames
+
+	maxSeries     int64
+	series        atomic.Int64
+	droppedSeries atomic.Uint64
+
+	reportStats    bool
+	createdSeries  atomic.Uint64
+	expiredSeries  atomic.Uint64
+	liveCounters   atomic.Int64
+	liveGauges     atomic.Int64
+	liveSummaries  atomic.Int64
+	liveHistograms atomic.Int64
+
+	gaugeDefinitions   []GaugeDefinition
+	summaryDefinitions []SummaryDefinition
+	counterDefinitions []CounterDefinition
+}
+
+// SinkStats are counts of the series of a PrometheusSink, to tell how much
+// they churn
+type SinkStats struct {
+	Created uint64 // Series created at runtime
+	Expired uint64 // Series deleted after not being updated for Expiration
+	Dropped uint64 // Series creations refused because MaxSeries was reached
+
+	// The series currently collected, including the pre-declared ones
+	LiveCounters   int64
+	LiveGauges     int64
+	LiveSummaries  int64
+	LiveHistograms int64
 }
 
 // expirableMetric is a metric that may be expired at any point in time if it is not updated regularly.
@@ -79,8 +182,22 @@ type expirableMetric struct {
 	deleted   bool
 }
 
-func (c *expirableMetric) markUpdated() {
-	atomic.SwapInt64(&c.updatedAtNano, time.Now().UnixNano())
+func (c *expirableMetric) markUpdated(now time.Time) {
+	atomic.SwapInt64(&c.updatedAtNano, now.UnixNano())
+}
+
+// lockLive read-locks the metric and marks it updated, unless it was deleted.
+// It returns whether the metric is live, in which case the caller must update
+// it and then read-unlock. A deleted metric may still be loaded from the map
+// until the deleting sweep unlocks, so callers re-create and retry.
+func (c *expirableMetric) lockLive(clock metrics.Clock) bool {
+	c.mut.RLock()
+	if c.deleted {
+		c.mut.RUnlock()
+		return false
+	}
+	c.markUpdated(clock.Now())
+	return true
 }
 
 // GaugeDefinition can be provided to PrometheusOpts to declare a constant gauge that is not deleted on expiry.
@@ -93,6 +210,14 @@ type GaugeDefinition struct {
 type gauge struct {
 	prometheus.Gauge
 	expirableMetric
+	constLabels prometheus.Labels
+}
+
+// runningTotal is the current value of an up/down counter series, set to its
+// gauge under the lock so that concurrent deltas are set in order
+type runningTotal struct {
+	lock sync.Mutex
+	val  float64
 }
 
 // SummaryDefinition can be provided to PrometheusOpts to declare a constant summary that is not deleted on expiry.
@@ -105,6 +230,14 @@ type SummaryDefinition struct {
 type summary struct {
 	prometheus.Summary
 	expirableMetric
+	constLabels prometheus.Labels
+}
+
+// histogram is a series of a timer histogram, see BuildHistogramEmitter
+type histogram struct {
+	prometheus.Histogram
+	expirableMetric
+	constLabels prometheus.Labels
 }
 
 // CounterDefinition can be provided to PrometheusOpts to declare a constant counter that is not deleted on expiry.
@@ -117,6 +250,7 @@ type CounterDefinition struct {
 type counter struct {
 	prometheus.Counter
 	expirableMetric
+	constLabels prometheus.Labels
 }
 
 // NewPrometheusSink creates a new PrometheusSink using the default options.
@@ -126,6 +260,10 @@ func NewPrometheusSink() (*PrometheusSink, error) {
 
 // NewPrometheusSinkFrom creates a new PrometheusSink using the passed options.
 func NewPrometheusSinkFrom(opts PrometheusOpts) (*PrometheusSink, error) {
+	if opts.KeepDots && model.NameValidationScheme != model.UTF8Validation {
+		return nil, errors.New("KeepDots requires model.NameValidationScheme to be model.UTF8Validation")
+	}
+
 	name := opts.Name
 	if name == "" {
 		name = "default_prometheus_sink"
@@ -134,14 +272,43 @@ func NewPrometheusSinkFrom(opts PrometheusOpts) (*PrometheusSink, error) {
 		gauges:     sync.Map{},
 		summaries:  sync.Map{},
 		counters:   sync.Map{},
+		histograms: sync.Map{},
 		expiration: opts.Expiration,
 		help:       make(map[string]string),
 		name:       name,
+		maxSeries:  int64(opts.MaxSeries),
+		namespace:  opts.Namespace,
+		subsystem:  opts.Subsystem,
+		clock:      opts.Clock,
+
+		constLabels: opts.ConstLabels,
+		reportStats: opts.ReportStats,
+
+		dualHistograms:       opts.DualHistograms,
+		dualHistogramBuckets: opts.DualHistogramBuckets,
+
+		keepDots: opts.KeepDots,
+
+		gaugeDefinitions:   opts.GaugeDefinitions,
+		summaryDefinitions: opts.SummaryDefinitions,
+		counterDefinitions: opts.CounterDefinitions,
+	}
+	if sink.clock == nil {
+		sink.clock = metrics.SystemClock
+	}
+	if len(opts.DualHistogramKeys) > 0 {
+		sink.dualHistogramKeys = make(map[string]struct{}, len(opts.DualHistogramKeys))
+		for _, key := range opts.DualHistogramKeys {
+			sink.dualHistogramKeys[key] = struct{}{}
+		}
+	}
+	if len(sink.dualHistogramBuckets) == 0 {
+		sink.dualHistogramBuckets = prometheus.DefBuckets
 	}
 
-	initGauges(&sink.gauges, opts.GaugeDefinitions, sink.help)
-	initSummaries(&sink.summaries, opts.SummaryDefinitions, sink.help)
-	initCounters(&sink.counters, opts.CounterDefinitions, sink.help)
+	sink.initGauges(false)
+	sink.initSummaries(false)
+	sink.initCounters(false)
 
 	reg := opts.Registerer
 	if reg == nil {
@@ -152,39 +319,37 @@ func NewPrometheusSinkFrom(opts PrometheusOpts) (*PrometheusSink, error) {
 }
 
 func (p *PrometheusSink) BuildMetricEmitter(mType metrics.MetricType, keys []string, labels []metrics.Label) metrics.MetricEmitter {
-	key, hash := flattenKey(keys, labels)
+	labels = p.withConstLabels(labels)
+	key, hash := p.flattenKey(keys, labels)
+	if key == "" {
+		// nothing is left of the key to name the metric
+		return func(val float64) {}
+	}
 
 	if mType == metrics.MetricTypeCounter {
-		c := p.loadCounter(key, hash, labels)
-
+		add := p.buildCounter(key, hash, labels)
 		return func(val float64) {
-			c.mut.RLock()
-			if c.deleted {
-				c.mut.RUnlock()
-				c = p.newCounter(key, hash, labels)
-				c.mut.RLock()
-			}
-			c.markUpdated()
-
-			c.Add(val)
-			c.mut.RUnlock()
+			add(val, nil)
 		}
 	}
 
 	if mType == metrics.MetricTypeGauge {
-		g := p.loadGauge(key, hash, labels)
+		return p.gaugeEmitter(key, hash, labels)
+	}
+
+	// up/down counters are gauges set to the running total of the deltas,
+	// kept by the sink so that it outlives the gauge expiring
+	if mType == metrics.MetricTypeUpDownCounter {
+		rt, _ := p.upDownTotals.LoadOrStore(hash, &runningTotal{})
+		total := rt.(*runningTotal)
+		set := p.gaugeEmitter(key, hash, labels)
 
 		return func(val float64) {
-			g.mut.RLock()
-			if g.deleted {
-				g.mut.RUnlock()
-				g = p.newGauge(key, hash, labels)
-				g.mut.RLock()
-			}
-			g.markUpdated()
+			total.lock.Lock()
+			defer total.lock.Unlock()
 
-			g.Set(val)
-			g.mut.RUnlock()
+			total.val += val
+			set(total.val)
 		}
 	}
 
@@ -192,125 +357,572 @@ func (p *PrometheusSink) BuildMetricEmitter(mType metrics.MetricType, keys []str
 	if mType == metrics.MetricTypeHistogram ||
 		mType == metrics.MetricTypeTimer ||
 		mType == metrics.MetricTypeDistribution {
-		s := p.loadSummary(key, hash, labels)
+		observe := p.summaryEmitter(key, hash, labels)
+		if !p.dualHistogram(key) {
+			return observe
+		}
 
+		observeHistogram := p.dualHistogramEmitter(key, labels)
 		return func(val float64) {
-			s.mut.RLock()
-			if s.deleted {
+			observe(val)
+			observeHistogram(val, nil)
+		}
+	}
+
+	// only reached by a metric type this sink doesn't support yet
+	p.logUnknownType(mType)
+	return func(val float64) {}
+}
+
+// gaugeEmitter returns an emitter setting the gauge series, re-created if it
+// expires
+func (p *PrometheusSink) gaugeEmitter(key string, hash uint64, labels []metrics.Label) metrics.MetricEmitter {
+	var cur atomic.Pointer[gauge]
+	cur.Store(p.loadGauge(key, hash, labels))
+
+	return func(val float64) {
+		for {
+			g := cur.Load()
+			if g == nil {
+				// refused at MaxSeries, retried until there is room
+				if g = p.loadGauge(key, hash, labels); g == nil {
+					return
+				}
+				cur.CompareAndSwap(nil, g)
+				continue
+			}
+			if g.lockLive(p.clock) {
+				g.Set(val)
+				g.mut.RUnlock()
+				return
+			}
+			recreated := p.newGauge(key, hash, g.constLabels)
+			if recreated == nil {
+				return
+			}
+			cur.CompareAndSwap(g, recreated)
+		}
+	}
+}
+
+// summaryEmitter returns an emitter observing values into the summary series,
+// re-created if it expires
+func (p *PrometheusSink) summaryEmitter(key string, hash uint64, labels []metrics.Label) metrics.MetricEmitter {
+	var cur atomic.Pointer[summary]
+	cur.Store(p.loadSummary(key, hash, labels))
+
+	return func(val float64) {
+		for {
+			s := cur.Load()
+			if s == nil {
+				// refused at MaxSeries, retried until there is room
+				if s = p.loadSummary(key, hash, labels); s == nil {
+					return
+				}
+				cur.CompareAndSwap(nil, s)
+				continue
+			}
+			if s.lockLive(p.clock) {
+				s.Observe(val)
 				s.mut.RUnlock()
-				s = p.newSummary(key, hash, labels)
-				s.mut.RLock()
+				return
+			}
+			recreated := p.newSummary(key, hash, s.constLabels)
+			if recreated == nil {
+				return
+			}
+			cur.CompareAndSwap(s, recreated)
+		}
+	}
+}
+
+// BuildHistogramEmitter returns an emitter observing values into a histogram
+// with the bucket upper bounds, for timers created with
+// metrics.NewTimerHistogram. Histogram series can't be pre-declared.
+func (p *PrometheusSink) BuildHistogramEmitter(mType metrics.MetricType, keys []string, labels []metrics.Label, buckets []float64) metrics.MetricEmitter {
+	observe := p.BuildHistogramEmitterWithExemplar(mType, keys, labels, buckets)
+	return func(val float64) {
+		observe(val, nil)
+	}
+}
+
+// BuildHistogramEmitterWithExemplar is like BuildHistogramEmitter, with an
+// emitter that attaches an OpenMetrics exemplar to the bucket of the
+// observation. Invalid exemplars are dropped as by
+// BuildMetricEmitterWithExemplar.
+func (p *PrometheusSink) BuildHistogramEmitterWithExemplar(mType metrics.MetricType, keys []string, labels []metrics.Label, buckets []float64) ExemplarEmitter {
+	labels = p.withConstLabels(labels)
+	key, hash := p.flattenKey(keys, labels)
+	if key == "" {
+		// nothing is left of the key to name the metric
+		return func(val float64, _ []metrics.Label) {}
+	}
+
+	observe := p.histogramEmitter(key, hash, labels, buckets)
+	return func(val float64, exemplar []metrics.Label) {
+		observe(val, exemplarLabels(exemplar))
+	}
+}
+
+// dualHistogramEmitter returns the emitter of the histogram observed along
+// with the summary of the key, see PrometheusOpts.DualHistograms
+func (p *PrometheusSink) dualHistogramEmitter(key string, labels []metrics.Label) func(val float64, exemplar prometheus.Labels) {
+	dualKey, dualHash := p.flattenKey([]string{key + dualHistogramSuffix}, labels)
+	return p.histogramEmitter(dualKey, dualHash, labels, p.dualHistogramBuckets)
+}
+
+// histogramEmitter returns a func observing values into the histogram series,
+// re-created if it expires, and attaching the exemplar, if not nil
+func (p *PrometheusSink) histogramEmitter(key string, hash uint64, labels []metrics.Label, buckets []float64) func(val float64, exemplar prometheus.Labels) {
+	var cur atomic.Pointer[histogram]
+	cur.Store(p.loadHistogram(key, hash, labels, buckets))
+
+	return func(val float64, exemplar prometheus.Labels) {
+		for {
+			h := cur.Load()
+			if h == nil {
+				// refused at MaxSeries, retried until there is room
+				if h = p.loadHistogram(key, hash, labels, buckets); h == nil {
+					return
+				}
+				cur.CompareAndSwap(nil, h)
+				continue
+			}
+			if h.lockLive(p.clock) {
+				if exemplar != nil {
+					h.Histogram.(prometheus.ExemplarObserver).ObserveWithExemplar(val, exemplar)
+				} else {
+					h.Observe(val)
+				}
+				h.mut.RUnlock()
+				return
+			}
+			recreated := p.newHistogram(key, hash, h.constLabels, buckets)
+			if recreated == nil {
+				return
 			}
-			s.markUpdated()
+			cur.CompareAndSwap(h, recreated)
+		}
+	}
+}
+
+// dualHistogram returns whether the metric of the key is also observed into a
+// histogram, see PrometheusOpts.DualHistograms
+func (p *PrometheusSink) dualHistogram(key string) bool {
+	if p.dualHistograms {
+		return true
+	}
+	_, ok := p.dualHistogramKeys[key]
+	return ok
+}
 
-			s.Observe(val)
-			s.mut.RUnlock()
+// logUnknownType logs that the sink drops the metrics of a type it doesn't
+// know, once per type
+func (p *PrometheusSink) logUnknownType(mType metrics.MetricType) {
+	if _, logged := p.unknownTypes.LoadOrStore(mType, struct{}{}); !logged {
+		log.Printf("[WARN] Unknown metric type %d, the Prometheus sink drops its metrics", mType)
+	}
+}
+
+// An ExemplarEmitter emits a value along with an exemplar, such as the trace
+// ID of the observation
+type ExemplarEmitter func(val float64, exemplar []metrics.Label)
+
+// BuildMetricEmitterWithExemplar is like BuildMetricEmitter, with an emitter
+// that attaches an OpenMetrics exemplar to the value. Counters keep the
+// exemplar. Histograms, timers, and distributions are summaries in this sink,
+// which the Prometheus client doesn't support exemplars on, so their exemplar
+// is kept on the observed bucket of the dual histogram if the key has one, see
+// PrometheusOpts.DualHistograms, and ignored otherwise like for gauges.
+// Invalid exemplars, with a bad label name or over prometheus.ExemplarMaxRunes,
+// are dropped and the value is emitted.
+func (p *PrometheusSink) BuildMetricEmitterWithExemplar(mType metrics.MetricType, keys []string, labels []metrics.Label) ExemplarEmitter {
+	observed := mType == metrics.MetricTypeHistogram ||
+		mType == metrics.MetricTypeTimer ||
+		mType == metrics.MetricTypeDistribution
+	if mType != metrics.MetricTypeCounter && !observed {
+		emitter := p.BuildMetricEmitter(mType, keys, labels)
+		return func(val float64, _ []metrics.Label) {
+			emitter(val)
 		}
 	}
 
-	// should never fall through here
-	return func(val float64) {}
+	labels = p.withConstLabels(labels)
+	key, hash := p.flattenKey(keys, labels)
+	if key == "" {
+		return func(val float64, _ []metrics.Label) {}
+	}
+
+	if observed {
+		observe := p.summaryEmitter(key, hash, labels)
+		if !p.dualHistogram(key) {
+			return func(val float64, _ []metrics.Label) {
+				observe(val)
+			}
+		}
+
+		observeHistogram := p.dualHistogramEmitter(key, labels)
+		return func(val float64, exemplar []metrics.Label) {
+			observe(val)
+			observeHistogram(val, exemplarLabels(exemplar))
+		}
+	}
+
+	add := p.buildCounter(key, hash, labels)
+	return func(val float64, exemplar []metrics.Label) {
+		add(val, exemplarLabels(exemplar))
+	}
+}
+
+// buildCounter returns a func adding to the counter series and attaching the
+// exemplar, if not nil
+func (p *PrometheusSink) buildCounter(key string, hash uint64, labels []metrics.Label) func(val float64, exemplar prometheus.Labels) {
+	var cur atomic.Pointer[counter]
+	cur.Store(p.loadCounter(key, hash, labels))
+
+	return func(val float64, exemplar prometheus.Labels) {
+		// Prometheus counters are monotonic and panic on a negative
+		// increment, so decrements are ignored
+		if val < 0 {
+			return
+		}
+
+		for {
+			c := cur.Load()
+			if c == nil {
+				// refused at MaxSeries, retried until there is room
+				if c = p.loadCounter(key, hash, labels); c == nil {
+					return
+				}
+				cur.CompareAndSwap(nil, c)
+				continue
+			}
+			if c.lockLive(p.clock) {
+				if exemplar != nil {
+					c.Counter.(prometheus.ExemplarAdder).AddWithExemplar(val, exemplar)
+				} else {
+					c.Add(val)
+				}
+				c.mut.RUnlock()
+				return
+			}
+			recreated := p.newCounter(key, hash, c.constLabels)
+			if recreated == nil {
+				return
+			}
+			cur.CompareAndSwap(c, recreated)
+		}
+	}
+}
+
+// exemplarLabels returns the exemplar as labels for the Prometheus client,
+// or nil if it is empty or invalid, which the client would panic on
+func exemplarLabels(exemplar []metrics.Label) prometheus.Labels {
+	if len(exemplar) == 0 {
+		return nil
+	}
+
+	var runes int
+	for _, l := range exemplar {
+		if !model.LabelName(l.Name).IsValid() || !utf8.ValidString(l.Value) {
+			return nil
+		}
+		runes += utf8.RuneCountInString(l.Name) + utf8.RuneCountInString(l.Value)
+	}
+	if runes > prometheus.ExemplarMaxRunes {
+		return nil
+	}
+	return prometheusLabels(exemplar)
 }
 
-func (p *PrometheusSink) loadCounter(key string, hash string, labels []metrics.Label) *counter {
+// ForgetMetric drops the series for the metric so that it is no longer
+// collected, rather than waiting for it to expire. Pre-declared metrics are
+// never dropped. A later emit to the series re-creates it. The running total
+// of an up/down counter is dropped too, so emitters built later start from
+// zero, while those built before keep adding to their total.
+func (p *PrometheusSink) ForgetMetric(mType metrics.MetricType, keys []string, labels []metrics.Label) {
+	labels = p.withConstLabels(labels)
+	key, hash := p.flattenKey(keys, labels)
+
+	switch mType {
+	case metrics.MetricTypeCounter:
+		p.forget(&p.counters, &p.liveCounters, hash, func(v interface{}) *expirableMetric {
+			return &v.(*counter).expirableMetric
+		})
+	case metrics.MetricTypeGauge, metrics.MetricTypeUpDownCounter:
+		if mType == metrics.MetricTypeUpDownCounter {
+			p.upDownTotals.Delete(hash)
+		}
+		p.forget(&p.gauges, &p.liveGauges, hash, func(v interface{}) *expirableMetric {
+			return &v.(*gauge).expirableMetric
+		})
+	case metrics.MetricTypeHistogram, metrics.MetricTypeTimer, metrics.MetricTypeDistribution:
+		p.forget(&p.summaries, &p.liveSummaries, hash, func(v interface{}) *expirableMetric {
+			return &v.(*summary).expirableMetric
+		})
+		p.forget(&p.histograms, &p.liveHistograms, hash, func(v interface{}) *expirableMetric {
+			return &v.(*histogram).expirableMetric
+		})
+		if p.dualHistogram(key) {
+			_, dualHash := p.flattenKey([]string{key + dualHistogramSuffix}, labels)
+			p.forget(&p.histograms, &p.liveHistograms, dualHash, func(v interface{}) *expirableMetric {
+				return &v.(*histogram).expirableMetric
+			})
+		}
+	}
+}
+
+// forget marks the series stored under hash as deleted and removes it, in the
+// same way collection does on expiry
+func (p *PrometheusSink) forget(m *sync.Map, live *atomic.Int64, hash uint64, expirable func(interface{}) *expirableMetric) {
+	v, ok := m.Load(hash)
+	if !ok {
+		return
+	}
+
+	p.remove(m, live, hash, v, expirable(v))
+}
+
+// remove marks a series created at runtime as deleted and removes it from the
+// map, unless it already was
+func (p *PrometheusSink) remove(m *sync.Map, live *atomic.Int64, k, v interface{}, e *expirableMetric) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	if e.canDelete && !e.deleted {
+		e.deleted = true
+		m.CompareAndDelete(k, v)
+		p.releaseSeries()
+		live.Add(-1)
+	}
+}
+
+func (p *PrometheusSink) loadCounter(key string, hash uint64, labels []metrics.Label) *counter {
 	pc, ok := p.counters.Load(hash)
 	if ok {
 		return pc.(*counter)
 	}
 
-	return p.newCounter(key, hash, labels)
+	return p.newCounter(key, hash, prometheusLabels(labels))
+}
+
+// reserveSeries returns whether a new series can be created under MaxSeries,
+// counting it if so and as dropped if not
+func (p *PrometheusSink) reserveSeries() bool {
+	if p.maxSeries <= 0 {
+		return true
+	}
+	if p.series.Add(1) > p.maxSeries {
+		p.series.Add(-1)
+		p.droppedSeries.Add(1)
+		return false
+	}
+	return true
+}
+
+// releaseSeries uncounts a series that was removed, or not stored
+func (p *PrometheusSink) releaseSeries() {
+	if p.maxSeries > 0 {
+		p.series.Add(-1)
+	}
+}
+
+// DroppedSeries returns the number of times a new series was refused because
+// MaxSeries was reached
+func (p *PrometheusSink) DroppedSeries() uint64 {
+	return p.droppedSeries.Load()
 }
 
-func (p *PrometheusSink) newCounter(key string, hash string, labels []metrics.Label) *counter {
+// newCounter creates the series, or returns nil if MaxSeries is reached. The
+// constLabels map is kept by the series and must not be modified.
+func (p *PrometheusSink) newCounter(key string, hash uint64, constLabels prometheus.Labels) *counter {
+	// re-created after a pre-declared series was replaced by Reset
+	if v, ok := p.counters.Load(hash); ok && !v.(*counter).canDelete {
+		return v.(*counter)
+	}
+	if !p.reserveSeries() {
+		return nil
+	}
+
 	help := key
-	existingHelp, ok := p.help[fmt.Sprintf("counter.%s", key)]
+	existingHelp, ok := p.help["counter."+key]
 	if ok {
 		help = existingHelp
 	}
 	c := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   p.namespace,
+		Subsystem:   p.subsystem,
 		Name:        key,
 		Help:        help,
-		ConstLabels: prometheusLabels(labels),
+		ConstLabels: constLabels,
 	})
 	pc := &counter{
-		Counter: c,
+		Counter:     c,
+		constLabels: constLabels,
 		expirableMetric: expirableMetric{
-			updatedAtNano: time.Now().UnixNano(),
+			updatedAtNano: p.clock.Now().UnixNano(),
 			canDelete:     true,
 		},
 	}
-	ret, _ := p.counters.LoadOrStore(hash, pc)
+	ret, loaded := p.counters.LoadOrStore(hash, pc)
+	if loaded {
+		p.releaseSeries()
+	} else {
+		p.createdSeries.Add(1)
+		p.liveCounters.Add(1)
+	}
 
 	return ret.(*counter)
 }
 
-func (p *PrometheusSink) loadGauge(key string, hash string, labels []metrics.Label) *gauge {
+func (p *PrometheusSink) loadGauge(key string, hash uint64, labels []metrics.Label) *gauge {
 	pg, ok := p.gauges.Load(hash)
 	if ok {
 		return pg.(*gauge)
 	}
 
-	return p.newGauge(key, hash, labels)
+	return p.newGauge(key, hash, prometheusLabels(labels))
 }
 
-func (p *PrometheusSink) newGauge(key string, hash string, labels []metrics.Label) *gauge {
+// newGauge creates the series, or returns nil if MaxSeries is reached. The
+// constLabels map is kept by the series and must not be modified.
+func (p *PrometheusSink) newGauge(key string, hash uint64, constLabels prometheus.Labels) *gauge {
+	// re-created after a pre-declared series was replaced by Reset
+	if v, ok := p.gauges.Load(hash); ok && !v.(*gauge).canDelete {
+		return v.(*gauge)
+	}
+	if !p.reserveSeries() {
+		return nil
+	}
+
 	help := key
-	existingHelp, ok := p.help[fmt.Sprintf("gauge.%s", key)]
+	existingHelp, ok := p.help["gauge."+key]
 	if ok {
 		help = existingHelp
 	}
 	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   p.namespace,
+		Subsystem:   p.subsystem,
 		Name:        key,
 		Help:        help,
-		ConstLabels: prometheusLabels(labels),
+		ConstLabels: constLabels,
 	})
 
 	pg := &gauge{
-		Gauge: g,
+		Gauge:       g,
+		constLabels: constLabels,
 		expirableMetric: expirableMetric{
-			updatedAtNano: time.Now().UnixNano(),
+			updatedAtNano: p.clock.Now().UnixNano(),
 			canDelete:     true,
 		},
 	}
-	ret, _ := p.gauges.LoadOrStore(hash, pg)
+	ret, loaded := p.gauges.LoadOrStore(hash, pg)
+	if loaded {
+		p.releaseSeries()
+	} else {
+		p.createdSeries.Add(1)
+		p.liveGauges.Add(1)
+	}
 
 	return ret.(*gauge)
 }
 
-func (p *PrometheusSink) loadSummary(key string, hash string, labels []metrics.Label) *summary {
+func (p *PrometheusSink) loadSummary(key string, hash uint64, labels []metrics.Label) *summary {
 	pg, ok := p.summaries.Load(hash)
 	if ok {
 		return pg.(*summary)
 	}
 
-	return p.newSummary(key, hash, labels)
+	return p.newSummary(key, hash, prometheusLabels(labels))
 }
 
-func (p *PrometheusSink) newSummary(key string, hash string, labels []metrics.Label) *summary {
+// newSummary creates the series, or returns nil if MaxSeries is reached. The
+// constLabels map is kept by the series and must not be modified.
+func (p *PrometheusSink) newSummary(key string, hash uint64, constLabels prometheus.Labels) *summary {
+	// re-created after a pre-declared series was replaced by Reset
+	if v, ok := p.summaries.Load(hash); ok && !v.(*summary).canDelete {
+		return v.(*summary)
+	}
+	if !p.reserveSeries() {
+		return nil
+	}
+
 	help := key
-	existingHelp, ok := p.help[fmt.Sprintf("summary.%s", key)]
+	existingHelp, ok := p.help["summary."+key]
 	if ok {
 		help = existingHelp
 	}
 	s := prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace:   p.namespace,
+		Subsystem:   p.subsystem,
 		Name:        key,
 		Help:        help,
 		MaxAge:      10 * time.Second,
-		ConstLabels: prometheusLabels(labels),
+		ConstLabels: constLabels,
 		Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
 	})
 	ps := &summary{
-		Summary: s,
+		Summary:     s,
+		constLabels: constLabels,
 		expirableMetric: expirableMetric{
-			updatedAtNano: time.Now().UnixNano(),
+			updatedAtNano: p.clock.Now().UnixNano(),
 			canDelete:     true,
 		},
 	}
-	ret, _ := p.summaries.LoadOrStore(hash, ps)
+	ret, loaded := p.summaries.LoadOrStore(hash, ps)
+	if loaded {
+		p.releaseSeries()
+	} else {
+		p.createdSeries.Add(1)
+		p.liveSummaries.Add(1)
+	}
 
 	return ret.(*summary)
 }
 
+func (p *PrometheusSink) loadHistogram(key string, hash uint64, labels []metrics.Label, buckets []float64) *histogram {
+	ph, ok := p.histograms.Load(hash)
+	if ok {
+		return ph.(*histogram)
+	}
+
+	return p.newHistogram(key, hash, prometheusLabels(labels), buckets)
+}
+
+// newHistogram creates the series, or returns nil if MaxSeries is reached.
+// The constLabels map is kept by the series and must not be modified.
+func (p *PrometheusSink) newHistogram(key string, hash uint64, constLabels prometheus.Labels, buckets []float64) *histogram {
+	if !p.reserveSeries() {
+		return nil
+	}
+
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace:   p.namespace,
+		Subsystem:   p.subsystem,
+		Name:        key,
+		Help:        key,
+		ConstLabels: constLabels,
+		Buckets:     buckets,
+	})
+	ph := &histogram{
+		Histogram:   h,
+		constLabels: constLabels,
+		expirableMetric: expirableMetric{
+			updatedAtNano: p.clock.Now().UnixNano(),
+			canDelete:     true,
+		},
+	}
+	ret, loaded := p.histograms.LoadOrStore(hash, ph)
+	if loaded {
+		p.releaseSeries()
+	} else {
+		p.createdSeries.Add(1)
+		p.liveHistograms.Add(1)
+	}
+
+	return ret.(*histogram)
+}
+
 // Describe sends a Collector.Describe value from the descriptor created around PrometheusSink.Name
 // Note that we cannot describe all the metrics (gauges, counters, summaries) in the sink as
 // metrics can be added at any point during the lifecycle of the sink, which does not respect
@@ -326,7 +938,99 @@ func (p *PrometheusSink) Describe(c chan<- *prometheus.Desc) {
 // logic to clean up ephemeral metrics if their value haven't been set for a
 // duration exceeding our allowed expiration time.
 func (p *PrometheusSink) Collect(c chan<- prometheus.Metric) {
-	p.collectAtTime(c, time.Now())
+	p.collectAtTime(c, p.clock.Now())
+	if p.reportStats {
+		p.collectStats(c)
+	}
+}
+
+// Gather collects the metrics of the sink into a throwaway registry, as a
+// scrape would, without the registry the sink is registered in. It's meant
+// for debugging, e.g. in tests and CLI tools. Like a scrape, it deletes the
+// series that expired.
+func (p *PrometheusSink) Gather() ([]*dto.MetricFamily, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(p); err != nil {
+		return nil, err
+	}
+	return reg.Gather()
+}
+
+// WriteText writes the metrics of Gather in the Prometheus text format
+func (p *PrometheusSink) WriteText(w io.Writer) error {
+	families, err := p.Gather()
+	if err != nil {
+		return err
+	}
+	for _, f := range families {
+		if _, err := expfmt.MetricFamilyToText(w, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset drops the series created at runtime and resets the pre-declared
+// metrics to zero, as if the sink was just created. It is safe to call while
+// emitting and collecting, emitters re-create their series on the next emit.
+// Up/down counters keep their running totals, which would be wrong otherwise.
+func (p *PrometheusSink) Reset() {
+	p.resetMap(&p.counters, &p.liveCounters, func(v interface{}) *expirableMetric {
+		return &v.(*counter).expirableMetric
+	})
+	p.resetMap(&p.gauges, &p.liveGauges, func(v interface{}) *expirableMetric {
+		return &v.(*gauge).expirableMetric
+	})
+	p.resetMap(&p.summaries, &p.liveSummaries, func(v interface{}) *expirableMetric {
+		return &v.(*summary).expirableMetric
+	})
+	p.resetMap(&p.histograms, &p.liveHistograms, func(v interface{}) *expirableMetric {
+		return &v.(*histogram).expirableMetric
+	})
+
+	p.initGauges(true)
+	p.initSummaries(true)
+	p.initCounters(true)
+}
+
+// resetMap removes the series of the map created at runtime
+func (p *PrometheusSink) resetMap(m *sync.Map, live *atomic.Int64, expirable func(interface{}) *expirableMetric) {
+	m.Range(func(k, v interface{}) bool {
+		p.remove(m, live, k, v, expirable(v))
+		return true
+	})
+}
+
+// Stats returns the counts of the sink's series
+func (p *PrometheusSink) Stats() SinkStats {
+	return SinkStats{
+		Created:        p.createdSeries.Load(),
+		Expired:        p.expiredSeries.Load(),
+		Dropped:        p.droppedSeries.Load(),
+		LiveCounters:   p.liveCounters.Load(),
+		LiveGauges:     p.liveGauges.Load(),
+		LiveSummaries:  p.liveSummaries.Load(),
+		LiveHistograms: p.liveHistograms.Load(),
+	}
+}
+
+// collectStats sends the Stats as metrics, see PrometheusOpts.ReportStats
+func (p *PrometheusSink) collectStats(c chan<- prometheus.Metric) {
+	name := func(n string) string {
+		return prometheus.BuildFQName(p.namespace, p.subsystem, "prometheus_sink_series_"+n)
+	}
+	constLabels := prometheusLabels(p.constLabels)
+	created := prometheus.NewDesc(name("created_total"), "Series created at runtime", nil, constLabels)
+	expired := prometheus.NewDesc(name("expired_total"), "Series deleted on expiry", nil, constLabels)
+	live := prometheus.NewDesc(name("live"), "Series currently collected", []string{"type"}, constLabels)
+
+	stats := p.Stats()
+	c <- prometheus.MustNewConstMetric(created, prometheus.CounterValue, float64(stats.Created))
+	c <- prometheus.MustNewConstMetric(expired, prometheus.CounterValue, float64(stats.Expired))
+	c <- prometheus.MustNewConstMetric(live, prometheus.GaugeValue, float64(stats.LiveCounters), "counter")
+	c <- prometheus.MustNewConstMetric(live, prometheus.GaugeValue, float64(stats.LiveGauges), "gauge")
+	c <- prometheus.MustNewConstMetric(live, prometheus.GaugeValue, float64(stats.LiveSummaries), "summary")
+	c <- prometheus.MustNewConstMetric(live, prometheus.GaugeValue, float64(stats.LiveHistograms), "histogram")
 }
 
 // collectAtTime allows internal testing of the expiry based logic here without
@@ -339,12 +1043,20 @@ func (p *PrometheusSink) collectAtTime(c chan<- prometheus.Metric, t time.Time)
 		}
 		g := v.(*gauge)
 		g.mut.Lock()
+		if g.deleted {
+			// removed by a concurrent sweep or forget
+			g.mut.Unlock()
+			return true
+		}
 
 		lastUpdate := time.Unix(0, g.updatedAtNano)
 		if expire && lastUpdate.Add(p.expiration).Before(t) {
 			if g.canDelete {
 				g.deleted = true
-				p.gauges.Delete(k)
+				p.gauges.CompareAndDelete(k, v)
+				p.releaseSeries()
+				p.expiredSeries.Add(1)
+				p.liveGauges.Add(-1)
 				g.mut.Unlock()
 				return true
 			}
@@ -359,12 +1071,20 @@ func (p *PrometheusSink) collectAtTime(c chan<- prometheus.Metric, t time.Time)
 		}
 		s := v.(*summary)
 		s.mut.Lock()
+		if s.deleted {
+			// removed by a concurrent sweep or forget
+			s.mut.Unlock()
+			return true
+		}
 
 		lastUpdate := time.Unix(0, s.updatedAtNano)
 		if expire && lastUpdate.Add(p.expiration).Before(t) {
 			if s.canDelete {
 				s.deleted = true
-				p.summaries.Delete(k)
+				p.summaries.CompareAndDelete(k, v)
+				p.releaseSeries()
+				p.expiredSeries.Add(1)
+				p.liveSummaries.Add(-1)
 				s.mut.Unlock()
 				return true
 			}
@@ -373,18 +1093,54 @@ func (p *PrometheusSink) collectAtTime(c chan<- prometheus.Metric, t time.Time)
 		s.Collect(c)
 		return true
 	})
+	p.histograms.Range(func(k, v interface{}) bool {
+		if v == nil {
+			return true
+		}
+		h := v.(*histogram)
+		h.mut.Lock()
+		if h.deleted {
+			// removed by a concurrent sweep or forget
+			h.mut.Unlock()
+			return true
+		}
+
+		lastUpdate := time.Unix(0, h.updatedAtNano)
+		if expire && lastUpdate.Add(p.expiration).Before(t) {
+			if h.canDelete {
+				h.deleted = true
+				p.histograms.CompareAndDelete(k, v)
+				p.releaseSeries()
+				p.expiredSeries.Add(1)
+				p.liveHistograms.Add(-1)
+				h.mut.Unlock()
+				return true
+			}
+		}
+		h.mut.Unlock()
+		h.Collect(c)
+		return true
+	})
 	p.counters.Range(func(k, v interface{}) bool {
 		if v == nil {
 			return true
 		}
 		count := v.(*counter)
 		count.mut.Lock()
+		if count.deleted {
+			// removed by a concurrent sweep or forget
+			count.mut.Unlock()
+			return true
+		}
 
 		lastUpdate := time.Unix(0, count.updatedAtNano)
 		if expire && lastUpdate.Add(p.expiration).Before(t) {
 			if count.canDelete {
 				count.deleted = true
-				p.counters.Delete(k)
+				p.counters.CompareAndDelete(k, v)
+				p.releaseSeries()
+				p.expiredSeries.Add(1)
+				p.liveCounters.Add(-1)
 				count.mut.Unlock()
 				return true
 			}
@@ -395,66 +1151,245 @@ func (p *PrometheusSink) collectAtTime(c chan<- prometheus.Metric, t time.Time)
 	})
 }
 
-func initGauges(m *sync.Map, gauges []GaugeDefinition, help map[string]string) {
-	for _, g := range gauges {
-		key, hash := flattenKey([]string{g.Name}, g.ConstLabels)
-		help[fmt.Sprintf("gauge.%s", key)] = g.Help
+// initGauges creates the pre-declared gauges at zero. When reset, the help is
+// already set and the current series are replaced.
+func (p *PrometheusSink) initGauges(reset bool) {
+	for _, g := range p.gaugeDefinitions {
+		labels := p.withConstLabels(g.ConstLabels)
+		key, hash := p.flattenKey([]string{g.Name}, labels)
+		if key == "" {
+			log.Printf("[ERR] Skipping Prometheus definition without a valid name: %q", g.Name)
+			continue
+		}
+		constLabels := prometheusLabels(labels)
+		if !reset {
+			p.help["gauge."+key] = g.Help
+		}
 		pG := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   p.namespace,
+			Subsystem:   p.subsystem,
 			Name:        key,
 			Help:        g.Help,
-			ConstLabels: prometheusLabels(g.ConstLabels),
+			ConstLabels: constLabels,
 		})
-		m.Store(hash, &gauge{Gauge: pG})
+		prev, loaded := p.gauges.Swap(hash, &gauge{Gauge: pG, constLabels: constLabels})
+		if !loaded {
+			p.liveGauges.Add(1)
+		} else {
+			markDeleted(&prev.(*gauge).expirableMetric)
+		}
 	}
-	return
 }
 
-func initSummaries(m *sync.Map, summaries []SummaryDefinition, help map[string]string) {
-	for _, s := range summaries {
-		key, hash := flattenKey([]string{s.Name}, s.ConstLabels)
-		help[fmt.Sprintf("summary.%s", key)] = s.Help
+func (p *PrometheusSink) initSummaries(reset bool) {
+	for _, s := range p.summaryDefinitions {
+		labels := p.withConstLabels(s.ConstLabels)
+		key, hash := p.flattenKey([]string{s.Name}, labels)
+		if key == "" {
+			log.Printf("[ERR] Skipping Prometheus definition without a valid name: %q", s.Name)
+			continue
+		}
+		constLabels := prometheusLabels(labels)
+		if !reset {
+			p.help["summary."+key] = s.Help
+		}
 		pS := prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:   p.namespace,
+			Subsystem:   p.subsystem,
 			Name:        key,
 			Help:        s.Help,
 			MaxAge:      10 * time.Second,
-			ConstLabels: prometheusLabels(s.ConstLabels),
+			ConstLabels: constLabels,
 			Objectives:  map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
 		})
-		m.Store(hash, &summary{Summary: pS})
+		prev, loaded := p.summaries.Swap(hash, &summary{Summary: pS, constLabels: constLabels})
+		if !loaded {
+			p.liveSummaries.Add(1)
+		} else {
+			markDeleted(&prev.(*summary).expirableMetric)
+		}
 	}
-	return
 }
 
-func initCounters(m *sync.Map, counters []CounterDefinition, help map[string]string) {
-	for _, c := range counters {
-		key, hash := flattenKey([]string{c.Name}, c.ConstLabels)
-		help[fmt.Sprintf("counter.%s", key)] = c.Help
+func (p *PrometheusSink) initCounters(reset bool) {
+	for _, c := range p.counterDefinitions {
+		labels := p.withConstLabels(c.ConstLabels)
+		key, hash := p.flattenKey([]string{c.Name}, labels)
+		if key == "" {
+			log.Printf("[ERR] Skipping Prometheus definition without a valid name: %q", c.Name)
+			continue
+		}
+		constLabels := prometheusLabels(labels)
+		if !reset {
+			p.help["counter."+key] = c.Help
+		}
 		pC := prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   p.namespace,
+			Subsystem:   p.subsystem,
 			Name:        key,
 			Help:        c.Help,
-			ConstLabels: prometheusLabels(c.ConstLabels),
+			ConstLabels: constLabels,
 		})
-		m.Store(hash, &counter{Counter: pC})
+		prev, loaded := p.counters.Swap(hash, &counter{Counter: pC, constLabels: constLabels})
+		if !loaded {
+			p.liveCounters.Add(1)
+		} else {
+			markDeleted(&prev.(*counter).expirableMetric)
+		}
 	}
-	return
 }
 
-var forbiddenChars = regexp.MustCompile("[ .=\\-/]")
+// markDeleted marks a series replaced in its map as deleted, so that emitters
+// holding it load the replacement
+func markDeleted(e *expirableMetric) {
+	e.mut.Lock()
+	e.deleted = true
+	e.mut.Unlock()
+}
 
-func flattenKey(parts []string, labels []metrics.Label) (string, string) {
-	key := strings.Join(parts, "_")
-	key = forbiddenChars.ReplaceAllString(key, "_")
+// withConstLabels returns the sink's const labels followed by the labels,
+// which are part of the series hash like any other label
+func (p *PrometheusSink) withConstLabels(labels []metrics.Label) []metrics.Label {
+	if len(p.constLabels) == 0 {
+		return labels
+	}
+
+	all := make([]metrics.Label, 0, len(p.constLabels)+len(labels))
+	all = append(all, p.constLabels...)
+	return append(all, labels...)
+}
 
-	hash := key
+// forbiddenChars replaces the characters not allowed in metric names
+var forbiddenChars = strings.NewReplacer(" ", "_", ".", "_", "=", "_", "-", "_", "/", "_")
+
+// forbiddenCharsKeepDots is forbiddenChars for PrometheusOpts.KeepDots
+var forbiddenCharsKeepDots = strings.NewReplacer(" ", "_", "=", "_", "-", "_", "/", "_")
+
+// maxFixedNames bounds the invalid names a fixedNames logs
+const maxFixedNames = 100
+
+// fixedNames logs the invalid names changed to valid ones, once per name. Only
+// the first maxFixedNames names are logged, as generated keys could otherwise
+// grow the set without bound.
+type fixedNames struct {
+	lock  sync.Mutex
+	names map[string]struct{}
+}
+
+// log logs that the name was changed, unless it already was or too many were
+func (f *fixedNames) log(name, fixed string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, logged := f.names[name]; logged || len(f.names) > maxFixedNames {
+		return
+	}
+	if f.names == nil {
+		f.names = make(map[string]struct{})
+	}
+	f.names[name] = struct{}{}
+	if len(f.names) > maxFixedNames {
+		log.Printf("[WARN] Over %d invalid Prometheus names, no longer logging them", maxFixedNames)
+		return
+	}
+	log.Printf("[WARN] Invalid Prometheus name %q changed to %q", name, fixed)
+}
+
+// validName returns the name changed to be a valid Prometheus metric name, if
+// it isn't. Invalid characters are replaced with '_' and a name starting with
+// a digit is prefixed with '_'. Changes are logged to fixed, if not nil. An
+// empty name can't be fixed and is returned as is.
+func validName(name string, fixed *fixedNames) string {
+	return fixName(name, validNameRune, fixed)
+}
+
+// validDottedName is validName for PrometheusOpts.KeepDots, keeping dots
+func validDottedName(name string, fixed *fixedNames) string {
+	return fixName(name, func(r rune, i int) bool {
+		return r == '.' || validNameRune(r, i)
+	}, fixed)
+}
+
+// fixName is validName, with validRune telling the runes valid in a name
+func fixName(name string, validRune func(r rune, i int) bool, fixedNames *fixedNames) string {
+	valid := true
+	for i, r := range name {
+		if !validRune(r, i) {
+			valid = false
+			break
+		}
+	}
+	if valid {
+		return name
+	}
+
+	fixed := strings.Map(func(r rune) rune {
+		if validRune(r, 1) {
+			return r
+		}
+		return '_'
+	}, name)
+	if fixed[0] >= '0' && fixed[0] <= '9' {
+		fixed = "_" + fixed
+	}
+
+	if fixedNames != nil {
+		fixedNames.log(name, fixed)
+	}
+	return fixed
+}
+
+// validNameRune returns whether the rune at byte offset i is valid in a
+// metric name, where digits are not allowed first
+func validNameRune(r rune, i int) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_' || r == ':' ||
+		(r >= '0' && r <= '9' && i > 0)
+}
+
+// flattenKey returns the metric name for the keys, and a hash identifying the
+// series by its name and labels. Each string is hashed with its length, so
+// that label values containing separators can't collide with other labels.
+// The name is made valid with validName, without logging, and is empty if
+// nothing is left of the keys.
+func flattenKey(parts []string, labels []metrics.Label) (string, uint64) {
+	key := validName(forbiddenChars.Replace(strings.Join(parts, "_")), nil)
+	return key, seriesHash(key, labels)
+}
+
+// flattenKey is flattenKey, logging the invalid names fixed and keeping dots
+// with PrometheusOpts.KeepDots
+func (p *PrometheusSink) flattenKey(parts []string, labels []metrics.Label) (string, uint64) {
+	var key string
+	if p.keepDots {
+		key = validDottedName(forbiddenCharsKeepDots.Replace(strings.Join(parts, ".")), &p.fixedNames)
+	} else {
+		key = validName(forbiddenChars.Replace(strings.Join(parts, "_")), &p.fixedNames)
+	}
+	return key, seriesHash(key, labels)
+}
+
+// seriesHash returns the hash identifying the series of the name and labels
+func seriesHash(key string, labels []metrics.Label) uint64 {
+	var d xxhash.Digest
+	d.Reset()
+	writeHashString(&d, key)
 	for _, label := range labels {
-		hash += fmt.Sprintf(";%s=%s", label.Name, label.Value)
+		writeHashString(&d, label.Name)
+		writeHashString(&d, label.Value)
 	}
 
-	return key, hash
+	return d.Sum64()
+}
+
+func writeHashString(d *xxhash.Digest, s string) {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], uint64(len(s)))
+	d.Write(n[:])
+	d.WriteString(s)
 }
 
 func prometheusLabels(labels []metrics.Label) prometheus.Labels {
-	l := make(prometheus.Labels)
+	l := make(prometheus.Labels, len(labels))
 	for _, label := range labels {
 		l[label.Name] = label.Value
 	}
@@ -471,14 +1406,27 @@ type PrometheusPushSink struct {
 	stopChan     chan struct{}
 }
 
+// A PrometheusPushOption configures a PrometheusPushSink
+type PrometheusPushOption func(s *PrometheusPushSink)
+
+// WithPushGatherer includes the metrics of the gatherer in each push, such as
+// a registry of the client's Go and process collectors
+func WithPushGatherer(g prometheus.Gatherer) PrometheusPushOption {
+	return func(s *PrometheusPushSink) {
+		s.pusher.Gatherer(g)
+	}
+}
+
 // NewPrometheusPushSink creates a PrometheusPushSink by taking an address, interval, and destination name.
-func NewPrometheusPushSink(address string, pushInterval time.Duration, name string) (*PrometheusPushSink, error) {
+func NewPrometheusPushSink(address string, pushInterval time.Duration, name string, opts ...PrometheusPushOption) (*PrometheusPushSink, error) {
 	promSink := &PrometheusSink{
 		gauges:     sync.Map{},
 		summaries:  sync.Map{},
 		counters:   sync.Map{},
+		histograms: sync.Map{},
 		expiration: 60 * time.Second,
 		name:       "default_prometheus_sink",
+		clock:      metrics.SystemClock,
 	}
 
 	pusher := push.New(address, name).Collector(promSink)
@@ -490,6 +1438,9 @@ func NewPrometheusPushSink(address string, pushInterval time.Duration, name stri
 		pushInterval,
 		make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(sink)
+	}
 
 	sink.flushMetrics()
 	return sink, nil
@@ -515,9 +1466,9 @@ func (s *PrometheusPushSink) flushMetrics() {
 }
 
 // Shutdown tears down the PrometheusPushSink, and blocks while flushing metrics to the backend.
-func (s *PrometheusPushSink) Shutdown() {
+func (s *PrometheusPushSink) Shutdown() error {
 	close(s.stopChan)
 	// Closing the channel only stops the running goroutine that pushes metrics.
 	// To minimize the chance of data loss pusher.Push is called one last time.
-	_ = s.pusher.Push()
+	return s.pusher.Push()
 }
@@ -1,13 +1,18 @@
 package prometheus
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -17,6 +22,7 @@ import (
 	metrics "github.com/mheffner/go-simple-metrics"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 const (
@@ -141,22 +147,22 @@ func TestDefinitions(t *testing.T) {
 	// definition matches the key we have for the map entry. Should fail if any metrics exist that aren't defined, or if
 	// the defined metrics don't exist.
 	sink.gauges.Range(func(key, value interface{}) bool {
-		name, _ := flattenKey([]string{gaugeDef.Name}, gaugeDef.ConstLabels)
-		if name != key {
+		_, hash := flattenKey([]string{gaugeDef.Name}, gaugeDef.ConstLabels)
+		if hash != key {
 			t.Fatalf("expected my_test_gauge, got #{name}")
 		}
 		return true
 	})
 	sink.summaries.Range(func(key, value interface{}) bool {
-		name, _ := flattenKey([]string{summaryDef.Name}, summaryDef.ConstLabels)
-		if name != key {
+		_, hash := flattenKey([]string{summaryDef.Name}, summaryDef.ConstLabels)
+		if hash != key {
 			t.Fatalf("expected my_test_summary, got #{name}")
 		}
 		return true
 	})
 	sink.counters.Range(func(key, value interface{}) bool {
-		name, _ := flattenKey([]string{counterDef.Name}, counterDef.ConstLabels)
-		if name != key {
+		_, hash := flattenKey([]string{counterDef.Name}, counterDef.ConstLabels)
+		if hash != key {
 			t.Fatalf("expected my_test_counter, got #{name}")
 		}
 		return true
@@ -359,6 +365,50 @@ func TestSetGauge(t *testing.T) {
 	}
 }
 
+func TestPushGatherer(t *testing.T) {
+	names := make(chan []string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		defer r.Body.Close()
+		dec := expfmt.NewDecoder(r.Body, expfmt.NewFormat(expfmt.TypeProtoDelim))
+		var got []string
+		for {
+			m := &dto.MetricFamily{}
+			if err := dec.Decode(m); err != nil {
+				break
+			}
+			got = append(got, m.GetName())
+		}
+		names <- got
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	extra := prometheus.NewCounter(prometheus.CounterOpts{Name: "extra_total", Help: "an extra counter"})
+	reg.MustRegister(extra)
+	extra.Inc()
+
+	sink, err := NewPrometheusPushSink(u.Host, time.Hour, "pushtest", WithPushGatherer(reg))
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"one", "two"}, nil)(42)
+	// shutting down pushes once more
+	if err := sink.Shutdown(); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	got := <-names
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"extra_total", "one_two"}) {
+		t.Fatalf("expected the sink and gatherer metrics, got %v", got)
+	}
+}
+
 func TestDefinitionsWithLabels(t *testing.T) {
 	gaugeDef := GaugeDefinition{
 		Name: "my.test.gauge",
@@ -429,3 +479,1128 @@ func TestMetricSinkInterface(t *testing.T) {
 	var pps *PrometheusPushSink
 	_ = metrics.MetricSink(pps)
 }
+
+func TestCounterIgnoresNegative(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: reg})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	emitter := sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"neg", "counter"}, nil)
+	emitter(5)
+	emitter(-2)
+
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		if pb.Counter == nil {
+			t.Fatalf("unexpected metric type %v", m.Desc())
+		}
+		if *pb.Counter.Value != float64(5) {
+			t.Fatalf("expected counter to ignore the decrement, got %f", *pb.Counter.Value)
+		}
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	emitter := sink.BuildMetricEmitter(metrics.MetricTypeDistribution, []string{"latency"}, nil)
+	emitter(10)
+	emitter(20)
+
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+
+	n := 0
+	for m := range ch {
+		n++
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		// there is no distribution type, they are summaries like histograms
+		if pb.Summary == nil || *pb.Summary.SampleCount != 2 || *pb.Summary.SampleSum != 30 {
+			t.Fatalf("expected a summary of the observations, got %v", &pb)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 metric, got %d", n)
+	}
+}
+
+func TestTimerHistogram(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: reg})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	met, err := metrics.New(sink, func(c *metrics.Config) {
+		c.EnableRuntimeMetrics = false
+		c.TimerHistogramBuckets = []float64{1, 0.1}
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	defer met.Shutdown()
+
+	start := time.Now()
+	timer := met.NewTimerHistogram("latency", metrics.L("route", "a"))
+	timer.MeasureSinceAt(start, start.Add(50*time.Millisecond))
+	timer.MeasureSinceAt(start, start.Add(500*time.Millisecond))
+	timer.MeasureSinceAt(start, start.Add(2*time.Second))
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "latency" || families[0].GetType() != dto.MetricType_HISTOGRAM {
+		t.Fatalf("expected a latency histogram, got %v", families)
+	}
+	h := families[0].GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 3 || h.GetSampleSum() != 2.55 {
+		t.Fatalf("expected 3 observations summing to 2.55s, got %d and %f", h.GetSampleCount(), h.GetSampleSum())
+	}
+	// the buckets are sorted and recorded in seconds, and are cumulative
+	expected := map[float64]uint64{0.1: 1, 1: 2}
+	if len(h.GetBucket()) != len(expected) {
+		t.Fatalf("expected %d buckets, got %v", len(expected), h.GetBucket())
+	}
+	for _, b := range h.GetBucket() {
+		if b.GetCumulativeCount() != expected[b.GetUpperBound()] {
+			t.Fatalf("expected %d observations up to %f, got %d", expected[b.GetUpperBound()], b.GetUpperBound(), b.GetCumulativeCount())
+		}
+	}
+
+	if stats := sink.Stats(); stats.LiveHistograms != 1 || stats.LiveSummaries != 0 {
+		t.Fatalf("expected a single histogram series, got %+v", stats)
+	}
+	timer.Forget()
+	if stats := sink.Stats(); stats.LiveHistograms != 0 {
+		t.Fatalf("expected the histogram to be forgotten, got %+v", stats)
+	}
+}
+
+func TestDualHistograms(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:           reg,
+		Expiration:           time.Minute,
+		DualHistogramKeys:    []string{"latency"},
+		DualHistogramBuckets: []float64{10, 100},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.BuildMetricEmitter(metrics.MetricTypeTimer, []string{"latency"}, []metrics.Label{metrics.L("route", "a")})(50)
+	sink.BuildMetricEmitter(metrics.MetricTypeTimer, []string{"other"}, nil)(50)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	types := map[string]dto.MetricType{}
+	for _, f := range families {
+		types[f.GetName()] = f.GetType()
+		if f.GetName() != "latency_histogram" {
+			continue
+		}
+		h := f.GetMetric()[0].GetHistogram()
+		if h.GetSampleCount() != 1 || h.GetBucket()[0].GetCumulativeCount() != 0 || h.GetBucket()[1].GetCumulativeCount() != 1 {
+			t.Fatalf("expected the observation in the 100 bucket, got %v", h)
+		}
+	}
+	expected := map[string]dto.MetricType{
+		"latency":           dto.MetricType_SUMMARY,
+		"latency_histogram": dto.MetricType_HISTOGRAM,
+		"other":             dto.MetricType_SUMMARY,
+	}
+	if !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected families %v, got %v", expected, types)
+	}
+
+	// both series of the metric expire
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now().Add(2*time.Minute))
+	close(ch)
+	if stats := sink.Stats(); stats.LiveSummaries != 0 || stats.LiveHistograms != 0 {
+		t.Fatalf("expected the series to expire, got %+v", stats)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: reg})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, []metrics.Label{metrics.L("code", "200")})(3)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"queue"}, nil)(7)
+
+	var buf bytes.Buffer
+	if err := sink.WriteText(&buf); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	expected := `# HELP queue queue
+# TYPE queue gauge
+queue 7
+# HELP requests requests
+# TYPE requests counter
+requests{code="200"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("bad output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	// the sink is still collected by the registry it's registered in
+	families, err := reg.Gather()
+	if err != nil || len(families) != 2 {
+		t.Fatalf("expected 2 families from the registry, got %d (err %v)", len(families), err)
+	}
+	if families, err = sink.Gather(); err != nil || len(families) != 2 {
+		t.Fatalf("expected 2 families, got %d (err %v)", len(families), err)
+	}
+}
+
+func TestUpDownCounter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: reg})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	keys := []string{"queue", "depth"}
+	sink.BuildMetricEmitter(metrics.MetricTypeUpDownCounter, keys, nil)(5)
+	sink.BuildMetricEmitter(metrics.MetricTypeUpDownCounter, keys, nil)(-2)
+
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+
+	n := 0
+	for m := range ch {
+		n++
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		if pb.Gauge == nil {
+			t.Fatalf("expected a gauge, got %v", m.Desc())
+		}
+		if *pb.Gauge.Value != float64(3) {
+			t.Fatalf("expected gauge value 3, got %f", *pb.Gauge.Value)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 metric, got %d", n)
+	}
+}
+
+func TestUpDownCounter_Expired(t *testing.T) {
+	clock := &stepClock{Clock: metrics.SystemClock, now: time.Now().Add(-time.Hour)}
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: reg,
+		Expiration: time.Minute,
+		Clock:      clock,
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	value := func() float64 {
+		t.Helper()
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("err = %v, want nil", err)
+		}
+		if len(families) != 1 {
+			t.Fatalf("expected 1 family, got %d", len(families))
+		}
+		return families[0].GetMetric()[0].GetGauge().GetValue()
+	}
+
+	emit := sink.BuildMetricEmitter(metrics.MetricTypeUpDownCounter, []string{"queue", "depth"}, nil)
+	emit(5)
+
+	// the total outlives the expired gauge
+	clock.Advance(2 * time.Minute)
+	if families, _ := reg.Gather(); len(families) != 0 {
+		t.Fatalf("expected the gauge to expire, got %d families", len(families))
+	}
+	emit(-1)
+	if v := value(); v != 4 {
+		t.Fatalf("expected 4 after expiry, got %f", v)
+	}
+
+	// and Reset
+	sink.Reset()
+	emit(2)
+	if v := value(); v != 6 {
+		t.Fatalf("expected 6 after Reset, got %f", v)
+	}
+}
+
+func TestNamespaceSubsystem(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: reg,
+		Namespace:  "org",
+		Subsystem:  "api",
+		GaugeDefinitions: []GaugeDefinition{
+			{Name: "declared", Help: "a declared gauge"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeHistogram, []string{"latency"}, nil)(1)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	help := map[string]string{}
+	for _, f := range families {
+		help[f.GetName()] = f.GetHelp()
+	}
+	expected := map[string]string{
+		"org_api_declared": "a declared gauge",
+		"org_api_requests": "requests",
+		"org_api_latency":  "latency",
+	}
+	if !reflect.DeepEqual(help, expected) {
+		t.Fatalf("expected metrics %v, got %v", expected, help)
+	}
+}
+
+func TestSinkConstLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:  reg,
+		ConstLabels: []metrics.Label{{Name: "instance", Value: "a"}, {Name: "version", Value: "1.2"}},
+		CounterDefinitions: []CounterDefinition{
+			{Name: "declared", Help: "a declared counter", ConstLabels: []metrics.Label{{Name: "kind", Value: "x"}}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, []metrics.Label{{Name: "code", Value: "200"}})(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"queue"}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeHistogram, []string{"latency"}, nil)(1)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if len(families) != 4 {
+		t.Fatalf("expected 4 metrics, got %d", len(families))
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["instance"] != "a" || labels["version"] != "1.2" {
+				t.Fatalf("expected the sink const labels on %s, got %v", f.GetName(), labels)
+			}
+		}
+	}
+
+	// forgetting matches the series with the sink const labels
+	sink.ForgetMetric(metrics.MetricTypeGauge, []string{"queue"}, nil)
+	families, err = reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if len(families) != 3 {
+		t.Fatalf("expected 3 metrics after forget, got %d", len(families))
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: reg,
+		GaugeDefinitions: []GaugeDefinition{
+			{Name: "", Help: "no name"},
+			{Name: "9lives", Help: "starts with a digit"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"2xx", "responses"}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"caf\u00e9@home"}, nil)(1)
+	// an empty key can't be fixed, so it isn't emitted
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{""}, nil)(1)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	expected := []string{"_2xx_responses", "_9lives", "caf__home"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected metrics %v, got %v", expected, names)
+	}
+}
+
+func TestInvalidNames_Logged(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	newSink := func() *PrometheusSink {
+		sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: prometheus.NewRegistry()})
+		if err != nil {
+			t.Fatalf("err = %v, want nil", err)
+		}
+		return sink
+	}
+
+	// each sink logs a name once
+	first, second := newSink(), newSink()
+	first.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"2xx"}, nil)(1)
+	first.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"2xx"}, nil)(1)
+	second.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"2xx"}, nil)(1)
+	if n := strings.Count(buf.String(), `Invalid Prometheus name "2xx"`); n != 2 {
+		t.Fatalf("expected the name to be logged once per sink, got %d times: %s", n, buf.String())
+	}
+
+	// the names logged are bounded
+	buf.Reset()
+	sink := newSink()
+	for i := 0; i < maxFixedNames+10; i++ {
+		sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{fmt.Sprintf("%dxx", i)}, nil)(1)
+	}
+	if n := strings.Count(buf.String(), "Invalid Prometheus name"); n != maxFixedNames {
+		t.Fatalf("expected %d names logged, got %d", maxFixedNames, n)
+	}
+	if n := strings.Count(buf.String(), "no longer logging"); n != 1 {
+		t.Fatalf("expected the limit to be logged once, got %d times", n)
+	}
+	if n := len(sink.fixedNames.names); n != maxFixedNames+1 {
+		t.Fatalf("expected %d names kept, got %d", maxFixedNames+1, n)
+	}
+}
+
+func TestKeepDots(t *testing.T) {
+	// dotted names are refused unless the client validates UTF-8 names
+	if _, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: prometheus.NewRegistry(), KeepDots: true}); err == nil {
+		t.Fatalf("expected an error with the legacy validation scheme")
+	}
+
+	model.NameValidationScheme = model.UTF8Validation
+	defer func() { model.NameValidationScheme = model.LegacyValidation }()
+
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: reg, KeepDots: true})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"http.requests"}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"counter", "db.queries"}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"pool size-max"}, nil)(1)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+	expected := []string{"counter.db.queries", "http.requests", "pool_size_max"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected metrics %v, got %v", expected, names)
+	}
+}
+
+func TestUnknownMetricType(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: reg})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	unknown := metrics.MetricType(100)
+	sink.BuildMetricEmitter(unknown, []string{"a"}, nil)(1)
+	sink.BuildMetricEmitter(unknown, []string{"b"}, nil)(1)
+
+	if n := strings.Count(buf.String(), "Unknown metric type 100"); n != 1 {
+		t.Fatalf("expected the unknown type to be logged once, got %d times: %s", n, buf.String())
+	}
+	if families, _ := reg.Gather(); len(families) != 0 {
+		t.Fatalf("expected no metrics, got %d families", len(families))
+	}
+}
+
+func TestStats(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:  reg,
+		Expiration:  time.Second,
+		ReportStats: true,
+		CounterDefinitions: []CounterDefinition{
+			{Name: "declared", Help: "a declared counter"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"queue"}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"pool"}, nil)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeHistogram, []string{"latency"}, nil)(1)
+	sink.ForgetMetric(metrics.MetricTypeGauge, []string{"pool"}, nil)
+
+	expected := SinkStats{Created: 4, LiveCounters: 2, LiveGauges: 1, LiveSummaries: 1}
+	if stats := sink.Stats(); stats != expected {
+		t.Fatalf("expected stats %+v, got %+v", expected, stats)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	values := map[string]float64{}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			name := f.GetName()
+			for _, l := range m.GetLabel() {
+				name += ";" + l.GetValue()
+			}
+			if m.Counter != nil {
+				values[name] = m.Counter.GetValue()
+			} else if m.Gauge != nil {
+				values[name] = m.Gauge.GetValue()
+			}
+		}
+	}
+	for name, val := range map[string]float64{
+		"prometheus_sink_series_created_total": 4,
+		"prometheus_sink_series_expired_total": 0,
+		"prometheus_sink_series_live;counter":  2,
+		"prometheus_sink_series_live;gauge":    1,
+		"prometheus_sink_series_live;summary":  1,
+	} {
+		if got, ok := values[name]; !ok || got != val {
+			t.Fatalf("expected %s to be %f, got %f", name, val, got)
+		}
+	}
+
+	// the runtime series expire, the declared counter doesn't
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now().Add(2*time.Second))
+	close(ch)
+
+	expected = SinkStats{Created: 4, Expired: 3, LiveCounters: 1}
+	if stats := sink.Stats(); stats != expected {
+		t.Fatalf("expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+// stepClock is a metrics.Clock whose time only moves with Advance
+type stepClock struct {
+	metrics.Clock
+
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *stepClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClock(t *testing.T) {
+	clock := &stepClock{Clock: metrics.SystemClock, now: time.Now().Add(-time.Hour)}
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: reg,
+		Expiration: time.Minute,
+		Clock:      clock,
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	emit := sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"queue"}, nil)
+	emit(1)
+
+	// the gauge expires by the clock, not the time it was set at
+	clock.Advance(30 * time.Second)
+	if families, _ := reg.Gather(); len(families) != 1 {
+		t.Fatalf("expected the gauge to be live, got %d families", len(families))
+	}
+	clock.Advance(time.Minute)
+	if families, _ := reg.Gather(); len(families) != 0 {
+		t.Fatalf("expected the gauge to expire, got %d families", len(families))
+	}
+
+	// emitting again re-creates it at the current time of the clock
+	emit(2)
+	clock.Advance(30 * time.Second)
+	if families, _ := reg.Gather(); len(families) != 1 {
+		t.Fatalf("expected the gauge to be live, got %d families", len(families))
+	}
+}
+
+func TestReset(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: reg,
+		CounterDefinitions: []CounterDefinition{
+			{Name: "declared", Help: "a declared counter"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	declared := sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"declared"}, nil)
+	runtime := sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"runtime"}, nil)
+	declared(5)
+	runtime(5)
+
+	values := func() map[string]float64 {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("err = %v, want nil", err)
+		}
+		values := map[string]float64{}
+		for _, f := range families {
+			m := f.GetMetric()[0]
+			if m.Counter != nil {
+				values[f.GetName()] = m.Counter.GetValue()
+			} else {
+				values[f.GetName()] = m.Gauge.GetValue()
+			}
+		}
+		return values
+	}
+
+	sink.Reset()
+	if got := values(); !reflect.DeepEqual(got, map[string]float64{"declared": 0}) {
+		t.Fatalf("expected only the declared counter at zero, got %v", got)
+	}
+	if stats := sink.Stats(); stats.LiveCounters != 1 || stats.LiveGauges != 0 {
+		t.Fatalf("expected one live counter, got %+v", stats)
+	}
+
+	// emitters built before the reset keep working
+	declared(2)
+	runtime(3)
+	if got := values(); !reflect.DeepEqual(got, map[string]float64{"declared": 2, "runtime": 3}) {
+		t.Fatalf("expected the emitted values after reset, got %v", got)
+	}
+}
+
+func TestResetRace(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: prometheus.NewRegistry(),
+		GaugeDefinitions: []GaugeDefinition{
+			{Name: "declared", Help: "a declared gauge"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	declared := sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"declared"}, nil)
+	runtime := sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"runtime"}, nil)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			declared(1)
+			runtime(1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			sink.Reset()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			ch := make(chan prometheus.Metric, 10)
+			sink.collectAtTime(ch, time.Now())
+			close(ch)
+		}
+	}()
+	wg.Wait()
+
+	// an emit after the last reset always lands in the collected series
+	declared(7)
+	runtime(7)
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+	n := 0
+	for m := range ch {
+		n++
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		if pb.Gauge != nil && pb.Gauge.GetValue() != 7 {
+			t.Fatalf("expected the declared gauge at 7, got %f", pb.Gauge.GetValue())
+		}
+		if pb.Counter != nil && pb.Counter.GetValue() < 7 {
+			t.Fatalf("expected the runtime counter at least 7, got %f", pb.Counter.GetValue())
+		}
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 metrics, got %d", n)
+	}
+	if stats := sink.Stats(); stats.LiveGauges != 1 || stats.LiveCounters != 1 {
+		t.Fatalf("expected one live gauge and counter, got %+v", stats)
+	}
+}
+
+func TestExemplar(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	trace := []metrics.Label{{Name: "trace_id", Value: "abc123"}}
+	sink.BuildMetricEmitterWithExemplar(metrics.MetricTypeCounter, []string{"requests"}, nil)(2, trace)
+	// invalid exemplars are dropped and the value still counted
+	sink.BuildMetricEmitterWithExemplar(metrics.MetricTypeCounter, []string{"errors"}, nil)(1, []metrics.Label{{Name: "bad-name", Value: "x"}})
+	// summaries don't keep exemplars
+	sink.BuildMetricEmitterWithExemplar(metrics.MetricTypeHistogram, []string{"latency"}, nil)(3, trace)
+
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+
+	got := map[string]*dto.Metric{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		got[m.Desc().String()] = &pb
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(got))
+	}
+	for desc, pb := range got {
+		switch {
+		case strings.Contains(desc, `"requests"`):
+			e := pb.Counter.GetExemplar()
+			if pb.Counter.GetValue() != 2 || e.GetValue() != 2 || len(e.GetLabel()) != 1 ||
+				e.GetLabel()[0].GetName() != "trace_id" || e.GetLabel()[0].GetValue() != "abc123" {
+				t.Fatalf("expected the counter with the trace exemplar, got %v", pb)
+			}
+		case strings.Contains(desc, `"errors"`):
+			if pb.Counter.GetValue() != 1 || pb.Counter.GetExemplar() != nil {
+				t.Fatalf("expected the counter without an exemplar, got %v", pb)
+			}
+		case strings.Contains(desc, `"latency"`):
+			if pb.Summary.GetSampleCount() != 1 {
+				t.Fatalf("expected the summary observation, got %v", pb)
+			}
+		default:
+			t.Fatalf("unexpected metric %s", desc)
+		}
+	}
+}
+
+func TestExemplar_Histogram(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:           prometheus.NewRegistry(),
+		DualHistogramKeys:    []string{"latency"},
+		DualHistogramBuckets: []float64{1, 5},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	trace := []metrics.Label{{Name: "trace_id", Value: "abc123"}}
+	sink.BuildMetricEmitterWithExemplar(metrics.MetricTypeTimer, []string{"latency"}, nil)(3, trace)
+	sink.BuildHistogramEmitterWithExemplar(metrics.MetricTypeTimer, []string{"queued"}, nil, []float64{1, 5})(0.5, trace)
+
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+
+	// the exemplar is kept on the bucket of the observation
+	bucketExemplar := func(pb *dto.Metric, bound float64) *dto.Exemplar {
+		for _, b := range pb.Histogram.GetBucket() {
+			if b.GetUpperBound() == bound {
+				return b.GetExemplar()
+			}
+		}
+		return nil
+	}
+	var histograms int
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		desc := m.Desc().String()
+		switch {
+		case strings.Contains(desc, `"latency_histogram"`):
+			histograms++
+			e := bucketExemplar(&pb, 5)
+			if e.GetValue() != 3 || len(e.GetLabel()) != 1 || e.GetLabel()[0].GetValue() != "abc123" {
+				t.Fatalf("expected the trace exemplar on the 5 bucket, got %s", pb.String())
+			}
+		case strings.Contains(desc, `"queued"`):
+			histograms++
+			e := bucketExemplar(&pb, 1)
+			if e.GetValue() != 0.5 || len(e.GetLabel()) != 1 || e.GetLabel()[0].GetValue() != "abc123" {
+				t.Fatalf("expected the trace exemplar on the 1 bucket, got %s", pb.String())
+			}
+		case strings.Contains(desc, `"latency"`):
+			if pb.Summary.GetSampleCount() != 1 {
+				t.Fatalf("expected the summary observation, got %s", pb.String())
+			}
+		default:
+			t.Fatalf("unexpected metric %s", desc)
+		}
+	}
+	if histograms != 2 {
+		t.Fatalf("expected 2 histograms, got %d", histograms)
+	}
+}
+
+func TestForgetMetric(t *testing.T) {
+	gaugeDef := GaugeDefinition{
+		Name: "my.test.gauge",
+		Help: "A gauge for testing? How helpful!",
+	}
+	reg := prometheus.NewRegistry()
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer:       reg,
+		GaugeDefinitions: []GaugeDefinition{gaugeDef},
+	})
+	if err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+
+	labels := []metrics.Label{{Name: "request", Value: "1"}}
+	counterEmitter := sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"ephemeral", "counter"}, labels)
+	counterEmitter(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"ephemeral", "gauge"}, labels)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeHistogram, []string{"ephemeral", "summary"}, labels)(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{gaugeDef.Name}, nil)(42)
+
+	sink.ForgetMetric(metrics.MetricTypeCounter, []string{"ephemeral", "counter"}, labels)
+	sink.ForgetMetric(metrics.MetricTypeGauge, []string{"ephemeral", "gauge"}, labels)
+	sink.ForgetMetric(metrics.MetricTypeHistogram, []string{"ephemeral", "summary"}, labels)
+	// pre-declared metrics are kept
+	sink.ForgetMetric(metrics.MetricTypeGauge, []string{gaugeDef.Name}, nil)
+
+	ch := make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+
+	var got []string
+	for m := range ch {
+		got = append(got, m.Desc().String())
+	}
+	if len(got) != 1 || !strings.Contains(got[0], "my_test_gauge") {
+		t.Fatalf("expected only the pre-declared gauge, got %v", got)
+	}
+
+	// emitting again re-creates the series
+	counterEmitter(2)
+	ch = make(chan prometheus.Metric, 10)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+
+	found := false
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		if pb.Counter != nil {
+			found = true
+			if *pb.Counter.Value != float64(2) {
+				t.Fatalf("expected re-created counter value 2, got %f", *pb.Counter.Value)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("expected counter to be re-created")
+	}
+}
+
+// Building the emitter for an existing series, before and after replacing the
+// regexp and fmt.Sprintf in flattenKey:
+//
+// BenchmarkBuildMetricEmitter 	  567582	      2467 ns/op	     544 B/op	      19 allocs/op
+// BenchmarkBuildMetricEmitter 	 2269362	       523.2 ns/op	     248 B/op	       6 allocs/op
+func BenchmarkBuildMetricEmitter(b *testing.B) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := []string{"service", "api", "request-count"}
+	labels := []metrics.Label{{Name: "method", Value: "GET"}, {Name: "code", Value: "200"}, {Name: "host", Value: "web-1"}}
+
+	// the series exists, only the emitter is built
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, keys, labels)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sink.BuildMetricEmitter(metrics.MetricTypeCounter, keys, labels)
+	}
+}
+
+func TestFlattenKey_AdversarialLabels(t *testing.T) {
+	for _, tc := range []struct {
+		a, b []metrics.Label
+	}{
+		{
+			a: []metrics.Label{{Name: "a", Value: "b;c=d"}},
+			b: []metrics.Label{{Name: "a", Value: "b"}, {Name: "c", Value: "d"}},
+		},
+		{
+			a: []metrics.Label{{Name: "a=b", Value: "c"}},
+			b: []metrics.Label{{Name: "a", Value: "b=c"}},
+		},
+		{
+			a: []metrics.Label{{Name: "a", Value: ""}},
+			b: nil,
+		},
+	} {
+		keyA, hashA := flattenKey([]string{"foo"}, tc.a)
+		keyB, hashB := flattenKey([]string{"foo"}, tc.b)
+		if keyA != keyB {
+			t.Fatalf("expected the same metric name, got %q and %q", keyA, keyB)
+		}
+		if hashA == hashB {
+			t.Fatalf("labels %v and %v collide", tc.a, tc.b)
+		}
+	}
+
+	// distinct series are kept for each label set
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"foo"}, []metrics.Label{{Name: "a", Value: "b;c=d"}})(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"foo"}, []metrics.Label{{Name: "a", Value: "b"}, {Name: "c", Value: "d"}})(2)
+
+	n := 0
+	sink.gauges.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != 2 {
+		t.Fatalf("expected 2 series, got %d", n)
+	}
+}
+
+// Emitting to an existing series doesn't allocate:
+//
+// BenchmarkEmit/existing         	11617203	       115.1 ns/op	       0 B/op	       0 allocs/op
+//
+// Re-creating an expired or forgotten series, before and after reusing its
+// labels map:
+//
+// BenchmarkEmit/recreated        	  407034	      3143 ns/op	    1352 B/op	      27 allocs/op
+// BenchmarkEmit/recreated        	  457382	      2825 ns/op	    1000 B/op	      24 allocs/op
+func BenchmarkEmit(b *testing.B) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	keys := []string{"service", "api", "request-count"}
+	labels := []metrics.Label{{Name: "method", Value: "GET"}, {Name: "code", Value: "200"}, {Name: "host", Value: "web-1"}}
+	emitter := sink.BuildMetricEmitter(metrics.MetricTypeCounter, keys, labels)
+
+	b.Run("existing", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			emitter(1)
+		}
+	})
+	// the series is forgotten before each emit, so it is re-created
+	b.Run("recreated", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sink.ForgetMetric(metrics.MetricTypeCounter, keys, labels)
+			emitter(1)
+		}
+	})
+}
+
+func TestMaxSeries(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: prometheus.NewRegistry(),
+		MaxSeries:  2,
+		GaugeDefinitions: []GaugeDefinition{
+			{Name: "declared", Help: "not counted towards the limit"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	label := func(v string) []metrics.Label {
+		return []metrics.Label{{Name: "user", Value: v}}
+	}
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, label("a"))(1)
+	sink.BuildMetricEmitter(metrics.MetricTypeGauge, []string{"active"}, label("a"))(1)
+	// existing series are still emitted to
+	sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, label("a"))(1)
+	dropped := sink.BuildMetricEmitter(metrics.MetricTypeCounter, []string{"requests"}, label("b"))
+	dropped(1)
+
+	// refused when built, and again when emitted to
+	if n := sink.DroppedSeries(); n != 2 {
+		t.Fatalf("expected 2 dropped series, got %d", n)
+	}
+	count := func(m *sync.Map) int {
+		n := 0
+		m.Range(func(k, v interface{}) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	if count(&sink.counters) != 1 || count(&sink.gauges) != 2 {
+		t.Fatalf("expected 1 counter and 2 gauges, got %d and %d", count(&sink.counters), count(&sink.gauges))
+	}
+
+	// forgetting a series makes room for the refused one on its next emit
+	sink.ForgetMetric(metrics.MetricTypeGauge, []string{"active"}, label("a"))
+	dropped(1)
+	if count(&sink.counters) != 2 || sink.DroppedSeries() != 2 {
+		t.Fatalf("expected the refused series to be created, got %d counters", count(&sink.counters))
+	}
+}
+
+func TestEmitCollectRace(t *testing.T) {
+	sink, err := NewPrometheusSinkFrom(PrometheusOpts{
+		Registerer: prometheus.NewRegistry(),
+		Expiration: time.Second,
+		MaxSeries:  10,
+	})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	keys := []string{"hammered"}
+	shared := sink.BuildMetricEmitter(metrics.MetricTypeCounter, keys, nil)
+	emitters := []metrics.MetricEmitter{shared}
+	for i := 0; i < 8; i++ {
+		emitters = append(emitters, sink.BuildMetricEmitter(metrics.MetricTypeCounter, keys, nil))
+	}
+
+	// expire everything, draining what's collected
+	sweep := func() {
+		ch := make(chan prometheus.Metric, 16)
+		sink.collectAtTime(ch, time.Now().Add(time.Hour))
+		close(ch)
+		for range ch {
+		}
+	}
+
+	stop := make(chan struct{})
+	var sweepers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		sweepers.Add(1)
+		go func() {
+			defer sweepers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sweep()
+				sink.ForgetMetric(metrics.MetricTypeCounter, keys, nil)
+			}
+		}()
+	}
+
+	var emitting sync.WaitGroup
+	for _, e := range emitters[1:] {
+		emitting.Add(1)
+		go func(e metrics.MetricEmitter) {
+			defer emitting.Done()
+			for i := 0; i < 10000; i++ {
+				e(1)
+				shared(1)
+			}
+		}(e)
+	}
+	emitting.Wait()
+	close(stop)
+	sweepers.Wait()
+
+	// every emitter must land in the same, single, collected series
+	sweep()
+	for _, e := range emitters {
+		e(1)
+	}
+
+	ch := make(chan prometheus.Metric, 16)
+	sink.collectAtTime(ch, time.Now())
+	close(ch)
+
+	var values []float64
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("unexpected error reading metric: %s", err)
+		}
+		values = append(values, *pb.Counter.Value)
+	}
+	if len(values) != 1 || values[0] != float64(len(emitters)) {
+		t.Fatalf("expected one series with value %d, got %v", len(emitters), values)
+	}
+	if n := sink.series.Load(); n != 1 {
+		t.Fatalf("expected 1 series counted, got %d", n)
+	}
+}
@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimitedDroppedKey is the key of the counter the RateLimitedSink reports
+// dropped observations under, emitted directly to the wrapped sink.
+var rateLimitedDroppedKey = []string{"rate_limited_sink.dropped"}
+
+// RateLimitedSink wraps a MetricSink and caps the total number of observations
+// forwarded per second using a token bucket shared by all emitters built from
+// it. Observations over the limit are dropped, and the number dropped is
+// reported to the wrapped sink as the "rate_limited_sink.dropped" counter the
+// next time an observation is allowed through.
+type RateLimitedSink struct {
+	sink  MetricSink
+	limit float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+
+	dropped        uint64 // update with atomic
+	droppedPending uint64 // update with atomic
+	droppedEmitter MetricEmitter
+}
+
+// NewRateLimitedSink creates a RateLimitedSink that forwards on average limit
+// observations per second, allowing bursts of up to burst observations.
+func NewRateLimitedSink(sink MetricSink, limit float64, burst int) *RateLimitedSink {
+	if burst < 1 {
+		burst = 1
+	}
+
+	s := &RateLimitedSink{
+		sink:           sink,
+		limit:          limit,
+		burst:          float64(burst),
+		tokens:         float64(burst),
+		now:            time.Now,
+		droppedEmitter: sink.BuildMetricEmitter(MetricTypeCounter, rateLimitedDroppedKey, nil),
+	}
+	s.last = s.now()
+
+	return s
+}
+
+func (s *RateLimitedSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	emitter := s.sink.BuildMetricEmitter(mType, keys, labels)
+
+	return func(val float64) {
+		if !s.take() {
+			return
+		}
+
+		emitter(val)
+		s.reportDropped()
+	}
+}
+
+// BuildMetricEmitterAt is like BuildMetricEmitter, delivering the values with
+// their timestamps to the wrapped sink if it is a TimestampSink
+func (s *RateLimitedSink) BuildMetricEmitterAt(mType MetricType, keys []string, labels []Label) MetricEmitterAt {
+	emitter := BuildMetricEmitterAt(s.sink, mType, keys, labels)
+
+	return func(val float64, at time.Time) {
+		if !s.take() {
+			return
+		}
+
+		emitter(val, at)
+		s.reportDropped()
+	}
+}
+
+// BuildMetricEmitterN is like BuildMetricEmitter, delivering counted values to
+// the wrapped sink if it is a CountedSink. A counted value takes one token,
+// being a single write to the sink, or is dropped as one observation.
+func (s *RateLimitedSink) BuildMetricEmitterN(mType MetricType, keys []string, labels []Label) MetricEmitterN {
+	emitter := BuildMetricEmitterN(s.sink, mType, keys, labels)
+
+	return func(val float64, count int) {
+		if !s.take() {
+			return
+		}
+
+		emitter(val, count)
+		s.reportDropped()
+	}
+}
+
+// BuildHistogramEmitter is like BuildMetricEmitter for the histogram emitter
+// of the wrapped sink, or returns nil if it isn't a HistogramSink
+func (s *RateLimitedSink) BuildHistogramEmitter(mType MetricType, keys []string, labels []Label, buckets []float64) MetricEmitter {
+	emitter := buildHistogramEmitter(s.sink, mType, keys, labels, buckets)
+	if emitter == nil {
+		return nil
+	}
+
+	return func(val float64) {
+		if !s.take() {
+			return
+		}
+
+		emitter(val)
+		s.reportDropped()
+	}
+}
+
+// SendErrors returns the send errors of the wrapped sink if it is a
+// SendErrorSink
+func (s *RateLimitedSink) SendErrors() uint64 {
+	return sendErrors(s.sink)
+}
+
+// take returns whether an observation may be forwarded, counting it as
+// dropped if not
+func (s *RateLimitedSink) take() bool {
+	if s.allow() {
+		return true
+	}
+
+	atomic.AddUint64(&s.dropped, 1)
+	atomic.AddUint64(&s.droppedPending, 1)
+	return false
+}
+
+// reportDropped emits any drops not yet reported to the wrapped sink
+func (s *RateLimitedSink) reportDropped() {
+	if n := atomic.SwapUint64(&s.droppedPending, 0); n > 0 {
+		s.droppedEmitter(float64(n))
+	}
+}
+
+// Dropped returns the total number of observations dropped by the limiter.
+func (s *RateLimitedSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// ForgetMetric forwards to the wrapped sink if it is a ForgetSink
+func (s *RateLimitedSink) ForgetMetric(mType MetricType, keys []string, labels []Label) {
+	if fs, ok := s.sink.(ForgetSink); ok {
+		fs.ForgetMetric(mType, keys, labels)
+	}
+}
+
+// Shutdown shuts down the wrapped sink if it is a ShutdownSink
+func (s *RateLimitedSink) Shutdown() error {
+	s.reportDropped()
+
+	if ss, ok := s.sink.(ShutdownSink); ok {
+		return ss.Shutdown()
+	}
+	return nil
+}
+
+// allow refills the bucket for the time elapsed and takes a token if one
+// is available
+func (s *RateLimitedSink) allow() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	if elapsed := now.Sub(s.last); elapsed > 0 {
+		s.tokens += elapsed.Seconds() * s.limit
+		if s.tokens > s.burst {
+			s.tokens = s.burst
+		}
+		s.last = now
+	}
+
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedSink(t *testing.T) {
+	m := &MockSink{}
+	s := NewRateLimitedSink(m, 10, 2)
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.last = now
+
+	// the limiter is shared across emitters
+	gauge := s.BuildMetricEmitter(MetricTypeGauge, []string{"gkey"}, nil)
+	counter := s.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)
+
+	// burst allows two, then we are limited
+	gauge(1)
+	counter(2)
+	gauge(3)
+	counter(4)
+
+	require.Len(t, m.keys, 2)
+	require.Equal(t, float64(1), m.vals[0])
+	require.Equal(t, float64(2), m.vals[1])
+	require.Equal(t, uint64(2), s.Dropped())
+
+	// 100ms at 10/s refills a single token
+	now = now.Add(100 * time.Millisecond)
+	gauge(5)
+	gauge(6)
+
+	require.Len(t, m.keys, 4)
+	require.Equal(t, []string{"gkey"}, m.keys[2])
+	require.Equal(t, float64(5), m.vals[2])
+
+	// the drops are reported after the next allowed observation
+	require.Equal(t, rateLimitedDroppedKey, m.keys[3])
+	require.Equal(t, float64(2), m.vals[3])
+	require.Equal(t, uint64(3), s.Dropped())
+
+	// refill never exceeds the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		counter(1)
+	}
+	require.Equal(t, uint64(6), s.Dropped())
+
+	// remaining drops are reported on shutdown
+	s.Shutdown()
+	require.True(t, m.shutdown)
+	require.Equal(t, rateLimitedDroppedKey, m.keys[len(m.keys)-1])
+	require.Equal(t, float64(3), m.vals[len(m.vals)-1])
+}
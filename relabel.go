@@ -0,0 +1,117 @@
+package metrics
+
+// RelabelRules declares how a RelabelSink rewrites the keys and labels of each
+// metric before delegating to the wrapped sink. Labels are processed in the
+// order drop, rename, then add.
+type RelabelRules struct {
+	Prefix       string            // Prepended to the keys as the first key segment
+	DropLabels   []string          // Names of labels to remove
+	RenameLabels map[string]string // Maps an original label name to its new name
+	AddLabels    []Label           // Constant labels appended to every metric
+}
+
+// RelabelSink wraps a MetricSink and rewrites metric keys and labels according
+// to a fixed set of rules. It allows the same measurement to be sent to
+// multiple backends through a FanoutSink with backend-appropriate naming.
+type RelabelSink struct {
+	sink   MetricSink
+	prefix string
+	drop   map[string]bool
+	rename map[string]string
+	add    []Label
+}
+
+// NewRelabelSink creates a RelabelSink applying rules to every metric built
+// through it.
+func NewRelabelSink(sink MetricSink, rules RelabelRules) *RelabelSink {
+	s := &RelabelSink{
+		sink:   sink,
+		prefix: rules.Prefix,
+		drop:   make(map[string]bool, len(rules.DropLabels)),
+		rename: make(map[string]string, len(rules.RenameLabels)),
+		add:    append([]Label{}, rules.AddLabels...),
+	}
+	for _, name := range rules.DropLabels {
+		s.drop[name] = true
+	}
+	for from, to := range rules.RenameLabels {
+		s.rename[from] = to
+	}
+
+	return s
+}
+
+func (s *RelabelSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	keys, labels = s.relabel(keys, labels)
+	return s.sink.BuildMetricEmitter(mType, keys, labels)
+}
+
+// BuildMetricEmitterAt relabels the metric and builds the timestamped emitter
+// of the wrapped sink, see BuildMetricEmitterAt
+func (s *RelabelSink) BuildMetricEmitterAt(mType MetricType, keys []string, labels []Label) MetricEmitterAt {
+	keys, labels = s.relabel(keys, labels)
+	return BuildMetricEmitterAt(s.sink, mType, keys, labels)
+}
+
+// BuildMetricEmitterN relabels the metric and builds the counted emitter of
+// the wrapped sink, see BuildMetricEmitterN
+func (s *RelabelSink) BuildMetricEmitterN(mType MetricType, keys []string, labels []Label) MetricEmitterN {
+	keys, labels = s.relabel(keys, labels)
+	return BuildMetricEmitterN(s.sink, mType, keys, labels)
+}
+
+// BuildHistogramEmitter relabels the metric and builds the histogram emitter
+// of the wrapped sink, or returns nil if it isn't a HistogramSink
+func (s *RelabelSink) BuildHistogramEmitter(mType MetricType, keys []string, labels []Label, buckets []float64) MetricEmitter {
+	if _, ok := s.sink.(HistogramSink); !ok {
+		return nil
+	}
+
+	keys, labels = s.relabel(keys, labels)
+	return buildHistogramEmitter(s.sink, mType, keys, labels, buckets)
+}
+
+// SendErrors returns the send errors of the wrapped sink if it is a
+// SendErrorSink
+func (s *RelabelSink) SendErrors() uint64 {
+	return sendErrors(s.sink)
+}
+
+// ForgetMetric relabels the metric and forwards to the wrapped sink if it is a
+// ForgetSink
+func (s *RelabelSink) ForgetMetric(mType MetricType, keys []string, labels []Label) {
+	if fs, ok := s.sink.(ForgetSink); ok {
+		keys, labels = s.relabel(keys, labels)
+		fs.ForgetMetric(mType, keys, labels)
+	}
+}
+
+// Shutdown shuts down the wrapped sink if it is a ShutdownSink
+func (s *RelabelSink) Shutdown() error {
+	if ss, ok := s.sink.(ShutdownSink); ok {
+		return ss.Shutdown()
+	}
+	return nil
+}
+
+// relabel returns rewritten copies of keys and labels, the inputs are not
+// modified
+func (s *RelabelSink) relabel(keys []string, labels []Label) ([]string, []Label) {
+	if s.prefix != "" {
+		keys = insert(0, s.prefix, keys)
+	}
+
+	out := make([]Label, 0, len(labels)+len(s.add))
+	for _, label := range labels {
+		if s.drop[label.Name] {
+			continue
+		}
+		if name, ok := s.rename[label.Name]; ok {
+			label.Name = name
+		}
+		out = append(out, label)
+	}
+	out = append(out, s.add...)
+
+	return keys, out
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelabelSink(t *testing.T) {
+	m := &MockSink{}
+	s := NewRelabelSink(m, RelabelRules{
+		Prefix:       "backend",
+		DropLabels:   []string{"noisy"},
+		RenameLabels: map[string]string{"host": "hostname"},
+		AddLabels:    []Label{L("env", "prod")},
+	})
+
+	keys := []string{"my", "metric"}
+	labels := []Label{L("host", "h1"), L("noisy", "x"), L("a", "b")}
+	origKeys := append([]string{}, keys...)
+	origLabels := append([]Label{}, labels...)
+
+	s.BuildMetricEmitter(MetricTypeGauge, keys, labels)(1)
+
+	require.Equal(t, []string{"backend", "my", "metric"}, m.keys[0])
+	require.Equal(t, []Label{L("hostname", "h1"), L("a", "b"), L("env", "prod")}, m.labels[0])
+
+	// inputs must not be modified
+	require.Equal(t, origKeys, keys)
+	require.Equal(t, origLabels, labels)
+}
+
+func TestRelabelSink_Fanout(t *testing.T) {
+	m1 := &MockSink{}
+	m2 := &MockSink{}
+	fh := &FanoutSink{Sinks: []MetricSink{
+		NewRelabelSink(m1, RelabelRules{Prefix: "one"}),
+		NewRelabelSink(m2, RelabelRules{DropLabels: []string{"a"}}),
+	}}
+
+	fh.BuildMetricEmitter(MetricTypeCounter, []string{"key"}, []Label{L("a", "b")})(1)
+
+	require.Equal(t, []string{"one", "key"}, m1.keys[0])
+	require.Equal(t, []Label{L("a", "b")}, m1.labels[0])
+
+	require.Equal(t, []string{"key"}, m2.keys[0])
+	require.Empty(t, m2.labels[0])
+}
+
+func TestRelabelSink_OptionalInterfaces(t *testing.T) {
+	m := &capableSink{}
+	s := NewRelabelSink(m, RelabelRules{Prefix: "backend"})
+
+	s.BuildMetricEmitterAt(MetricTypeGauge, []string{"gkey"}, nil)(1, time.Now())
+	s.BuildMetricEmitterN(MetricTypeHistogram, []string{"hkey"}, nil)(2, 3)
+	s.BuildHistogramEmitter(MetricTypeTimer, []string{"tkey"}, nil, []float64{1})(0.5)
+
+	require.Equal(t, [][]string{{"backend", "gkey"}, {"backend", "hkey"}, {"backend", "tkey"}}, m.keys)
+}
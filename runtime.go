@@ -3,9 +3,12 @@ package metrics
 import (
 	"context"
 	"runtime"
-	"time"
 )
 
+// defaultRuntimeMetricsPrefix is the key prefix of runtime metrics if
+// RuntimeMetricsPrefix is not set
+const defaultRuntimeMetricsPrefix = "runtime"
+
 type runtimeMetrics struct {
 	numGoroutines  Gauge
 	allocBytes     Gauge
@@ -16,30 +19,125 @@ type runtimeMetrics struct {
 	totalGCPauseNS Gauge
 	totalGCRuns    Gauge
 	gcPauseNS      Histogram
+	gcCPUFraction  Gauge
+	heapIdleBytes  Gauge
+	heapInuseBytes Gauge
+	stackInuse     Gauge
+	nextGCBytes    Gauge
+
+	// memStats is whether any selected metric is read from runtime.MemStats
+	memStats     bool
+	readMemStats func(*runtime.MemStats)
 }
 
-// Periodically collects runtime stats to publish
-func (m *Metrics) collectStats(ctx context.Context) {
+// newRuntimeMetrics creates the metrics emitted from runtime.MemStats
+func (m *Metrics) newRuntimeMetrics() *runtimeMetrics {
 	rm := &runtimeMetrics{
-		numGoroutines:  m.NewGauge("runtime.num_goroutines"),
-		allocBytes:     m.NewGauge("runtime.alloc_bytes"),
-		sysBytes:       m.NewGauge("runtime.sys_bytes"),
-		mallocCount:    m.NewGauge("runtime.malloc_count"),
-		freeCount:      m.NewGauge("runtime.free_count"),
-		heapObjects:    m.NewGauge("runtime.heap_objects"),
-		totalGCPauseNS: m.NewGauge("runtime.total_gc_pause_ns"),
-		totalGCRuns:    m.NewGauge("runtime.total_gc_runs"),
-		gcPauseNS:      m.NewHistogram("runtime.gc_pause_ns"),
+		numGoroutines:  m.newRuntimeGauge("num_goroutines"),
+		allocBytes:     m.newRuntimeGauge("alloc_bytes"),
+		sysBytes:       m.newRuntimeGauge("sys_bytes"),
+		mallocCount:    m.newRuntimeGauge("malloc_count"),
+		freeCount:      m.newRuntimeGauge("free_count"),
+		heapObjects:    m.newRuntimeGauge("heap_objects"),
+		totalGCPauseNS: m.newRuntimeGauge("total_gc_pause_ns"),
+		totalGCRuns:    m.newRuntimeGauge("total_gc_runs"),
+		gcPauseNS:      m.newRuntimeHistogram("gc_pause_ns"),
+		gcCPUFraction:  m.newRuntimeGauge("gc_cpu_fraction"),
+		heapIdleBytes:  m.newRuntimeGauge("heap_idle_bytes"),
+		heapInuseBytes: m.newRuntimeGauge("heap_inuse_bytes"),
+		stackInuse:     m.newRuntimeGauge("stack_inuse_bytes"),
+		nextGCBytes:    m.newRuntimeGauge("next_gc_bytes"),
+		readMemStats:   runtime.ReadMemStats,
 	}
 
-	lastNumGC := uint32(0)
+	// only the goroutine count doesn't need the stop-the-world MemStats read
+	rm.memStats = len(m.cfg.RuntimeMetricsSelect) == 0
+	for _, name := range m.cfg.RuntimeMetricsSelect {
+		if name != "num_goroutines" {
+			rm.memStats = true
+		}
+	}
+	return rm
+}
 
-	t := time.NewTicker(m.cfg.ProfileInterval)
+// runtimeKey returns the key for a runtime metric, under the configured prefix
+func (m *Metrics) runtimeKey(name string) string {
+	prefix := m.cfg.RuntimeMetricsPrefix
+	if prefix == "" {
+		prefix = defaultRuntimeMetricsPrefix
+	}
+	return prefix + "." + name
+}
+
+// runtimeSelected returns whether the named runtime metric should be collected
+func (m *Metrics) runtimeSelected(name string) bool {
+	if len(m.cfg.RuntimeMetricsSelect) == 0 {
+		return true
+	}
+	for _, s := range m.cfg.RuntimeMetricsSelect {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newRuntimeGauge creates the named runtime gauge, metrics that aren't
+// selected are dropped
+func (m *Metrics) newRuntimeGauge(name string) Gauge {
+	if !m.runtimeSelected(name) {
+		return &gauge{baseMetric: baseMetric{drop: true}}
+	}
+	return m.NewGauge(m.runtimeKey(name), m.cfg.RuntimeMetricsLabels...)
+}
+
+func (m *Metrics) newRuntimeHistogram(name string) Histogram {
+	if !m.runtimeSelected(name) {
+		return &histogram{baseMetric: baseMetric{drop: true}}
+	}
+	return m.NewHistogram(m.runtimeKey(name), m.cfg.RuntimeMetricsLabels...)
+}
+
+// Periodically collects runtime, process, and self stats to publish
+func (m *Metrics) collectStats(ctx context.Context) {
+	var emitters []func()
+	switch {
+	case !m.cfg.EnableRuntimeMetrics:
+	case m.cfg.EnableRuntimeMetricsV2:
+		rm := m.newRuntimeMetricsV2()
+		emitters = append(emitters, func() {
+			m.emitRuntimeMetricsV2(rm)
+		})
+	default:
+		rm := m.newRuntimeMetrics()
+		lastNumGC := uint32(0)
+		emitters = append(emitters, func() {
+			m.emitRuntimeStats(rm, &lastNumGC)
+		})
+	}
+	if m.cfg.EnableProcessMetrics {
+		pm := m.newProcessMetrics()
+		emitters = append(emitters, func() {
+			m.emitProcessStats(pm)
+		})
+	}
+	if m.self != nil {
+		sm := m.newSelfMetrics()
+		emitters = append(emitters, func() {
+			m.emitSelfStats(sm)
+		})
+	}
+
+	t := m.newTicker(m.cfg.ProfileInterval)
+	defer t.Stop()
 
 	for {
 		select {
-		case <-t.C:
-			m.emitRuntimeStats(rm, &lastNumGC)
+		case <-t.C():
+			t.ticked()
+			for _, emit := range emitters {
+				emit()
+			}
 		case <-ctx.Done():
 			return
 		}
@@ -52,9 +150,13 @@ func (m *Metrics) emitRuntimeStats(rm *runtimeMetrics, lastNumGC *uint32) {
 	numRoutines := runtime.NumGoroutine()
 	rm.numGoroutines.Set(float64(numRoutines))
 
+	if !rm.memStats {
+		return
+	}
+
 	// Export memory stats
 	var stats runtime.MemStats
-	runtime.ReadMemStats(&stats)
+	rm.readMemStats(&stats)
 
 	rm.allocBytes.Set(float64(stats.Alloc))
 	rm.sysBytes.Set(float64(stats.Sys))
@@ -63,6 +165,11 @@ func (m *Metrics) emitRuntimeStats(rm *runtimeMetrics, lastNumGC *uint32) {
 	rm.heapObjects.Set(float64(stats.HeapObjects))
 	rm.totalGCPauseNS.Set(float64(stats.PauseTotalNs))
 	rm.totalGCRuns.Set(float64(stats.NumGC))
+	rm.gcCPUFraction.Set(stats.GCCPUFraction)
+	rm.heapIdleBytes.Set(float64(stats.HeapIdle))
+	rm.heapInuseBytes.Set(float64(stats.HeapInuse))
+	rm.stackInuse.Set(float64(stats.StackInuse))
+	rm.nextGCBytes.Set(float64(stats.NextGC))
 
 	// Export info about the last few GC runs
 	num := stats.NumGC
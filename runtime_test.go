@@ -1,7 +1,10 @@
 package metrics
 
 import (
+	"math"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -9,17 +12,7 @@ func TestMetrics_EmitRuntimeStats(t *testing.T) {
 	runtime.GC()
 	m, met := mockMetric(t)
 
-	rm := &runtimeMetrics{
-		numGoroutines:  met.NewGauge("runtime.num_goroutines"),
-		allocBytes:     met.NewGauge("runtime.alloc_bytes"),
-		sysBytes:       met.NewGauge("runtime.sys_bytes"),
-		mallocCount:    met.NewGauge("runtime.malloc_count"),
-		freeCount:      met.NewGauge("runtime.free_count"),
-		heapObjects:    met.NewGauge("runtime.heap_objects"),
-		totalGCPauseNS: met.NewGauge("runtime.total_gc_pause_ns"),
-		totalGCRuns:    met.NewGauge("runtime.total_gc_runs"),
-		gcPauseNS:      met.NewHistogram("runtime.gc_pause_ns"),
-	}
+	rm := met.newRuntimeMetrics()
 
 	lastNumGC := uint32(0)
 
@@ -61,7 +54,182 @@ func TestMetrics_EmitRuntimeStats(t *testing.T) {
 		t.Fatalf("bad val: %v", m.vals)
 	}
 
-	if m.vals[8] <= 1000 {
+	if m.getKeys()[8][0] != "runtime.gc_cpu_fraction" {
+		t.Fatalf("bad key %v", m.getKeys())
+	}
+	if m.vals[8] < 0 || m.vals[8] > 1 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+
+	if m.vals[9] <= 0 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+
+	if m.vals[10] <= 40000 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+
+	if m.vals[11] <= 1000 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+
+	if m.getKeys()[12][0] != "runtime.next_gc_bytes" {
+		t.Fatalf("bad key %v", m.getKeys())
+	}
+	if m.vals[12] <= 40000 {
+		t.Fatalf("bad val: %v", m.vals)
+	}
+
+	if m.vals[13] <= 1000 {
 		t.Fatalf("bad val: %v", m.vals)
 	}
 }
+
+func TestMetrics_EmitRuntimeMetricsV2(t *testing.T) {
+	runtime.GC()
+	m, met := mockMetric(t)
+
+	rm := met.newRuntimeMetricsV2()
+	met.emitRuntimeMetricsV2(rm)
+
+	vals := make(map[string][]float64)
+	for i, k := range m.getKeys() {
+		vals[k[0]] = append(vals[k[0]], m.vals[i])
+	}
+
+	// keys shared with the MemStats collector keep their names
+	if v := vals["runtime.num_goroutines"]; len(v) != 1 || v[0] < 1 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := vals["runtime.alloc_bytes"]; len(v) != 1 || v[0] <= 40000 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := vals["runtime.sys_bytes"]; len(v) != 1 || v[0] <= 100000 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := vals["runtime.heap_objects"]; len(v) != 1 || v[0] <= 100 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := vals["runtime.total_gc_runs"]; len(v) != 1 || v[0] < 1 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := vals["runtime.total_gc_pause_ns"]; len(v) != 1 || v[0] <= 0 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := vals["runtime.gc_pause_ns"]; len(v) == 0 || len(v) > maxRuntimeHistogramSamples {
+		t.Fatalf("bad gc pause samples: %d", len(v))
+	}
+	if v := vals["runtime.sched_latency_ns"]; len(v) == 0 || len(v) > maxRuntimeHistogramSamples {
+		t.Fatalf("bad sched latency samples: %d", len(v))
+	}
+
+	// only new observations are sampled on the next read
+	gcRuns := vals["runtime.total_gc_runs"][0]
+	m.keys, m.vals, m.labels = nil, nil, nil
+	met.emitRuntimeMetricsV2(rm)
+
+	vals = make(map[string][]float64)
+	for i, k := range m.getKeys() {
+		vals[k[0]] = append(vals[k[0]], m.vals[i])
+	}
+	if vals["runtime.total_gc_runs"][0] == gcRuns && len(vals["runtime.gc_pause_ns"]) != 0 {
+		t.Fatalf("unexpected gc pause samples without a GC: %v", vals["runtime.gc_pause_ns"])
+	}
+}
+
+func TestBucketValue(t *testing.T) {
+	buckets := []float64{math.Inf(-1), 1, 3, math.Inf(1)}
+	if v := bucketValue(buckets, 0); v != 1 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := bucketValue(buckets, 1); v != 2 {
+		t.Fatalf("bad val: %v", v)
+	}
+	if v := bucketValue(buckets, 2); v != 3 {
+		t.Fatalf("bad val: %v", v)
+	}
+}
+
+func TestMetrics_RuntimeMetricsPrefixAndLabels(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.RuntimeMetricsPrefix = "component.go"
+		c.RuntimeMetricsLabels = []Label{{"component", "db"}}
+		c.BaseLabels = []Label{{"env", "test"}}
+	})
+
+	lastNumGC := uint32(0)
+	met.emitRuntimeStats(met.newRuntimeMetrics(), &lastNumGC)
+
+	if m.getKeys()[0][0] != "component.go.num_goroutines" {
+		t.Fatalf("bad key %v", m.getKeys())
+	}
+	if !reflect.DeepEqual(m.labels[0], []Label{{"component", "db"}, {"env", "test"}}) {
+		t.Fatalf("bad labels %v", m.labels[0])
+	}
+
+	// other metrics are unaffected
+	met.SetGauge("gauge", 1)
+	n := len(m.getKeys()) - 1
+	if !reflect.DeepEqual(m.labels[n], []Label{{"env", "test"}}) {
+		t.Fatalf("bad labels %v", m.labels[n])
+	}
+
+	m, met = mockMetric(t, func(c *Config) {
+		c.RuntimeMetricsPrefix = "component.go"
+	})
+	met.emitRuntimeMetricsV2(met.newRuntimeMetricsV2())
+	for _, k := range m.getKeys() {
+		if !strings.HasPrefix(k[0], "component.go.") {
+			t.Fatalf("bad key %v", k)
+		}
+	}
+}
+
+func TestMetrics_RuntimeMetricsSelect(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.RuntimeMetricsSelect = []string{"num_goroutines"}
+	})
+
+	rm := met.newRuntimeMetrics()
+	reads := 0
+	rm.readMemStats = func(stats *runtime.MemStats) {
+		reads++
+		runtime.ReadMemStats(stats)
+	}
+
+	lastNumGC := uint32(0)
+	met.emitRuntimeStats(rm, &lastNumGC)
+
+	if reads != 0 {
+		t.Fatalf("memstats should not be read")
+	}
+	if !reflect.DeepEqual(m.getKeys(), [][]string{{"runtime.num_goroutines"}}) {
+		t.Fatalf("bad keys %v", m.getKeys())
+	}
+
+	m, met = mockMetric(t, func(c *Config) {
+		c.RuntimeMetricsSelect = []string{"num_goroutines", "heap_objects"}
+	})
+	rm = met.newRuntimeMetrics()
+	rm.readMemStats = func(stats *runtime.MemStats) {
+		reads++
+		runtime.ReadMemStats(stats)
+	}
+	met.emitRuntimeStats(rm, &lastNumGC)
+
+	if reads != 1 {
+		t.Fatalf("memstats should be read once, got %d", reads)
+	}
+	if !reflect.DeepEqual(m.getKeys(), [][]string{{"runtime.num_goroutines"}, {"runtime.heap_objects"}}) {
+		t.Fatalf("bad keys %v", m.getKeys())
+	}
+
+	m, met = mockMetric(t, func(c *Config) {
+		c.RuntimeMetricsSelect = []string{"num_goroutines", "total_gc_pause_ns"}
+	})
+	runtime.GC()
+	met.emitRuntimeMetricsV2(met.newRuntimeMetricsV2())
+	if !reflect.DeepEqual(m.getKeys(), [][]string{{"runtime.num_goroutines"}, {"runtime.total_gc_pause_ns"}}) {
+		t.Fatalf("bad keys %v", m.getKeys())
+	}
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"math"
+	rtmetrics "runtime/metrics"
+)
+
+// maxRuntimeHistogramSamples caps the number of samples emitted per interval
+// for each runtime histogram. Busier intervals are downsampled, keeping the
+// shape of the distribution.
+const maxRuntimeHistogramSamples = 256
+
+const rtGCPauses = "/gc/pauses:seconds"
+
+// runtimeGaugesV2 maps runtime/metrics names to the gauges they are emitted
+// as, under the runtime metrics prefix. Where there is an equivalent
+// runtime.MemStats field the key matches the one used by emitRuntimeStats.
+var runtimeGaugesV2 = []struct {
+	name string
+	key  string
+}{
+	{"/sched/goroutines:goroutines", "num_goroutines"},
+	{"/memory/classes/heap/objects:bytes", "alloc_bytes"},
+	{"/memory/classes/total:bytes", "sys_bytes"},
+	{"/gc/heap/allocs:objects", "malloc_count"},
+	{"/gc/heap/frees:objects", "free_count"},
+	{"/gc/heap/objects:objects", "heap_objects"},
+	{"/gc/cycles/total:gc-cycles", "total_gc_runs"},
+	{"/cpu/classes/gc/mark/assist:cpu-seconds", "gc_assist_cpu_seconds"},
+	{"/sync/mutex/wait/total:seconds", "mutex_wait_seconds"},
+}
+
+// runtimeHistogramsV2 maps runtime/metrics histograms of seconds to the
+// histograms they are sampled into, in nanoseconds
+var runtimeHistogramsV2 = []struct {
+	name string
+	key  string
+}{
+	{rtGCPauses, "gc_pause_ns"},
+	{"/sched/latencies:seconds", "sched_latency_ns"},
+}
+
+type runtimeMetricsV2 struct {
+	samples    []rtmetrics.Sample
+	gauges     map[string]Gauge
+	histograms map[string]Histogram
+	lastCounts map[string][]uint64
+
+	// runtime/metrics has no total pause time, so it is estimated from the
+	// pause histogram
+	totalGCPauseNS Gauge
+	gcPauseNS      float64
+}
+
+// newRuntimeMetricsV2 creates the metrics for the runtime/metrics series
+// supported by the running Go version
+func (m *Metrics) newRuntimeMetricsV2() *runtimeMetricsV2 {
+	supported := make(map[string]bool)
+	for _, desc := range rtmetrics.All() {
+		supported[desc.Name] = true
+	}
+
+	rm := &runtimeMetricsV2{
+		gauges:         make(map[string]Gauge),
+		histograms:     make(map[string]Histogram),
+		lastCounts:     make(map[string][]uint64),
+		totalGCPauseNS: m.newRuntimeGauge("total_gc_pause_ns"),
+	}
+	for _, g := range runtimeGaugesV2 {
+		if supported[g.name] && m.runtimeSelected(g.key) {
+			rm.samples = append(rm.samples, rtmetrics.Sample{Name: g.name})
+			rm.gauges[g.name] = m.newRuntimeGauge(g.key)
+		}
+	}
+	for _, h := range runtimeHistogramsV2 {
+		// the total pause time is estimated from the pause histogram
+		needed := m.runtimeSelected(h.key) || (h.name == rtGCPauses && m.runtimeSelected("total_gc_pause_ns"))
+		if supported[h.name] && needed {
+			rm.samples = append(rm.samples, rtmetrics.Sample{Name: h.name})
+			rm.histograms[h.name] = m.newRuntimeHistogram(h.key)
+		}
+	}
+
+	return rm
+}
+
+// Emits runtime statistics read from the runtime/metrics package
+func (m *Metrics) emitRuntimeMetricsV2(rm *runtimeMetricsV2) {
+	rtmetrics.Read(rm.samples)
+
+	for _, s := range rm.samples {
+		switch s.Value.Kind() {
+		case rtmetrics.KindUint64:
+			rm.gauges[s.Name].Set(float64(s.Value.Uint64()))
+		case rtmetrics.KindFloat64:
+			rm.gauges[s.Name].Set(s.Value.Float64())
+		case rtmetrics.KindFloat64Histogram:
+			total := rm.sampleHistogram(s.Name, s.Value.Float64Histogram())
+			if s.Name == rtGCPauses {
+				rm.gcPauseNS += total
+				rm.totalGCPauseNS.Set(rm.gcPauseNS)
+			}
+		}
+	}
+}
+
+// sampleHistogram emits the observations added to the histogram since the
+// last read, and returns their estimated sum in nanoseconds
+func (rm *runtimeMetricsV2) sampleHistogram(name string, h *rtmetrics.Float64Histogram) float64 {
+	last := rm.lastCounts[name]
+
+	deltas := make([]uint64, len(h.Counts))
+	var total uint64
+	for i, c := range h.Counts {
+		var prev uint64
+		if i < len(last) {
+			prev = last[i]
+		}
+		if c > prev {
+			deltas[i] = c - prev
+			total += deltas[i]
+		}
+	}
+	rm.lastCounts[name] = append(last[:0], h.Counts...)
+
+	scale := 1.0
+	if total > maxRuntimeHistogramSamples {
+		scale = float64(maxRuntimeHistogramSamples) / float64(total)
+	}
+
+	hist := rm.histograms[name]
+	sum := float64(0)
+	var seen uint64
+	emitted := 0
+	for i, d := range deltas {
+		if d == 0 {
+			continue
+		}
+
+		val := bucketValue(h.Buckets, i) * float64(1e9)
+		sum += float64(d) * val
+
+		// round the running total so rounding errors don't accumulate
+		// past the cap
+		seen += d
+		n := int(math.Round(float64(seen)*scale)) - emitted
+		for j := 0; j < n; j++ {
+			hist.Sample(val)
+		}
+		emitted += n
+	}
+	return sum
+}
+
+// bucketValue returns a representative value for bucket i, the midpoint of
+// its boundaries or the finite boundary for the open-ended buckets
+func bucketValue(buckets []float64, i int) float64 {
+	lo, hi := buckets[i], buckets[i+1]
+	switch {
+	case math.IsInf(lo, -1):
+		return hi
+	case math.IsInf(hi, 1):
+		return lo
+	default:
+		return lo + (hi-lo)/2
+	}
+}
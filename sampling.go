@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SamplingSink wraps a MetricSink and forwards only a fraction of the
+// observations for selected metric types. Unlike sample rates provided by
+// specific backends this works with any sink. Metric types without a
+// configured rate are always forwarded, which is usually what you want for
+// counters since sampling them distorts totals.
+type SamplingSink struct {
+	sink  MetricSink
+	rates map[MetricType]float64
+
+	rndLock sync.Mutex
+	rnd     *rand.Rand
+}
+
+// NewSamplingSink creates a SamplingSink that forwards observations of each
+// metric type in rates with the given probability, between 0 and 1. For
+// example, {MetricTypeHistogram: 0.1} forwards 10% of histogram samples.
+func NewSamplingSink(sink MetricSink, rates map[MetricType]float64) *SamplingSink {
+	r := make(map[MetricType]float64, len(rates))
+	for mType, rate := range rates {
+		r[mType] = rate
+	}
+
+	return &SamplingSink{
+		sink:  sink,
+		rates: r,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *SamplingSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	emitter := s.sink.BuildMetricEmitter(mType, keys, labels)
+
+	sampled := s.sampler(mType)
+	if sampled == nil {
+		return emitter
+	}
+
+	return func(val float64) {
+		if sampled() {
+			emitter(val)
+		}
+	}
+}
+
+// BuildMetricEmitterAt is like BuildMetricEmitter, delivering the sampled
+// values with their timestamps to the wrapped sink if it is a TimestampSink
+func (s *SamplingSink) BuildMetricEmitterAt(mType MetricType, keys []string, labels []Label) MetricEmitterAt {
+	emitter := BuildMetricEmitterAt(s.sink, mType, keys, labels)
+
+	sampled := s.sampler(mType)
+	if sampled == nil {
+		return emitter
+	}
+
+	return func(val float64, at time.Time) {
+		if sampled() {
+			emitter(val, at)
+		}
+	}
+}
+
+// BuildMetricEmitterN is like BuildMetricEmitter, delivering counted values
+// to the wrapped sink if it is a CountedSink. The observations of a counted
+// value are forwarded or skipped together.
+func (s *SamplingSink) BuildMetricEmitterN(mType MetricType, keys []string, labels []Label) MetricEmitterN {
+	emitter := BuildMetricEmitterN(s.sink, mType, keys, labels)
+
+	sampled := s.sampler(mType)
+	if sampled == nil {
+		return emitter
+	}
+
+	return func(val float64, count int) {
+		if sampled() {
+			emitter(val, count)
+		}
+	}
+}
+
+// BuildHistogramEmitter is like BuildMetricEmitter for the histogram emitter
+// of the wrapped sink, or returns nil if it isn't a HistogramSink
+func (s *SamplingSink) BuildHistogramEmitter(mType MetricType, keys []string, labels []Label, buckets []float64) MetricEmitter {
+	emitter := buildHistogramEmitter(s.sink, mType, keys, labels, buckets)
+	if emitter == nil {
+		return nil
+	}
+
+	sampled := s.sampler(mType)
+	if sampled == nil {
+		return emitter
+	}
+
+	return func(val float64) {
+		if sampled() {
+			emitter(val)
+		}
+	}
+}
+
+// SendErrors returns the send errors of the wrapped sink if it is a
+// SendErrorSink
+func (s *SamplingSink) SendErrors() uint64 {
+	return sendErrors(s.sink)
+}
+
+// ForgetMetric forwards to the wrapped sink if it is a ForgetSink
+func (s *SamplingSink) ForgetMetric(mType MetricType, keys []string, labels []Label) {
+	if fs, ok := s.sink.(ForgetSink); ok {
+		fs.ForgetMetric(mType, keys, labels)
+	}
+}
+
+// Shutdown shuts down the wrapped sink if it is a ShutdownSink
+func (s *SamplingSink) Shutdown() error {
+	if ss, ok := s.sink.(ShutdownSink); ok {
+		return ss.Shutdown()
+	}
+	return nil
+}
+
+// sampler returns a func telling whether to forward an observation of the
+// metric type, or nil if they are all forwarded
+func (s *SamplingSink) sampler(mType MetricType) func() bool {
+	rate, ok := s.rates[mType]
+	if !ok || rate >= 1 {
+		return nil
+	}
+	if rate <= 0 {
+		return func() bool { return false }
+	}
+	return func() bool { return s.sample() < rate }
+}
+
+// sample returns a random value in [0, 1)
+func (s *SamplingSink) sample() float64 {
+	s.rndLock.Lock()
+	defer s.rndLock.Unlock()
+
+	return s.rnd.Float64()
+}
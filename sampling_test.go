@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSamplingSink(t *testing.T) {
+	m := &MockSink{}
+	s := NewSamplingSink(m, map[MetricType]float64{
+		MetricTypeHistogram: 0.1,
+		MetricTypeTimer:     0,
+		MetricTypeGauge:     1,
+	})
+	s.rnd = rand.New(rand.NewSource(1))
+
+	counter := s.BuildMetricEmitter(MetricTypeCounter, []string{"ckey"}, nil)
+	gauge := s.BuildMetricEmitter(MetricTypeGauge, []string{"gkey"}, nil)
+	timer := s.BuildMetricEmitter(MetricTypeTimer, []string{"tkey"}, nil)
+	histogram := s.BuildMetricEmitter(MetricTypeHistogram, []string{"hkey"}, nil)
+
+	for i := 0; i < 1000; i++ {
+		counter(1)
+		gauge(1)
+		timer(1)
+		histogram(1)
+	}
+
+	counts := map[string]int{}
+	for _, k := range m.keys {
+		counts[k[0]]++
+	}
+
+	// types without a rate, or a rate of one, are never sampled
+	require.Equal(t, 1000, counts["ckey"])
+	require.Equal(t, 1000, counts["gkey"])
+
+	// a rate of zero drops everything
+	require.Equal(t, 0, counts["tkey"])
+
+	require.Greater(t, counts["hkey"], 50)
+	require.Less(t, counts["hkey"], 150)
+
+	s.Shutdown()
+	require.True(t, m.shutdown)
+}
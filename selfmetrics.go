@@ -0,0 +1,114 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// defaultSelfMetricsPrefix is the key prefix of self metrics if
+// Config.SelfMetricsPrefix isn't set
+const defaultSelfMetricsPrefix = "gosm.self"
+
+// numMetricTypes is the number of MetricType values
+const numMetricTypes = int(MetricTypeUpDownCounter) + 1
+
+// metricTypeNames are the names of each MetricType, as used for the type
+// label of self metrics
+var metricTypeNames = [numMetricTypes]string{
+	MetricTypeCounter:       "counter",
+	MetricTypeGauge:         "gauge",
+	MetricTypeTimer:         "timer",
+	MetricTypeHistogram:     "histogram",
+	MetricTypeDistribution:  "distribution",
+	MetricTypeUpDownCounter: "updowncounter",
+}
+
+// selfStats counts what the self metrics report, once enabled
+type selfStats struct {
+	emits [numMetricTypes]atomic.Uint64
+}
+
+// countEmit counts an emit of the type if self metrics are enabled
+func (m *Metrics) countEmit(mType MetricType) {
+	m.countEmits(mType, 1)
+}
+
+// countEmits counts n emits of the type if self metrics are enabled
+func (m *Metrics) countEmits(mType MetricType, n uint64) {
+	if s := m.root().self; s != nil && int(mType) < numMetricTypes {
+		s.emits[mType].Add(n)
+	}
+}
+
+// selfMetrics are the metrics reporting on the metrics pipeline. They are
+// emitted without being counted themselves.
+type selfMetrics struct {
+	emitsPerSecond [numMetricTypes]*gauge
+	filtered       *counter
+	labelsBlocked  *counter
+	sendErrors     *counter
+
+	lastAt         time.Time
+	lastEmits      [numMetricTypes]uint64
+	lastFilter     FilterStats
+	lastSendErrors uint64
+}
+
+func (m *Metrics) newSelfMetrics() *selfMetrics {
+	prefix := m.cfg.SelfMetricsPrefix
+	if prefix == "" {
+		prefix = defaultSelfMetricsPrefix
+	}
+
+	sm := &selfMetrics{
+		filtered:      m.NewCounter(prefix + ".filtered").(*counter),
+		labelsBlocked: m.NewCounter(prefix + ".labels_blocked").(*counter),
+		sendErrors:    m.NewCounter(prefix + ".send_errors").(*counter),
+		lastAt:        m.clock().Now(),
+	}
+	for t, name := range metricTypeNames {
+		sm.emitsPerSecond[t] = m.NewGauge(prefix+".emits_per_second", L("type", name)).(*gauge)
+	}
+	return sm
+}
+
+// emitSelfStats emits the rate of emits by type, and the metrics filtered,
+// labels blocked, and send errors of the sink since the last call
+func (m *Metrics) emitSelfStats(sm *selfMetrics) {
+	now := m.clock().Now()
+	elapsed := now.Sub(sm.lastAt).Seconds()
+	sm.lastAt = now
+
+	s := m.root().self
+	for t := range sm.emitsPerSecond {
+		emits := s.emits[t].Load()
+		if elapsed > 0 {
+			emitSelf(&sm.emitsPerSecond[t].baseMetric, float64(emits-sm.lastEmits[t])/elapsed)
+		}
+		sm.lastEmits[t] = emits
+	}
+
+	stats := m.FilterStats()
+	emitSelf(&sm.filtered.baseMetric, float64(stats.FilteredByPrefix-sm.lastFilter.FilteredByPrefix))
+	emitSelf(&sm.labelsBlocked.baseMetric, float64(stats.BlockedLabels-sm.lastFilter.BlockedLabels))
+	sm.lastFilter = stats
+
+	if es, ok := m.currentSink().(SendErrorSink); ok {
+		errs := es.SendErrors()
+		// the sink may have been replaced since the last call
+		if errs >= sm.lastSendErrors {
+			emitSelf(&sm.sendErrors.baseMetric, float64(errs-sm.lastSendErrors))
+		}
+		sm.lastSendErrors = errs
+	}
+}
+
+// emitSelf emits the value of a self metric without counting it
+func emitSelf(b *baseMetric, val float64) {
+	if b.drop {
+		return
+	}
+
+	emitter, _ := b.current()
+	emitter(val)
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// errorSink reports a fixed count of send errors
+type errorSink struct {
+	MockSink
+	errs uint64
+}
+
+func (s *errorSink) SendErrors() uint64 {
+	return s.errs
+}
+
+func TestMetrics_SelfMetrics(t *testing.T) {
+	m := &errorSink{errs: 3}
+	met, err := New(m, func(c *Config) {
+		c.EnableHostnameLabel = false
+		c.EnableRuntimeMetrics = false
+		c.BlockedPrefixes = []string{"debug"}
+		c.SelfMetricsPrefix = "self"
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+	met.self = &selfStats{}
+
+	met.Incr("ckey", 1)
+	met.Incr("ckey", 1)
+	met.SetGauge("gkey", 1)
+	met.Incr("debug.ckey", 1)
+	b := met.Batch()
+	b.Sample("hkey", 1)
+	b.Emit()
+
+	sm := met.newSelfMetrics()
+	sm.lastAt = time.Now().Add(-time.Second)
+	met.emitSelfStats(sm)
+
+	values := map[string]float64{}
+	for i, keys := range m.keys[4:] {
+		name := keys[0]
+		if len(m.labels[4+i]) > 0 {
+			name += ";" + m.labels[4+i][0].Value
+		}
+		values[name] = m.vals[4+i]
+	}
+	require.InDelta(t, 2, values["self.emits_per_second;counter"], 0.1)
+	require.InDelta(t, 1, values["self.emits_per_second;gauge"], 0.1)
+	require.InDelta(t, 1, values["self.emits_per_second;histogram"], 0.1)
+	require.Equal(t, 0.0, values["self.emits_per_second;timer"])
+	require.Equal(t, 1.0, values["self.filtered"])
+	require.Equal(t, 0.0, values["self.labels_blocked"])
+	require.Equal(t, 3.0, values["self.send_errors"])
+
+	// the self metrics are not counted as emits themselves
+	n := len(m.keys)
+	m.errs = 5
+	met.emitSelfStats(sm)
+	for i, keys := range m.keys[n:] {
+		switch keys[0] {
+		case "self.send_errors":
+			require.Equal(t, 2.0, m.vals[n+i])
+		default:
+			require.Equal(t, 0.0, m.vals[n+i], keys)
+		}
+	}
+}
+
+func TestMetrics_SelfMetricsDisabled(t *testing.T) {
+	_, met := mockMetric(t)
+	met.Incr("ckey", 1)
+	require.Nil(t, met.self)
+
+	err := (&Config{EnableSelfMetrics: true}).Validate()
+	require.ErrorContains(t, err, "ProfileInterval must be positive")
+}
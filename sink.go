@@ -1,8 +1,14 @@
 package metrics
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type MetricType int
@@ -13,6 +19,7 @@ const (
 	MetricTypeTimer
 	MetricTypeHistogram
 	MetricTypeDistribution
+	MetricTypeUpDownCounter
 )
 
 // The MetricSink interface is used to transmit metrics information
@@ -26,8 +33,117 @@ type ShutdownSink interface {
 
 	// Shutdown the metric sink, flush metrics to storage, and cleanup resources.
 	// Called immediately prior to application exit. Implementations must block
-	// until metrics are flushed to storage.
-	Shutdown()
+	// until metrics are flushed to storage, and return any error encountered
+	// while doing so.
+	Shutdown() error
+}
+
+// A ForgetSink is a MetricSink that keeps per-series state and can drop it on
+// request, used when a memoized metric is forgotten. Sinks that don't
+// implement it are unaffected by Forget.
+type ForgetSink interface {
+	MetricSink
+
+	// ForgetMetric drops any state held for the series identified by the metric
+	// type, keys, and labels, as passed to BuildMetricEmitter.
+	ForgetMetric(mType MetricType, keys []string, labels []Label)
+}
+
+// A SendErrorSink is a MetricSink that counts the metrics it failed to send,
+// reported by the self metrics if enabled
+type SendErrorSink interface {
+	MetricSink
+
+	// SendErrors returns the number of metrics dropped or failed to send
+	// since the sink was created
+	SendErrors() uint64
+}
+
+// A HistogramSink is a MetricSink that can record values into buckets with
+// fixed upper bounds, such as a Prometheus histogram, rather than aggregating
+// them itself. NewTimerHistogram uses it when the sink implements it.
+type HistogramSink interface {
+	MetricSink
+
+	// BuildHistogramEmitter returns an emitter of values in the unit of the
+	// bucket upper bounds, which are sorted in increasing order. Sinks
+	// wrapping another sink return nil if the wrapped sink isn't a
+	// HistogramSink, so the timer is built with BuildMetricEmitter instead.
+	BuildHistogramEmitter(mType MetricType, keys []string, labels []Label, buckets []float64) MetricEmitter
+}
+
+// buildHistogramEmitter returns the histogram emitter of the sink, or nil if
+// it isn't a HistogramSink, for sinks wrapping it
+func buildHistogramEmitter(sink MetricSink, mType MetricType, keys []string, labels []Label, buckets []float64) MetricEmitter {
+	if hs, ok := sink.(HistogramSink); ok {
+		return hs.BuildHistogramEmitter(mType, keys, labels, buckets)
+	}
+	return nil
+}
+
+// sendErrors returns the send errors of the sink, or zero if it isn't a
+// SendErrorSink, for sinks wrapping it
+func sendErrors(sink MetricSink) uint64 {
+	if es, ok := sink.(SendErrorSink); ok {
+		return es.SendErrors()
+	}
+	return 0
+}
+
+// A MetricEmitterAt emits a value observed at the given time, such as when
+// replaying buffered or historical metrics
+type MetricEmitterAt func(val float64, at time.Time)
+
+// A TimestampSink is a MetricSink that can send values with the time they
+// were observed, rather than the time they were emitted
+type TimestampSink interface {
+	MetricSink
+
+	// BuildMetricEmitterAt is like BuildMetricEmitter, for timestamped values.
+	// A zero time is the same as the current time.
+	BuildMetricEmitterAt(mType MetricType, keys []string, labels []Label) MetricEmitterAt
+}
+
+// BuildMetricEmitterAt builds an emitter of timestamped values for any sink.
+// Values emitted to a sink that isn't a TimestampSink are sent as if they
+// were observed now.
+func BuildMetricEmitterAt(sink MetricSink, mType MetricType, keys []string, labels []Label) MetricEmitterAt {
+	if ts, ok := sink.(TimestampSink); ok {
+		return ts.BuildMetricEmitterAt(mType, keys, labels)
+	}
+
+	emitter := sink.BuildMetricEmitter(mType, keys, labels)
+	return func(val float64, _ time.Time) {
+		emitter(val)
+	}
+}
+
+// A MetricEmitterN emits a value observed count times, such as observations
+// already aggregated by the caller
+type MetricEmitterN func(val float64, count int)
+
+// A CountedSink is a MetricSink that can record a value observed many times
+// at once, rather than once per observation
+type CountedSink interface {
+	MetricSink
+
+	// BuildMetricEmitterN is like BuildMetricEmitter, for counted values
+	BuildMetricEmitterN(mType MetricType, keys []string, labels []Label) MetricEmitterN
+}
+
+// BuildMetricEmitterN builds an emitter of counted values for any sink.
+// Values emitted to a sink that isn't a CountedSink are emitted count times.
+func BuildMetricEmitterN(sink MetricSink, mType MetricType, keys []string, labels []Label) MetricEmitterN {
+	if cs, ok := sink.(CountedSink); ok {
+		return cs.BuildMetricEmitterN(mType, keys, labels)
+	}
+
+	emitter := sink.BuildMetricEmitter(mType, keys, labels)
+	return func(val float64, count int) {
+		for n := 0; n < count; n++ {
+			emitter(val)
+		}
+	}
 }
 
 // BlackholeSink is used to just blackhole messages
@@ -41,29 +157,191 @@ func (s *BlackholeSink) BuildMetricEmitter(_ MetricType, _ []string, _ []Label)
 // FanoutSink is used to sink to fanout values to multiple sinks
 type FanoutSink struct {
 	Sinks []MetricSink
+
+	// ShutdownTimeout bounds how long Shutdown waits for the inner sinks, if
+	// positive. Otherwise Shutdown waits until every sink is shut down.
+	ShutdownTimeout time.Duration
+}
+
+// ErrShutdownTimeout is returned by FanoutSink.Shutdown if an inner sink is
+// still shutting down when the ShutdownTimeout expires
+var ErrShutdownTimeout = errors.New("timed out waiting for sinks to shut down")
+
+// SendErrors returns the sum of the send errors of the inner sinks that
+// report them
+func (fh FanoutSink) SendErrors() uint64 {
+	var n uint64
+	for _, s := range fh.Sinks {
+		if es, ok := s.(SendErrorSink); ok {
+			n += es.SendErrors()
+		}
+	}
+	return n
 }
 
+// NewFanout returns a FanoutSink over the sinks, skipping nil sinks
+func NewFanout(sinks ...MetricSink) FanoutSink {
+	fh := FanoutSink{Sinks: make([]MetricSink, 0, len(sinks))}
+	for _, s := range sinks {
+		if s != nil {
+			fh.Sinks = append(fh.Sinks, s)
+		}
+	}
+	return fh
+}
+
+// fanoutPanics counts the panics recovered from inner sinks of any FanoutSink
+var fanoutPanics atomic.Uint64
+
+// FanoutPanics returns the number of panics recovered from the inner sinks of
+// FanoutSinks, when building or calling their emitters
+func FanoutPanics() uint64 {
+	return fanoutPanics.Load()
+}
+
+// BuildMetricEmitter builds an emitter for each inner sink, skipping nil
+// sinks. A panic in an inner sink is recovered and counted in FanoutPanics,
+// so one misbehaving sink doesn't affect the others.
 func (fh FanoutSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
-	emitters := make([]MetricEmitter, len(fh.Sinks))
-	for i := 0; i < len(fh.Sinks); i++ {
-		emitters[i] = fh.Sinks[i].BuildMetricEmitter(mType, keys, labels)
+	emitters := make([]MetricEmitter, 0, len(fh.Sinks))
+	for _, s := range fh.Sinks {
+		if s == nil {
+			continue
+		}
+		if e := buildFanoutEmitter(s, mType, keys, labels); e != nil {
+			emitters = append(emitters, e)
+		}
 	}
 
 	return func(val float64) {
-		for i := 0; i < len(fh.Sinks); i++ {
-			emitters[i](val)
+		for _, e := range emitters {
+			fanoutEmit(e, val)
 		}
 	}
 }
 
-func (fh FanoutSink) Shutdown() {
+// buildFanoutEmitter returns the emitter of the sink, or nil if it panics
+func buildFanoutEmitter(s MetricSink, mType MetricType, keys []string, labels []Label) (e MetricEmitter) {
+	defer func() {
+		if r := recover(); r != nil {
+			fanoutPanics.Add(1)
+			log.Printf("[ERR] Panic recovered building fanout sink emitter! Err: %v", r)
+			e = nil
+		}
+	}()
+	return s.BuildMetricEmitter(mType, keys, labels)
+}
+
+func fanoutEmit(e MetricEmitter, val float64) {
+	defer func() {
+		if r := recover(); r != nil {
+			fanoutPanics.Add(1)
+			log.Printf("[ERR] Panic recovered in fanout sink emitter! Err: %v", r)
+		}
+	}()
+	e(val)
+}
+
+// BuildMetricEmitterAt is like BuildMetricEmitter, passing the timestamps to the
+// inner sinks that support them
+func (fh FanoutSink) BuildMetricEmitterAt(mType MetricType, keys []string, labels []Label) MetricEmitterAt {
+	emitters := make([]MetricEmitterAt, 0, len(fh.Sinks))
+	for _, s := range fh.Sinks {
+		if s == nil {
+			continue
+		}
+		if e := buildFanoutEmitterAt(s, mType, keys, labels); e != nil {
+			emitters = append(emitters, e)
+		}
+	}
+
+	return func(val float64, at time.Time) {
+		for _, e := range emitters {
+			fanoutEmitAt(e, val, at)
+		}
+	}
+}
+
+func buildFanoutEmitterAt(s MetricSink, mType MetricType, keys []string, labels []Label) (e MetricEmitterAt) {
+	defer func() {
+		if r := recover(); r != nil {
+			fanoutPanics.Add(1)
+			log.Printf("[ERR] Panic recovered building fanout sink emitter! Err: %v", r)
+			e = nil
+		}
+	}()
+	return BuildMetricEmitterAt(s, mType, keys, labels)
+}
+
+func fanoutEmitAt(e MetricEmitterAt, val float64, at time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			fanoutPanics.Add(1)
+			log.Printf("[ERR] Panic recovered in fanout sink emitter! Err: %v", r)
+		}
+	}()
+	e(val, at)
+}
+
+func (fh FanoutSink) ForgetMetric(mType MetricType, keys []string, labels []Label) {
 	for _, s := range fh.Sinks {
-		if ss, ok := s.(ShutdownSink); ok {
-			ss.Shutdown()
+		if fs, ok := s.(ForgetSink); ok {
+			fs.ForgetMetric(mType, keys, labels)
 		}
 	}
 }
 
+// Shutdown shuts down the inner sinks concurrently, so a slow sink doesn't
+// delay the others, and returns the combined errors of all that failed. If
+// the ShutdownTimeout expires first, ErrShutdownTimeout is returned along with
+// the errors of the sinks that finished, and the rest are left to finish in
+// the background.
+func (fh FanoutSink) Shutdown() error {
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		errs []error
+	)
+	for _, s := range fh.Sinks {
+		ss, ok := s.(ShutdownSink)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ss.Shutdown(); err != nil {
+				lock.Lock()
+				errs = append(errs, err)
+				lock.Unlock()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if fh.ShutdownTimeout > 0 {
+		t := time.NewTimer(fh.ShutdownTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-done:
+	case <-timeout:
+		lock.Lock()
+		defer lock.Unlock()
+		return errors.Join(append([]error{ErrShutdownTimeout}, errs...)...)
+	}
+	return errors.Join(errs...)
+}
+
 // sinkURLFactoryFunc is an generic interface around the *SinkFromURL() function provided
 // by each sink type
 type sinkURLFactoryFunc func(*url.URL) (MetricSink, error)
@@ -73,28 +351,60 @@ type sinkURLFactoryFunc func(*url.URL) (MetricSink, error)
 var sinkRegistry = map[string]sinkURLFactoryFunc{
 	"statsite": NewStatsiteSinkFromURL,
 	"inmem":    NewInmemSinkFromURL,
+	"expvar":   NewExpvarSinkFromURL,
+}
+
+// sinkRegistryLock guards sinkRegistry
+var sinkRegistryLock sync.RWMutex
+
+// RegisterSinkFactory registers a factory function used by NewMetricSinkFromURL
+// to create sinks for URLs with the given scheme. The factory receives the
+// parsed URL and may use its host, path, and query parameters to configure the
+// sink. An error is returned if the scheme is already registered.
+//
+// RegisterSinkFactory is safe to call concurrently with NewMetricSinkFromURL,
+// though it is typically called from an init function. The factory itself may
+// be invoked concurrently and must be safe for that.
+func RegisterSinkFactory(scheme string, fn func(*url.URL) (MetricSink, error)) error {
+	if fn == nil {
+		return fmt.Errorf("cannot register metric sink %q: nil factory", scheme)
+	}
+
+	sinkRegistryLock.Lock()
+	defer sinkRegistryLock.Unlock()
+
+	if _, ok := sinkRegistry[scheme]; ok {
+		return fmt.Errorf("cannot register metric sink, duplicate sink name: %q", scheme)
+	}
+	sinkRegistry[scheme] = fn
+	return nil
 }
 
 // NewMetricSinkFromURL allows a generic URL input to configure any of the
 // supported sinks. The scheme of the URL identifies the type of the sink, the
 // and query parameters are used to set options.
 //
-// "statsd://" - Initializes a StatsdSink. The host and port are passed through
-// as the "addr" of the sink
-//
 // "statsite://" - Initializes a StatsiteSink. The host and port become the
 // "addr" of the sink
 //
 // "inmem://" - Initializes an InmemSink. The host and port are ignored. The
 // "interval" and "duration" query parameters must be specified with valid
 // durations, see NewInmemSink for details.
+//
+// "dogstatsd://" - Initializes a DogStatsdSink, registered when the datadog
+// subpackage is imported. The host and port become the "addr" of the sink and
+// the "host" query parameter sets the hostname.
+//
+// Additional schemes may be added with RegisterSinkFactory.
 func NewMetricSinkFromURL(urlStr string) (MetricSink, error) {
 	u, err := url.Parse(urlStr)
 	if err != nil {
 		return nil, err
 	}
 
+	sinkRegistryLock.RLock()
 	sinkURLFactoryFunc := sinkRegistry[u.Scheme]
+	sinkRegistryLock.RUnlock()
 	if sinkURLFactoryFunc == nil {
 		return nil, fmt.Errorf(
 			"cannot create metric sink, unrecognized sink name: %q", u.Scheme)
@@ -102,3 +412,71 @@ func NewMetricSinkFromURL(urlStr string) (MetricSink, error) {
 
 	return sinkURLFactoryFunc(u)
 }
+
+// NewMetricSinkFromURLs creates a sink from a comma-separated list of URLs,
+// each parsed as by NewMetricSinkFromURL. When more than one URL is given the
+// sinks are combined in a FanoutSink. Empty entries are skipped. If any URL
+// fails, an error naming each failed URL is returned and any sinks already
+// created are shut down.
+func NewMetricSinkFromURLs(urls string) (MetricSink, error) {
+	sinks, err := newMetricSinksFromURLs(urls)
+	if err != nil {
+		_ = FanoutSink{Sinks: sinks}.Shutdown()
+		return nil, err
+	}
+	return combineSinks(sinks)
+}
+
+// NewMetricSinkFromURLsPartial is like NewMetricSinkFromURLs, but if some URLs
+// fail it still returns a sink over the ones that succeeded, along with the
+// error naming each failed URL. This lets an application start when one
+// backend is unavailable. The sink is nil only if no sink could be created.
+func NewMetricSinkFromURLsPartial(urls string) (MetricSink, error) {
+	sinks, err := newMetricSinksFromURLs(urls)
+	if len(sinks) == 0 && err != nil {
+		return nil, err
+	}
+
+	sink, combineErr := combineSinks(sinks)
+	if combineErr != nil {
+		return nil, combineErr
+	}
+	return sink, err
+}
+
+// newMetricSinksFromURLs creates the sink of each URL in the comma-separated
+// list, returning those created and an error naming each failed URL
+func newMetricSinksFromURLs(urls string) ([]MetricSink, error) {
+	var sinks []MetricSink
+	var errs []error
+	for _, urlStr := range strings.Split(urls, ",") {
+		urlStr = strings.TrimSpace(urlStr)
+		if urlStr == "" {
+			continue
+		}
+
+		sink, err := NewMetricSinkFromURL(urlStr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", urlStr, err))
+			continue
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if len(errs) > 0 {
+		return sinks, fmt.Errorf("cannot create metric sinks: %w", errors.Join(errs...))
+	}
+	return sinks, nil
+}
+
+// combineSinks returns the only sink, or a FanoutSink over several
+func combineSinks(sinks []MetricSink) (MetricSink, error) {
+	switch len(sinks) {
+	case 0:
+		return nil, fmt.Errorf("cannot create metric sink, no URLs provided")
+	case 1:
+		return sinks[0], nil
+	default:
+		return NewFanout(sinks...), nil
+	}
+}
@@ -1,19 +1,25 @@
 package metrics
 
 import (
+	"errors"
+	"net/url"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 type MockSink struct {
 	lock sync.Mutex
 
-	shutdown bool
-	keys     [][]string
-	vals     []float64
-	labels   [][]Label
+	shutdown    bool
+	shutdowns   int
+	shutdownErr error
+	keys        [][]string
+	vals        []float64
+	labels      [][]Label
+	forgotten   [][]string
 }
 
 var _ MetricSink = &MockSink{}
@@ -36,11 +42,20 @@ func (m *MockSink) BuildMetricEmitter(mType MetricType, keys []string, labels []
 	}
 }
 
-func (m *MockSink) Shutdown() {
+func (m *MockSink) ForgetMetric(mType MetricType, keys []string, labels []Label) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.forgotten = append(m.forgotten, keys)
+}
+
+func (m *MockSink) Shutdown() error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	m.shutdown = true
+	m.shutdowns++
+	return m.shutdownErr
 }
 
 func TestFanoutSink_Gauge_Labels(t *testing.T) {
@@ -133,6 +148,162 @@ func TestFanoutSink_Sample_Labels(t *testing.T) {
 	}
 }
 
+func TestFanoutSink_Shutdown(t *testing.T) {
+	err1 := errors.New("first")
+	err2 := errors.New("second")
+	m1 := &MockSink{shutdownErr: err1}
+	m2 := &MockSink{}
+	m3 := &MockSink{shutdownErr: err2}
+	fh := &FanoutSink{Sinks: []MetricSink{m1, &BlackholeSink{}, m2, m3}}
+
+	err := fh.Shutdown()
+	if !errors.Is(err, err1) || !errors.Is(err, err2) {
+		t.Fatalf("expected combined errors, got: %v", err)
+	}
+	if !m1.shutdown || !m2.shutdown || !m3.shutdown {
+		t.Fatalf("all sinks should be shut down")
+	}
+
+	if err := (&FanoutSink{Sinks: []MetricSink{&MockSink{}}}).Shutdown(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// slowShutdownSink blocks in Shutdown until release is closed
+type slowShutdownSink struct {
+	BlackholeSink
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowShutdownSink) Shutdown() error {
+	close(s.started)
+	<-s.release
+	return nil
+}
+
+func TestFanoutSink_Shutdown_Concurrent(t *testing.T) {
+	slow1 := &slowShutdownSink{started: make(chan struct{}), release: make(chan struct{})}
+	slow2 := &slowShutdownSink{started: make(chan struct{}), release: make(chan struct{})}
+	fh := &FanoutSink{Sinks: []MetricSink{slow1, slow2}}
+
+	done := make(chan error)
+	go func() {
+		done <- fh.Shutdown()
+	}()
+
+	// both are shutting down at the same time
+	<-slow1.started
+	<-slow2.started
+	close(slow1.release)
+	close(slow2.release)
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFanoutSink_Shutdown_Timeout(t *testing.T) {
+	slow := &slowShutdownSink{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(slow.release)
+	errFailed := errors.New("failed")
+	m := &MockSink{shutdownErr: errFailed}
+	fh := &FanoutSink{Sinks: []MetricSink{slow, m}, ShutdownTimeout: 10 * time.Millisecond}
+
+	err := fh.Shutdown()
+	if !errors.Is(err, ErrShutdownTimeout) || !errors.Is(err, errFailed) {
+		t.Fatalf("expected timeout and sink errors, got: %v", err)
+	}
+}
+
+// panicEmitSink builds emitters that panic
+type panicEmitSink struct{}
+
+func (s *panicEmitSink) BuildMetricEmitter(_ MetricType, _ []string, _ []Label) MetricEmitter {
+	return func(val float64) {
+		panic("emit")
+	}
+}
+
+func TestFanoutSink_Panics(t *testing.T) {
+	m1 := &MockSink{}
+	m2 := &MockSink{}
+	fh := &FanoutSink{Sinks: []MetricSink{&panicSink{}, m1, nil, &panicEmitSink{}, m2}}
+
+	before := FanoutPanics()
+	e := fh.BuildMetricEmitter(MetricTypeCounter, []string{"test"}, nil)
+	e(1)
+	e(2)
+
+	if !reflect.DeepEqual(m1.vals, []float64{1, 2}) || !reflect.DeepEqual(m2.vals, []float64{1, 2}) {
+		t.Fatalf("working sinks missed values: %v, %v", m1.vals, m2.vals)
+	}
+	// one on build, one for each emit
+	if n := FanoutPanics() - before; n != 3 {
+		t.Fatalf("expected 3 recovered panics, got %d", n)
+	}
+}
+
+func TestFanoutSink_ForgetMetric(t *testing.T) {
+	m1 := &MockSink{}
+	m2 := &MockSink{}
+	fh := &FanoutSink{Sinks: []MetricSink{m1, &BlackholeSink{}, m2}}
+
+	k := []string{"test"}
+	fh.ForgetMetric(MetricTypeGauge, k, nil)
+
+	if !reflect.DeepEqual(m1.forgotten, [][]string{k}) {
+		t.Fatalf("metric not forgotten")
+	}
+	if !reflect.DeepEqual(m2.forgotten, [][]string{k}) {
+		t.Fatalf("metric not forgotten")
+	}
+}
+
+// timestampSink records the timestamps of the values emitted with them
+type timestampSink struct {
+	MockSink
+	times []time.Time
+}
+
+func (s *timestampSink) BuildMetricEmitterAt(mType MetricType, keys []string, labels []Label) MetricEmitterAt {
+	emitter := s.MockSink.BuildMetricEmitter(mType, keys, labels)
+	return func(val float64, at time.Time) {
+		s.lock.Lock()
+		s.times = append(s.times, at)
+		s.lock.Unlock()
+		emitter(val)
+	}
+}
+
+func TestBuildMetricEmitterAt(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+
+	// sinks without timestamps get the value
+	m := &MockSink{}
+	BuildMetricEmitterAt(m, MetricTypeGauge, []string{"gkey"}, nil)(1, at)
+	if !reflect.DeepEqual(m.vals, []float64{1}) {
+		t.Fatalf("bad vals %v", m.vals)
+	}
+
+	ts := &timestampSink{}
+	BuildMetricEmitterAt(ts, MetricTypeGauge, []string{"gkey"}, nil)(1, at)
+	if !reflect.DeepEqual(ts.times, []time.Time{at}) {
+		t.Fatalf("bad times %v", ts.times)
+	}
+
+	// fanouts pass timestamps to the sinks that support them
+	m, ts = &MockSink{}, &timestampSink{}
+	fh := NewFanout(m, nil, ts)
+	var _ TimestampSink = fh
+	fh.BuildMetricEmitterAt(MetricTypeCounter, []string{"ckey"}, nil)(2, at)
+	if !reflect.DeepEqual(m.vals, []float64{2}) || !reflect.DeepEqual(ts.vals, []float64{2}) {
+		t.Fatalf("bad vals %v %v", m.vals, ts.vals)
+	}
+	if !reflect.DeepEqual(ts.times, []time.Time{at}) {
+		t.Fatalf("bad times %v", ts.times)
+	}
+}
+
 func TestNewMetricSinkFromURL(t *testing.T) {
 	for _, tc := range []struct {
 		desc      string
@@ -150,6 +321,11 @@ func TestNewMetricSinkFromURL(t *testing.T) {
 			input:  "inmem://?interval=30s&retain=30s",
 			expect: reflect.TypeOf(&InmemSink{}),
 		},
+		{
+			desc:   "expvar scheme yields an ExpvarSink",
+			input:  "expvar://",
+			expect: reflect.TypeOf(&ExpvarSink{}),
+		},
 		{
 			desc:      "unknown scheme yields an error",
 			input:     "notasink://whatever",
@@ -174,3 +350,193 @@ func TestNewMetricSinkFromURL(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterSinkFactory(t *testing.T) {
+	var got *url.URL
+	err := RegisterSinkFactory("testsink", func(u *url.URL) (MetricSink, error) {
+		got = u
+		return &BlackholeSink{}, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	t.Cleanup(func() {
+		sinkRegistryLock.Lock()
+		delete(sinkRegistry, "testsink")
+		sinkRegistryLock.Unlock()
+	})
+
+	ms, err := NewMetricSinkFromURL("testsink://somehost:123?opt=val")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if _, ok := ms.(*BlackholeSink); !ok {
+		t.Fatalf("expected a BlackholeSink, got: %T", ms)
+	}
+	if got.Host != "somehost:123" || got.Query().Get("opt") != "val" {
+		t.Fatalf("bad url passed to factory: %v", got)
+	}
+
+	err = RegisterSinkFactory("testsink", NewInmemSinkFromURL)
+	if err == nil || !strings.Contains(err.Error(), "duplicate sink name: \"testsink\"") {
+		t.Fatalf("expected duplicate error, got: %v", err)
+	}
+
+	err = RegisterSinkFactory("inmem", NewInmemSinkFromURL)
+	if err == nil {
+		t.Fatalf("expected duplicate error for a built-in scheme")
+	}
+}
+
+func TestNewMetricSinkFromURLs(t *testing.T) {
+	ms, err := NewMetricSinkFromURLs("inmem://?interval=30s&retain=30s")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if _, ok := ms.(*InmemSink); !ok {
+		t.Fatalf("expected a single URL to yield its sink, got: %T", ms)
+	}
+
+	ms, err = NewMetricSinkFromURLs(" inmem://?interval=30s&retain=30s,, inmem://?interval=10s&retain=10s ,")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	fh, ok := ms.(FanoutSink)
+	if !ok {
+		t.Fatalf("expected a FanoutSink, got: %T", ms)
+	}
+	if len(fh.Sinks) != 2 {
+		t.Fatalf("expected 2 sinks, got: %d", len(fh.Sinks))
+	}
+	for _, s := range fh.Sinks {
+		if _, ok := s.(*InmemSink); !ok {
+			t.Fatalf("expected an InmemSink, got: %T", s)
+		}
+	}
+
+	_, err = NewMetricSinkFromURLs("inmem://?interval=30s&retain=30s,notasink://whatever,inmem://?retain=1s")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, expect := range []string{
+		"\"notasink://whatever\": cannot create metric sink, unrecognized sink name",
+		"\"inmem://?retain=1s\": Bad 'interval' param",
+	} {
+		if !strings.Contains(err.Error(), expect) {
+			t.Fatalf("expected err: %q to contain: %q", err, expect)
+		}
+	}
+
+	_, err = NewMetricSinkFromURLs(" , ")
+	if err == nil || !strings.Contains(err.Error(), "no URLs provided") {
+		t.Fatalf("expected no URLs error, got: %v", err)
+	}
+}
+
+func TestNewFanout(t *testing.T) {
+	m1 := &MockSink{}
+	m2 := &MockSink{}
+	fh := NewFanout(m1, nil, m2)
+	if len(fh.Sinks) != 2 || fh.Sinks[0] != m1 || fh.Sinks[1] != m2 {
+		t.Fatalf("expected the non-nil sinks, got: %v", fh.Sinks)
+	}
+}
+
+func TestNewMetricSinkFromURLsPartial(t *testing.T) {
+	ms, err := NewMetricSinkFromURLsPartial("inmem://?interval=30s&retain=30s,notasink://whatever,inmem://?interval=10s&retain=10s")
+	if err == nil || !strings.Contains(err.Error(), "\"notasink://whatever\": cannot create metric sink") {
+		t.Fatalf("expected the failed URL in the error, got: %v", err)
+	}
+	fh, ok := ms.(FanoutSink)
+	if !ok || len(fh.Sinks) != 2 {
+		t.Fatalf("expected a FanoutSink over the 2 created sinks, got: %#v", ms)
+	}
+
+	ms, err = NewMetricSinkFromURLsPartial("notasink://whatever,inmem://?interval=10s&retain=10s")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if _, ok := ms.(*InmemSink); !ok {
+		t.Fatalf("expected the only created sink, got: %T", ms)
+	}
+
+	ms, err = NewMetricSinkFromURLsPartial("notasink://whatever")
+	if ms != nil || err == nil {
+		t.Fatalf("expected only an error, got: %v, %v", ms, err)
+	}
+
+	ms, err = NewMetricSinkFromURLsPartial("inmem://?interval=10s&retain=10s")
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if _, ok := ms.(*InmemSink); !ok {
+		t.Fatalf("expected an InmemSink, got: %T", ms)
+	}
+}
+
+// capableSink implements every optional sink interface, recording what
+// reached it through them
+type capableSink struct {
+	timestampSink
+	counts  []int
+	buckets [][]float64
+}
+
+func (s *capableSink) BuildMetricEmitterN(mType MetricType, keys []string, labels []Label) MetricEmitterN {
+	emitter := s.MockSink.BuildMetricEmitter(mType, keys, labels)
+	return func(val float64, count int) {
+		s.lock.Lock()
+		s.counts = append(s.counts, count)
+		s.lock.Unlock()
+		emitter(val)
+	}
+}
+
+func (s *capableSink) BuildHistogramEmitter(mType MetricType, keys []string, labels []Label, buckets []float64) MetricEmitter {
+	s.buckets = append(s.buckets, buckets)
+	return s.MockSink.BuildMetricEmitter(mType, keys, labels)
+}
+
+func (s *capableSink) SendErrors() uint64 {
+	return 7
+}
+
+func TestWrappingSinks_OptionalInterfaces(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	for name, wrap := range map[string]func(MetricSink) MetricSink{
+		"relabel": func(s MetricSink) MetricSink {
+			return NewRelabelSink(s, RelabelRules{Prefix: "p"})
+		},
+		"sampling": func(s MetricSink) MetricSink {
+			return NewSamplingSink(s, map[MetricType]float64{MetricTypeHistogram: 1})
+		},
+		"ratelimit": func(s MetricSink) MetricSink {
+			return NewRateLimitedSink(s, 100, 10)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			inner := &capableSink{}
+			sink := wrap(inner)
+
+			BuildMetricEmitterAt(sink, MetricTypeGauge, []string{"gkey"}, nil)(1, at)
+			BuildMetricEmitterN(sink, MetricTypeHistogram, []string{"hkey"}, nil)(2, 3)
+			sink.(HistogramSink).BuildHistogramEmitter(MetricTypeTimer, []string{"tkey"}, nil, []float64{1, 2})(0.5)
+
+			if !reflect.DeepEqual(inner.vals, []float64{1, 2, 0.5}) {
+				t.Fatalf("bad vals %v", inner.vals)
+			}
+			if !reflect.DeepEqual(inner.times, []time.Time{at}) {
+				t.Fatalf("bad times %v", inner.times)
+			}
+			if !reflect.DeepEqual(inner.counts, []int{3}) {
+				t.Fatalf("bad counts %v", inner.counts)
+			}
+			if !reflect.DeepEqual(inner.buckets, [][]float64{{1, 2}}) {
+				t.Fatalf("bad buckets %v", inner.buckets)
+			}
+			if errs := sink.(SendErrorSink).SendErrors(); errs != 7 {
+				t.Fatalf("bad send errors %d", errs)
+			}
+		})
+	}
+}
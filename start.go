@@ -2,36 +2,120 @@ package metrics
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
 	"os"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	iradix "github.com/hashicorp/go-immutable-radix/v2"
 )
 
 // Config is used to configure metrics settings
 type Config struct {
-	ServiceName          string        // Name of service, added to labels if EnableServiceLabel is set
-	HostName             string        // Hostname to use. If not provided and EnableHostname, it will be os.Hostname
-	EnableHostnameLabel  bool          // Enable adding hostname to labels
-	EnableServiceLabel   bool          // Enable adding service to labels
-	EnableServicePrefix  bool          // Enable adding service to the metrics key
-	EnableRuntimeMetrics bool          // Enables profiling of runtime metrics (GC, Goroutines, Memory)
-	EnableTypePrefix     bool          // Prefixes key with a type ("counter", "gauge", "timer")
-	TimerGranularity     time.Duration // Granularity of timers.
-	ProfileInterval      time.Duration // Interval to profile runtime metrics
-	PersistentInterval   time.Duration // Interval to publish persisted metrics
+	ServiceName            string        // Name of service, added to labels if EnableServiceLabel is set, and to keys if EnableServicePrefix is set
+	HostName               string        // Hostname to use. If not provided and EnableHostname, it will be os.Hostname
+	EnableHostnameLabel    bool          // Enable adding hostname to labels
+	EnableServiceLabel     bool          // Enable adding service to labels
+	EnableServicePrefix    bool          // Enable adding service to the metrics key, see ServicePrefixSeparator
+	EnableRuntimeMetrics   bool          // Enables profiling of runtime metrics (GC, Goroutines, Memory)
+	EnableRuntimeMetricsV2 bool          // Collects runtime metrics from the runtime/metrics package, without stopping the world
+	EnableProcessMetrics   bool          // Enables process CPU, memory, and file descriptor metrics, where supported by the OS
+	EnableTypePrefix       bool          // Prefixes key with a type ("counter", "gauge", "timer")
+	TimerGranularity       time.Duration // Granularity of timers, milliseconds if zero
+	TimerHistogramBuckets  []float64     // Bucket upper bounds in seconds of NewTimerHistogram, DefaultTimerBuckets if empty
+	ProfileInterval        time.Duration // Interval to profile runtime and process metrics
+
+	// PersistentInterval is the interval to publish persisted and aggregated
+	// metrics on. Zero disables publishing: the metrics are never sent, not
+	// even on Shutdown. Validate accepts zero, since it's how applications
+	// without persisted metrics turn the publisher off and a Config can't
+	// tell whether persisted metrics will be created.
+	PersistentInterval time.Duration
+	TickerJitter       float64 // Fraction of the intervals above the first collection is randomly delayed by, 0 disables jitter
+
+	// ServicePrefixSeparator joins the service prefix to the key, e.g. "_"
+	// for "myservice_requests". If empty, the service is a key segment of its
+	// own, which sinks join like the rest of the key, e.g. with ".".
+	ServicePrefixSeparator string
+
+	// ExclusiveServiceNaming makes Validate reject enabling both
+	// EnableServicePrefix and EnableServiceLabel. Otherwise both add the
+	// service, to the key and as a label.
+	ExclusiveServiceNaming bool
+
+	// EnableSelfMetrics emits metrics about the metrics pipeline every
+	// ProfileInterval: the rate of emits by type, the metrics dropped by
+	// filters and labels blocked, and send errors if the sink reports them.
+	EnableSelfMetrics bool
+	SelfMetricsPrefix string // Prefix of self metric keys, defaults to "gosm.self"
+
+	// DryRun records the metrics that would reach the sink, and the ones the
+	// filters drop, instead of sending them, for DryRunReport. The sink is
+	// only shut down.
+	DryRun bool
+
+	RuntimeMetricsPrefix string   // Prefix of runtime metric keys, defaults to "runtime"
+	RuntimeMetricsLabels []Label  // Labels applied only to runtime metrics
+	RuntimeMetricsSelect []string // Names of runtime metrics to collect, without the prefix, e.g. "num_goroutines". Collects all if empty
 
 	BaseLabels []Label // Default labels applied to all measurements
-
-	AllowedPrefixes []string // A list of metric prefixes to allow, with '.' as the separator
-	BlockedPrefixes []string // A list of metric prefixes to block, with '.' as the separator
+	SortLabels bool    // Sort labels by name before they are passed to the sink, so series are consistent regardless of label order
+
+	DropEmptyLabels bool // Remove labels with an empty value
+
+	// MaxLabels caps the number of labels of a metric after enrichment, if
+	// positive. With MaxLabelsTruncate the first MaxLabels labels are kept, in
+	// the order passed to the sink: scope and caller labels, then host, service,
+	// and base labels, or by name if SortLabels is set.
+	MaxLabels       int
+	MaxLabelsPolicy MaxLabelsPolicy // What to do with a metric over MaxLabels
+
+	// MaxSeriesPerMetric caps the number of distinct label sets of each key,
+	// if positive, across all sinks. Once reached, metrics with a new label
+	// set are dropped while the label sets already seen keep being emitted.
+	// The label sets seen are kept for the lifetime of the Metrics, except
+	// those of memoized metrics released with Forget.
+	MaxSeriesPerMetric int
+
+	AllowedPrefixes []string // A list of metric prefixes to allow, with '.' as the separator and '*' matching any run of characters within a segment
+	BlockedPrefixes []string // A list of metric prefixes to block, with '.' as the separator and '*' matching any run of characters within a segment
 	AllowedLabels   []string // A list of metric labels to allow, with '.' as the separator
 	BlockedLabels   []string // A list of metric labels to block, with '.' as the separator
+	AllowedPatterns []string // A list of regular expressions matching metric keys to allow
+	BlockedPatterns []string // A list of regular expressions matching metric keys to block
 	FilterDefault   bool     // Whether to allow metrics by default
+
+	BlockedLabelValues map[string][]string // Label values to remove, keyed by label name
+
+	// ContextLabeler returns the labels to add to metrics emitted with a
+	// context, such as IncrCtx, e.g. a trace ID or tenant. It is only called by
+	// the context variants, after the per-call labels.
+	ContextLabeler func(ctx context.Context) []Label
+
+	// PanicHandler is invoked with the recovered value and stack trace if a
+	// background goroutine, such as the runtime collector or persisted metric
+	// publisher, panics. If not set the panic is logged with the standard logger.
+	PanicHandler func(recovered any, stack []byte)
+
+	// Clock is the time source of timers and of the runtime, process, self,
+	// and persisted metric collectors. If not set SystemClock is used.
+	Clock Clock
 }
 
+// MaxLabelsPolicy is how metrics with more than Config.MaxLabels labels are
+// handled
+type MaxLabelsPolicy int
+
+const (
+	// MaxLabelsTruncate removes the labels past MaxLabels
+	MaxLabelsTruncate MaxLabelsPolicy = iota
+	// MaxLabelsDrop drops the metric
+	MaxLabelsDrop
+)
+
 type Label struct {
 	Name  string
 	Value string
@@ -40,27 +124,58 @@ type Label struct {
 // Metrics represents an instance of a metrics sink that can
 // be used to emit
 type Metrics struct {
-	cfg           Config
-	sink          MetricSink
-	filter        *iradix.Tree[bool]
-	allowedLabels map[string]bool
-	blockedLabels map[string]bool
+	cfg        Config
+	sink       MetricSink                 // the sink passed to New
+	setSink    atomic.Pointer[MetricSink] // replaces sink once SetSink is called
+	sinkGen    atomic.Uint64              // incremented by SetSink
+	sinkLock   sync.Mutex                 // serializes SetSink
+	filters    atomic.Pointer[filterSet]  // nil if no filters are configured
+	filterLock sync.Mutex
+
+	self             *selfStats  // set if self metrics are enabled
+	dryRun           *dryRunSink // set if DryRun is enabled
+	filteredByPrefix atomic.Uint64
+	labelsBlocked    atomic.Uint64
+	overLabelLimit   atomic.Uint64
+	overSeriesLimit  atomic.Uint64
+	seriesSeen       sync.Map // joined key to *seriesSet, for MaxSeriesPerMetric
 
 	runtimeMetricsCancel context.CancelFunc
 	runtimeWaitG         sync.WaitGroup
 
 	persistedGauges        sync.Map
 	aggregatedCounters     sync.Map
+	persistentCounters     sync.Map
+	aggregatedGauges       sync.Map
 	persistedPublishCancel context.CancelFunc
 	persistedPublishWaitG  sync.WaitGroup
+	persistMinInterval     atomic.Int64 // smallest per-metric interval, 0 if none
+	persistReset           chan struct{}
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+
+	// parent is set on scoped views created by With and WithPrefix, and refers
+	// to the instance that owns the filters and background publishers
+	parent          *Metrics
+	scopeLabels     []Label
+	scopePrefix     string
+	persistInterval time.Duration
 }
 
 // Shared global metrics instance
 var globalMetrics atomic.Value // *Metrics
 
 func init() {
-	// Initialize to a blackhole sink to avoid errors
-	globalMetrics.Store(&Metrics{sink: &BlackholeSink{}})
+	globalMetrics.Store(newBootstrapMetrics())
+}
+
+// newBootstrapMetrics returns the global instance used before NewGlobal and
+// after Shutdown. It emits to a blackhole sink to avoid errors, with the
+// default configuration so metrics behave as they would from New if the sink
+// is replaced with SetSink.
+func newBootstrapMetrics() *Metrics {
+	return &Metrics{cfg: *defaultConfig(), sink: &BlackholeSink{}}
 }
 
 // Default returns the shared global metrics instance.
@@ -78,8 +193,10 @@ func defaultConfig() *Config {
 		EnableTypePrefix:     false,            // Disable type prefix
 		TimerGranularity:     time.Millisecond, // Timers are in milliseconds
 		ProfileInterval:      time.Second,      // Poll runtime every second
+		RuntimeMetricsPrefix: "runtime",        // Runtime metrics under runtime.*
 		FilterDefault:        true,             // Don't filter metrics by default
 		PersistentInterval:   time.Second,      // Publish persisted metrics every 1sec
+		TickerJitter:         0.1,              // Delay the first collection by up to 10% of the interval
 	}
 
 	// Try to get the hostname
@@ -90,21 +207,96 @@ func defaultConfig() *Config {
 
 type ConfigOption func(cfg *Config)
 
+// timerGranularity returns the unit timers are emitted in, TimerGranularity
+// or milliseconds if it isn't set
+func (c *Config) timerGranularity() time.Duration {
+	if c.TimerGranularity == 0 {
+		return time.Millisecond
+	}
+	return c.TimerGranularity
+}
+
+// Validate returns an error describing each invalid setting of the Config.
+// Zero values with a documented default, or that disable a feature, are valid.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.TimerGranularity < 0 {
+		errs = append(errs, fmt.Errorf("TimerGranularity must not be negative, got %s", c.TimerGranularity))
+	}
+	if (c.EnableRuntimeMetrics || c.EnableProcessMetrics || c.EnableSelfMetrics) && c.ProfileInterval <= 0 {
+		errs = append(errs, fmt.Errorf("ProfileInterval must be positive to collect runtime, process, or self metrics, got %s", c.ProfileInterval))
+	}
+	if c.ExclusiveServiceNaming && c.EnableServicePrefix && c.EnableServiceLabel {
+		errs = append(errs, errors.New("EnableServicePrefix and EnableServiceLabel must not both be set with ExclusiveServiceNaming"))
+	}
+	if c.MaxLabels < 0 {
+		errs = append(errs, fmt.Errorf("MaxLabels must not be negative, got %d, use 0 for no limit", c.MaxLabels))
+	}
+	if c.MaxSeriesPerMetric < 0 {
+		errs = append(errs, fmt.Errorf("MaxSeriesPerMetric must not be negative, got %d, use 0 for no limit", c.MaxSeriesPerMetric))
+	}
+	if c.TickerJitter < 0 || c.TickerJitter > 1 {
+		errs = append(errs, fmt.Errorf("TickerJitter must be between 0 and 1, got %g, use 0 to disable jitter", c.TickerJitter))
+	}
+	if c.PersistentInterval < 0 {
+		errs = append(errs, fmt.Errorf("PersistentInterval must not be negative, got %s, use 0 to disable publishing", c.PersistentInterval))
+	}
+	errs = append(errs, conflictingEntries("prefix", c.AllowedPrefixes, c.BlockedPrefixes)...)
+	errs = append(errs, conflictingEntries("label", c.AllowedLabels, c.BlockedLabels)...)
+	errs = append(errs, conflictingEntries("pattern", c.AllowedPatterns, c.BlockedPatterns)...)
+	if _, err := compilePatterns(c.AllowedPatterns); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := compilePatterns(c.BlockedPatterns); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// conflictingEntries returns an error for each entry both allowed and blocked
+func conflictingEntries(kind string, allowed, blocked []string) []error {
+	var errs []error
+	for _, a := range allowed {
+		for _, b := range blocked {
+			if a == b {
+				errs = append(errs, fmt.Errorf("%s %q is both allowed and blocked", kind, a))
+			}
+		}
+	}
+	return errs
+}
+
 // New is used to create a new instance of Metrics
 func New(sink MetricSink, opts ...ConfigOption) (*Metrics, error) {
 	cfg := defaultConfig()
 	for _, opt := range opts {
 		opt(cfg)
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
 	met := &Metrics{}
 	met.cfg = *cfg
 	met.sink = sink
 	met.persistedGauges = sync.Map{}
-	met.setFilterAndLabels(met.cfg.AllowedPrefixes, met.cfg.BlockedPrefixes, met.cfg.AllowedLabels, met.cfg.BlockedLabels)
+	met.persistReset = make(chan struct{}, 1)
+	filters := newFilterSet(met.cfg.AllowedPrefixes, met.cfg.BlockedPrefixes, met.cfg.AllowedLabels, met.cfg.BlockedLabels)
+	if err := filters.setPatterns(met.cfg.AllowedPatterns, met.cfg.BlockedPatterns); err != nil {
+		return nil, err
+	}
+	filters.setLabelValues(met.cfg.BlockedLabelValues)
+	met.filters.Store(filters)
 
-	// Start the runtime collector
-	if met.cfg.EnableRuntimeMetrics {
+	if met.cfg.EnableSelfMetrics {
+		met.self = &selfStats{}
+	}
+	if met.cfg.DryRun {
+		met.dryRun = &dryRunSink{}
+	}
+
+	// Start the runtime, process, and self metrics collector
+	if met.cfg.EnableRuntimeMetrics || met.cfg.EnableProcessMetrics || met.cfg.EnableSelfMetrics {
 		ctx, cancel := context.WithCancel(context.Background())
 		met.runtimeMetricsCancel = cancel
 		met.runtimeWaitG = sync.WaitGroup{}
@@ -112,7 +304,7 @@ func New(sink MetricSink, opts ...ConfigOption) (*Metrics, error) {
 
 		go func() {
 			// prevent any impact to app
-			defer panicRecover()
+			defer met.panicRecover()
 
 			defer met.runtimeWaitG.Done()
 			met.collectStats(ctx)
@@ -128,7 +320,7 @@ func New(sink MetricSink, opts ...ConfigOption) (*Metrics, error) {
 
 		go func() {
 			// prevent any impact to app
-			defer panicRecover()
+			defer met.panicRecover()
 
 			defer met.persistedPublishWaitG.Done()
 			met.pollPersistedMetrics(ctx)
@@ -153,6 +345,43 @@ func L(name string, value string) Label {
 	return Label{Name: name, Value: value}
 }
 
+// A LabelKey is a label name declared once, usually as a constant, so uses of
+// the label can't misspell it, e.g. const HostKey LabelKey = "host"
+type LabelKey string
+
+// Value returns the label of the key with the value
+func (k LabelKey) Value(value string) Label {
+	return Label{Name: string(k), Value: value}
+}
+
+// LabelsFromMap returns the labels of the map of names to values, sorted by
+// name so the order is deterministic
+func LabelsFromMap(m map[string]string) []Label {
+	labels := make([]Label, 0, len(m))
+	for name, value := range m {
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// Labels returns labels from alternating names and values, in order, e.g.
+// Labels("method", "GET", "code", "200"). It panics if given an odd number of
+// strings.
+func Labels(pairs ...string) []Label {
+	if len(pairs)%2 == 1 {
+		panic("metrics.Labels: odd number of arguments")
+	}
+
+	labels := make([]Label, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		labels = append(labels, Label{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return labels
+}
+
 // StatValue defines the allowed values for the simple interface
 type StatValue interface {
 	int | int8 | int32 | int64 | float32 | float64
@@ -172,6 +401,11 @@ func Incr[V StatValue](key string, val V, labels ...Label) {
 	currMetrics().Incr(key, float64(val), labels...)
 }
 
+// Decr decrements a counter, see Counter.Decr for sink support
+func Decr[V StatValue](key string, val V, labels ...Label) {
+	currMetrics().Decr(key, float64(val), labels...)
+}
+
 // Sample records an observation in a histogram
 func Sample[V StatValue](key string, val V, labels ...Label) {
 	currMetrics().Sample(key, float64(val), labels...)
@@ -182,11 +416,60 @@ func MeasureSince(key string, start time.Time, labels ...Label) {
 	currMetrics().MeasureSince(key, start, labels...)
 }
 
+// MeasureSinceAt records the time elapsed from start to end, often as a
+// histogram
+func MeasureSinceAt(key string, start, end time.Time, labels ...Label) {
+	currMetrics().MeasureSinceAt(key, start, end, labels...)
+}
+
+// Time records how long fn takes to run as a timer, even if fn panics
+func Time(key string, fn func(), labels ...Label) {
+	currMetrics().Time(key, fn, labels...)
+}
+
+// TimeErr records how long fn takes to run as a timer, even if fn panics, and
+// returns its error
+func TimeErr(key string, fn func() error, labels ...Label) error {
+	return currMetrics().TimeErr(key, fn, labels...)
+}
+
 // Observe records an observation as part of a distribution
 func Observe[V StatValue](key string, val V, labels ...Label) {
 	currMetrics().Observe(key, float64(val), labels...)
 }
 
+// SetGaugeCtx records the current observed value, with labels from the context
+func SetGaugeCtx[V StatValue](ctx context.Context, key string, val V, labels ...Label) {
+	currMetrics().SetGaugeCtx(ctx, key, float64(val), labels...)
+}
+
+// IncrCtx increments a counter, with labels from the context
+func IncrCtx[V StatValue](ctx context.Context, key string, val V, labels ...Label) {
+	currMetrics().IncrCtx(ctx, key, float64(val), labels...)
+}
+
+// DecrCtx decrements a counter, with labels from the context
+func DecrCtx[V StatValue](ctx context.Context, key string, val V, labels ...Label) {
+	currMetrics().DecrCtx(ctx, key, float64(val), labels...)
+}
+
+// SampleCtx records an observation in a histogram, with labels from the context
+func SampleCtx[V StatValue](ctx context.Context, key string, val V, labels ...Label) {
+	currMetrics().SampleCtx(ctx, key, float64(val), labels...)
+}
+
+// MeasureSinceCtx records the time elapsed since an event, with labels from the
+// context
+func MeasureSinceCtx(ctx context.Context, key string, start time.Time, labels ...Label) {
+	currMetrics().MeasureSinceCtx(ctx, key, start, labels...)
+}
+
+// ObserveCtx records an observation as part of a distribution, with labels from
+// the context
+func ObserveCtx[V StatValue](ctx context.Context, key string, val V, labels ...Label) {
+	currMetrics().ObserveCtx(ctx, key, float64(val), labels...)
+}
+
 //
 // Memoized versions
 //
@@ -206,6 +489,17 @@ func NewTimer(key string, labels ...Label) Timer {
 	return currMetrics().NewTimer(key, labels...)
 }
 
+// NewTimerStart creates a memoized timer that is started immediately
+func NewTimerStart(key string, labels ...Label) RunningTimer {
+	return currMetrics().NewTimerStart(key, labels...)
+}
+
+// NewTimerHistogram creates a memoized timer recorded into histogram buckets,
+// see Metrics.NewTimerHistogram
+func NewTimerHistogram(key string, labels ...Label) Timer {
+	return currMetrics().NewTimerHistogram(key, labels...)
+}
+
 // NewHistogram creates a memoized histogram
 func NewHistogram(key string, labels ...Label) Histogram {
 	return currMetrics().NewHistogram(key, labels...)
@@ -216,36 +510,62 @@ func NewDistribution(key string, labels ...Label) Distribution {
 	return currMetrics().NewDistribution(key, labels...)
 }
 
+// NewUpDownCounter creates a memoized up/down counter
+func NewUpDownCounter(key string, labels ...Label) UpDownCounter {
+	return currMetrics().NewUpDownCounter(key, labels...)
+}
+
 //
 // persistent versions
 //
 
-func NewPersistentGauge(key string, labels ...Label) PersistentGauge {
-	return currMetrics().NewPersistentGauge(key, labels...)
+func NewPersistentGauge(key string, labels []Label, opts ...PersistOption) PersistentGauge {
+	return currMetrics().NewPersistentGauge(key, labels, opts...)
 }
 
-func NewAggregatedCounter(key string, labels ...Label) AggregatedCounter {
-	return currMetrics().NewAggregatedCounter(key, labels...)
+func NewPersistentGaugeFunc(key string, fn func() float64, labels []Label, opts ...PersistOption) PersistentGaugeFunc {
+	return currMetrics().NewPersistentGaugeFunc(key, fn, labels, opts...)
+}
+
+func NewAggregatedCounter(key string, labels []Label, opts ...PersistOption) AggregatedCounter {
+	return currMetrics().NewAggregatedCounter(key, labels, opts...)
+}
+
+func NewAggregatedGauge(key string, labels []Label, opts ...PersistOption) AggregatedGauge {
+	return currMetrics().NewAggregatedGauge(key, labels, opts...)
+}
+
+func NewPersistentCounter(key string, labels []Label, opts ...PersistOption) PersistentCounter {
+	return currMetrics().NewPersistentCounter(key, labels, opts...)
 }
 
 // Shutdown disables metric collection, then blocks while attempting to flush metrics to storage.
 // WARNING: Not all MetricSink backends support this functionality, and calling this will cause them to leak resources.
-// This is intended for use immediately prior to application exit.
-func Shutdown() {
+// This is intended for use immediately prior to application exit. Any error
+// returned by the sink while flushing is returned.
+func Shutdown() error {
 	m := globalMetrics.Load().(*Metrics)
 	// Swap whatever MetricSink is currently active with a BlackholeSink. Callers must not have a
 	// reason to expect that calls to the library will successfully collect metrics after Shutdown
 	// has been called.
-	globalMetrics.Store(&Metrics{sink: &BlackholeSink{}})
-	m.Shutdown()
+	globalMetrics.Store(newBootstrapMetrics())
+	return m.Shutdown()
 }
 
 func currMetrics() *Metrics {
 	return globalMetrics.Load().(*Metrics)
 }
 
-func panicRecover() {
+// panicRecover recovers a panic in a background goroutine and hands it to the
+// configured PanicHandler
+func (m *Metrics) panicRecover() {
 	if r := recover(); r != nil {
-		// log?
+		stack := debug.Stack()
+		if m.cfg.PanicHandler != nil {
+			m.cfg.PanicHandler(r, stack)
+			return
+		}
+
+		log.Printf("[ERR] Panic recovered in metrics goroutine! Err: %v\n%s", r, stack)
 	}
 }
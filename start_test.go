@@ -1,8 +1,10 @@
 package metrics
 
 import (
+	"errors"
 	"io/ioutil"
 	"log"
+	"math"
 	"reflect"
 	"sync/atomic"
 	"testing"
@@ -31,6 +33,139 @@ func TestDefaultConfig(t *testing.T) {
 	if conf.ProfileInterval != time.Second {
 		t.Fatalf("bad interval")
 	}
+	if conf.RuntimeMetricsPrefix != "runtime" {
+		t.Fatalf("bad runtime prefix")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	require.NoError(t, defaultConfig().Validate())
+	require.NoError(t, (&Config{}).Validate())
+
+	for _, tc := range []struct {
+		desc      string
+		opt       ConfigOption
+		expectErr string
+	}{
+		{
+			desc:      "negative timer granularity",
+			opt:       func(c *Config) { c.TimerGranularity = -time.Second },
+			expectErr: "TimerGranularity must not be negative",
+		},
+		{
+			desc:      "zero profile interval with runtime metrics",
+			opt:       func(c *Config) { c.ProfileInterval = 0 },
+			expectErr: "ProfileInterval must be positive",
+		},
+		{
+			desc: "zero profile interval with process metrics",
+			opt: func(c *Config) {
+				c.EnableRuntimeMetrics = false
+				c.EnableProcessMetrics = true
+				c.ProfileInterval = 0
+			},
+			expectErr: "ProfileInterval must be positive",
+		},
+		{
+			desc: "service prefix and label with exclusive service naming",
+			opt: func(c *Config) {
+				c.ServiceName = "svc"
+				c.EnableServicePrefix = true
+				c.EnableServiceLabel = true
+				c.ExclusiveServiceNaming = true
+			},
+			expectErr: "EnableServicePrefix and EnableServiceLabel must not both be set",
+		},
+		{
+			desc:      "negative max labels",
+			opt:       func(c *Config) { c.MaxLabels = -1 },
+			expectErr: "MaxLabels must not be negative",
+		},
+		{
+			desc:      "negative max series per metric",
+			opt:       func(c *Config) { c.MaxSeriesPerMetric = -1 },
+			expectErr: "MaxSeriesPerMetric must not be negative",
+		},
+		{
+			desc:      "ticker jitter over 1",
+			opt:       func(c *Config) { c.TickerJitter = 1.5 },
+			expectErr: "TickerJitter must be between 0 and 1",
+		},
+		{
+			desc:      "negative persistent interval",
+			opt:       func(c *Config) { c.PersistentInterval = -time.Second },
+			expectErr: "PersistentInterval must not be negative",
+		},
+		{
+			desc: "prefix allowed and blocked",
+			opt: func(c *Config) {
+				c.AllowedPrefixes = []string{"a", "debug"}
+				c.BlockedPrefixes = []string{"debug"}
+			},
+			expectErr: `prefix "debug" is both allowed and blocked`,
+		},
+		{
+			desc: "label allowed and blocked",
+			opt: func(c *Config) {
+				c.AllowedLabels = []string{"host"}
+				c.BlockedLabels = []string{"host"}
+			},
+			expectErr: `label "host" is both allowed and blocked`,
+		},
+		{
+			desc: "pattern allowed and blocked",
+			opt: func(c *Config) {
+				c.AllowedPatterns = []string{"^db"}
+				c.BlockedPatterns = []string{"^db"}
+			},
+			expectErr: `pattern "^db" is both allowed and blocked`,
+		},
+		{
+			desc:      "invalid pattern",
+			opt:       func(c *Config) { c.AllowedPatterns = []string{"debug("} },
+			expectErr: `invalid metric filter pattern "debug("`,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			c := defaultConfig()
+			tc.opt(c)
+			require.ErrorContains(t, c.Validate(), tc.expectErr)
+
+			_, err := New(&MockSink{}, tc.opt)
+			require.ErrorContains(t, err, tc.expectErr)
+		})
+	}
+
+	// every problem is reported
+	c := defaultConfig()
+	c.TimerGranularity = -1
+	c.PersistentInterval = -1
+	err := c.Validate()
+	require.ErrorContains(t, err, "TimerGranularity")
+	require.ErrorContains(t, err, "PersistentInterval")
+}
+
+func TestLabelsFromMap(t *testing.T) {
+	labels := LabelsFromMap(map[string]string{"zone": "a", "app": "web", "env": "prod"})
+	require.Equal(t, []Label{L("app", "web"), L("env", "prod"), L("zone", "a")}, labels)
+	require.Empty(t, LabelsFromMap(nil))
+}
+
+func TestLabelKey(t *testing.T) {
+	const methodKey LabelKey = "method"
+	require.Equal(t, L("method", "GET"), methodKey.Value("GET"))
+
+	m, met := mockMetric(t)
+	met.Incr("requests", 1, methodKey.Value("GET"), L("code", "200"))
+	require.Equal(t, []Label{L("method", "GET"), L("code", "200")}, m.labels[0])
+}
+
+func TestLabels(t *testing.T) {
+	require.Equal(t, []Label{L("method", "GET"), L("code", "200")}, Labels("method", "GET", "code", "200"))
+	require.Empty(t, Labels())
+	require.Panics(t, func() {
+		Labels("method", "GET", "code")
+	})
 }
 
 func Test_GlobalMetrics_Labels(t *testing.T) {
@@ -65,6 +200,18 @@ func Test_GlobalMetrics_Labels(t *testing.T) {
 	}
 }
 
+func Test_GlobalMetrics_Decr(t *testing.T) {
+	s := &MockSink{}
+	globalMetrics.Store(&Metrics{cfg: Config{FilterDefault: true}, sink: s})
+
+	labels := []Label{{"a", "b"}}
+	Decr("test", 4, labels...)
+
+	require.Equal(t, []string{"test"}, s.keys[0])
+	require.Equal(t, float64(-4), s.vals[0])
+	require.Equal(t, labels, s.labels[0])
+}
+
 func Test_GlobalMetrics_Memomized(t *testing.T) {
 	labels := []Label{{"a", "b"}}
 
@@ -176,6 +323,21 @@ func Test_GlobalMetrics_DefaultLabels(t *testing.T) {
 	}
 }
 
+func Test_GlobalMetrics_MeasureSinceAt(t *testing.T) {
+	s := &MockSink{}
+	m := &Metrics{sink: s, cfg: Config{TimerGranularity: time.Millisecond, FilterDefault: true}}
+	globalMetrics.Store(m)
+
+	start := time.Now()
+	MeasureSinceAt("test", start, start.Add(250*time.Millisecond))
+	if !reflect.DeepEqual(s.keys[0], []string{"test"}) {
+		t.Fatalf("key not equal")
+	}
+	if s.vals[0] != 250 {
+		t.Fatalf("got val %v want 250", s.vals[0])
+	}
+}
+
 func Test_GlobalMetrics_MeasureSince(t *testing.T) {
 	s := &MockSink{}
 	m := &Metrics{sink: s, cfg: Config{TimerGranularity: time.Millisecond, FilterDefault: true}}
@@ -205,6 +367,22 @@ func Test_GlobalMetrics_MeasureSince(t *testing.T) {
 	}
 }
 
+func Test_GlobalMetrics_Bootstrap(t *testing.T) {
+	globalMetrics.Store(newBootstrapMetrics())
+	defer globalMetrics.Store(newBootstrapMetrics())
+
+	// safe to use before NewGlobal
+	MeasureSince("test", time.Now().Add(-time.Second))
+	Incr("test", 1)
+
+	s := &MockSink{}
+	require.NoError(t, Default().SetSink(s))
+	MeasureSince("test", time.Now().Add(-time.Second))
+	require.Len(t, s.vals, 1)
+	require.False(t, math.IsInf(s.vals[0], 0) || math.IsNaN(s.vals[0]))
+	require.InDelta(t, 1000, s.vals[0], 100)
+}
+
 func Test_GlobalMetrics_Shutdown(t *testing.T) {
 	s := &MockSink{}
 	m := &Metrics{sink: s}
@@ -225,6 +403,82 @@ func Test_GlobalMetrics_Shutdown(t *testing.T) {
 	}
 }
 
+func Test_Shutdown_Twice(t *testing.T) {
+	s := &MockSink{}
+	m, err := New(s, func(cfg *Config) {
+		cfg.ProfileInterval = 10 * time.Millisecond
+		cfg.PersistentInterval = 10 * time.Millisecond
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, m.Shutdown())
+	require.NoError(t, m.Shutdown())
+	require.Equal(t, 1, s.shutdowns)
+
+	s = &MockSink{}
+	_, err = NewGlobal(s)
+	require.NoError(t, err)
+
+	Shutdown()
+	Shutdown()
+	require.Equal(t, 1, s.shutdowns)
+}
+
+func Test_Shutdown_Error(t *testing.T) {
+	flushErr := errors.New("flush failed")
+	s := &MockSink{shutdownErr: flushErr}
+	m, err := New(s, func(cfg *Config) {
+		cfg.EnableRuntimeMetrics = false
+	})
+	require.NoError(t, err)
+
+	require.ErrorIs(t, m.Shutdown(), flushErr)
+	// repeated calls report the same result
+	require.ErrorIs(t, m.Shutdown(), flushErr)
+	require.Equal(t, 1, s.shutdowns)
+
+	// views never shut down the sink
+	require.NoError(t, m.With(L("a", "b")).Shutdown())
+
+	s = &MockSink{shutdownErr: flushErr}
+	_, err = NewGlobal(s, func(cfg *Config) {
+		cfg.EnableRuntimeMetrics = false
+	})
+	require.NoError(t, err)
+	require.ErrorIs(t, Shutdown(), flushErr)
+}
+
+type panicSink struct{}
+
+func (p *panicSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
+	panic("sink failure")
+}
+
+func Test_PanicHandler(t *testing.T) {
+	type recovered struct {
+		val   any
+		stack []byte
+	}
+	ch := make(chan recovered, 1)
+
+	m, err := New(&panicSink{}, func(cfg *Config) {
+		cfg.PersistentInterval = 0
+		cfg.PanicHandler = func(r any, stack []byte) {
+			ch <- recovered{r, stack}
+		}
+	})
+	require.NoError(t, err)
+	defer m.Shutdown()
+
+	select {
+	case r := <-ch:
+		require.Equal(t, "sink failure", r.val)
+		require.Contains(t, string(r.stack), "collectStats")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("panic handler was not called")
+	}
+}
+
 // Benchmark_GlobalMetrics_Direct/direct-8         	 5000000	       278 ns/op
 // Benchmark_GlobalMetrics_Direct/atomic.Value-8   	 5000000	       235 ns/op
 func Benchmark_GlobalMetrics_Direct(b *testing.B) {
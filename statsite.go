@@ -6,7 +6,9 @@ import (
 	"log"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,12 +17,51 @@ const (
 	// inactivity. Prevents stats from getting stuck in a buffer
 	// forever.
 	flushInterval = 100 * time.Millisecond
+
+	// defaultStatsiteBufferSize is the write buffer size, as of bufio
+	defaultStatsiteBufferSize = 4096
+
+	// The wait before reconnecting doubles from the min to the max
+	defaultStatsiteMinBackoff = 100 * time.Millisecond
+	defaultStatsiteMaxBackoff = 5 * time.Second
 )
 
 // NewStatsiteSinkFromURL creates an StatsiteSink from a URL. It is used
-// (and tested) from NewMetricSinkFromURL.
+// (and tested) from NewMetricSinkFromURL. The "buffer_size" query parameter
+// sets the write buffer size in bytes, and "flush_interval", "min_backoff",
+// and "max_backoff" are durations like "250ms".
 func NewStatsiteSinkFromURL(u *url.URL) (MetricSink, error) {
-	return NewStatsiteSink(u.Host)
+	params := u.Query()
+
+	var opts []StatsiteOption
+	if v := params.Get("buffer_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("bad buffer_size %q, must be a positive integer", v)
+		}
+		opts = append(opts, WithStatsiteBufferSize(size))
+	}
+	if v := params.Get("flush_interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad flush_interval %q, must be a positive duration", v)
+		}
+		opts = append(opts, WithStatsiteFlushInterval(d))
+	}
+	if params.Has("min_backoff") || params.Has("max_backoff") {
+		minBackoff, maxBackoff := defaultStatsiteMinBackoff, defaultStatsiteMaxBackoff
+		for name, d := range map[string]*time.Duration{"min_backoff": &minBackoff, "max_backoff": &maxBackoff} {
+			if v := params.Get(name); v != "" {
+				var err error
+				if *d, err = time.ParseDuration(v); err != nil || *d <= 0 {
+					return nil, fmt.Errorf("bad %s %q, must be a positive duration", name, v)
+				}
+			}
+		}
+		opts = append(opts, WithStatsiteBackoff(minBackoff, maxBackoff))
+	}
+
+	return NewStatsiteSink(u.Host, opts...)
 }
 
 // StatsiteSink provides a MetricSink that can be used with a
@@ -28,6 +69,46 @@ func NewStatsiteSinkFromURL(u *url.URL) (MetricSink, error) {
 type StatsiteSink struct {
 	addr        string
 	metricQueue chan string
+
+	bufferSize    int
+	flushInterval time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+
+	// sendErrors counts the metrics dropped on a full queue or while
+	// reconnecting, and the failed writes and flushes
+	sendErrors atomic.Uint64
+}
+
+// A StatsiteOption configures a StatsiteSink
+type StatsiteOption func(s *StatsiteSink)
+
+// WithStatsiteBufferSize sets the size in bytes of the write buffer, which is
+// written out when full or on the flush interval. Larger buffers make fewer,
+// larger writes.
+func WithStatsiteBufferSize(size int) StatsiteOption {
+	return func(s *StatsiteSink) {
+		s.bufferSize = size
+	}
+}
+
+// WithStatsiteFlushInterval sets how often the buffered metrics are written
+// out, 100ms by default. A non-positive interval keeps the default.
+func WithStatsiteFlushInterval(d time.Duration) StatsiteOption {
+	return func(s *StatsiteSink) {
+		s.flushInterval = d
+	}
+}
+
+// WithStatsiteBackoff sets the wait before reconnecting after the connection
+// fails, which doubles from minBackoff up to maxBackoff and starts over once a flush
+// succeeds. It is 100ms to 5s by default, and a non-positive bound keeps its
+// default.
+func WithStatsiteBackoff(minBackoff, maxBackoff time.Duration) StatsiteOption {
+	return func(s *StatsiteSink) {
+		s.minBackoff = minBackoff
+		s.maxBackoff = maxBackoff
+	}
 }
 
 func (s *StatsiteSink) BuildMetricEmitter(mType MetricType, keys []string, labels []Label) MetricEmitter {
@@ -39,6 +120,9 @@ func (s *StatsiteSink) BuildMetricEmitter(mType MetricType, keys []string, label
 			s.pushMetric(fmt.Sprintf("%s:%f|c\n", flatKey, val))
 		case MetricTypeGauge:
 			s.pushMetric(fmt.Sprintf("%s:%f|g\n", flatKey, val))
+		case MetricTypeUpDownCounter:
+			// a signed gauge value is applied as a delta
+			s.pushMetric(fmt.Sprintf("%s:%+f|g\n", flatKey, val))
 		case MetricTypeTimer:
 			fallthrough
 		case MetricTypeDistribution:
@@ -50,10 +134,30 @@ func (s *StatsiteSink) BuildMetricEmitter(mType MetricType, keys []string, label
 }
 
 // NewStatsiteSink is used to create a new StatsiteSink
-func NewStatsiteSink(addr string) (*StatsiteSink, error) {
+func NewStatsiteSink(addr string, opts ...StatsiteOption) (*StatsiteSink, error) {
 	s := &StatsiteSink{
-		addr:        addr,
-		metricQueue: make(chan string, 4096),
+		addr:          addr,
+		metricQueue:   make(chan string, 4096),
+		bufferSize:    defaultStatsiteBufferSize,
+		flushInterval: flushInterval,
+		minBackoff:    defaultStatsiteMinBackoff,
+		maxBackoff:    defaultStatsiteMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// the flush ticker and backoff timers need positive durations
+	if s.flushInterval <= 0 {
+		s.flushInterval = flushInterval
+	}
+	if s.minBackoff <= 0 {
+		s.minBackoff = defaultStatsiteMinBackoff
+	}
+	if s.maxBackoff <= 0 {
+		s.maxBackoff = defaultStatsiteMaxBackoff
+	}
+	if s.maxBackoff < s.minBackoff {
+		s.maxBackoff = s.minBackoff
 	}
 	go func() {
 		defer func() {
@@ -68,8 +172,9 @@ func NewStatsiteSink(addr string) (*StatsiteSink, error) {
 }
 
 // Close is used to stop flushing to statsite
-func (s *StatsiteSink) Shutdown() {
+func (s *StatsiteSink) Shutdown() error {
 	close(s.metricQueue)
+	return nil
 }
 
 // Flattens the key for formatting, removes spaces
@@ -100,16 +205,23 @@ func (s *StatsiteSink) pushMetric(m string) {
 	select {
 	case s.metricQueue <- m:
 	default:
+		s.sendErrors.Add(1)
 	}
 }
 
+// SendErrors returns the number of metrics dropped or failed to send
+func (s *StatsiteSink) SendErrors() uint64 {
+	return s.sendErrors.Load()
+}
+
 // Flushes metrics
 func (s *StatsiteSink) flushMetrics() {
 	var sock net.Conn
 	var err error
 	var wait <-chan time.Time
 	var buffered *bufio.Writer
-	ticker := time.NewTicker(flushInterval)
+	backoff := s.minBackoff
+	ticker := time.NewTicker(s.flushInterval)
 	defer ticker.Stop()
 
 CONNECT:
@@ -121,7 +233,7 @@ CONNECT:
 	}
 
 	// Create a buffered writer
-	buffered = bufio.NewWriter(sock)
+	buffered = bufio.NewWriterSize(sock, s.bufferSize)
 
 	for {
 		select {
@@ -132,22 +244,37 @@ CONNECT:
 			}
 
 			// Try to send to statsite
-			_, err := buffered.Write([]byte(metric))
+			_, err := buffered.WriteString(metric)
 			if err != nil {
 				log.Printf("[ERR] Error writing to statsite! Err: %s", err)
+				s.sendErrors.Add(1)
 				goto WAIT
 			}
 		case <-ticker.C:
+			if buffered.Buffered() == 0 {
+				continue
+			}
 			if err := buffered.Flush(); err != nil {
 				log.Printf("[ERR] Error flushing to statsite! Err: %s", err)
+				s.sendErrors.Add(1)
 				goto WAIT
 			}
+			// the connection works, so the next reconnect starts over
+			backoff = s.minBackoff
 		}
 	}
 
 WAIT:
-	// Wait for a while
-	wait = time.After(time.Duration(5) * time.Second)
+	if sock != nil {
+		sock.Close()
+		sock = nil
+	}
+
+	// Wait for a while, longer after each failed attempt
+	wait = time.After(backoff)
+	if backoff *= 2; backoff > s.maxBackoff {
+		backoff = s.maxBackoff
+	}
 	for {
 		select {
 		// Dequeue the messages to avoid backlog
@@ -155,10 +282,17 @@ WAIT:
 			if !ok {
 				goto QUIT
 			}
+			s.sendErrors.Add(1)
 		case <-wait:
 			goto CONNECT
 		}
 	}
 QUIT:
+	if sock != nil {
+		if err := buffered.Flush(); err != nil {
+			s.sendErrors.Add(1)
+		}
+		sock.Close()
+	}
 	s.metricQueue = nil
 }
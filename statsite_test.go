@@ -23,6 +23,9 @@ func TestStatsite_PushFullQueue(t *testing.T) {
 
 	s := &StatsiteSink{metricQueue: q}
 	s.pushMetric("omit")
+	if n := s.SendErrors(); n != 1 {
+		t.Fatalf("bad send errors %d", n)
+	}
 
 	out := <-q
 	if out != "full" {
@@ -74,6 +77,27 @@ func TestStatsite_Conn(t *testing.T) {
 			t.Fatalf("bad line %s", line)
 		}
 
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			t.Errorf("unexpected err %s", err)
+			return
+		}
+		if line != "updown_labels.val.label:-3.000000|g\n" {
+			t.Errorf("bad line %s", line)
+			return
+		}
+
+		// statsite has no distribution type, they are sent as timers
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			t.Errorf("unexpected err %s", err)
+			return
+		}
+		if line != "dist_labels.val.label:9.000000|ms\n" {
+			t.Errorf("bad line %s", line)
+			return
+		}
+
 		conn.Close()
 		done <- true
 	}()
@@ -85,6 +109,8 @@ func TestStatsite_Conn(t *testing.T) {
 	s.BuildMetricEmitter(MetricTypeGauge, []string{"gauge_labels", "val"}, []Label{{"a", "label"}})(2)
 	s.BuildMetricEmitter(MetricTypeCounter, []string{"counter_labels", "me"}, []Label{{"a", "label"}})(5)
 	s.BuildMetricEmitter(MetricTypeHistogram, []string{"sample_labels", "slow thingy"}, []Label{{"a", "label"}})(7)
+	s.BuildMetricEmitter(MetricTypeUpDownCounter, []string{"updown_labels", "val"}, []Label{{"a", "label"}})(-3)
+	s.BuildMetricEmitter(MetricTypeDistribution, []string{"dist_labels", "val"}, []Label{{"a", "label"}})(9)
 
 	select {
 	case <-done:
@@ -94,6 +120,95 @@ func TestStatsite_Conn(t *testing.T) {
 	}
 }
 
+func TestStatsite_Reconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	defer ln.Close()
+
+	// the server reads a line and drops the connection, then reads a line
+	// from the connection the sink makes again
+	lines := make(chan string, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Errorf("unexpected err %s", err)
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+			if err != nil {
+				t.Errorf("unexpected err %s", err)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	s, err := NewStatsiteSink(ln.Addr().String(),
+		WithStatsiteFlushInterval(5*time.Millisecond),
+		WithStatsiteBackoff(5*time.Millisecond, 20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("bad error")
+	}
+	defer s.Shutdown()
+
+	emit := s.BuildMetricEmitter(MetricTypeGauge, []string{"gauge"}, nil)
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < 2; {
+		select {
+		case line := <-lines:
+			if line != "gauge:1.000000|g\n" {
+				t.Fatalf("bad line %s", line)
+			}
+			i++
+		case <-time.After(5 * time.Millisecond):
+			emit(1)
+		case <-timeout:
+			t.Fatalf("timeout")
+		}
+	}
+}
+
+func TestStatsite_Options(t *testing.T) {
+	u, err := url.Parse("statsite://localhost:0?buffer_size=65536&flush_interval=1s&max_backoff=1m")
+	if err != nil {
+		t.Fatalf("error parsing URL: %s", err)
+	}
+	ms, err := NewStatsiteSinkFromURL(u)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	s := ms.(*StatsiteSink)
+	defer s.Shutdown()
+
+	if s.bufferSize != 65536 || s.flushInterval != time.Second {
+		t.Fatalf("bad buffer size %d or flush interval %s", s.bufferSize, s.flushInterval)
+	}
+	if s.minBackoff != defaultStatsiteMinBackoff || s.maxBackoff != time.Minute {
+		t.Fatalf("bad backoff %s to %s", s.minBackoff, s.maxBackoff)
+	}
+
+	// non-positive options keep the defaults
+	s, err = NewStatsiteSink("localhost:0", WithStatsiteFlushInterval(0), WithStatsiteBackoff(-time.Second, 0))
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer s.Shutdown()
+	if s.flushInterval != flushInterval || s.minBackoff != defaultStatsiteMinBackoff || s.maxBackoff != defaultStatsiteMaxBackoff {
+		t.Fatalf("bad flush interval %s or backoff %s to %s", s.flushInterval, s.minBackoff, s.maxBackoff)
+	}
+
+	for _, bad := range []string{"buffer_size=0", "flush_interval=fast", "min_backoff=-1s"} {
+		u, _ := url.Parse("statsite://localhost:0?" + bad)
+		if _, err := NewStatsiteSinkFromURL(u); err == nil {
+			t.Fatalf("expected an error for %s", bad)
+		}
+	}
+}
+
 func TestNewStatsiteSinkFromURL(t *testing.T) {
 	t.Skipf("tries to connect to statsd address and times out")
 
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"sort"
+	"time"
+)
+
+// DefaultTimerBuckets are the upper bounds in seconds of the buckets of
+// NewTimerHistogram, for latencies of 5ms to 10s, as of the Prometheus client
+var DefaultTimerBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// timerHistogram is a timer recorded in seconds into histogram buckets
+type timerHistogram struct {
+	baseMetric
+}
+
+// NewTimerHistogram returns a timer that records durations in seconds into
+// the buckets of Config.TimerHistogramBuckets, or DefaultTimerBuckets, when
+// the sink is a HistogramSink like the Prometheus sink. The buckets are in
+// seconds regardless of TimerGranularity. Other sinks, including ones
+// wrapping a HistogramSink such as the FanoutSink, receive a timer in units of
+// TimerGranularity, the same as from NewTimer.
+func (m *Metrics) NewTimerHistogram(key string, labels ...Label) Timer {
+	t := &timerHistogram{}
+	allowed, keys, labels := m.enrich("timer", key, labels)
+	if !allowed {
+		t.drop = true
+		return t
+	}
+
+	t.buckets = m.cfg.TimerHistogramBuckets
+	if len(t.buckets) == 0 {
+		t.buckets = DefaultTimerBuckets
+	}
+	t.buckets = append([]float64(nil), t.buckets...)
+	sort.Float64s(t.buckets)
+
+	m.build(&t.baseMetric, MetricTypeTimer, keys, labels)
+	return t
+}
+
+func (t *timerHistogram) MeasureSince(start time.Time) {
+	if t.drop {
+		return
+	}
+
+	t.MeasureSinceAt(start, t.root.clock().Now())
+}
+
+func (t *timerHistogram) MeasureSinceAt(start, end time.Time) {
+	if t.drop {
+		return
+	}
+
+	t.emit(end.Sub(start).Seconds())
+}
+
+// buildTimerHistogram builds an emitter of seconds for the sink, converted to
+// TimerGranularity for a timer if the sink isn't a HistogramSink or wraps one
+// that isn't
+func (b *baseMetric) buildTimerHistogram(sink MetricSink) MetricEmitter {
+	if emitter := buildHistogramEmitter(sink, b.mType, b.keys, b.labels, b.buckets); emitter != nil {
+		return emitter
+	}
+
+	perSecond := float64(time.Second) / float64(b.root.cfg.timerGranularity())
+	emitter := sink.BuildMetricEmitter(b.mType, b.keys, b.labels)
+	return func(val float64) {
+		emitter(val * perSecond)
+	}
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_TimerHistogram_Fallback(t *testing.T) {
+	m, met := mockMetric(t, func(c *Config) {
+		c.TimerGranularity = time.Microsecond
+	})
+
+	// sinks without histograms get a timer in units of TimerGranularity
+	start := time.Now()
+	met.NewTimerHistogram("timer").MeasureSinceAt(start, start.Add(250*time.Millisecond))
+
+	require.Equal(t, []string{"timer"}, m.getKeys()[0])
+	require.Equal(t, []float64{250000}, m.vals)
+}
+
+func TestMetrics_TimerHistogram_WrappedFallback(t *testing.T) {
+	m := &MockSink{}
+	met, err := New(NewRelabelSink(m, RelabelRules{}), func(c *Config) {
+		c.EnableHostnameLabel = false
+		c.EnableRuntimeMetrics = false
+	})
+	require.NoError(t, err)
+	defer met.Shutdown()
+
+	// a wrapper of a sink without histograms is no histogram sink either
+	start := time.Now()
+	met.NewTimerHistogram("timer").MeasureSinceAt(start, start.Add(250*time.Millisecond))
+
+	require.Equal(t, []float64{250}, m.vals)
+}